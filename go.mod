@@ -9,5 +9,6 @@ require (
 	github.com/stretchr/testify v1.8.1
 	golang.org/x/oauth2 v0.8.0
 	google.golang.org/api v0.103.0
+	google.golang.org/grpc v1.51.0
 	google.golang.org/protobuf v1.28.1
 )
@@ -0,0 +1,125 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudtrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = time.Minute
+)
+
+// ErrCircuitOpen is returned without querying GCP while a project's requests keep failing
+var ErrCircuitOpen = errors.New("circuit open")
+
+// circuitBreaker fast-fails requests for a project after several consecutive
+// failures (e.g. the API is disabled), so every panel doesn't keep waiting on
+// and spending quota for requests that will fail
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	projects  map[string]*breakerState
+}
+
+// breakerState is the recent failures of a single project
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		projects:  map[string]*breakerState{},
+	}
+}
+
+// allow returns an error if requests for the project should fail fast
+func (b *circuitBreaker) allow(projectID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.projects[projectID]
+	if !ok || !b.now().Before(state.openUntil) {
+		return nil
+	}
+	return fmt.Errorf("%w: project %s failed %d consecutive requests, retrying after %s",
+		ErrCircuitOpen, projectID, state.failures, state.openUntil.Format(time.RFC3339))
+}
+
+// record tracks the result of a request for the project. Once the threshold
+// is reached the breaker opens, and after the cooldown a single further
+// failure opens it again until a request succeeds
+func (b *circuitBreaker) record(projectID string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		delete(b.projects, projectID)
+		return
+	}
+	if !isProjectFailure(err) {
+		return
+	}
+
+	state, ok := b.projects[projectID]
+	if !ok {
+		state = &breakerState{}
+		b.projects[projectID] = state
+	}
+	state.failures++
+	if state.failures >= b.threshold {
+		state.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// isProjectFailure reports whether an error suggests requests for the whole project are
+// failing, because the project or backend is unhealthy: the API is unavailable or slow,
+// quota is exhausted or access is denied. Errors of a single request, like a bad filter,
+// a missing trace or a cancelled request, don't count
+func isProjectFailure(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+			return true
+		}
+		return apiErr.Code >= http.StatusInternalServerError
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted,
+		codes.PermissionDenied, codes.Unauthenticated, codes.Internal:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudtrace
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(3, time.Minute)
+	breaker.now = func() time.Time { return now }
+	apiErr := status.Error(codes.PermissionDenied, "API disabled")
+
+	// Failures below the threshold don't open the breaker
+	breaker.record("failing", apiErr)
+	breaker.record("failing", apiErr)
+	require.NoError(t, breaker.allow("failing"))
+
+	// A success resets the consecutive failures
+	breaker.record("failing", nil)
+	breaker.record("failing", apiErr)
+	breaker.record("failing", apiErr)
+	require.NoError(t, breaker.allow("failing"))
+
+	// Missing traces, bad queries and cancelled requests aren't project failures
+	breaker.record("failing", status.Error(codes.NotFound, "no trace"))
+	breaker.record("failing", status.Error(codes.InvalidArgument, "bad filter"))
+	breaker.record("failing", status.Error(codes.InvalidArgument, "bad filter"))
+	breaker.record("failing", context.Canceled)
+	require.NoError(t, breaker.allow("failing"))
+
+	// Reaching the threshold opens the breaker for that project only
+	breaker.record("failing", apiErr)
+	require.ErrorIs(t, breaker.allow("failing"), ErrCircuitOpen)
+	require.NoError(t, breaker.allow("healthy"))
+
+	// After the cooldown requests are allowed again, but a single failure reopens it
+	now = now.Add(time.Minute)
+	require.NoError(t, breaker.allow("failing"))
+	breaker.record("failing", apiErr)
+	require.ErrorIs(t, breaker.allow("failing"), ErrCircuitOpen)
+
+	// A success after the cooldown closes it
+	now = now.Add(time.Minute)
+	breaker.record("failing", nil)
+	breaker.record("failing", apiErr)
+	require.NoError(t, breaker.allow("failing"))
+}
+
+func TestIsProjectFailure(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "Unavailable", err: status.Error(codes.Unavailable, "unavailable"), expected: true},
+		{name: "Deadline exceeded", err: status.Error(codes.DeadlineExceeded, "deadline exceeded"), expected: true},
+		{name: "Context deadline exceeded", err: context.DeadlineExceeded, expected: true},
+		{name: "Quota exhausted", err: status.Error(codes.ResourceExhausted, "quota"), expected: true},
+		{name: "Permission denied", err: status.Error(codes.PermissionDenied, "API disabled"), expected: true},
+		{name: "Unauthenticated", err: status.Error(codes.Unauthenticated, "bad credentials"), expected: true},
+		{name: "Internal", err: status.Error(codes.Internal, "internal"), expected: true},
+		{name: "HTTP server error", err: &googleapi.Error{Code: http.StatusBadGateway}, expected: true},
+		{name: "HTTP forbidden", err: &googleapi.Error{Code: http.StatusForbidden}, expected: true},
+		{name: "Invalid filter", err: status.Error(codes.InvalidArgument, "bad filter"), expected: false},
+		{name: "Missing trace", err: status.Error(codes.NotFound, "no trace"), expected: false},
+		{name: "HTTP bad request", err: &googleapi.Error{Code: http.StatusBadRequest}, expected: false},
+		{name: "Cancelled", err: context.Canceled, expected: false},
+		{name: "Other errors", err: errors.New("other"), expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, isProjectFailure(tc.err))
+		})
+	}
+}
+
+func TestListTraces_CircuitBreaker(t *testing.T) {
+	now := time.Now()
+	service := &fakeTraceService{listErr: status.Error(codes.PermissionDenied, "API disabled")}
+	breaker := newCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+	client := &Client{tClient: service, breaker: breaker}
+	query := &TracesQuery{ProjectID: "testing", Limit: 10}
+
+	for i := 0; i < 2; i++ {
+		_, err := client.ListTraces(context.Background(), query)
+		require.NoError(t, err)
+	}
+	require.Len(t, service.listRequests, 2)
+
+	// The open breaker fails fast without querying GCP
+	_, err := client.ListTraces(context.Background(), query)
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	_, err = client.GetTrace(context.Background(), &TraceQuery{ProjectID: "testing", TraceID: "1"})
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Len(t, service.listRequests, 2)
+	require.Empty(t, service.getRequests)
+
+	// Once the cooldown passes and GCP recovers, requests succeed and close the breaker
+	now = now.Add(time.Minute)
+	service.listErr = nil
+	_, err = client.ListTraces(context.Background(), query)
+	require.NoError(t, err)
+	require.NoError(t, breaker.allow("testing"))
+}
@@ -16,9 +16,16 @@ package cloudtrace
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	trace "cloud.google.com/go/trace/apiv1"
@@ -26,26 +33,117 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"golang.org/x/oauth2"
 	resourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/impersonate"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	cloudtracepb "cloud.google.com/go/trace/apiv1/tracepb"
 )
 
-const testConnectionTimeWindow = time.Hour * 24 * 30 // 30 days
+// ErrInvalidTimeRange is returned when a query's time range ends before it starts
+var ErrInvalidTimeRange = errors.New("invalid time range")
 
-// API implements the methods we need to query traces and list projects from GCP
+// ErrNoTraces is returned when testing the connection to a project finds no traces
+var ErrNoTraces = errors.New("no entries")
+
+// ErrInvalidRegion is returned for a region that isn't a GCP region or multi-region name
+var ErrInvalidRegion = errors.New("invalid region")
+
+// ErrConnectionTimeout is returned when testing the connection to a project
+// doesn't get a response in time
+var ErrConnectionTimeout = errors.New("connection timed out")
+
+// regionPattern matches GCP regions like "europe-west4", and multi-regions like "eu"
+var regionPattern = regexp.MustCompile(`^[a-z]+(-[a-z]+[0-9]+)?$`)
+
+// ErrResourceManagerDisabled is returned when projects can't be listed because
+// the Cloud Resource Manager API isn't enabled
+var ErrResourceManagerDisabled = errors.New("cloud resource manager API is disabled")
+
+// ErrProjectsPermissionDenied is returned when projects can't be listed for lack of
+// permission, if the ProjectsQuery asks for it rather than no projects
+var ErrProjectsPermissionDenied = errors.New("permission denied to list projects")
+
+// DownstreamError is an error caused by GCP rather than the plugin, such as a
+// request timing out, so it isn't mistaken for a plugin bug. The plugin SDK
+// version used doesn't have downstream errors, so this serves the same purpose
+type DownstreamError struct {
+	Err error
+}
+
+func (e *DownstreamError) Error() string {
+	return fmt.Sprintf("downstream error: %s", e.Err)
+}
+
+func (e *DownstreamError) Unwrap() error {
+	return e.Err
+}
+
+// wrapDownstreamError wraps timeouts and unavailable errors from GCP as DownstreamErrors
+func wrapDownstreamError(err error) error {
+	if isDownstreamError(err) {
+		return &DownstreamError{Err: err}
+	}
+	return err
+}
+
+func isDownstreamError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.DeadlineExceeded, codes.Unavailable:
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// ResourceManagerDisabledHint explains how to fix ErrResourceManagerDisabled
+const ResourceManagerDisabledHint = "Enable the Cloud Resource Manager API (cloudresourcemanager.googleapis.com) " +
+	"in the project of the service account to list projects, or enter project IDs manually"
+
+const (
+	testConnectionTimeWindow = time.Hour * 24 * 30 // 30 days
+	defaultTracesCacheTTL    = time.Second * 30
+	maxConcurrentGetTraces   = 5
+	defaultOrderBy           = "start desc"
+	// defaultTestConnectionTimeout is how long TestConnection waits for a response
+	defaultTestConnectionTimeout = time.Second * 15
+	// sampledBuckets is the number of equal slices the time range of a sampled query is split into
+	sampledBuckets = 10
+	// maxSortedTraces is how many traces ListTraces reads past a smaller limit, so the
+	// traces it keeps are the first of the requested order rather than of the first pages
+	maxSortedTraces = 1000
+)
+
+// LatencyOrderBy orders traces by their whole latency, rather than the
+// duration of their root span, by fetching every span of each trace.
+// It can be followed by " desc" like Cloud Trace API orders
+const LatencyOrderBy = "latency"
+
+// API implements the methods we need to query traces and list projects from GCP.
+// It's backed by the v1 Cloud Trace API: the v2 API has richer span fields
+// (links, time events, status) but only supports writing spans, not reading them,
+// so there's no v2 client. Span status is read from v1 span labels instead.
+// Links and time events have no v1 equivalent, so span links, events and logs can't be shown
 type API interface {
 	// ListTraces retrieves all traces matching some query filter up to the given limit
 	ListTraces(context.Context, *TracesQuery) ([]*cloudtracepb.Trace, error)
 	// GetTrace retrieves a trace matching a trace ID
 	GetTrace(context.Context, *TraceQuery) (*cloudtracepb.Trace, error)
-	// TestConnection queries for any trace from the given project
-	TestConnection(ctx context.Context, projectID string) error
+	// GetTraces retrieves the traces matching several trace IDs
+	GetTraces(context.Context, *TracesBatchQuery) ([]*cloudtracepb.Trace, error)
+	// TestConnection queries for any trace from the given project, returning how many were found
+	TestConnection(ctx context.Context, projectID string) (int, error)
 	// ListProjects returns the project IDs of all visible projects
-	ListProjects(context.Context) ([]string, error)
+	ListProjects(context.Context, *ProjectsQuery) ([]string, error)
 	// Close closes the underlying connection to the GCP API
 	Close() error
 }
@@ -53,50 +151,322 @@ type API interface {
 // Client wraps a GCP trace client to fetch traces and spance,
 // and a resourcemanager client to list projects
 type Client struct {
-	tClient *trace.Client
-	rClient *resourcemanager.ProjectsService
+	tClient traceService
+	rClient projectService
+	cache   *tracesCache
+	// pageSize is the maximum page size of ListTraces requests, if set
+	pageSize int32
+	// maxTimeRange is the longest time range ListTraces will query, if set
+	maxTimeRange time.Duration
+	// breaker fast-fails requests for projects that keep failing, if set
+	breaker *circuitBreaker
+	// testConnectionWindow and testConnectionPageSize are the time window and page size
+	// of TestConnection queries, testConnectionTimeWindow and 1 if unset
+	testConnectionWindow   time.Duration
+	testConnectionPageSize int32
+	// testConnectionTimeout is how long TestConnection waits, defaultTestConnectionTimeout if unset
+	testConnectionTimeout time.Duration
+	// projectsRetry retries ListProjects requests failing with transient errors, if set
+	projectsRetry *retryPolicy
 }
 
-// NewClient creates a new Client using jsonCreds for authentication
-func NewClient(ctx context.Context, jsonCreds []byte) (*Client, error) {
-	client, err := trace.NewClient(ctx, option.WithCredentialsJSON(jsonCreds),
-		option.WithUserAgent("googlecloud-trace-datasource"))
-	if err != nil {
-		return nil, err
+// traceService is the subset of the GCP trace client used by Client
+type traceService interface {
+	ListTraces(context.Context, *cloudtracepb.ListTracesRequest) traceIterator
+	GetTrace(context.Context, *cloudtracepb.GetTraceRequest) (*cloudtracepb.Trace, error)
+	Close() error
+}
+
+// traceIterator iterates over the traces returned from a ListTraces call
+type traceIterator interface {
+	Next() (*cloudtracepb.Trace, error)
+}
+
+// gcpTraceService implements traceService using the GCP trace client
+type gcpTraceService struct {
+	client *trace.Client
+}
+
+func (s *gcpTraceService) ListTraces(ctx context.Context, req *cloudtracepb.ListTracesRequest) traceIterator {
+	it := s.client.ListTraces(ctx, req)
+	if it == nil {
+		return nil
 	}
-	rClient, err := resourcemanager.NewService(ctx, option.WithCredentialsJSON(jsonCreds),
-		option.WithUserAgent("googlecloud-trace-datasource"))
+	return it
+}
+
+func (s *gcpTraceService) GetTrace(ctx context.Context, req *cloudtracepb.GetTraceRequest) (*cloudtracepb.Trace, error) {
+	return s.client.GetTrace(ctx, req)
+}
+
+func (s *gcpTraceService) Close() error {
+	return s.client.Close()
+}
+
+// projectService is the subset of the resourcemanager client used by Client
+type projectService interface {
+	List(context.Context) ([]*resourcemanager.Project, error)
+}
+
+// gcpProjectService implements projectService using the resourcemanager client
+type gcpProjectService struct {
+	projects *resourcemanager.ProjectsService
+}
+
+func (s *gcpProjectService) List(ctx context.Context) ([]*resourcemanager.Project, error) {
+	response, err := s.projects.List().Context(ctx).Do()
 	if err != nil {
 		return nil, err
 	}
+	return response.Projects, nil
+}
 
-	return &Client{
-		tClient: client,
-		rClient: rClient.Projects,
-	}, nil
+// userContextKey is the context key for the Grafana user running a query
+type userContextKey struct{}
+
+// ContextWithUser returns a context carrying the Grafana user running a query,
+// which is included in the logs of the queries made with it
+func ContextWithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
 }
 
-// NewClient creates a new Client using GCE metadata for authentication
-func NewClientWithGCE(ctx context.Context) (*Client, error) {
-	client, err := trace.NewClient(ctx,
-		option.WithUserAgent("googlecloud-trace-datasource"))
-	if err != nil {
-		return nil, err
+// withUser appends the Grafana user from ctx, if any, to the log args
+func withUser(ctx context.Context, args ...interface{}) []interface{} {
+	if user, ok := ctx.Value(userContextKey{}).(string); ok && user != "" {
+		args = append(args, "user", user)
 	}
-	rClient, err := resourcemanager.NewService(ctx,
-		option.WithUserAgent("googlecloud-trace-datasource"))
-	if err != nil {
-		return nil, err
+	return args
+}
+
+// ClientOption configures optional settings of a Client
+type ClientOption func(*clientSettings)
+
+// clientSettings holds the optional settings of a Client
+type clientSettings struct {
+	keepalive    *keepalive.ClientParameters
+	shared       bool
+	pageSize     int32
+	maxTimeRange time.Duration
+	// maxRecvMsgSize is the largest trace API response in bytes, the gRPC default if 0
+	maxRecvMsgSize int
+	// testConnectionWindow and testConnectionPageSize configure TestConnection queries
+	testConnectionWindow   time.Duration
+	testConnectionPageSize int32
+	// testConnectionTimeout is how long TestConnection waits for a response
+	testConnectionTimeout time.Duration
+	// requestReason is sent with every GCP request, to attribute them in audit logs
+	requestReason string
+	// projectsRetryAttempts is the most attempts of ListProjects requests, 3 if 0
+	projectsRetryAttempts int
+	// endpoint is the regional trace API endpoint, the global endpoint if empty
+	endpoint string
+	// err is the error of an invalid option, returned when creating the Client
+	err error
+}
+
+// WithKeepalive sets gRPC keepalive parameters on the trace API connection so
+// idle connections aren't dropped by NATs or firewalls
+func WithKeepalive(params keepalive.ClientParameters) ClientOption {
+	return func(s *clientSettings) {
+		s.keepalive = &params
 	}
+}
 
-	return &Client{
-		tClient: client,
-		rClient: rClient.Projects,
-	}, nil
+// WithSharedConnection reuses the trace API connection of any other Client
+// created with the same credentials and settings, instead of opening a new one
+func WithSharedConnection() ClientOption {
+	return func(s *clientSettings) {
+		s.shared = true
+	}
+}
+
+// WithPageSize sets the page size of ListTraces requests, independent of the
+// number of traces requested. Smaller pages return the first results sooner
+func WithPageSize(pageSize int32) ClientOption {
+	return func(s *clientSettings) {
+		s.pageSize = pageSize
+	}
+}
+
+// WithMaxTimeRange limits how far back ListTraces queries, moving the start of
+// longer time ranges forward to protect API quota
+func WithMaxTimeRange(maxTimeRange time.Duration) ClientOption {
+	return func(s *clientSettings) {
+		s.maxTimeRange = maxTimeRange
+	}
+}
+
+// WithMaxRecvMsgSize sets the largest trace API response in bytes, raising the
+// gRPC default of 4MB so large traces can be fetched
+func WithMaxRecvMsgSize(maxRecvMsgSize int) ClientOption {
+	return func(s *clientSettings) {
+		s.maxRecvMsgSize = maxRecvMsgSize
+	}
+}
+
+// WithConnectionTest widens the time window and page size TestConnection queries,
+// for projects whose traces are older than the default window of 30 days
+func WithConnectionTest(window time.Duration, pageSize int32) ClientOption {
+	return func(s *clientSettings) {
+		s.testConnectionWindow = window
+		s.testConnectionPageSize = pageSize
+	}
+}
+
+// WithConnectionTestTimeout sets how long TestConnection waits for a response
+// before failing, 15 seconds by default
+func WithConnectionTestTimeout(timeout time.Duration) ClientOption {
+	return func(s *clientSettings) {
+		s.testConnectionTimeout = timeout
+	}
+}
+
+// WithRequestReason sends a reason with every GCP request, which is recorded in
+// Cloud Audit Logs so requests from the plugin can be attributed, e.g. to a ticket
+func WithRequestReason(reason string) ClientOption {
+	return func(s *clientSettings) {
+		s.requestReason = reason
+	}
+}
+
+// WithProjectsRetryAttempts sets the most attempts of ListProjects requests failing with
+// transient Resource Manager errors, 3 by default. 1 disables retries
+func WithProjectsRetryAttempts(attempts int) ClientOption {
+	return func(s *clientSettings) {
+		s.projectsRetryAttempts = attempts
+	}
+}
+
+// WithRegion queries the regional trace API endpoint of a region, for traces stored there
+// for data residency. Creating the Client fails for an invalid region, see RegionalEndpoint,
+// rather than falling back to the global endpoint
+func WithRegion(region string) ClientOption {
+	return func(s *clientSettings) {
+		endpoint, err := RegionalEndpoint(region)
+		if err != nil {
+			s.err = err
+			return
+		}
+		s.endpoint = endpoint
+	}
+}
+
+// RegionalEndpoint returns the trace API endpoint of a region or multi-region,
+// e.g. "cloudtrace.europe-west4.rep.googleapis.com:443" for "europe-west4"
+func RegionalEndpoint(region string) (string, error) {
+	if !regionPattern.MatchString(region) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidRegion, region)
+	}
+	return fmt.Sprintf("cloudtrace.%s.rep.googleapis.com:443", region), nil
+}
+
+func newClientSettings(opts []ClientOption) clientSettings {
+	var settings clientSettings
+	for _, opt := range opts {
+		opt(&settings)
+	}
+	return settings
+}
+
+// projectsRetry returns the retry policy of ListProjects requests
+func (s clientSettings) projectsRetry() *retryPolicy {
+	attempts := s.projectsRetryAttempts
+	if attempts <= 0 {
+		attempts = defaultProjectsRetryAttempts
+	}
+	return newRetryPolicy(attempts, defaultProjectsRetryDuration)
+}
+
+// traceOptions returns the options for creating the GCP trace client
+func (s clientSettings) traceOptions(opts ...option.ClientOption) []option.ClientOption {
+	opts = append(opts, option.WithUserAgent("googlecloud-trace-datasource"))
+	if s.keepalive != nil {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithKeepaliveParams(*s.keepalive)))
+	}
+	if s.maxRecvMsgSize > 0 {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(s.maxRecvMsgSize))))
+	}
+	if s.requestReason != "" {
+		opts = append(opts, option.WithRequestReason(s.requestReason))
+	}
+	if s.endpoint != "" {
+		opts = append(opts, option.WithEndpoint(s.endpoint))
+	}
+	return opts
+}
+
+// resourceManagerOptions returns the options for creating the GCP resource manager client
+func (s clientSettings) resourceManagerOptions(opts ...option.ClientOption) []option.ClientOption {
+	opts = append(opts, option.WithUserAgent("googlecloud-trace-datasource"))
+	if s.requestReason != "" {
+		opts = append(opts, option.WithRequestReason(s.requestReason))
+	}
+	return opts
+}
+
+// poolKey identifies connections that can be shared, given a key for the credentials used
+func (s clientSettings) poolKey(credentialsKey string) string {
+	key := credentialsKey
+	if s.keepalive != nil {
+		key = fmt.Sprintf("%s|keepalive=%+v", key, *s.keepalive)
+	}
+	if s.maxRecvMsgSize > 0 {
+		key = fmt.Sprintf("%s|maxRecvMsgSize=%d", key, s.maxRecvMsgSize)
+	}
+	if s.requestReason != "" {
+		key = fmt.Sprintf("%s|requestReason=%s", key, s.requestReason)
+	}
+	if s.endpoint != "" {
+		key = fmt.Sprintf("%s|endpoint=%s", key, s.endpoint)
+	}
+	return key
+}
+
+// newTraceService creates the GCP trace client, or reuses a shared one if enabled
+func newTraceService(ctx context.Context, settings clientSettings, credentialsKey string, opts ...option.ClientOption) (traceService, error) {
+	create := func() (traceService, error) {
+		client, err := trace.NewClient(ctx, settings.traceOptions(opts...)...)
+		if err != nil {
+			return nil, err
+		}
+		return &gcpTraceService{client: client}, nil
+	}
+
+	if !settings.shared {
+		return create()
+	}
+	return sharedTraceServices.acquire(settings.poolKey(credentialsKey), create)
+}
+
+// credentialsKey returns a key identifying JSON credentials without including them
+func credentialsKey(jsonCreds []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(jsonCreds))
+}
+
+// NewClient creates a new Client using jsonCreds for authentication
+func NewClient(ctx context.Context, jsonCreds []byte, opts ...ClientOption) (*Client, error) {
+	settings := newClientSettings(opts)
+	if settings.err != nil {
+		return nil, settings.err
+	}
+	return newClient(ctx, settings, credentialsKey(jsonCreds), option.WithCredentialsJSON(jsonCreds))
+}
+
+// NewClient creates a new Client using GCE metadata for authentication
+func NewClientWithGCE(ctx context.Context, opts ...ClientOption) (*Client, error) {
+	settings := newClientSettings(opts)
+	if settings.err != nil {
+		return nil, settings.err
+	}
+	return newClient(ctx, settings, "gce")
 }
 
 // NewClient creates a new Clients using service account impersonation
-func NewClientWithImpersonation(ctx context.Context, jsonCreds []byte, impersonateSA string) (*Client, error) {
+func NewClientWithImpersonation(ctx context.Context, jsonCreds []byte, impersonateSA string, opts ...ClientOption) (*Client, error) {
+	settings := newClientSettings(opts)
+	if settings.err != nil {
+		return nil, settings.err
+	}
 	var ts oauth2.TokenSource
 	var err error
 	if jsonCreds == nil {
@@ -114,23 +484,61 @@ func NewClientWithImpersonation(ctx context.Context, jsonCreds []byte, impersona
 		return nil, err
 	}
 
-	client, err := trace.NewClient(ctx, option.WithTokenSource(ts),
-		option.WithUserAgent("googlecloud-trace-datasource"))
+	return newClient(ctx, settings, fmt.Sprintf("%s|impersonate=%s", credentialsKey(jsonCreds), impersonateSA), option.WithTokenSource(ts))
+}
+
+// newClient creates a Client with the given settings, connecting to GCP with the credentials
+// of authOpts. credentialsKey identifies the credentials, to share connections made with them
+func newClient(ctx context.Context, settings clientSettings, credentialsKey string, authOpts ...option.ClientOption) (*Client, error) {
+	tClient, err := newTraceService(ctx, settings, credentialsKey, authOpts...)
 	if err != nil {
 		return nil, err
 	}
-	rClient, err := resourcemanager.NewService(ctx, option.WithTokenSource(ts),
-		option.WithUserAgent("googlecloud-trace-datasource"))
+	rClient, err := resourcemanager.NewService(ctx, settings.resourceManagerOptions(authOpts...)...)
 	if err != nil {
+		tClient.Close()
 		return nil, err
 	}
 
 	return &Client{
-		tClient: client,
-		rClient: rClient.Projects,
+		tClient:                tClient,
+		rClient:                &gcpProjectService{projects: rClient.Projects},
+		cache:                  newTracesCache(defaultTracesCacheTTL),
+		pageSize:               settings.pageSize,
+		maxTimeRange:           settings.maxTimeRange,
+		testConnectionWindow:   settings.testConnectionWindow,
+		testConnectionPageSize: settings.testConnectionPageSize,
+		testConnectionTimeout:  settings.testConnectionTimeout,
+		breaker:                newCircuitBreaker(defaultBreakerThreshold, defaultBreakerCooldown),
+		projectsRetry:          settings.projectsRetry(),
 	}, nil
 }
 
+// AccessSecret reads the payload of a Secret Manager secret version using
+// application default credentials. If resource doesn't name a version,
+// the latest version is used
+func AccessSecret(ctx context.Context, resource string) ([]byte, error) {
+	if !strings.Contains(resource, "/versions/") {
+		resource = fmt.Sprintf("%s/versions/latest", strings.TrimSuffix(resource, "/"))
+	}
+
+	service, err := secretmanager.NewService(ctx,
+		option.WithUserAgent("googlecloud-trace-datasource"))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := service.Projects.Secrets.Versions.Access(resource).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	if response.Payload == nil {
+		return nil, errors.New("empty secret payload")
+	}
+
+	return base64.StdEncoding.DecodeString(response.Payload.Data)
+}
+
 // Close closes the underlying connection to the GCP API
 func (c *Client) Close() error {
 	return c.tClient.Close()
@@ -142,6 +550,17 @@ type TracesQuery struct {
 	Filter    string
 	Limit     int64
 	TimeRange TimeRange
+	// OrderBy is the Cloud Trace API sort order, "start desc" if empty. Like the API,
+	// fields sort ascending unless followed by " desc", and may be followed by " asc"
+	OrderBy string
+	// BypassCache skips any cached result and always queries GCP
+	BypassCache bool
+	// CompleteView requests every span of each trace rather than only the root span
+	CompleteView bool
+	// Sampled spreads the traces evenly across the time range, rather than returning only
+	// the first by OrderBy. The time range is split into buckets, each listed with its own
+	// API call, so sampled queries make up to 10 calls instead of 1
+	Sampled bool
 }
 
 // TraceQuery is the information from a Grafana query needed to query GCP for a trace
@@ -150,16 +569,56 @@ type TraceQuery struct {
 	TraceID   string
 }
 
+// ProjectsQuery is the information needed to list GCP projects
+type ProjectsQuery struct {
+	// IncludeDeleted includes projects that are pending deletion
+	IncludeDeleted bool
+	// ReportMissingPermission returns ErrProjectsPermissionDenied without permission
+	// to list projects, rather than no projects. It's left to the caller to log
+	ReportMissingPermission bool
+	// NoRetry lists projects in a single attempt, for checks of whether projects can be listed
+	NoRetry bool
+}
+
+// TracesBatchQuery is the information needed to query GCP for several traces by ID
+type TracesBatchQuery struct {
+	ProjectID string
+	TraceIDs  []string
+}
+
 // ListProjects returns the project IDs of all visible projects
-func (c *Client) ListProjects(ctx context.Context) ([]string, error) {
-	response, err := c.rClient.List().Do()
+func (c *Client) ListProjects(ctx context.Context, q *ProjectsQuery) ([]string, error) {
+	retry := c.projectsRetry
+	if q.NoRetry {
+		retry = nil
+	}
+	var projects []*resourcemanager.Project
+	err := retry.do(ctx, "ListProjects", func() error {
+		var err error
+		projects, err = c.rClient.List(ctx)
+		return err
+	})
 	if err != nil {
+		if isAPIDisabled(err) {
+			log.DefaultLogger.Warn("Cloud Resource Manager API is disabled, projects can't be listed", "hint", ResourceManagerDisabledHint, "error", err)
+			return []string{}, fmt.Errorf("%w: %s", ErrResourceManagerDisabled, err)
+		}
+		// Listing projects is only a convenience, so missing permissions
+		// shouldn't break anything that depends on it
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden {
+			if q.ReportMissingPermission {
+				return []string{}, fmt.Errorf("%w: %s", ErrProjectsPermissionDenied, err)
+			}
+			log.DefaultLogger.Warn("missing permission to list projects", "error", err)
+			return []string{}, nil
+		}
 		return nil, err
 	}
 
 	projectIDs := []string{}
-	for _, p := range response.Projects {
-		if p.LifecycleState == "DELETE_REQUESTED" || p.LifecycleState == "DELETE_IN_PROGRESS" {
+	for _, p := range projects {
+		if !q.IncludeDeleted && (p.LifecycleState == "DELETE_REQUESTED" || p.LifecycleState == "DELETE_IN_PROGRESS") {
 			continue
 		}
 		projectIDs = append(projectIDs, p.ProjectId)
@@ -167,70 +626,198 @@ func (c *Client) ListProjects(ctx context.Context) ([]string, error) {
 	return projectIDs, nil
 }
 
-// TestConnection queries for any trace from the given project
-func (c *Client) TestConnection(ctx context.Context, projectID string) error {
+// isAPIDisabled reports whether a GCP API error is because the API isn't enabled in the project
+func isAPIDisabled(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		if item.Reason == "accessNotConfigured" {
+			return true
+		}
+	}
+	return strings.Contains(apiErr.Message, "SERVICE_DISABLED") || strings.Contains(apiErr.Message, "it is disabled")
+}
+
+// TestConnection queries for any trace from the given project, returning how many
+// traces were found, up to the connection test page size
+func (c *Client) TestConnection(ctx context.Context, projectID string) (int, error) {
 	start := time.Now()
 
-	listCtx, cancel := context.WithTimeout(ctx, time.Duration(time.Minute*1))
+	timeout := defaultTestConnectionTimeout
+	if c.testConnectionTimeout > 0 {
+		timeout = c.testConnectionTimeout
+	}
+	listCtx, cancel := context.WithTimeout(ctx, timeout)
 
 	defer func() {
 		cancel()
 		log.DefaultLogger.Info("Finished testConnection", "duration", time.Since(start).String())
 	}()
 
+	window := testConnectionTimeWindow
+	if c.testConnectionWindow > 0 {
+		window = c.testConnectionWindow
+	}
+	pageSize := int32(1)
+	if c.testConnectionPageSize > 0 {
+		pageSize = c.testConnectionPageSize
+	}
+
 	it := c.tClient.ListTraces(listCtx, &cloudtracepb.ListTracesRequest{
 		ProjectId: projectID,
-		PageSize:  1,
-		StartTime: timestamppb.New(time.Now().Add(-testConnectionTimeWindow)),
+		PageSize:  pageSize,
+		StartTime: timestamppb.New(time.Now().Add(-window)),
 	})
 
-	if listCtx.Err() != nil {
-		return errors.New("timeout")
+	if listCtx.Err() == context.DeadlineExceeded {
+		return 0, connectionTimeoutError(timeout)
 	}
 
-	entry, err := it.Next()
-	if err == iterator.Done {
-		return errors.New("no entries")
-	}
-	if err == context.DeadlineExceeded {
-		return errors.New("list entries: timeout")
-	}
-	if err != nil {
-		return fmt.Errorf("list entries: %w", err)
+	// Stop after a page size of traces, so the test doesn't wait on requests for more pages
+	found := 0
+	for int32(found) < pageSize {
+		entry, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if listCtx.Err() == context.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded) {
+			return found, connectionTimeoutError(timeout)
+		}
+		if err != nil {
+			return found, fmt.Errorf("list entries: %w", err)
+		}
+		if entry == nil {
+			break
+		}
+		found++
 	}
-	if entry == nil {
-		return errors.New("no entries")
+	if found == 0 {
+		return 0, ErrNoTraces
 	}
 
-	return nil
+	return found, nil
 }
 
-// ListTraces retrieves all traces matching some query filter up to the given limit
-func (c *Client) ListTraces(ctx context.Context, q *TracesQuery) ([]*cloudtracepb.Trace, error) {
-	// Never exceed the maximum page size
-	pageSize := int32(math.Min(float64(q.Limit), 1000))
+// connectionTimeoutError returns ErrConnectionTimeout with how long TestConnection waited
+func connectionTimeoutError(timeout time.Duration) error {
+	return fmt.Errorf("%w after %s", ErrConnectionTimeout, timeout)
+}
+
+// ClampTimeRange returns the query with its time range shortened to end at the same time
+// but last no longer than maxTimeRange, or the query itself if it's short enough.
+// A maxTimeRange of 0 is unlimited
+func ClampTimeRange(q *TracesQuery, maxTimeRange time.Duration) *TracesQuery {
+	if maxTimeRange <= 0 || q.TimeRange.To.Sub(q.TimeRange.From) <= maxTimeRange {
+		return q
+	}
+	clamped := *q
+	clamped.TimeRange.From = q.TimeRange.To.Add(-maxTimeRange)
+	return &clamped
+}
+
+// NewListTracesRequest creates the Cloud Trace API request for the first page of traces matching a query
+func NewListTracesRequest(q *TracesQuery) *cloudtracepb.ListTracesRequest {
+	orderBy := q.OrderBy
+	if orderBy == "" {
+		orderBy = defaultOrderBy
+	}
 
 	req := cloudtracepb.ListTracesRequest{
 		ProjectId: q.ProjectID,
 		Filter:    q.Filter,
 		StartTime: timestamppb.New(q.TimeRange.From),
 		EndTime:   timestamppb.New(q.TimeRange.To),
-		OrderBy:   "start desc",
-		PageSize:  pageSize,
-		View:      tracepb.ListTracesRequest_ROOTSPAN,
+		OrderBy:   orderBy,
+		// Never exceed the maximum page size
+		PageSize: int32(math.Min(float64(q.Limit), 1000)),
+		View:     tracepb.ListTracesRequest_ROOTSPAN,
+	}
+	if q.CompleteView {
+		req.View = tracepb.ListTracesRequest_COMPLETE
+	}
+	// Latency isn't a Cloud Trace API order, so fetch the closest order with
+	// every span, and sort by latency afterwards
+	if orderByField := strings.Fields(orderBy); len(orderByField) > 0 && orderByField[0] == LatencyOrderBy {
+		req.View = tracepb.ListTracesRequest_COMPLETE
+		req.OrderBy = strings.Replace(orderBy, LatencyOrderBy, "duration", 1)
+	}
+	req.OrderBy = apiOrderBy(req.OrderBy)
+	return &req
+}
+
+// apiOrderBy returns an order as the Cloud Trace API expects it. The API sorts ascending
+// unless the field is followed by " desc", and doesn't accept an explicit " asc"
+func apiOrderBy(orderBy string) string {
+	fields := strings.Fields(orderBy)
+	if len(fields) == 2 && fields[1] == "asc" {
+		return fields[0]
+	}
+	return orderBy
+}
+
+// isOldestFirst reports whether an order lists the oldest traces first, e.g. "start" or "start asc"
+func isOldestFirst(orderBy string) bool {
+	fields := strings.Fields(orderBy)
+	return len(fields) > 0 && fields[0] == "start" && (len(fields) == 1 || fields[1] != "desc")
+}
+
+// ListTraces retrieves all traces matching some query filter up to the given limit
+func (c *Client) ListTraces(ctx context.Context, q *TracesQuery) ([]*cloudtracepb.Trace, error) {
+	if q.TimeRange.From.After(q.TimeRange.To) {
+		return nil, fmt.Errorf("%w: from %s is after to %s", ErrInvalidTimeRange,
+			q.TimeRange.From.Format(time.RFC3339), q.TimeRange.To.Format(time.RFC3339))
+	}
+	if clamped := ClampTimeRange(q, c.maxTimeRange); clamped != q {
+		log.DefaultLogger.Debug("Clamping time range", "project", q.ProjectID, "maxTimeRange", c.maxTimeRange.String())
+		q = clamped
+	}
+	if q.Sampled && q.Limit > 1 {
+		return c.listSampledTraces(ctx, q)
+	}
+
+	if c.cache != nil && !q.BypassCache {
+		if entries, ok := c.cache.get(q); ok {
+			log.DefaultLogger.Debug("Using cached traces", withUser(ctx, "project", q.ProjectID)...)
+			return entries, nil
+		}
+	}
+
+	if c.breaker != nil {
+		if err := c.breaker.allow(q.ProjectID); err != nil {
+			return nil, err
+		}
+	}
+
+	req := NewListTracesRequest(q)
+	if c.pageSize > 0 && c.pageSize < req.PageSize {
+		req.PageSize = c.pageSize
+	}
+	orderBy := q.OrderBy
+	if orderBy == "" {
+		orderBy = defaultOrderBy
 	}
 
 	start := time.Now()
 	defer func() {
-		log.DefaultLogger.Info("Finished listing traces", "duration", time.Since(start).String())
+		log.DefaultLogger.Info("Finished listing traces", withUser(ctx, "project", q.ProjectID, "filter", q.Filter, "duration", time.Since(start).String())...)
 	}()
 
-	it := c.tClient.ListTraces(ctx, &req)
+	it := c.tClient.ListTraces(ctx, req)
 	if it == nil {
 		return nil, errors.New("nil response")
 	}
 
+	// Read past the limit, so it's applied after sorting rather than to the traces
+	// of the first pages in whatever order they're returned
+	readLimit := q.Limit
+	if readLimit < maxSortedTraces {
+		readLimit = maxSortedTraces
+	}
+
 	var i int64
+	var iterErr error
 	entries := []*cloudtracepb.Trace{}
 	for {
 		resp, err := it.Next()
@@ -239,18 +826,148 @@ func (c *Client) ListTraces(ctx context.Context, q *TracesQuery) ([]*cloudtracep
 		}
 		if err != nil {
 			log.DefaultLogger.Error("error getting page", "error", err)
+			iterErr = err
 			break
 		}
 
 		entries = append(entries, resp)
 		i++
-		if i >= q.Limit {
+		if i >= readLimit {
 			break
 		}
 	}
+
+	sortTraces(entries, orderBy)
+	if q.Limit > 0 && int64(len(entries)) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+
+	if c.breaker != nil {
+		c.breaker.record(q.ProjectID, iterErr)
+	}
+
+	// Partial results are still returned, but fail if GCP didn't respond at all
+	if len(entries) == 0 && isDownstreamError(iterErr) {
+		return nil, &DownstreamError{Err: iterErr}
+	}
+
+	// Only cache full results so a transient error isn't served repeatedly
+	if c.cache != nil && iterErr == nil {
+		c.cache.set(q, entries)
+	}
+	return entries, nil
+}
+
+// listSampledTraces lists traces spread evenly across the time range of a query, by splitting
+// it into equal buckets and listing an equal share of the limit from each
+func (c *Client) listSampledTraces(ctx context.Context, q *TracesQuery) ([]*cloudtracepb.Trace, error) {
+	buckets := int64(sampledBuckets)
+	if q.Limit < buckets {
+		buckets = q.Limit
+	}
+	bucketWidth := q.TimeRange.To.Sub(q.TimeRange.From) / time.Duration(buckets)
+	orderBy := q.OrderBy
+	if orderBy == "" {
+		orderBy = defaultOrderBy
+	}
+	oldestFirst := isOldestFirst(orderBy)
+
+	seen := map[string]bool{}
+	entries := []*cloudtracepb.Trace{}
+	for i := int64(0); i < buckets; i++ {
+		bucket := *q
+		bucket.Sampled = false
+		// Give any remainder of the limit to the newest buckets, or the oldest if listing oldest first
+		bucket.Limit = q.Limit / buckets
+		if (!oldestFirst && i >= buckets-q.Limit%buckets) || (oldestFirst && i < q.Limit%buckets) {
+			bucket.Limit++
+		}
+		bucket.TimeRange.From = q.TimeRange.From.Add(time.Duration(i) * bucketWidth)
+		if i < buckets-1 {
+			bucket.TimeRange.To = bucket.TimeRange.From.Add(bucketWidth)
+		}
+
+		traces, err := c.ListTraces(ctx, &bucket)
+		if err != nil {
+			return nil, err
+		}
+		// Traces overlapping two buckets may be listed in both
+		for _, t := range traces {
+			if !seen[t.GetTraceId()] {
+				seen[t.GetTraceId()] = true
+				entries = append(entries, t)
+			}
+		}
+	}
+
+	sortTraces(entries, orderBy)
 	return entries, nil
 }
 
+// sortTraces sorts traces by a Cloud Trace API order, e.g. "duration desc", then by trace ID.
+// Traces are compared by their root span, and unknown orders are left as they are
+func sortTraces(traces []*cloudtracepb.Trace, orderBy string) {
+	fields := strings.Fields(orderBy)
+	if len(fields) == 0 {
+		return
+	}
+	desc := len(fields) > 1 && fields[1] == "desc"
+
+	var less func(a, b *cloudtracepb.Trace) bool
+	switch fields[0] {
+	case "trace_id":
+		less = func(a, b *cloudtracepb.Trace) bool { return a.GetTraceId() < b.GetTraceId() }
+	case "name":
+		less = func(a, b *cloudtracepb.Trace) bool { return GetRootSpan(a).GetName() < GetRootSpan(b).GetName() }
+	case "duration":
+		less = func(a, b *cloudtracepb.Trace) bool { return getRootSpanDuration(a) < getRootSpanDuration(b) }
+	case LatencyOrderBy:
+		less = func(a, b *cloudtracepb.Trace) bool {
+			return GetTraceLatency(a.GetSpans()) < GetTraceLatency(b.GetSpans())
+		}
+	case "start":
+		less = func(a, b *cloudtracepb.Trace) bool {
+			return GetRootSpan(a).GetStartTime().AsTime().Before(GetRootSpan(b).GetStartTime().AsTime())
+		}
+	default:
+		return
+	}
+
+	sort.SliceStable(traces, func(i, j int) bool {
+		a, b := traces[i], traces[j]
+		if desc {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		// Break ties by trace ID so equal traces don't swap between refreshes
+		return traces[i].GetTraceId() < traces[j].GetTraceId()
+	})
+}
+
+// GetRootSpan returns the root span of a trace, or its first span if it has no root
+func GetRootSpan(trace *cloudtracepb.Trace) *cloudtracepb.TraceSpan {
+	spans := trace.GetSpans()
+	for _, s := range spans {
+		if s.GetParentSpanId() == 0 {
+			return s
+		}
+	}
+	if len(spans) > 0 {
+		return spans[0]
+	}
+	return nil
+}
+
+func getRootSpanDuration(trace *cloudtracepb.Trace) time.Duration {
+	root := GetRootSpan(trace)
+	return root.GetEndTime().AsTime().Sub(root.GetStartTime().AsTime())
+}
+
 // GetTrace retrieves a single trace given a trace ID
 func (c *Client) GetTrace(ctx context.Context, q *TraceQuery) (*cloudtracepb.Trace, error) {
 	req := cloudtracepb.GetTraceRequest{
@@ -260,12 +977,21 @@ func (c *Client) GetTrace(ctx context.Context, q *TraceQuery) (*cloudtracepb.Tra
 
 	start := time.Now()
 	defer func() {
-		log.DefaultLogger.Info(fmt.Sprintf("Finished getting trace: %s", q.TraceID), "duration", time.Since(start).String())
+		log.DefaultLogger.Info(fmt.Sprintf("Finished getting trace: %s", q.TraceID), withUser(ctx, "project", q.ProjectID, "duration", time.Since(start).String())...)
 	}()
 
+	if c.breaker != nil {
+		if err := c.breaker.allow(q.ProjectID); err != nil {
+			return nil, err
+		}
+	}
+
 	trace, err := c.tClient.GetTrace(ctx, &req)
+	if c.breaker != nil {
+		c.breaker.record(q.ProjectID, err)
+	}
 	if err != nil {
-		return nil, err
+		return nil, wrapDownstreamError(err)
 	}
 	if trace == nil {
 		return nil, errors.New("nil response")
@@ -273,3 +999,129 @@ func (c *Client) GetTrace(ctx context.Context, q *TraceQuery) (*cloudtracepb.Tra
 
 	return trace, nil
 }
+
+// GetTraces retrieves the traces matching several trace IDs, fetching a few at a time.
+// Traces that were retrieved are returned in the order of the requested IDs, along
+// with an error describing any that couldn't be
+func (c *Client) GetTraces(ctx context.Context, q *TracesBatchQuery) ([]*cloudtracepb.Trace, error) {
+	traces := make([]*cloudtracepb.Trace, len(q.TraceIDs))
+	errs := make([]error, len(q.TraceIDs))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentGetTraces)
+	for i, traceID := range q.TraceIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, traceID string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			traces[i], errs[i] = c.GetTrace(ctx, &TraceQuery{
+				ProjectID: q.ProjectID,
+				TraceID:   traceID,
+			})
+		}(i, traceID)
+	}
+	wg.Wait()
+
+	found := make([]*cloudtracepb.Trace, 0, len(traces))
+	errMessages := []string{}
+	for i, t := range traces {
+		if errs[i] != nil {
+			errMessages = append(errMessages, fmt.Sprintf("%s: %s", q.TraceIDs[i], errs[i]))
+			continue
+		}
+		found = append(found, t)
+	}
+	if len(errMessages) > 0 {
+		return found, fmt.Errorf("failed getting %d of %d traces: %s", len(errMessages), len(q.TraceIDs), strings.Join(errMessages, "; "))
+	}
+
+	return found, nil
+}
+
+// tracesCacheKey identifies a ListTraces request for caching
+type tracesCacheKey struct {
+	projectID string
+	filter    string
+	orderBy   string
+	from      int64
+	to        int64
+	limit     int64
+	complete  bool
+}
+
+// tracesCacheEntry is a cached ListTraces result and when it expires
+type tracesCacheEntry struct {
+	traces  []*cloudtracepb.Trace
+	expires time.Time
+}
+
+// tracesCache is a short lived cache of ListTraces results so that
+// repeated identical queries (e.g. quick dashboard refreshes) don't re-query GCP
+type tracesCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[tracesCacheKey]tracesCacheEntry
+}
+
+func newTracesCache(ttl time.Duration) *tracesCache {
+	return &tracesCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[tracesCacheKey]tracesCacheEntry{},
+	}
+}
+
+// key returns the cache key of a query. Its time range is rounded down to the TTL, so
+// refreshes of relative time ranges like "now-1h" a few seconds apart share an entry
+func (tc *tracesCache) key(q *TracesQuery) tracesCacheKey {
+	return tracesCacheKey{
+		projectID: q.ProjectID,
+		filter:    q.Filter,
+		orderBy:   q.OrderBy,
+		from:      q.TimeRange.From.Truncate(tc.ttl).UnixNano(),
+		to:        q.TimeRange.To.Truncate(tc.ttl).UnixNano(),
+		limit:     q.Limit,
+		complete:  q.CompleteView,
+	}
+}
+
+// get returns the cached traces for the query if present and not expired
+func (tc *tracesCache) get(q *TracesQuery) ([]*cloudtracepb.Trace, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	key := tc.key(q)
+	entry, ok := tc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !tc.now().Before(entry.expires) {
+		delete(tc.entries, key)
+		return nil, false
+	}
+
+	// Return a copy so callers can't modify the cached slice
+	return append([]*cloudtracepb.Trace{}, entry.traces...), true
+}
+
+// set caches the traces for the query, dropping any expired entries
+func (tc *tracesCache) set(q *TracesQuery, traces []*cloudtracepb.Trace) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	now := tc.now()
+	for key, entry := range tc.entries {
+		if !now.Before(entry.expires) {
+			delete(tc.entries, key)
+		}
+	}
+
+	tc.entries[tc.key(q)] = tracesCacheEntry{
+		traces:  append([]*cloudtracepb.Trace{}, traces...),
+		expires: now.Add(tc.ttl),
+	}
+}
@@ -0,0 +1,1074 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudtrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/trace/apiv1/tracepb"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/stretchr/testify/require"
+	resourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeTraceService returns canned traces and records the requests it receives
+type fakeTraceService struct {
+	mu           sync.Mutex
+	traces       []*tracepb.Trace
+	listErr      error
+	getErr       error
+	listRequests []*tracepb.ListTracesRequest
+	getRequests  []*tracepb.GetTraceRequest
+	closed       int
+	// filterByTime only lists traces whose first span starts in the request's time range
+	filterByTime bool
+	// block makes listed traces wait until the request's context is done, like an unresponsive API
+	block bool
+	// sortByOrder lists traces in the request's order, like the API does
+	sortByOrder bool
+}
+
+func (f *fakeTraceService) ListTraces(ctx context.Context, req *tracepb.ListTracesRequest) traceIterator {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listRequests = append(f.listRequests, req)
+	if f.block {
+		return &fakeTraceIterator{blockCtx: ctx}
+	}
+	if f.sortByOrder {
+		traces := append([]*tracepb.Trace{}, f.traces...)
+		sortTraces(traces, req.OrderBy)
+		return &fakeTraceIterator{traces: traces, err: f.listErr}
+	}
+	if !f.filterByTime {
+		return &fakeTraceIterator{traces: f.traces, err: f.listErr}
+	}
+	traces := []*tracepb.Trace{}
+	for _, t := range f.traces {
+		start := t.GetSpans()[0].GetStartTime().AsTime()
+		if !start.Before(req.StartTime.AsTime()) && start.Before(req.EndTime.AsTime()) {
+			traces = append(traces, t)
+		}
+	}
+	return &fakeTraceIterator{traces: traces, err: f.listErr}
+}
+
+func (f *fakeTraceService) GetTrace(_ context.Context, req *tracepb.GetTraceRequest) (*tracepb.Trace, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.getRequests = append(f.getRequests, req)
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+	for _, t := range f.traces {
+		if t.TraceId == req.TraceId {
+			return t, nil
+		}
+	}
+	return nil, errors.New("trace not found")
+}
+
+func (f *fakeTraceService) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed++
+	return nil
+}
+
+// fakeTraceIterator iterates over a fixed set of traces, then returns err
+// (or iterator.Done if err is nil). If blockCtx is set, it waits for it to be done instead
+type fakeTraceIterator struct {
+	traces   []*tracepb.Trace
+	err      error
+	i        int
+	blockCtx context.Context
+}
+
+func (it *fakeTraceIterator) Next() (*tracepb.Trace, error) {
+	if it.blockCtx != nil {
+		<-it.blockCtx.Done()
+		return nil, it.blockCtx.Err()
+	}
+	if it.i >= len(it.traces) {
+		if it.err != nil {
+			return nil, it.err
+		}
+		return nil, iterator.Done
+	}
+	t := it.traces[it.i]
+	it.i++
+	return t, nil
+}
+
+// fakeProjectService returns canned projects or an error. If failures is set, only
+// that many calls return the error
+type fakeProjectService struct {
+	projects []*resourcemanager.Project
+	err      error
+	failures int
+	calls    int
+}
+
+func (f *fakeProjectService) List(context.Context) ([]*resourcemanager.Project, error) {
+	f.calls++
+	if f.err != nil && (f.failures == 0 || f.calls <= f.failures) {
+		return nil, f.err
+	}
+	return f.projects, nil
+}
+
+func TestListTraces_Cache(t *testing.T) {
+	now := time.Now()
+	service := &fakeTraceService{
+		traces: []*tracepb.Trace{{TraceId: "1"}, {TraceId: "2"}},
+	}
+	cache := newTracesCache(time.Minute)
+	cache.now = func() time.Time { return now }
+	client := &Client{tClient: service, cache: cache}
+
+	query := &TracesQuery{
+		ProjectID: "testing",
+		Filter:    "root:span",
+		Limit:     10,
+		TimeRange: TimeRange{From: now.Add(-time.Hour), To: now},
+	}
+
+	// First query misses the cache
+	traces, err := client.ListTraces(context.Background(), query)
+	require.NoError(t, err)
+	require.Len(t, traces, 2)
+	require.Len(t, service.listRequests, 1)
+
+	// Identical query hits the cache
+	traces, err = client.ListTraces(context.Background(), query)
+	require.NoError(t, err)
+	require.Len(t, traces, 2)
+	require.Len(t, service.listRequests, 1)
+
+	// Bypassing the cache always queries GCP
+	bypassQuery := *query
+	bypassQuery.BypassCache = true
+	_, err = client.ListTraces(context.Background(), &bypassQuery)
+	require.NoError(t, err)
+	require.Len(t, service.listRequests, 2)
+
+	// Changed filter misses the cache
+	changedQuery := *query
+	changedQuery.Filter = "root:other"
+	_, err = client.ListTraces(context.Background(), &changedQuery)
+	require.NoError(t, err)
+	require.Len(t, service.listRequests, 3)
+
+	// Expired entries are not used
+	now = now.Add(time.Minute)
+	_, err = client.ListTraces(context.Background(), query)
+	require.NoError(t, err)
+	require.Len(t, service.listRequests, 4)
+}
+
+func TestListTraces_CacheRelativeTimeRange(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	service := &fakeTraceService{
+		traces: []*tracepb.Trace{{TraceId: "1"}, {TraceId: "2"}},
+	}
+	cache := newTracesCache(time.Minute)
+	cache.now = func() time.Time { return now }
+	client := &Client{tClient: service, cache: cache}
+
+	// A "now-1h" query refreshed every few seconds
+	query := func() *TracesQuery {
+		return &TracesQuery{
+			ProjectID: "testing",
+			Limit:     10,
+			TimeRange: TimeRange{From: now.Add(-time.Hour), To: now},
+		}
+	}
+
+	_, err := client.ListTraces(context.Background(), query())
+	require.NoError(t, err)
+	require.Len(t, service.listRequests, 1)
+
+	now = now.Add(5 * time.Second)
+	traces, err := client.ListTraces(context.Background(), query())
+	require.NoError(t, err)
+	require.Len(t, traces, 2)
+	require.Len(t, service.listRequests, 1)
+
+	now = now.Add(20 * time.Second)
+	_, err = client.ListTraces(context.Background(), query())
+	require.NoError(t, err)
+	require.Len(t, service.listRequests, 1)
+
+	// The time range moved on to the next TTL bucket
+	now = now.Add(40 * time.Second)
+	_, err = client.ListTraces(context.Background(), query())
+	require.NoError(t, err)
+	require.Len(t, service.listRequests, 2)
+}
+
+func TestListProjects(t *testing.T) {
+	testCases := []struct {
+		name                    string
+		service                 *fakeProjectService
+		includeDeleted          bool
+		reportMissingPermission bool
+		expectedProjects        []string
+		expectedErr             error
+	}{
+		{
+			name: "Active and deleted projects",
+			service: &fakeProjectService{
+				projects: []*resourcemanager.Project{
+					{ProjectId: "active", LifecycleState: "ACTIVE"},
+					{ProjectId: "requested", LifecycleState: "DELETE_REQUESTED"},
+					{ProjectId: "in-progress", LifecycleState: "DELETE_IN_PROGRESS"},
+				},
+			},
+			expectedProjects: []string{"active"},
+		},
+		{
+			name: "Including deleted projects",
+			service: &fakeProjectService{
+				projects: []*resourcemanager.Project{
+					{ProjectId: "active", LifecycleState: "ACTIVE"},
+					{ProjectId: "requested", LifecycleState: "DELETE_REQUESTED"},
+					{ProjectId: "in-progress", LifecycleState: "DELETE_IN_PROGRESS"},
+				},
+			},
+			includeDeleted:   true,
+			expectedProjects: []string{"active", "requested", "in-progress"},
+		},
+		{
+			name:             "Nil projects",
+			service:          &fakeProjectService{},
+			expectedProjects: []string{},
+		},
+		{
+			name: "Permission error returns empty list",
+			service: &fakeProjectService{
+				err: &googleapi.Error{Code: http.StatusForbidden, Message: "permission denied"},
+			},
+			expectedProjects: []string{},
+		},
+		{
+			name: "Permission error is reported if asked",
+			service: &fakeProjectService{
+				err: &googleapi.Error{Code: http.StatusForbidden, Message: "permission denied"},
+			},
+			reportMissingPermission: true,
+			expectedProjects:        []string{},
+			expectedErr:             ErrProjectsPermissionDenied,
+		},
+		{
+			name: "Disabled API returns empty list",
+			service: &fakeProjectService{
+				err: &googleapi.Error{
+					Code:    http.StatusForbidden,
+					Message: "Cloud Resource Manager API has not been used in project 123 before or it is disabled.",
+					Errors:  []googleapi.ErrorItem{{Reason: "accessNotConfigured"}},
+				},
+			},
+			expectedProjects: []string{},
+			expectedErr:      ErrResourceManagerDisabled,
+		},
+		{
+			name: "Other errors are returned",
+			service: &fakeProjectService{
+				err: &googleapi.Error{Code: http.StatusInternalServerError, Message: "internal"},
+			},
+			expectedErr: &googleapi.Error{Code: http.StatusInternalServerError, Message: "internal"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &Client{rClient: tc.service}
+
+			projects, err := client.ListProjects(context.Background(), &ProjectsQuery{
+				IncludeDeleted:          tc.includeDeleted,
+				ReportMissingPermission: tc.reportMissingPermission,
+			})
+			if errors.Is(tc.expectedErr, ErrResourceManagerDisabled) || errors.Is(tc.expectedErr, ErrProjectsPermissionDenied) {
+				require.ErrorIs(t, err, tc.expectedErr)
+				require.Equal(t, tc.expectedProjects, projects)
+				return
+			}
+			if tc.expectedErr != nil {
+				require.EqualError(t, err, tc.expectedErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedProjects, projects)
+		})
+	}
+}
+
+func TestClientSettings_Keepalive(t *testing.T) {
+	params := keepalive.ClientParameters{
+		Time:                time.Minute,
+		Timeout:             time.Second * 20,
+		PermitWithoutStream: true,
+	}
+
+	defaultSettings := newClientSettings(nil)
+	require.Nil(t, defaultSettings.keepalive)
+
+	settings := newClientSettings([]ClientOption{WithKeepalive(params)})
+	require.Equal(t, &params, settings.keepalive)
+	// The keepalive dial option is added to the default trace client options
+	require.Len(t, settings.traceOptions(), len(defaultSettings.traceOptions())+1)
+}
+
+func TestClientSettings_MaxRecvMsgSize(t *testing.T) {
+	defaultSettings := newClientSettings(nil)
+	require.Zero(t, defaultSettings.maxRecvMsgSize)
+
+	settings := newClientSettings([]ClientOption{WithMaxRecvMsgSize(32 * 1024 * 1024)})
+	require.Equal(t, 32*1024*1024, settings.maxRecvMsgSize)
+	// The call option is added to the default trace client options
+	require.Len(t, settings.traceOptions(), len(defaultSettings.traceOptions())+1)
+	// Connections with different limits aren't shared
+	require.NotEqual(t, defaultSettings.poolKey("creds"), settings.poolKey("creds"))
+}
+
+func TestClientSettings_RequestReason(t *testing.T) {
+	defaultSettings := newClientSettings(nil)
+	require.Empty(t, defaultSettings.requestReason)
+
+	settings := newClientSettings([]ClientOption{WithRequestReason("grafana-dashboards")})
+	require.Equal(t, "grafana-dashboards", settings.requestReason)
+	// The reason is forwarded to both the trace and resource manager clients
+	require.Len(t, settings.traceOptions(), len(defaultSettings.traceOptions())+1)
+	require.Len(t, settings.resourceManagerOptions(), len(defaultSettings.resourceManagerOptions())+1)
+	// Connections with different reasons aren't shared
+	require.NotEqual(t, defaultSettings.poolKey("creds"), settings.poolKey("creds"))
+}
+
+func TestRegionalEndpoint(t *testing.T) {
+	testCases := []struct {
+		region           string
+		expectedEndpoint string
+		expectedErr      error
+	}{
+		{region: "europe-west4", expectedEndpoint: "cloudtrace.europe-west4.rep.googleapis.com:443"},
+		{region: "northamerica-northeast1", expectedEndpoint: "cloudtrace.northamerica-northeast1.rep.googleapis.com:443"},
+		{region: "eu", expectedEndpoint: "cloudtrace.eu.rep.googleapis.com:443"},
+		{region: "", expectedErr: ErrInvalidRegion},
+		{region: "Europe-West4", expectedErr: ErrInvalidRegion},
+		{region: "europe-west4.evil.com/", expectedErr: ErrInvalidRegion},
+		{region: "europe-west4-a", expectedErr: ErrInvalidRegion},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.region, func(t *testing.T) {
+			endpoint, err := RegionalEndpoint(tc.region)
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedEndpoint, endpoint)
+		})
+	}
+}
+
+func TestClientSettings_Region(t *testing.T) {
+	defaultSettings := newClientSettings(nil)
+	require.Empty(t, defaultSettings.endpoint)
+
+	settings := newClientSettings([]ClientOption{WithRegion("europe-west4")})
+	require.Equal(t, "cloudtrace.europe-west4.rep.googleapis.com:443", settings.endpoint)
+	// The endpoint option is added to the default trace client options
+	require.Len(t, settings.traceOptions(), len(defaultSettings.traceOptions())+1)
+	// Connections to different endpoints aren't shared
+	require.NotEqual(t, defaultSettings.poolKey("creds"), settings.poolKey("creds"))
+}
+
+func TestNewClient_InvalidRegion(t *testing.T) {
+	// A mistyped region fails, rather than querying the global endpoint
+	_, err := NewClient(context.Background(), []byte(`{"type": "service_account"}`), WithRegion("Europe-West4"))
+	require.ErrorIs(t, err, ErrInvalidRegion)
+
+	_, err = NewClientWithGCE(context.Background(), WithRegion("Europe-West4"))
+	require.ErrorIs(t, err, ErrInvalidRegion)
+
+	_, err = NewClientWithImpersonation(context.Background(), nil, "sa@testing.iam.gserviceaccount.com", WithRegion("Europe-West4"))
+	require.ErrorIs(t, err, ErrInvalidRegion)
+}
+
+func TestTestConnection(t *testing.T) {
+	service := &fakeTraceService{}
+	client := &Client{tClient: service}
+	found, err := client.TestConnection(context.Background(), "testing")
+	require.ErrorIs(t, err, ErrNoTraces)
+	require.Equal(t, 0, found)
+	require.Equal(t, int32(1), service.listRequests[0].PageSize)
+	require.WithinDuration(t, time.Now().Add(-testConnectionTimeWindow), service.listRequests[0].StartTime.AsTime(), time.Minute)
+
+	service = &fakeTraceService{traces: []*tracepb.Trace{{TraceId: "1"}, {TraceId: "2"}}}
+	client = &Client{tClient: service, testConnectionWindow: 365 * 24 * time.Hour, testConnectionPageSize: 10}
+	found, err = client.TestConnection(context.Background(), "testing")
+	require.NoError(t, err)
+	require.Equal(t, 2, found)
+	require.Equal(t, int32(10), service.listRequests[0].PageSize)
+	require.WithinDuration(t, time.Now().Add(-365*24*time.Hour), service.listRequests[0].StartTime.AsTime(), time.Minute)
+
+	// At most a page size of traces is counted, even if more are listed
+	service = &fakeTraceService{traces: []*tracepb.Trace{{TraceId: "1"}, {TraceId: "2"}, {TraceId: "3"}}}
+	client = &Client{tClient: service, testConnectionPageSize: 2}
+	found, err = client.TestConnection(context.Background(), "testing")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), service.listRequests[0].PageSize)
+	require.Equal(t, 2, found)
+}
+
+func TestTestConnection_Timeout(t *testing.T) {
+	service := &fakeTraceService{block: true}
+	client := &Client{tClient: service, testConnectionTimeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	_, err := client.TestConnection(context.Background(), "testing")
+	require.ErrorIs(t, err, ErrConnectionTimeout)
+	require.EqualError(t, err, "connection timed out after 50ms")
+	require.Less(t, time.Since(start), defaultTestConnectionTimeout)
+}
+
+func TestTestConnection_ParentContextCanceled(t *testing.T) {
+	service := &fakeTraceService{block: true}
+	client := &Client{tClient: service, testConnectionTimeout: time.Minute}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := client.TestConnection(ctx, "testing")
+	require.ErrorIs(t, err, context.Canceled)
+	require.NotErrorIs(t, err, ErrConnectionTimeout)
+}
+
+func TestWithConnectionTestTimeout(t *testing.T) {
+	settings := &clientSettings{}
+	WithConnectionTestTimeout(5 * time.Second)(settings)
+	require.Equal(t, 5*time.Second, settings.testConnectionTimeout)
+}
+
+func TestGetTraces(t *testing.T) {
+	service := &fakeTraceService{
+		traces: []*tracepb.Trace{{TraceId: "1"}, {TraceId: "2"}, {TraceId: "3"}},
+	}
+	client := &Client{tClient: service}
+
+	testCases := []struct {
+		name             string
+		traceIDs         []string
+		expectedTraceIDs []string
+		expectedErr      string
+	}{
+		{
+			name:             "All traces found",
+			traceIDs:         []string{"3", "1", "2"},
+			expectedTraceIDs: []string{"3", "1", "2"},
+		},
+		{
+			name:             "Some traces missing",
+			traceIDs:         []string{"1", "missing", "2"},
+			expectedTraceIDs: []string{"1", "2"},
+			expectedErr:      "failed getting 1 of 3 traces: missing: trace not found",
+		},
+		{
+			name:             "No trace IDs",
+			traceIDs:         []string{},
+			expectedTraceIDs: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			traces, err := client.GetTraces(context.Background(), &TracesBatchQuery{
+				ProjectID: "testing",
+				TraceIDs:  tc.traceIDs,
+			})
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			traceIDs := []string{}
+			for _, trace := range traces {
+				traceIDs = append(traceIDs, trace.TraceId)
+			}
+			require.Equal(t, tc.expectedTraceIDs, traceIDs)
+		})
+	}
+}
+
+// capturingLogger records the args of Info logs
+type capturingLogger struct {
+	log.Logger
+	infoArgs [][]interface{}
+}
+
+func (l *capturingLogger) Info(_ string, args ...interface{}) {
+	l.infoArgs = append(l.infoArgs, args)
+}
+
+func TestListTraces_LogsUser(t *testing.T) {
+	logger := &capturingLogger{Logger: log.DefaultLogger}
+	defer func(original log.Logger) {
+		log.DefaultLogger = original
+	}(log.DefaultLogger)
+	log.DefaultLogger = logger
+
+	client := &Client{tClient: &fakeTraceService{}}
+	query := &TracesQuery{ProjectID: "testing", Limit: 10}
+
+	_, err := client.ListTraces(ContextWithUser(context.Background(), "alice"), query)
+	require.NoError(t, err)
+	require.Len(t, logger.infoArgs, 1)
+	require.Subset(t, logger.infoArgs[0], []interface{}{"user", "alice"})
+
+	_, err = client.ListTraces(context.Background(), query)
+	require.NoError(t, err)
+	require.Len(t, logger.infoArgs, 2)
+	require.NotContains(t, logger.infoArgs[1], "user")
+}
+
+func TestListTraces_PageSize(t *testing.T) {
+	traces := []*tracepb.Trace{}
+	for i := 0; i < 30; i++ {
+		traces = append(traces, &tracepb.Trace{TraceId: fmt.Sprint(i)})
+	}
+
+	testCases := []struct {
+		name             string
+		pageSize         int32
+		limit            int64
+		expectedPageSize int32
+		expectedTraces   int
+	}{
+		{
+			name:             "Page size from limit by default",
+			limit:            20,
+			expectedPageSize: 20,
+			expectedTraces:   20,
+		},
+		{
+			name:             "Page size never exceeds the maximum",
+			limit:            5000,
+			expectedPageSize: 1000,
+			expectedTraces:   30,
+		},
+		{
+			name:             "Smaller configured page size",
+			pageSize:         5,
+			limit:            20,
+			expectedPageSize: 5,
+			expectedTraces:   20,
+		},
+		{
+			name:             "Limit smaller than configured page size",
+			pageSize:         50,
+			limit:            20,
+			expectedPageSize: 20,
+			expectedTraces:   20,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := &fakeTraceService{traces: traces}
+			client := &Client{tClient: service, pageSize: tc.pageSize}
+
+			result, err := client.ListTraces(context.Background(), &TracesQuery{ProjectID: "testing", Limit: tc.limit})
+			require.NoError(t, err)
+			require.Len(t, result, tc.expectedTraces)
+			require.Len(t, service.listRequests, 1)
+			require.Equal(t, tc.expectedPageSize, service.listRequests[0].PageSize)
+		})
+	}
+}
+
+func TestListTraces_SortsBeforeLimit(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	trace := func(id string, startOffset time.Duration, duration time.Duration) *tracepb.Trace {
+		return &tracepb.Trace{
+			TraceId: id,
+			Spans: []*tracepb.TraceSpan{{
+				Name:      "span" + id,
+				StartTime: timestamppb.New(start.Add(startOffset)),
+				EndTime:   timestamppb.New(start.Add(startOffset + duration)),
+			}},
+		}
+	}
+	// Two pages of traces returned out of order
+	traces := []*tracepb.Trace{
+		trace("1", time.Second, 30*time.Millisecond),
+		trace("2", 3*time.Second, 10*time.Millisecond),
+		trace("3", 2*time.Second, 50*time.Millisecond),
+		trace("4", 0, 20*time.Millisecond),
+	}
+
+	testCases := []struct {
+		name             string
+		orderBy          string
+		limit            int64
+		expectedTraceIDs []string
+	}{
+		{
+			name:             "Default order is newest first",
+			limit:            4,
+			expectedTraceIDs: []string{"2", "3", "1", "4"},
+		},
+		{
+			name:             "Oldest first",
+			orderBy:          "start",
+			limit:            4,
+			expectedTraceIDs: []string{"4", "1", "3", "2"},
+		},
+		{
+			name:             "Longest first",
+			orderBy:          "duration desc",
+			limit:            4,
+			expectedTraceIDs: []string{"3", "1", "4", "2"},
+		},
+		{
+			name:             "Name",
+			orderBy:          "name desc",
+			limit:            4,
+			expectedTraceIDs: []string{"4", "3", "2", "1"},
+		},
+		{
+			name:             "Unknown order is unchanged",
+			orderBy:          "unknown",
+			limit:            4,
+			expectedTraceIDs: []string{"1", "2", "3", "4"},
+		},
+		{
+			name:             "Limit applied after sorting",
+			orderBy:          "trace_id desc",
+			limit:            2,
+			expectedTraceIDs: []string{"4", "3"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &Client{tClient: &fakeTraceService{traces: traces}}
+
+			result, err := client.ListTraces(context.Background(), &TracesQuery{
+				ProjectID: "testing",
+				Limit:     tc.limit,
+				OrderBy:   tc.orderBy,
+			})
+			require.NoError(t, err)
+
+			traceIDs := []string{}
+			for _, trace := range result {
+				traceIDs = append(traceIDs, trace.TraceId)
+			}
+			require.Equal(t, tc.expectedTraceIDs, traceIDs)
+		})
+	}
+}
+
+func TestListTraces_Ascending(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	// Ten traces a second apart, newest first
+	traces := []*tracepb.Trace{}
+	for i := 9; i >= 0; i-- {
+		traces = append(traces, &tracepb.Trace{
+			TraceId: fmt.Sprint(i),
+			Spans: []*tracepb.TraceSpan{{
+				StartTime: timestamppb.New(start.Add(time.Duration(i) * time.Second)),
+				EndTime:   timestamppb.New(start.Add(time.Duration(i)*time.Second + time.Millisecond)),
+			}},
+		})
+	}
+
+	testCases := []struct {
+		name             string
+		orderBy          string
+		pageSize         int32
+		limit            int64
+		expectedOrderBy  string
+		expectedTraceIDs []string
+	}{
+		{
+			name:             "Newest first by default",
+			limit:            3,
+			expectedOrderBy:  "start desc",
+			expectedTraceIDs: []string{"9", "8", "7"},
+		},
+		{
+			name:             "Oldest first",
+			orderBy:          "start",
+			limit:            3,
+			expectedOrderBy:  "start",
+			expectedTraceIDs: []string{"0", "1", "2"},
+		},
+		{
+			name:             "Explicit ascending order",
+			orderBy:          "start asc",
+			limit:            3,
+			expectedOrderBy:  "start",
+			expectedTraceIDs: []string{"0", "1", "2"},
+		},
+		{
+			name:             "Ascending over several pages",
+			orderBy:          "start asc",
+			pageSize:         2,
+			limit:            5,
+			expectedOrderBy:  "start",
+			expectedTraceIDs: []string{"0", "1", "2", "3", "4"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := &fakeTraceService{traces: traces, sortByOrder: true}
+			client := &Client{tClient: service, pageSize: tc.pageSize}
+
+			result, err := client.ListTraces(context.Background(), &TracesQuery{
+				ProjectID: "testing",
+				Limit:     tc.limit,
+				OrderBy:   tc.orderBy,
+			})
+			require.NoError(t, err)
+			require.Len(t, service.listRequests, 1)
+			require.Equal(t, tc.expectedOrderBy, service.listRequests[0].OrderBy)
+
+			traceIDs := []string{}
+			for _, trace := range result {
+				traceIDs = append(traceIDs, trace.TraceId)
+			}
+			require.Equal(t, tc.expectedTraceIDs, traceIDs)
+		})
+	}
+}
+
+func TestListTraces_TimeRange(t *testing.T) {
+	to := time.UnixMilli(1660920349373)
+
+	testCases := []struct {
+		name         string
+		maxTimeRange time.Duration
+		timeRange    TimeRange
+		expectedFrom time.Time
+		expectedErr  error
+	}{
+		{
+			name:         "Valid time range",
+			timeRange:    TimeRange{From: to.Add(-time.Hour), To: to},
+			expectedFrom: to.Add(-time.Hour),
+		},
+		{
+			name:        "Inverted time range",
+			timeRange:   TimeRange{From: to.Add(time.Hour), To: to},
+			expectedErr: ErrInvalidTimeRange,
+		},
+		{
+			name:         "Time range within the maximum",
+			maxTimeRange: 24 * time.Hour,
+			timeRange:    TimeRange{From: to.Add(-time.Hour), To: to},
+			expectedFrom: to.Add(-time.Hour),
+		},
+		{
+			name:         "Time range over the maximum is clamped",
+			maxTimeRange: 24 * time.Hour,
+			timeRange:    TimeRange{From: to.Add(-7 * 24 * time.Hour), To: to},
+			expectedFrom: to.Add(-24 * time.Hour),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := &fakeTraceService{}
+			client := &Client{tClient: service, maxTimeRange: tc.maxTimeRange}
+
+			_, err := client.ListTraces(context.Background(), &TracesQuery{
+				ProjectID: "testing",
+				Limit:     10,
+				TimeRange: tc.timeRange,
+			})
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, err, tc.expectedErr)
+				require.Empty(t, service.listRequests)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, service.listRequests, 1)
+			require.Equal(t, tc.expectedFrom.UnixMilli(), service.listRequests[0].StartTime.AsTime().UnixMilli())
+			require.Equal(t, to.UnixMilli(), service.listRequests[0].EndTime.AsTime().UnixMilli())
+		})
+	}
+}
+
+func TestListTraces_Sampled(t *testing.T) {
+	to := time.UnixMilli(1660920349373)
+	from := to.Add(-100 * time.Minute)
+	// A trace a minute, newest first like the API returns them
+	traces := []*tracepb.Trace{}
+	for i := 99; i >= 0; i-- {
+		start := from.Add(time.Duration(i) * time.Minute)
+		traces = append(traces, &tracepb.Trace{
+			TraceId: fmt.Sprint(i),
+			Spans: []*tracepb.TraceSpan{{
+				SpanId:    1,
+				StartTime: timestamppb.New(start),
+				EndTime:   timestamppb.New(start.Add(time.Second)),
+			}},
+		})
+	}
+	// tracesPerBucket counts the traces in each tenth of the time range
+	tracesPerBucket := func(traces []*tracepb.Trace) []int {
+		counts := make([]int, 10)
+		for _, t := range traces {
+			counts[t.GetSpans()[0].GetStartTime().AsTime().Sub(from)/(10*time.Minute)]++
+		}
+		return counts
+	}
+
+	testCases := []struct {
+		name             string
+		sampled          bool
+		orderBy          string
+		limit            int64
+		expectedRequests int
+		expectedBuckets  []int
+	}{
+		{
+			name:             "Newest traces",
+			limit:            20,
+			expectedRequests: 1,
+			expectedBuckets:  []int{0, 0, 0, 0, 0, 0, 0, 0, 10, 10},
+		},
+		{
+			name:             "Sampled evenly",
+			sampled:          true,
+			limit:            20,
+			expectedRequests: 10,
+			expectedBuckets:  []int{2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+		},
+		{
+			name:             "Remainder from the newest buckets",
+			sampled:          true,
+			limit:            25,
+			expectedRequests: 10,
+			expectedBuckets:  []int{2, 2, 2, 2, 2, 3, 3, 3, 3, 3},
+		},
+		{
+			name:             "Remainder from the oldest buckets when oldest first",
+			sampled:          true,
+			orderBy:          "start asc",
+			limit:            25,
+			expectedRequests: 10,
+			expectedBuckets:  []int{3, 3, 3, 3, 3, 2, 2, 2, 2, 2},
+		},
+		{
+			name:             "Fewer traces than buckets",
+			sampled:          true,
+			limit:            5,
+			expectedRequests: 5,
+			expectedBuckets:  []int{0, 1, 0, 1, 0, 1, 0, 1, 0, 1},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := &fakeTraceService{traces: traces, filterByTime: true}
+			client := &Client{tClient: service}
+
+			result, err := client.ListTraces(context.Background(), &TracesQuery{
+				ProjectID: "testing",
+				Limit:     tc.limit,
+				TimeRange: TimeRange{From: from, To: to},
+				Sampled:   tc.sampled,
+				OrderBy:   tc.orderBy,
+			})
+			require.NoError(t, err)
+			require.Len(t, service.listRequests, tc.expectedRequests)
+			require.Len(t, result, int(tc.limit))
+			require.Equal(t, tc.expectedBuckets, tracesPerBucket(result))
+
+			// Still in the requested order
+			for i := 1; i < len(result); i++ {
+				previous, next := result[i-1].GetSpans()[0].GetStartTime().AsTime(), result[i].GetSpans()[0].GetStartTime().AsTime()
+				if isOldestFirst(tc.orderBy) {
+					require.True(t, previous.Before(next))
+				} else {
+					require.True(t, previous.After(next))
+				}
+			}
+		})
+	}
+}
+
+func TestListTraces_EqualStartTimes(t *testing.T) {
+	startTime := timestamppb.New(time.UnixMilli(1660920349373))
+	trace := func(id string) *tracepb.Trace {
+		return &tracepb.Trace{
+			TraceId: id,
+			Spans:   []*tracepb.TraceSpan{{StartTime: startTime, EndTime: startTime}},
+		}
+	}
+
+	// Every refresh returns the same traces in a different order
+	refreshes := [][]*tracepb.Trace{
+		{trace("b"), trace("c"), trace("a")},
+		{trace("c"), trace("a"), trace("b")},
+		{trace("a"), trace("b"), trace("c")},
+	}
+
+	for _, traces := range refreshes {
+		client := &Client{tClient: &fakeTraceService{traces: traces}}
+
+		result, err := client.ListTraces(context.Background(), &TracesQuery{ProjectID: "testing", Limit: 10})
+		require.NoError(t, err)
+
+		traceIDs := []string{}
+		for _, trace := range result {
+			traceIDs = append(traceIDs, trace.TraceId)
+		}
+		require.Equal(t, []string{"a", "b", "c"}, traceIDs)
+	}
+}
+
+func TestDownstreamErrors(t *testing.T) {
+	testCases := []struct {
+		name               string
+		err                error
+		expectedDownstream bool
+	}{
+		{
+			name:               "Deadline exceeded",
+			err:                status.Error(codes.DeadlineExceeded, "deadline exceeded"),
+			expectedDownstream: true,
+		},
+		{
+			name:               "Unavailable",
+			err:                status.Error(codes.Unavailable, "unavailable"),
+			expectedDownstream: true,
+		},
+		{
+			name:               "Context deadline exceeded",
+			err:                context.DeadlineExceeded,
+			expectedDownstream: true,
+		},
+		{
+			name:               "Other errors",
+			err:                status.Error(codes.InvalidArgument, "bad request"),
+			expectedDownstream: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &Client{tClient: &fakeTraceService{listErr: tc.err, getErr: tc.err}}
+
+			_, listErr := client.ListTraces(context.Background(), &TracesQuery{ProjectID: "testing", Limit: 10})
+			_, getErr := client.GetTrace(context.Background(), &TraceQuery{ProjectID: "testing", TraceID: "1"})
+
+			var downstreamErr *DownstreamError
+			require.ErrorIs(t, getErr, tc.err)
+			if tc.expectedDownstream {
+				require.ErrorAs(t, listErr, &downstreamErr)
+				require.ErrorIs(t, listErr, tc.err)
+				require.ErrorAs(t, getErr, &downstreamErr)
+			} else {
+				// Listing still returns whatever was found for other errors
+				require.NoError(t, listErr)
+				require.False(t, errors.As(getErr, &downstreamErr))
+			}
+		})
+	}
+}
+
+func TestListTraces_LatencyOrder(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	span := func(id uint64, parentID uint64, duration time.Duration) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start),
+			EndTime:      timestamppb.New(start.Add(duration)),
+		}
+	}
+	// The longest root span isn't the longest trace, as another trace's child outlasts its root
+	traces := []*tracepb.Trace{
+		{TraceId: "longRoot", Spans: []*tracepb.TraceSpan{span(1, 0, 100*time.Millisecond), span(2, 1, 50*time.Millisecond)}},
+		{TraceId: "longChild", Spans: []*tracepb.TraceSpan{span(1, 0, 20*time.Millisecond), span(2, 1, 300*time.Millisecond)}},
+		{TraceId: "short", Spans: []*tracepb.TraceSpan{span(1, 0, 10*time.Millisecond)}},
+	}
+
+	testCases := []struct {
+		name             string
+		orderBy          string
+		expectedView     tracepb.ListTracesRequest_ViewType
+		expectedOrderBy  string
+		expectedTraceIDs []string
+	}{
+		{
+			name:             "Root span duration",
+			orderBy:          "duration desc",
+			expectedView:     tracepb.ListTracesRequest_ROOTSPAN,
+			expectedOrderBy:  "duration desc",
+			expectedTraceIDs: []string{"longRoot", "longChild", "short"},
+		},
+		{
+			name:             "Whole trace latency",
+			orderBy:          "latency desc",
+			expectedView:     tracepb.ListTracesRequest_COMPLETE,
+			expectedOrderBy:  "duration desc",
+			expectedTraceIDs: []string{"longChild", "longRoot", "short"},
+		},
+		{
+			name:             "Whole trace latency ascending",
+			orderBy:          "latency",
+			expectedView:     tracepb.ListTracesRequest_COMPLETE,
+			expectedOrderBy:  "duration",
+			expectedTraceIDs: []string{"short", "longRoot", "longChild"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := &fakeTraceService{traces: traces}
+			client := &Client{tClient: service}
+
+			result, err := client.ListTraces(context.Background(), &TracesQuery{ProjectID: "testing", Limit: 10, OrderBy: tc.orderBy})
+			require.NoError(t, err)
+			require.Len(t, service.listRequests, 1)
+			require.Equal(t, tc.expectedView, service.listRequests[0].View)
+			require.Equal(t, tc.expectedOrderBy, service.listRequests[0].OrderBy)
+
+			traceIDs := []string{}
+			for _, trace := range result {
+				traceIDs = append(traceIDs, trace.TraceId)
+			}
+			require.Equal(t, tc.expectedTraceIDs, traceIDs)
+		})
+	}
+}
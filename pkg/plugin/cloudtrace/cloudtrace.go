@@ -16,52 +16,231 @@ package cloudtrace
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/trace/apiv1/tracepb"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
 	servicePrefix        = "service."
 	gaeServicePrefix     = "g.co/gae/app/"
+	baggagePrefix        = "baggage."
 	otelServiceKey       = "service.name"
 	gaeServiceKey        = "g.co/gae/app/module"
 	gaeServiceVersionKey = "g.co/gae/app/version"
 	otelMethodKey        = "http.method"
 	cloudTraceMethodKey  = "/http/method"
+	otelURLKey           = "http.url"
+	otelTargetKey        = "http.target"
+	cloudTraceURLKey     = "/http/url"
+	otelHostKey          = "http.host"
+	cloudTraceHostKey    = "/http/host"
+	otelGRPCStatusKey    = "rpc.grpc.status_code"
+	// Messaging semantic convention labels, with the names from before and after v1.17
+	otelMessagingSystemKey          = "messaging.system"
+	otelMessagingOperationKey       = "messaging.operation"
+	otelMessagingOperationTypeKey   = "messaging.operation.type"
+	otelMessagingDestinationKey     = "messaging.destination"
+	otelMessagingDestinationNameKey = "messaging.destination.name"
 )
 
+// grpcStatusNames are the names of gRPC status codes, indexed by code
+var grpcStatusNames = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+const (
+	filterForm         = "[key]:[value]"
+	labelFilterForm    = "LABEL:[key]:[value]"
+	hasLabelFilterForm = "HasLabel:[key]=[value]"
+
+	spanFilterServicePrefix = "service:"
+
+	// DefaultMaxFilterTerms is the default maximum number of filter parts in query text
+	DefaultMaxFilterTerms = 50
+)
+
+// ErrTooManyFilterTerms is returned when query text has more filter parts than allowed
+var ErrTooManyFilterTerms = errors.New("too many filter terms")
+
+// traceReferenceRe matches Cloud Logging trace fields, e.g. projects/my-project/traces/abc123
+var traceReferenceRe = regexp.MustCompile(`projects/([^/\s"']+)/traces/([0-9a-fA-F]+)`)
+
 // Regex for individual filters within query text
 var re = regexp.MustCompile(`(?:[^\s"]+|"(?:\\"|[^"])*")+`)
 
+// FilterParseError is returned when a filter part of the query text
+// cannot be converted to a Cloud Trace API filter
+type FilterParseError struct {
+	// Token is the offending filter part
+	Token string
+	// Expected is the form the filter part should have been in
+	Expected string
+	// Position is the byte offset of Token within the query text
+	Position int
+}
+
+func (e *FilterParseError) Error() string {
+	return fmt.Sprintf("bad filter [%s]. Must be in form %s", e.Token, e.Expected)
+}
+
+// FilterKeyword describes a query text filter keyword and
+// the Cloud Trace API filter key it is converted to
+type FilterKeyword struct {
+	Keyword     string `json:"keyword"`
+	APIKey      string `json:"apiKey"`
+	Description string `json:"description"`
+	// ClientSide keywords are matched against the listed traces rather than
+	// by the Cloud Trace API, so they have no API key
+	ClientSide bool `json:"clientSide,omitempty"`
+	// Operators are the comparison operators the keyword can be used with, e.g. Status:>=500
+	Operators []string `json:"operators,omitempty"`
+}
+
+// comparisonOperators are the operators of comparison filter parts, like LatencyMs:>500
+var comparisonOperators = []string{">", "<", ">=", "<="}
+
+// filterKeywords are the supported query text filter keywords
+var filterKeywords = []FilterKeyword{
+	{Keyword: "RootSpan", APIKey: "root", Description: "Root span name starts with the value"},
+	{Keyword: "SpanName", APIKey: "span", Description: "Any span name starts with the value"},
+	{Keyword: "HasLabel", APIKey: "label", Description: "Any span has a label with the value as its key, or [key]=[value] for a label with a value"},
+	{Keyword: "MinLatency", APIKey: "latency", Description: "Trace latency is at least the value, e.g. 100ms, or compared with the value in ms", Operators: comparisonOperators},
+	{Keyword: "URL", APIKey: "url", Description: "Root span URL starts with the value"},
+	{Keyword: "Method", APIKey: "method", Description: "Root span HTTP method is the value"},
+	// Currently matches the Google Cloud Trace UI filter, but ignores "service.version" matches
+	{Keyword: "Version", APIKey: gaeServiceVersionKey, Description: "App Engine service version starts with the value"},
+	// Currently matches the Google Cloud Trace UI filter, but ignores "service.name" matches
+	{Keyword: "Service", APIKey: gaeServiceKey, Description: "App Engine service name starts with the value"},
+	{Keyword: "Status", APIKey: "/http/status_code", Description: "HTTP status code starts with the value, or is compared with it", Operators: comparisonOperators},
+	{Keyword: TracePrefixKeyword, Description: "Trace ID starts with the value, among the listed traces", ClientSide: true},
+	{Keyword: ContainsSpanKeyword, Description: "Any span name is exactly the value, among the listed traces", ClientSide: true},
+	{Keyword: LatencyMsKeyword, Description: "Trace latency in ms is compared with the value, e.g. LatencyMs:>500", ClientSide: true, Operators: comparisonOperators},
+	{Keyword: latencyKeyword, Description: "Same as LatencyMs", ClientSide: true, Operators: comparisonOperators},
+}
+
+// GetFilterSchema returns the supported query text filter keywords
+func GetFilterSchema() []FilterKeyword {
+	return append([]FilterKeyword{}, filterKeywords...)
+}
+
 // TimeRange holds both a from and to time
 type TimeRange struct {
 	From time.Time
 	To   time.Time
 }
 
+// ServiceNamePrecedence controls which label is used as the service name
+// when a span has both an OTEL and a GAE service label
+type ServiceNamePrecedence string
+
+const (
+	// ServiceNameOTELFirst prefers the OTEL "service.name" label
+	ServiceNameOTELFirst ServiceNamePrecedence = "otel"
+	// ServiceNameGAEFirst prefers the GAE "g.co/gae/app/module" label
+	ServiceNameGAEFirst ServiceNamePrecedence = "gae"
+	// ServiceNameConcat joins both labels as "[otel]/[gae]" if they differ
+	ServiceNameConcat ServiceNamePrecedence = "concat"
+)
+
 // GetServiceName returns the service name for the span
 func GetServiceName(span *tracepb.TraceSpan) string {
+	return GetServiceNameWithPrecedence(span, ServiceNameOTELFirst)
+}
+
+// GetServiceNameWithPrecedence returns the service name for the span,
+// using precedence to choose between the OTEL and GAE service labels.
+// Unknown precedences are treated as ServiceNameOTELFirst
+func GetServiceNameWithPrecedence(span *tracepb.TraceSpan, precedence ServiceNamePrecedence) string {
 	labels := span.GetLabels()
 
-	// In both cases treating "not existing" and "empty value" the same
-	serviceName := labels[otelServiceKey]
-	if serviceName == "" {
-		serviceName = labels[gaeServiceKey]
+	// In all cases treating "not existing" and "empty value" the same
+	otelServiceName := labels[otelServiceKey]
+	gaeServiceName := labels[gaeServiceKey]
+
+	switch {
+	case otelServiceName == "":
+		return gaeServiceName
+	case gaeServiceName == "":
+		return otelServiceName
+	case precedence == ServiceNameGAEFirst:
+		return gaeServiceName
+	case precedence == ServiceNameConcat && otelServiceName != gaeServiceName:
+		return fmt.Sprintf("%s/%s", otelServiceName, gaeServiceName)
+	default:
+		return otelServiceName
 	}
+}
+
+// ParseTraceReference extracts the project and trace ID from text containing
+// a Cloud Logging trace field (e.g. a pasted log line with
+// trace=projects/my-project/traces/abc123). Otherwise the text is
+// treated as a plain trace ID, and the project is empty
+func ParseTraceReference(text string) (projectID string, traceID string) {
+	if match := traceReferenceRe.FindStringSubmatch(text); match != nil {
+		return match[1], match[2]
+	}
+	return "", strings.TrimSpace(text)
+}
 
-	return serviceName
+// traceIDListSeparators are the separators of trace IDs in lists from metrics panels:
+// Grafana's multi-value formats ({a,b}, ["a","b"], a|b) or plain whitespace
+var traceIDListSeparators = regexp.MustCompile(`[\s,|{}\[\]"']+`)
+
+// ParseTraceIDs extracts the trace IDs from a list of them, like the exemplar trace IDs of
+// a metrics panel interpolated into a query. Cloud Logging trace fields are reduced to their
+// trace ID. Blank and repeated IDs are dropped, otherwise IDs keep their order
+func ParseTraceIDs(text string) []string {
+	traceIDs := []string{}
+	seen := map[string]bool{}
+	for _, part := range traceIDListSeparators.Split(text, -1) {
+		_, traceID := ParseTraceReference(part)
+		if traceID == "" || seen[traceID] {
+			continue
+		}
+		seen[traceID] = true
+		traceIDs = append(traceIDs, traceID)
+	}
+	return traceIDs
 }
 
 // GetTraceName gets the name, service label value, and method label value
 // for the span and combines them to create a descriptive name
 func GetTraceName(span *tracepb.TraceSpan) string {
+	return GetTraceNameWithPrecedence(span, ServiceNameOTELFirst)
+}
+
+// GetTraceNameWithPrecedence is GetTraceName, using precedence to choose
+// between the OTEL and GAE service labels like the service name of spans
+func GetTraceNameWithPrecedence(span *tracepb.TraceSpan, precedence ServiceNamePrecedence) string {
 	namePart := span.GetName()
 
-	servicePart := GetServiceName(span)
+	servicePart := GetServiceNameWithPrecedence(span, precedence)
 	if servicePart != "" {
 		servicePart = fmt.Sprintf("%s: ", servicePart)
 	}
@@ -75,8 +254,13 @@ func GetTraceName(span *tracepb.TraceSpan) string {
 }
 
 // GetSpanOperationName gets the name and method label value
-// for the span and combines them to create a descriptive name
+// for the span and combines them to create a descriptive name.
+// Messaging spans are named by their system, operation and destination instead
 func GetSpanOperationName(span *tracepb.TraceSpan) string {
+	if name := getMessagingOperationName(span); name != "" {
+		return name
+	}
+
 	namePart := span.GetName()
 
 	methodPart := getHTTPMethod(span)
@@ -87,25 +271,147 @@ func GetSpanOperationName(span *tracepb.TraceSpan) string {
 	return fmt.Sprintf("%s%s", methodPart, namePart)
 }
 
+// GetHTTPURL returns the HTTP URL (or OTEL target if no full URL is known) of the span
+func GetHTTPURL(span *tracepb.TraceSpan) string {
+	labels := span.GetLabels()
+
+	// In all cases treating "not existing" and "empty value" the same
+	for _, key := range []string{otelURLKey, cloudTraceURLKey, otelTargetKey} {
+		if value := labels[key]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// GetHTTPHost returns the HTTP host of the span, falling back to the host of its URL
+func GetHTTPHost(span *tracepb.TraceSpan) string {
+	labels := span.GetLabels()
+
+	// In all cases treating "not existing" and "empty value" the same
+	for _, key := range []string{otelHostKey, cloudTraceHostKey} {
+		if value := labels[key]; value != "" {
+			return value
+		}
+	}
+
+	if parsedURL, err := url.Parse(GetHTTPURL(span)); err == nil {
+		return parsedURL.Host
+	}
+	return ""
+}
+
+// GetGRPCStatus returns the name of the gRPC status code of an OpenTelemetry gRPC span
+// (e.g. "NOT_FOUND" for 5), or the code as it is if it isn't a known code
+func GetGRPCStatus(span *tracepb.TraceSpan) string {
+	value := span.GetLabels()[otelGRPCStatusKey]
+	if code, err := strconv.Atoi(value); err == nil && code >= 0 && code < len(grpcStatusNames) {
+		return grpcStatusNames[code]
+	}
+	return value
+}
+
+// maxSafeTagInt is the largest integer that survives conversion to a JavaScript number
+const maxSafeTagInt = 1<<53 - 1
+
+var decimalTagValue = regexp.MustCompile(`^-?(?:0|[1-9]\d*)\.\d+$`)
+
+// tag is a Grafana trace key/value pair
+type tag struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
 // GetTags converts Google Trace labels to Grafana service and span tags
 func GetTags(span *tracepb.TraceSpan) (serviceTags json.RawMessage, spanTags json.RawMessage, err error) {
+	return GetTagsWithOptions(span, TagOptions{})
+}
+
+// GetTagsWithServicePrefixes converts Google Trace labels to Grafana service and span tags,
+// also treating labels starting with any of the given prefixes as service tags
+func GetTagsWithServicePrefixes(span *tracepb.TraceSpan, servicePrefixes []string) (serviceTags json.RawMessage, spanTags json.RawMessage, err error) {
+	return GetTagsWithOptions(span, TagOptions{ServicePrefixes: servicePrefixes})
+}
+
+// TagOptions control which labels become tags, and which of them are service tags
+type TagOptions struct {
+	// ServicePrefixes are label key prefixes treated as service tags, in
+	// addition to the OTEL and GAE service prefixes
+	ServicePrefixes []string
+	// Include are glob patterns (e.g. "http.*") of label keys to emit as tags. All labels are emitted if empty
+	Include []string
+	// Exclude are glob patterns of label keys not to emit as tags, applied after Include
+	Exclude []string
+	// DisplayKeys maps label keys to the keys their tags are shown with (e.g. "/http/url"
+	// to "http.url"). Include, Exclude and ServicePrefixes still match the label keys
+	DisplayKeys map[string]string
+	// MaxTags is the most service and span tags emitted, keeping the first label keys
+	// alphabetically and adding a TruncatedTagsKey tag counting the rest. Unlimited if not positive
+	MaxTags int
+}
+
+// TruncatedTagsKey is the key of the span tag counting the tags left out beyond TagOptions.MaxTags
+const TruncatedTagsKey = "_truncated_tags"
+
+// displayKey returns the key the tag of a label is shown with
+func (o TagOptions) displayKey(key string) string {
+	if displayKey, ok := o.DisplayKeys[key]; ok && displayKey != "" {
+		return displayKey
+	}
+	return key
+}
+
+// emits reports whether a label key should be emitted as a tag
+func (o TagOptions) emits(key string) bool {
+	if len(o.Include) > 0 && !matchesAnyGlob(key, o.Include) {
+		return false
+	}
+	return !matchesAnyGlob(key, o.Exclude)
+}
+
+// GetTagsWithOptions converts Google Trace labels to Grafana service and span tags.
+// OTEL baggage labels (starting with "baggage.") are left to GetBaggageTags
+func GetTagsWithOptions(span *tracepb.TraceSpan, opts TagOptions) (serviceTags json.RawMessage, spanTags json.RawMessage, err error) {
+	prefixes := append([]string{servicePrefix, gaeServicePrefix}, opts.ServicePrefixes...)
+
 	spanLabels := span.GetLabels()
-	serviceTagsMapArray := []map[string]string{}
-	spanTagsMapArray := []map[string]string{}
-	for key, value := range spanLabels {
-		if strings.HasPrefix(key, servicePrefix) || strings.HasPrefix(key, gaeServicePrefix) {
-			serviceTagsMapArray = append(serviceTagsMapArray, map[string]string{"key": key, "value": value})
+	keys := make([]string, 0, len(spanLabels))
+	for key := range spanLabels {
+		if opts.emits(key) && !strings.HasPrefix(key, baggagePrefix) {
+			keys = append(keys, key)
+		}
+	}
+	// Sorted so the tags kept when truncating don't depend on map order either
+	sort.Strings(keys)
+	truncated := 0
+	if opts.MaxTags > 0 && len(keys) > opts.MaxTags {
+		truncated = len(keys) - opts.MaxTags
+		keys = keys[:opts.MaxTags]
+	}
+
+	serviceTagsArray := []tag{}
+	spanTagsArray := []tag{}
+	for _, key := range keys {
+		value := spanLabels[key]
+		if hasAnyPrefix(key, prefixes) {
+			serviceTagsArray = append(serviceTagsArray, tag{Key: opts.displayKey(key), Value: getTypedTagValue(value)})
 		} else {
-			spanTagsMapArray = append(spanTagsMapArray, map[string]string{"key": key, "value": value})
+			spanTagsArray = append(spanTagsArray, tag{Key: opts.displayKey(key), Value: getTypedTagValue(value)})
 		}
 	}
+	// Display keys may sort differently to label keys, so the tags are sorted again
+	sortTags(serviceTagsArray)
+	sortTags(spanTagsArray)
+	if truncated > 0 {
+		spanTagsArray = append(spanTagsArray, tag{Key: TruncatedTagsKey, Value: truncated})
+	}
 
-	serviceTags, err = json.Marshal(serviceTagsMapArray)
+	serviceTags, err = json.Marshal(serviceTagsArray)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	spanTags, err = json.Marshal(spanTagsMapArray)
+	spanTags, err = json.Marshal(spanTagsArray)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -113,16 +419,939 @@ func GetTags(span *tracepb.TraceSpan) (serviceTags json.RawMessage, spanTags jso
 	return serviceTags, spanTags, nil
 }
 
+// GetBaggageTags converts the OTEL baggage and correlation context labels of a span
+// (e.g. "baggage.user_id") to Grafana tags, keyed without the "baggage." prefix unless remapped
+func GetBaggageTags(span *tracepb.TraceSpan, opts TagOptions) (json.RawMessage, error) {
+	baggageTagsArray := []tag{}
+	for key, value := range span.GetLabels() {
+		if !opts.emits(key) || !strings.HasPrefix(key, baggagePrefix) {
+			continue
+		}
+		displayKey := opts.displayKey(key)
+		if displayKey == key {
+			displayKey = strings.TrimPrefix(key, baggagePrefix)
+		}
+		baggageTagsArray = append(baggageTagsArray, tag{Key: displayKey, Value: getTypedTagValue(value)})
+	}
+	sortTags(baggageTagsArray)
+	return json.Marshal(baggageTagsArray)
+}
+
+// sortTags sorts tags by key, so their order doesn't depend on the map order of span labels
+func sortTags(tags []tag) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].Key < tags[j].Key
+	})
+}
+
+func matchesAnyGlob(s string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchesGlob(s, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesGlob reports whether s matches a glob pattern, where * matches any
+// characters (including "/", unlike path.Match) and ? matches a single character
+func matchesGlob(s string, pattern string) bool {
+	var si, pi int
+	// Where to resume after the last *, if the rest of the pattern stops matching
+	starPi, starSi := -1, 0
+	for si < len(s) {
+		switch {
+		case pi < len(pattern) && (pattern[pi] == '?' || pattern[pi] == s[si]):
+			si++
+			pi++
+		case pi < len(pattern) && pattern[pi] == '*':
+			starPi, starSi = pi, si
+			pi++
+		case starPi >= 0:
+			// Let the last * match one more character
+			starSi++
+			si = starSi
+			pi = starPi + 1
+		default:
+			return false
+		}
+	}
+	for pi < len(pattern) && pattern[pi] == '*' {
+		pi++
+	}
+	return pi == len(pattern)
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// getTypedTagValue converts label values that are clearly booleans or numbers
+// to those types so they can be formatted, otherwise the value stays a string.
+// Values that would change when parsed (e.g. "007" or very large integers) stay strings
+func getTypedTagValue(value string) interface{} {
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(i, 10) == value {
+		if i <= maxSafeTagInt && i >= -maxSafeTagInt {
+			return i
+		}
+		return value
+	}
+
+	if decimalTagValue.MatchString(value) {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+
+	return value
+}
+
+// GetWarningCount counts the labels of a span that indicate a warning or error.
+// Spans from the v1 API carry no time events, so error and warning details exported
+// as labels are used instead: labels with error, exception or warning keys
+// (e.g. "/error/message", "exception.type") and labels with error or warning
+// values (e.g. "otel.status_code": "ERROR"). Empty and false values aren't counted
+func GetWarningCount(span *tracepb.TraceSpan) int64 {
+	var count int64
+	for key, value := range span.GetLabels() {
+		key, value = strings.ToLower(key), strings.ToLower(value)
+		switch value {
+		case "", "false", "0", "ok", "unset":
+			continue
+		case "error", "warn", "warning":
+			count++
+			continue
+		}
+		if strings.Contains(key, "error") || strings.Contains(key, "exception") || strings.Contains(key, "warn") {
+			count++
+		}
+	}
+	return count
+}
+
+// IsErrorSpan reports whether a span failed, from its OpenTelemetry status labels
+// or an HTTP 5xx status code
+func IsErrorSpan(span *tracepb.TraceSpan) bool {
+	return getOTLPStatus(span).Code == otlpStatusError
+}
+
+// GetSpanStatus returns the OpenTelemetry status of a span, OK, ERROR or UNSET. Spans with
+// HTTP 5xx status codes are errors, like IsErrorSpan
+func GetSpanStatus(span *tracepb.TraceSpan) string {
+	switch getOTLPStatus(span).Code {
+	case otlpStatusOK:
+		return "OK"
+	case otlpStatusError:
+		return "ERROR"
+	default:
+		return "UNSET"
+	}
+}
+
+// GetErrorService returns the service the errors of a trace originate in: the service of its
+// deepest error span, preferring server spans at the same depth since a client span's error
+// is usually caused by the server it calls. It's empty if no span failed. Only the spans
+// given are considered, so traces listed with only their root span are attributed to it
+func GetErrorService(spans []*tracepb.TraceSpan, precedence ServiceNamePrecedence) string {
+	var origin *SpanTreeNode
+	for _, node := range GetSpanTree(spans) {
+		if !IsErrorSpan(node.Span) {
+			continue
+		}
+		if origin == nil || node.Depth > origin.Depth ||
+			(node.Depth == origin.Depth && origin.Span.GetKind() != tracepb.TraceSpan_RPC_SERVER && node.Span.GetKind() == tracepb.TraceSpan_RPC_SERVER) {
+			node := node
+			origin = &node
+		}
+	}
+	if origin == nil {
+		return ""
+	}
+	return GetServiceNameWithPrecedence(origin.Span, precedence)
+}
+
+// SpanTreeNode is a span and its depth within the span tree of its trace
+type SpanTreeNode struct {
+	Span  *tracepb.TraceSpan
+	Depth int
+}
+
+// GetSpanTree orders spans depth-first so every span follows its parent, and
+// computes the depth of each span in the tree. Spans whose parent is missing
+// from the trace are treated as roots, and parent cycles are broken at the
+// first span visited twice, so every span is returned exactly once.
+func GetSpanTree(spans []*tracepb.TraceSpan) []SpanTreeNode {
+	spansByID := make(map[uint64]*tracepb.TraceSpan, len(spans))
+	for _, s := range spans {
+		spansByID[s.GetSpanId()] = s
+	}
+
+	roots := []*tracepb.TraceSpan{}
+	children := map[uint64][]*tracepb.TraceSpan{}
+	for _, s := range spans {
+		parentID := s.GetParentSpanId()
+		if _, ok := spansByID[parentID]; parentID == 0 || parentID == s.GetSpanId() || !ok {
+			roots = append(roots, s)
+			continue
+		}
+		children[parentID] = append(children[parentID], s)
+	}
+
+	nodes := make([]SpanTreeNode, 0, len(spans))
+	visited := make(map[*tracepb.TraceSpan]bool, len(spans))
+	var walk func(s *tracepb.TraceSpan, depth int)
+	walk = func(s *tracepb.TraceSpan, depth int) {
+		if visited[s] {
+			return
+		}
+		visited[s] = true
+		nodes = append(nodes, SpanTreeNode{Span: s, Depth: depth})
+		for _, child := range children[s.GetSpanId()] {
+			walk(child, depth+1)
+		}
+	}
+
+	for _, root := range roots {
+		walk(root, 0)
+	}
+	// Anything left is part of a parent cycle with no way back to a root
+	for _, s := range spans {
+		walk(s, 0)
+	}
+
+	return nodes
+}
+
+// EdgeTagKey is the tag key of the edge a client span belongs to
+const EdgeTagKey = "edge"
+
+// SpanEdge is an RPC_CLIENT span and an RPC_SERVER span it called. Edge is
+// the "[client service]->[server service]" tag value of the call, and is
+// empty with a nil Server if no server span was found for the client
+type SpanEdge struct {
+	Client *tracepb.TraceSpan
+	Server *tracepb.TraceSpan
+	Edge   string
+}
+
+// GetSpanEdges pairs each RPC_CLIENT span with the RPC_SERVER spans that are its
+// direct children, for building service dependency maps. Clients calling several
+// servers (e.g. retries) get an edge for each, and clients without any server get
+// a single unmatched edge
+func GetSpanEdges(spans []*tracepb.TraceSpan, precedence ServiceNamePrecedence) []SpanEdge {
+	servers := map[uint64][]*tracepb.TraceSpan{}
+	for _, s := range spans {
+		if s.GetKind() == tracepb.TraceSpan_RPC_SERVER && s.GetParentSpanId() != 0 {
+			servers[s.GetParentSpanId()] = append(servers[s.GetParentSpanId()], s)
+		}
+	}
+
+	edges := []SpanEdge{}
+	for _, client := range spans {
+		if client.GetKind() != tracepb.TraceSpan_RPC_CLIENT {
+			continue
+		}
+
+		children := servers[client.GetSpanId()]
+		if len(children) == 0 {
+			edges = append(edges, SpanEdge{Client: client})
+			continue
+		}
+		for _, server := range children {
+			edges = append(edges, SpanEdge{
+				Client: client,
+				Server: server,
+				Edge:   fmt.Sprintf("%s->%s", GetServiceNameWithPrecedence(client, precedence), GetServiceNameWithPrecedence(server, precedence)),
+			})
+		}
+	}
+
+	return edges
+}
+
+// FilterSpans returns the spans matching a span filter, along with their ancestors so
+// matches keep their context, in their original order. A filter in the form
+// service:[name] matches spans of that service, any other filter matches spans
+// whose operation name contains it. Both are case insensitive
+func FilterSpans(spans []*tracepb.TraceSpan, filter string, precedence ServiceNamePrecedence) []*tracepb.TraceSpan {
+	filter = strings.ToLower(strings.TrimSpace(filter))
+	if filter == "" {
+		return spans
+	}
+
+	matches := func(s *tracepb.TraceSpan) bool {
+		return strings.Contains(strings.ToLower(GetSpanOperationName(s)), filter)
+	}
+	if strings.HasPrefix(filter, spanFilterServicePrefix) {
+		service := strings.TrimPrefix(filter, spanFilterServicePrefix)
+		matches = func(s *tracepb.TraceSpan) bool {
+			return strings.ToLower(GetServiceNameWithPrecedence(s, precedence)) == service
+		}
+	}
+
+	return filterSpansWithAncestors(spans, matches)
+}
+
+// FilterSpansByDuration returns the spans lasting at least minDuration, along with their
+// ancestors so matches keep their context, in their original order. A minDuration of 0 keeps every span
+func FilterSpansByDuration(spans []*tracepb.TraceSpan, minDuration time.Duration) []*tracepb.TraceSpan {
+	if minDuration <= 0 {
+		return spans
+	}
+
+	return filterSpansWithAncestors(spans, func(s *tracepb.TraceSpan) bool {
+		return s.GetEndTime().AsTime().Sub(s.GetStartTime().AsTime()) >= minDuration
+	})
+}
+
+// FilterSpansByWindow limits spans to those active during the window from start to end (and their
+// ancestors), like zooming in on part of a long trace. A zero end leaves the window open ended
+func FilterSpansByWindow(spans []*tracepb.TraceSpan, start time.Time, end time.Time) []*tracepb.TraceSpan {
+	return filterSpansWithAncestors(spans, func(s *tracepb.TraceSpan) bool {
+		return !s.GetEndTime().AsTime().Before(start) && (end.IsZero() || !s.GetStartTime().AsTime().After(end))
+	})
+}
+
+// GetTraceStart returns the earliest start of a trace's spans, or the zero time if it has none
+func GetTraceStart(spans []*tracepb.TraceSpan) time.Time {
+	var earliest time.Time
+	for i, s := range spans {
+		if start := s.GetStartTime().AsTime(); i == 0 || start.Before(earliest) {
+			earliest = start
+		}
+	}
+	return earliest
+}
+
+// filterSpansWithAncestors returns the spans that match, and their ancestors, in their original order
+func filterSpansWithAncestors(spans []*tracepb.TraceSpan, matches func(*tracepb.TraceSpan) bool) []*tracepb.TraceSpan {
+	spansByID := make(map[uint64]*tracepb.TraceSpan, len(spans))
+	for _, s := range spans {
+		spansByID[s.GetSpanId()] = s
+	}
+
+	keep := map[*tracepb.TraceSpan]bool{}
+	for _, s := range spans {
+		if !matches(s) {
+			continue
+		}
+		// Keep the span and walk up its ancestors, stopping at any already kept
+		for s != nil && !keep[s] {
+			keep[s] = true
+			if s.GetParentSpanId() == 0 {
+				break
+			}
+			s = spansByID[s.GetParentSpanId()]
+		}
+	}
+
+	filtered := []*tracepb.TraceSpan{}
+	for _, s := range spans {
+		if keep[s] {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// GetCriticalPath returns the IDs of the spans of a trace on its critical path: the chain
+// of spans that determines its total duration. Starting from the root ending last, each
+// span's path continues through the child that ends last, then through the children
+// ending before that child started, and so on. Child ends are clamped to their parent's,
+// so time spent waiting on a child that outlives its parent isn't counted
+func GetCriticalPath(spans []*tracepb.TraceSpan) map[uint64]bool {
+	spansByID := make(map[uint64]*tracepb.TraceSpan, len(spans))
+	for _, s := range spans {
+		spansByID[s.GetSpanId()] = s
+	}
+
+	// Spans without a parent in the trace are children of a virtual root
+	children := map[uint64][]*tracepb.TraceSpan{}
+	roots := []*tracepb.TraceSpan{}
+	for _, s := range spans {
+		if _, ok := spansByID[s.GetParentSpanId()]; ok && s.GetParentSpanId() != s.GetSpanId() {
+			children[s.GetParentSpanId()] = append(children[s.GetParentSpanId()], s)
+		} else {
+			roots = append(roots, s)
+		}
+	}
+
+	onPath := map[uint64]bool{}
+	var walk func(candidates []*tracepb.TraceSpan, cursor time.Time)
+	walk = func(candidates []*tracepb.TraceSpan, cursor time.Time) {
+		for {
+			// The next span on the path is the one ending last before the cursor
+			var next *tracepb.TraceSpan
+			var nextEnd time.Time
+			for _, s := range candidates {
+				if onPath[s.GetSpanId()] || !s.GetStartTime().AsTime().Before(cursor) {
+					continue
+				}
+				end := s.GetEndTime().AsTime()
+				if end.After(cursor) {
+					end = cursor
+				}
+				if next == nil || end.After(nextEnd) {
+					next, nextEnd = s, end
+				}
+			}
+			if next == nil {
+				return
+			}
+
+			onPath[next.GetSpanId()] = true
+			walk(children[next.GetSpanId()], nextEnd)
+			cursor = next.GetStartTime().AsTime()
+		}
+	}
+
+	var traceEnd time.Time
+	for _, s := range roots {
+		if end := s.GetEndTime().AsTime(); end.After(traceEnd) {
+			traceEnd = end
+		}
+	}
+	// The cursor starts just after the end, so spans with no duration are still included
+	walk(roots, traceEnd.Add(time.Nanosecond))
+
+	return onPath
+}
+
+// RetryCountLabel is the label of a collapsed span counting the spans collapsed into it
+const RetryCountLabel = "count"
+
+// CollapseRetries collapses sibling spans with the same name and service that run one
+// after another, like retries, into the first of them. Overlapping siblings, like parallel
+// calls, are kept. The first span is labeled with the number of spans collapsed and ends
+// when the last of them ends, and their children are moved to it. Spans are copied
+// before changing them, and otherwise returned in their original order
+func CollapseRetries(spans []*tracepb.TraceSpan, precedence ServiceNamePrecedence) []*tracepb.TraceSpan {
+	siblings := map[uint64][]*tracepb.TraceSpan{}
+	parentIDs := []uint64{}
+	for _, s := range spans {
+		if _, ok := siblings[s.GetParentSpanId()]; !ok {
+			parentIDs = append(parentIDs, s.GetParentSpanId())
+		}
+		siblings[s.GetParentSpanId()] = append(siblings[s.GetParentSpanId()], s)
+	}
+
+	sameOperation := func(a *tracepb.TraceSpan, b *tracepb.TraceSpan) bool {
+		return a.GetName() == b.GetName() &&
+			GetServiceNameWithPrecedence(a, precedence) == GetServiceNameWithPrecedence(b, precedence)
+	}
+
+	// collapsedInto maps the ID of each collapsed span to the span it was collapsed into
+	collapsedInto := map[uint64]uint64{}
+	replaced := map[*tracepb.TraceSpan]*tracepb.TraceSpan{}
+	for _, parentID := range parentIDs {
+		group := siblings[parentID]
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].GetStartTime().AsTime().Before(group[j].GetStartTime().AsTime())
+		})
+
+		for i := 0; i < len(group); {
+			j := i + 1
+			// A retry starts once the previous attempt has ended
+			for j < len(group) && sameOperation(group[i], group[j]) &&
+				!group[j].GetStartTime().AsTime().Before(group[j-1].GetEndTime().AsTime()) {
+				j++
+			}
+			if j-i > 1 {
+				collapsed := proto.Clone(group[i]).(*tracepb.TraceSpan)
+				labels := make(map[string]string, len(collapsed.GetLabels())+1)
+				for key, value := range collapsed.GetLabels() {
+					labels[key] = value
+				}
+				labels[RetryCountLabel] = strconv.Itoa(j - i)
+				collapsed.Labels = labels
+				for _, s := range group[i+1 : j] {
+					if s.GetEndTime().AsTime().After(collapsed.GetEndTime().AsTime()) {
+						collapsed.EndTime = s.GetEndTime()
+					}
+					collapsedInto[s.GetSpanId()] = collapsed.GetSpanId()
+				}
+				replaced[group[i]] = collapsed
+			}
+			i = j
+		}
+	}
+
+	if len(collapsedInto) == 0 {
+		return spans
+	}
+
+	result := make([]*tracepb.TraceSpan, 0, len(spans)-len(collapsedInto))
+	for _, s := range spans {
+		if _, ok := collapsedInto[s.GetSpanId()]; ok {
+			continue
+		}
+		collapsed, copied := replaced[s]
+		if !copied {
+			collapsed = s
+		}
+		if parentID, ok := collapsedInto[s.GetParentSpanId()]; ok {
+			if !copied {
+				collapsed = proto.Clone(s).(*tracepb.TraceSpan)
+			}
+			collapsed.ParentSpanId = parentID
+		}
+		s = collapsed
+		result = append(result, s)
+	}
+	return result
+}
+
+// MissingSpanName is the name of the placeholder spans standing in for missing parent spans
+const MissingSpanName = "(missing span)"
+
+// AddMissingParents adds a placeholder for each parent span referenced by spans of a partial trace
+// (e.g. truncated or partly sampled) but missing from it, so the orphaned spans still render under
+// their common parent rather than breaking the waterfall. Placeholders start and end with their
+// children, and are children of the trace's root span if it has one. It returns the spans with any
+// placeholders appended, and the number of orphaned spans
+func AddMissingParents(spans []*tracepb.TraceSpan) ([]*tracepb.TraceSpan, int) {
+	spanIDs := make(map[uint64]bool, len(spans))
+	var rootID uint64
+	for _, s := range spans {
+		spanIDs[s.GetSpanId()] = true
+		if s.GetParentSpanId() == 0 && rootID == 0 {
+			rootID = s.GetSpanId()
+		}
+	}
+
+	placeholders := map[uint64]*tracepb.TraceSpan{}
+	missingIDs := []uint64{}
+	orphans := 0
+	for _, s := range spans {
+		parentID := s.GetParentSpanId()
+		if parentID == 0 || spanIDs[parentID] {
+			continue
+		}
+		orphans++
+
+		placeholder, ok := placeholders[parentID]
+		if !ok {
+			placeholder = &tracepb.TraceSpan{
+				SpanId:       parentID,
+				ParentSpanId: rootID,
+				Name:         MissingSpanName,
+				StartTime:    s.GetStartTime(),
+				EndTime:      s.GetEndTime(),
+			}
+			placeholders[parentID] = placeholder
+			missingIDs = append(missingIDs, parentID)
+			continue
+		}
+		if s.GetStartTime().AsTime().Before(placeholder.GetStartTime().AsTime()) {
+			placeholder.StartTime = s.GetStartTime()
+		}
+		if s.GetEndTime().AsTime().After(placeholder.GetEndTime().AsTime()) {
+			placeholder.EndTime = s.GetEndTime()
+		}
+	}
+	if orphans == 0 {
+		return spans, 0
+	}
+
+	result := make([]*tracepb.TraceSpan, 0, len(spans)+len(missingIDs))
+	result = append(result, spans...)
+	for _, id := range missingIDs {
+		result = append(result, placeholders[id])
+	}
+	return result, orphans
+}
+
+// LimitSpans keeps the limit earliest starting spans, in their original order. Parents start
+// before their children, so spans are dropped before their ancestors, barring clock skew
+func LimitSpans(spans []*tracepb.TraceSpan, limit int) []*tracepb.TraceSpan {
+	if limit < 0 {
+		limit = 0
+	}
+	if len(spans) <= limit {
+		return spans
+	}
+
+	byStart := make([]*tracepb.TraceSpan, len(spans))
+	copy(byStart, spans)
+	sort.SliceStable(byStart, func(i, j int) bool {
+		return byStart[i].GetStartTime().AsTime().Before(byStart[j].GetStartTime().AsTime())
+	})
+	kept := make(map[*tracepb.TraceSpan]bool, limit)
+	for _, s := range byStart[:limit] {
+		kept[s] = true
+	}
+
+	result := make([]*tracepb.TraceSpan, 0, limit)
+	for _, s := range spans {
+		if kept[s] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// ExcludeServices drops the spans of the given services (matched case insensitively), like
+// noisy sidecars. The children of dropped spans are reparented to their nearest kept
+// ancestor so the trace keeps its structure. Reparented spans are copies, the originals are unchanged
+func ExcludeServices(spans []*tracepb.TraceSpan, services []string, precedence ServiceNamePrecedence) []*tracepb.TraceSpan {
+	if len(services) == 0 {
+		return spans
+	}
+	excludedServices := make(map[string]bool, len(services))
+	for _, service := range services {
+		excludedServices[strings.ToLower(service)] = true
+	}
+
+	// excludedParents maps the ID of each dropped span to its parent's ID
+	excludedParents := map[uint64]uint64{}
+	for _, s := range spans {
+		if excludedServices[strings.ToLower(GetServiceNameWithPrecedence(s, precedence))] {
+			excludedParents[s.GetSpanId()] = s.GetParentSpanId()
+		}
+	}
+	if len(excludedParents) == 0 {
+		return spans
+	}
+
+	result := make([]*tracepb.TraceSpan, 0, len(spans)-len(excludedParents))
+	for _, s := range spans {
+		if _, ok := excludedParents[s.GetSpanId()]; ok {
+			continue
+		}
+		parentID := s.GetParentSpanId()
+		for seen := 0; seen <= len(excludedParents); seen++ {
+			grandparentID, ok := excludedParents[parentID]
+			if !ok {
+				break
+			}
+			parentID = grandparentID
+		}
+		if parentID != s.GetParentSpanId() {
+			s = proto.Clone(s).(*tracepb.TraceSpan)
+			s.ParentSpanId = parentID
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// MergedTraceLabel is the label of merged spans naming the trace each is from
+const MergedTraceLabel = "merged.trace_id"
+
+// MergedRootSpanName is the name of the synthetic root span of merged traces
+const MergedRootSpanName = "Merged traces"
+
+// MergeTraces stitches several traces, like the traces of an async workflow, into one trace
+// whose ID joins theirs with "+". The root spans of each trace (and spans whose parent isn't
+// in their trace) become children of a synthetic root span, which starts at the earliest span
+// start and ends at the latest span end, so the traces line up on one timeline by their own
+// timestamps. Spans are labeled with the trace they're from, and spans whose IDs clash with
+// another trace's are given new IDs. Spans are copies, the originals are unchanged
+func MergeTraces(traces []*tracepb.Trace) *tracepb.Trace {
+	merged := &tracepb.Trace{}
+	if len(traces) == 0 {
+		return merged
+	}
+	merged.ProjectId = traces[0].GetProjectId()
+
+	taken := map[uint64]bool{}
+	for _, t := range traces {
+		for _, s := range t.GetSpans() {
+			taken[s.GetSpanId()] = true
+		}
+	}
+	var lastID uint64
+	newID := func() uint64 {
+		for {
+			lastID++
+			if !taken[lastID] {
+				taken[lastID] = true
+				return lastID
+			}
+		}
+	}
+
+	root := &tracepb.TraceSpan{
+		SpanId: newID(),
+		Name:   MergedRootSpanName,
+	}
+	traceIDs := make([]string, 0, len(traces))
+	spans := []*tracepb.TraceSpan{root}
+	claimed := map[uint64]bool{}
+	for _, t := range traces {
+		traceIDs = append(traceIDs, t.GetTraceId())
+
+		ids := make(map[uint64]uint64, len(t.GetSpans()))
+		for _, s := range t.GetSpans() {
+			if claimed[s.GetSpanId()] {
+				ids[s.GetSpanId()] = newID()
+			} else {
+				claimed[s.GetSpanId()] = true
+				ids[s.GetSpanId()] = s.GetSpanId()
+			}
+		}
+
+		for _, s := range t.GetSpans() {
+			span := proto.Clone(s).(*tracepb.TraceSpan)
+			span.SpanId = ids[s.GetSpanId()]
+			parentID, ok := ids[s.GetParentSpanId()]
+			if !ok || s.GetParentSpanId() == 0 || s.GetParentSpanId() == s.GetSpanId() {
+				parentID = root.GetSpanId()
+			}
+			span.ParentSpanId = parentID
+			labels := make(map[string]string, len(span.GetLabels())+1)
+			for key, value := range span.GetLabels() {
+				labels[key] = value
+			}
+			labels[MergedTraceLabel] = t.GetTraceId()
+			span.Labels = labels
+
+			if root.GetStartTime() == nil || span.GetStartTime().AsTime().Before(root.GetStartTime().AsTime()) {
+				root.StartTime = span.GetStartTime()
+			}
+			if root.GetEndTime() == nil || span.GetEndTime().AsTime().After(root.GetEndTime().AsTime()) {
+				root.EndTime = span.GetEndTime()
+			}
+			spans = append(spans, span)
+		}
+	}
+
+	merged.TraceId = strings.Join(traceIDs, "+")
+	root.Labels = map[string]string{MergedTraceLabel: merged.GetTraceId()}
+	merged.Spans = spans
+	return merged
+}
+
+// GetTraceLatency returns the latency of the whole trace, from the start
+// of its root span (or earliest span if there is no root) to the latest span end
+func GetTraceLatency(spans []*tracepb.TraceSpan) time.Duration {
+	if len(spans) == 0 {
+		return 0
+	}
+
+	var rootStart, earliestStart, latestEnd time.Time
+	for i, s := range spans {
+		start := s.GetStartTime().AsTime()
+		end := s.GetEndTime().AsTime()
+		if s.GetParentSpanId() == 0 && rootStart.IsZero() {
+			rootStart = start
+		}
+		if i == 0 || start.Before(earliestStart) {
+			earliestStart = start
+		}
+		if i == 0 || end.After(latestEnd) {
+			latestEnd = end
+		}
+	}
+
+	if rootStart.IsZero() {
+		rootStart = earliestStart
+	}
+	return latestEnd.Sub(rootStart)
+}
+
+// GetSelfTimes returns the self time of each span of a trace by ID: its duration minus the
+// durations of its direct children, clamped at zero. Overlapping children are each subtracted
+// in full, so a span only waiting on concurrent children has no self time
+func GetSelfTimes(spans []*tracepb.TraceSpan) map[uint64]time.Duration {
+	duration := func(s *tracepb.TraceSpan) time.Duration {
+		// Clock skew can end spans before they start
+		if d := s.GetEndTime().AsTime().Sub(s.GetStartTime().AsTime()); d > 0 {
+			return d
+		}
+		return 0
+	}
+
+	childDurations := make(map[uint64]time.Duration, len(spans))
+	for _, s := range spans {
+		if s.GetParentSpanId() != 0 && s.GetParentSpanId() != s.GetSpanId() {
+			childDurations[s.GetParentSpanId()] += duration(s)
+		}
+	}
+
+	selfTimes := make(map[uint64]time.Duration, len(spans))
+	for _, s := range spans {
+		selfTime := duration(s) - childDurations[s.GetSpanId()]
+		if selfTime < 0 {
+			selfTime = 0
+		}
+		selfTimes[s.GetSpanId()] = selfTime
+	}
+	return selfTimes
+}
+
+// GetSkewedSpans returns the IDs of the spans starting before their parent span, in their
+// original order. That's impossible unless the clocks of the services recording them differ
+func GetSkewedSpans(spans []*tracepb.TraceSpan) []uint64 {
+	spansByID := make(map[uint64]*tracepb.TraceSpan, len(spans))
+	for _, s := range spans {
+		spansByID[s.GetSpanId()] = s
+	}
+
+	skewed := []uint64{}
+	for _, s := range spans {
+		parent, ok := spansByID[s.GetParentSpanId()]
+		if !ok || s.GetParentSpanId() == 0 || parent == s {
+			continue
+		}
+		if s.GetStartTime().AsTime().Before(parent.GetStartTime().AsTime()) {
+			skewed = append(skewed, s.GetSpanId())
+		}
+	}
+	return skewed
+}
+
+// GetDurationOutliers flags each duration that exceeds the mean
+// of all durations by more than stdDevs standard deviations
+func GetDurationOutliers(durations []float64, stdDevs float64) []bool {
+	outliers := make([]bool, len(durations))
+	if len(durations) == 0 {
+		return outliers
+	}
+
+	var sum float64
+	for _, d := range durations {
+		sum += d
+	}
+	mean := sum / float64(len(durations))
+
+	var squaredDiffs float64
+	for _, d := range durations {
+		squaredDiffs += (d - mean) * (d - mean)
+	}
+	threshold := mean + stdDevs*math.Sqrt(squaredDiffs/float64(len(durations)))
+
+	for i, d := range durations {
+		outliers[i] = d > threshold
+	}
+	return outliers
+}
+
+// ServiceStats are the span duration statistics of a single service
+type ServiceStats struct {
+	Service     string
+	SpanCount   int64
+	AvgDuration time.Duration
+	P95Duration time.Duration
+}
+
+// GetLatencyHistogram counts latencies into the buckets bounded by the given ascending boundaries.
+// There's one more count than boundaries: below the first boundary, between each pair of boundaries,
+// and at or above the last. Each bucket includes its lower boundary, and empty buckets count zero
+func GetLatencyHistogram(latencies []time.Duration, boundaries []time.Duration) []int64 {
+	counts := make([]int64, len(boundaries)+1)
+	for _, latency := range latencies {
+		bucket := sort.Search(len(boundaries), func(i int) bool {
+			return latency < boundaries[i]
+		})
+		counts[bucket]++
+	}
+	return counts
+}
+
+// GetServiceStats groups the spans of all traces by service name and returns
+// the span count and average and 95th percentile span duration of each
+// service, ordered by service name
+func GetServiceStats(traces []*tracepb.Trace, precedence ServiceNamePrecedence) []ServiceStats {
+	durationsByService := map[string][]time.Duration{}
+	for _, t := range traces {
+		for _, s := range t.GetSpans() {
+			service := GetServiceNameWithPrecedence(s, precedence)
+			duration := s.GetEndTime().AsTime().Sub(s.GetStartTime().AsTime())
+			durationsByService[service] = append(durationsByService[service], duration)
+		}
+	}
+
+	stats := make([]ServiceStats, 0, len(durationsByService))
+	for service, durations := range durationsByService {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+		var sum time.Duration
+		for _, d := range durations {
+			sum += d
+		}
+		// Nearest-rank percentile
+		p95Index := int(math.Ceil(0.95*float64(len(durations)))) - 1
+
+		stats = append(stats, ServiceStats{
+			Service:     service,
+			SpanCount:   int64(len(durations)),
+			AvgDuration: sum / time.Duration(len(durations)),
+			P95Duration: durations[p95Index],
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Service < stats[j].Service })
+
+	return stats
+}
+
+// GetLabelKeysAndMethods returns the sorted, unique label keys and HTTP methods of all spans in the traces
+func GetLabelKeysAndMethods(traces []*tracepb.Trace) (labelKeys []string, methods []string) {
+	keySet := map[string]bool{}
+	methodSet := map[string]bool{}
+	for _, t := range traces {
+		for _, s := range t.GetSpans() {
+			for key := range s.GetLabels() {
+				keySet[key] = true
+			}
+			if method := getHTTPMethod(s); method != "" {
+				methodSet[method] = true
+			}
+		}
+	}
+
+	return sortedKeys(keySet), sortedKeys(methodSet)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // GetListTracesFilter takes the raw query text from a user and converts it
 // to a filter string as expected by the Cloud Trace API
 func GetListTracesFilter(queryText string) (string, error) {
-	// Collect all filter parts from the query text
-	qTFilters := re.FindAllString(queryText, -1)
+	return GetListTracesFilterWithMaxTerms(queryText, DefaultMaxFilterTerms)
+}
+
+// GetListTracesFilterWithMaxTerms is GetListTracesFilter, but fails if the query text
+// has more than maxTerms filter parts. DefaultMaxFilterTerms is used if maxTerms isn't positive
+func GetListTracesFilterWithMaxTerms(queryText string, maxTerms int) (string, error) {
+	if maxTerms <= 0 {
+		maxTerms = DefaultMaxFilterTerms
+	}
 
-	filters := make([]string, 0, len(qTFilters))
-	for _, qTFilter := range qTFilters {
+	// Collect all filter parts (and their positions) from the query text
+	qTFilterIndexes := re.FindAllStringIndex(queryText, -1)
+	if len(qTFilterIndexes) > maxTerms {
+		return "", fmt.Errorf("%w: query has %d filter terms, the maximum is %d", ErrTooManyFilterTerms, len(qTFilterIndexes), maxTerms)
+	}
+
+	filters := make([]string, 0, len(qTFilterIndexes))
+	for _, qTFilterIndex := range qTFilterIndexes {
+		qTFilter := queryText[qTFilterIndex[0]:qTFilterIndex[1]]
 		key, value, err := getFilterKeyValue(qTFilter)
 		if err != nil {
+			var parseErr *FilterParseError
+			if errors.As(err, &parseErr) {
+				parseErr.Position = qTFilterIndex[0]
+			}
 			return "", err
 		}
 
@@ -132,6 +1361,329 @@ func GetListTracesFilter(queryText string) (string, error) {
 	return strings.Join(filters, " "), nil
 }
 
+// TracePrefixKeyword is the query text filter keyword matching traces whose ID starts with
+// the value. The Cloud Trace API can't filter by trace ID prefix, so it's applied to the
+// listed traces: only matches among the traces listed up to the query limit are found
+const TracePrefixKeyword = "TracePrefix"
+
+// ExtractTracePrefix removes TracePrefix:[value] filter parts from query text, returning
+// the value of the last one and the remaining query text to send to the Cloud Trace API.
+// Query text without a prefix is returned unchanged
+func ExtractTracePrefix(queryText string) (prefix string, rest string) {
+	found := false
+	parts := []string{}
+	for _, part := range re.FindAllString(queryText, -1) {
+		if value := strings.TrimPrefix(part, TracePrefixKeyword+":"); value != part {
+			prefix, found = strings.Trim(value, `"`), true
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if !found {
+		return "", queryText
+	}
+	return prefix, strings.Join(parts, " ")
+}
+
+// GetOriginalFilterPosition maps a position in rest, query text with filter parts removed by
+// ExtractTracePrefix, ExtractComparisons or ExtractContainsSpan, back to the same filter part
+// in the original query text. Positions outside of rest's filter parts are returned unchanged
+func GetOriginalFilterPosition(queryText string, rest string, position int) int {
+	originalIndexes := re.FindAllStringIndex(queryText, -1)
+	o := 0
+	for _, restIndex := range re.FindAllStringIndex(rest, -1) {
+		// rest keeps the filter parts of the original in order, so skip the removed ones
+		part := rest[restIndex[0]:restIndex[1]]
+		for o < len(originalIndexes) && queryText[originalIndexes[o][0]:originalIndexes[o][1]] != part {
+			o++
+		}
+		if o == len(originalIndexes) {
+			break
+		}
+		if position >= restIndex[0] && position < restIndex[1] {
+			return originalIndexes[o][0] + position - restIndex[0]
+		}
+		o++
+	}
+	return position
+}
+
+// FilterTracesByPrefix returns the traces whose ID starts with prefix, ignoring case
+func FilterTracesByPrefix(traces []*tracepb.Trace, prefix string) []*tracepb.Trace {
+	prefix = strings.ToLower(prefix)
+	filtered := []*tracepb.Trace{}
+	for _, t := range traces {
+		if strings.HasPrefix(strings.ToLower(t.GetTraceId()), prefix) {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+// ContainsSpanKeyword is the query text filter keyword matching traces with a span of exactly
+// the value as its name, whether or not it's the root span. The Cloud Trace API "span:" filter
+// behind SpanName is root span oriented, so it's applied to every span of the listed traces:
+// only matches among the traces listed up to the query limit are found
+const ContainsSpanKeyword = "ContainsSpan"
+
+// ExtractContainsSpan removes ContainsSpan:[name] filter parts from query text, returning their
+// names and the remaining query text to send to the Cloud Trace API.
+// Query text without span names is returned unchanged
+func ExtractContainsSpan(queryText string) (names []string, rest string) {
+	names = []string{}
+	parts := []string{}
+	for _, part := range re.FindAllString(queryText, -1) {
+		if value := strings.TrimPrefix(part, ContainsSpanKeyword+":"); value != part {
+			names = append(names, strings.Trim(value, `"`))
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(names) == 0 {
+		return names, queryText
+	}
+	return names, strings.Join(parts, " ")
+}
+
+// FilterTracesByContainsSpan returns the traces with a span named each of names. Traces
+// need every span listed (the COMPLETE view) to find spans other than the root span
+func FilterTracesByContainsSpan(traces []*tracepb.Trace, names []string) []*tracepb.Trace {
+	if len(names) == 0 {
+		return traces
+	}
+
+	filtered := []*tracepb.Trace{}
+	for _, t := range traces {
+		spanNames := map[string]bool{}
+		for _, s := range t.GetSpans() {
+			spanNames[s.GetName()] = true
+		}
+		containsAll := true
+		for _, name := range names {
+			if !spanNames[name] {
+				containsAll = false
+				break
+			}
+		}
+		if containsAll {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+// LatencyMsKeyword is the comparison filter key comparing the latency of whole traces in ms
+const LatencyMsKeyword = "LatencyMs"
+
+// comparisonPattern matches numeric comparison filter parts, like LatencyMs:>500
+var comparisonPattern = regexp.MustCompile(`^([^:]+):(>=|<=|>|<)(-?[0-9]+(?:\.[0-9]+)?)$`)
+
+// Comparison is a numeric comparison filter from query text, like LatencyMs:>500 or
+// /http/response/size:<=1024. The Cloud Trace API filter grammar has no comparisons
+// (other than a minimum latency), so they're applied to the listed traces
+type Comparison struct {
+	Key      string
+	Operator string
+	Value    float64
+}
+
+// matches reports whether a value satisfies the comparison
+func (c Comparison) matches(value float64) bool {
+	switch c.Operator {
+	case ">":
+		return value > c.Value
+	case "<":
+		return value < c.Value
+	case ">=":
+		return value >= c.Value
+	case "<=":
+		return value <= c.Value
+	}
+	return false
+}
+
+// latencyKeyword is an alias of LatencyMsKeyword in comparisons
+const latencyKeyword = "Latency"
+
+// comparisonKey converts the key of a comparison like other filter keys, e.g. Status to
+// /http/status_code. Latency keys compare the latency of whole traces in ms, like LatencyMs
+func comparisonKey(key string) string {
+	switch key {
+	case latencyKeyword, "MinLatency":
+		return LatencyMsKeyword
+	}
+	for _, keyword := range filterKeywords {
+		if key == keyword.Keyword && !keyword.ClientSide {
+			return keyword.APIKey
+		}
+	}
+	return key
+}
+
+// ExtractComparisons removes numeric comparison filter parts ([key]:>[number], :<, :>= and :<=)
+// from query text, returning them and the remaining query text to send to the Cloud Trace API.
+// Filter keywords are converted to the label keys they filter by, e.g. Status:>=500
+// compares /http/status_code
+func ExtractComparisons(queryText string) ([]Comparison, string) {
+	comparisons := []Comparison{}
+	parts := []string{}
+	for _, part := range re.FindAllString(queryText, -1) {
+		match := comparisonPattern.FindStringSubmatch(part)
+		if match == nil {
+			parts = append(parts, part)
+			continue
+		}
+		value, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			parts = append(parts, part)
+			continue
+		}
+		comparisons = append(comparisons, Comparison{Key: comparisonKey(match[1]), Operator: match[2], Value: value})
+	}
+	if len(comparisons) == 0 {
+		return comparisons, queryText
+	}
+	return comparisons, strings.Join(parts, " ")
+}
+
+// FilterTracesByComparisons returns the traces matching every comparison. LatencyMs compares
+// the latency of the whole trace in ms. Other keys compare the numeric value of the label
+// with that key, and match if any span's label does; non-numeric values never match
+func FilterTracesByComparisons(traces []*tracepb.Trace, comparisons []Comparison) []*tracepb.Trace {
+	if len(comparisons) == 0 {
+		return traces
+	}
+
+	matches := func(t *tracepb.Trace, c Comparison) bool {
+		if c.Key == LatencyMsKeyword {
+			return c.matches(float64(GetTraceLatency(t.GetSpans()).Microseconds()) / 1000)
+		}
+		for _, s := range t.GetSpans() {
+			value, ok := s.GetLabels()[c.Key]
+			if !ok {
+				continue
+			}
+			if number, err := strconv.ParseFloat(value, 64); err == nil && c.matches(number) {
+				return true
+			}
+		}
+		return false
+	}
+
+	filtered := []*tracepb.Trace{}
+	for _, t := range traces {
+		matchesAll := true
+		for _, c := range comparisons {
+			if !matches(t, c) {
+				matchesAll = false
+				break
+			}
+		}
+		if matchesAll {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+// FilterMultiServiceTraces returns the traces with spans from more than one service. Traces
+// need every span listed (the COMPLETE view) to find all of their services
+func FilterMultiServiceTraces(traces []*tracepb.Trace, precedence ServiceNamePrecedence) []*tracepb.Trace {
+	filtered := []*tracepb.Trace{}
+	for _, t := range traces {
+		services := map[string]bool{}
+		for _, s := range t.GetSpans() {
+			if service := GetServiceNameWithPrecedence(s, precedence); service != "" {
+				services[service] = true
+			}
+		}
+		if len(services) > 1 {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+// MergeListTracesFilters combines two Cloud Trace API filters. Parts of
+// defaultFilter whose key also appears in filter are dropped, so filter wins
+func MergeListTracesFilters(defaultFilter string, filter string) string {
+	keys := map[string]bool{}
+	filterParts := re.FindAllString(filter, -1)
+	for _, part := range filterParts {
+		keys[getFilterPartKey(part)] = true
+	}
+
+	merged := []string{}
+	for _, part := range re.FindAllString(defaultFilter, -1) {
+		if !keys[getFilterPartKey(part)] {
+			merged = append(merged, part)
+		}
+	}
+	merged = append(merged, filterParts...)
+
+	return strings.Join(merged, " ")
+}
+
+// GetListTracesFilterValues returns the values of the parts of a Cloud Trace API filter with the given key
+func GetListTracesFilterValues(filter string, key string) []string {
+	values := []string{}
+	for _, part := range re.FindAllString(filter, -1) {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) == 2 && getFilterPartKey(part) == key {
+			values = append(values, strings.Trim(kv[1], `"`))
+		}
+	}
+	return values
+}
+
+// getFilterPartKey returns the key of a Cloud Trace API filter part, without special chars
+func getFilterPartKey(filterPart string) string {
+	key := strings.SplitN(filterPart, ":", 2)[0]
+	return strings.TrimLeft(key, "+^")
+}
+
+// getMessagingOperationName names a messaging span like "kafka SEND orders", from its
+// messaging labels, or returns "" if it isn't a messaging span. Without an operation label
+// the operation is SEND for producer spans and RECEIVE for consumer spans
+func getMessagingOperationName(span *tracepb.TraceSpan) string {
+	labels := span.GetLabels()
+	system := labels[otelMessagingSystemKey]
+	if system == "" {
+		return ""
+	}
+
+	operation := labels[otelMessagingOperationTypeKey]
+	if operation == "" {
+		operation = labels[otelMessagingOperationKey]
+	}
+	if operation == "" {
+		switch getOTLPSpanKind(span) {
+		case otlpSpanKindProducer:
+			operation = "send"
+		case otlpSpanKindConsumer:
+			operation = "receive"
+		}
+	}
+
+	parts := []string{system}
+	if operation != "" {
+		parts = append(parts, strings.ToUpper(operation))
+	}
+	if destination := GetMessagingDestination(span); destination != "" {
+		parts = append(parts, destination)
+	}
+	return strings.Join(parts, " ")
+}
+
+// GetMessagingDestination returns the topic or queue of a messaging span, or "" if it has none
+func GetMessagingDestination(span *tracepb.TraceSpan) string {
+	labels := span.GetLabels()
+	if destination := labels[otelMessagingDestinationNameKey]; destination != "" {
+		return destination
+	}
+	return labels[otelMessagingDestinationKey]
+}
+
 func getHTTPMethod(span *tracepb.TraceSpan) string {
 	labels := span.GetLabels()
 
@@ -145,10 +1697,13 @@ func getHTTPMethod(span *tracepb.TraceSpan) string {
 }
 
 func getFilterKeyValue(qTFilter string) (key string, value string, err error) {
+	// Special chars may already be at the front of the key, as in Cloud Trace UI filters
+	keyPrefix := qTFilter[:len(qTFilter)-len(strings.TrimLeft(qTFilter, "+^"))]
+
 	// Filter part must be in form [key]:[value] from user
-	qTFilterParts := strings.SplitN(qTFilter, ":", 2)
+	qTFilterParts := strings.SplitN(qTFilter[len(keyPrefix):], ":", 2)
 	if len(qTFilterParts) != 2 {
-		return "", "", fmt.Errorf("bad filter [%s]. Must be in form [key]:[value]", qTFilter)
+		return "", "", &FilterParseError{Token: qTFilter, Expected: filterForm}
 	}
 
 	key = qTFilterParts[0]
@@ -159,53 +1714,65 @@ func getFilterKeyValue(qTFilter string) (key string, value string, err error) {
 		qTFilterParts := strings.SplitN(value, ":", 2)
 
 		if len(qTFilterParts) != 2 {
-			return "", "", fmt.Errorf("bad filter [%s]. Must be in form LABEL:[key]:[value]", qTFilter)
+			return "", "", &FilterParseError{Token: qTFilter, Expected: labelFilterForm}
 		}
 
 		// Cloud Trace API should not have "LABEL:" in filter
 		key = qTFilterParts[0]
 		value = qTFilterParts[1]
+
+		// Special chars may be at the front of the label key instead, as in LABEL:+[key]:[value]
+		labelKeyPrefix := key[:len(key)-len(strings.TrimLeft(key, "+^"))]
+		keyPrefix += labelKeyPrefix
+		key = key[len(labelKeyPrefix):]
 	}
 
+	hasLabel := key == "HasLabel"
+
 	// Convert key to Cloud Trace API expected form if needed
-	switch key {
-	case "RootSpan":
-		key = "root"
-	case "SpanName":
-		key = "span"
-	case "HasLabel":
-		key = "label"
-	case "MinLatency":
-		key = "latency"
-	case "URL":
-		key = "url"
-	case "Method":
-		key = "method"
-		// Currently matches the Google Cloud Trace UI filter, but ignores "service.version" matches
-	case "Version":
-		key = gaeServiceVersionKey
-		// Currently matches the Google Cloud Trace UI filter, but ignores "service.name" matches
-	case "Service":
-		key = gaeServiceKey
-	case "Status":
-		key = "/http/status_code"
+	for _, keyword := range filterKeywords {
+		if key == keyword.Keyword && !keyword.ClientSide {
+			key = keyword.APIKey
+			break
+		}
 	}
 
+	exact := strings.Contains(keyPrefix, "+")
+	root := strings.Contains(keyPrefix, "^")
+
 	// If the value has less than 2 chars, no need to check for special filter chars
-	if len(value) < 2 {
-		return key, value, nil
+	if len(value) >= 2 {
+		firstChar := string(value[0])
+		secondChar := string(value[1])
+
+		// Move specials chars from the front of value to key for Google Cloud Trace compatibility
+		if (secondChar == "^" && firstChar == "+") || (secondChar == "+" && firstChar == "^") {
+			exact, root = true, true
+			value = value[2:]
+		} else if firstChar == "+" || firstChar == "^" {
+			exact = exact || firstChar == "+"
+			root = root || firstChar == "^"
+			value = value[1:]
+		}
 	}
 
-	firstChar := string(value[0])
-	secondChar := string(value[1])
+	// HasLabel:[key]=[value] is shorthand for a label with a value, rather than just existing
+	if hasLabel && strings.Contains(value, "=") {
+		labelParts := strings.SplitN(value, "=", 2)
+		if labelParts[0] == "" {
+			return "", "", &FilterParseError{Token: qTFilter, Expected: hasLabelFilterForm}
+		}
+		key = labelParts[0]
+		value = labelParts[1]
+	}
 
-	// Move specials chars from the front of value to key for Google Cloud Trace compatibility
-	if (secondChar == "^" && firstChar == "+") || (secondChar == "+" && firstChar == "^") {
+	// Each special char is only added to the key once, whichever side it came from
+	if exact && root {
 		key = fmt.Sprintf("+^%s", key)
-		value = value[2:]
-	} else if firstChar == "+" || firstChar == "^" {
-		key = fmt.Sprintf("%s%s", firstChar, key)
-		value = value[1:]
+	} else if exact {
+		key = fmt.Sprintf("+%s", key)
+	} else if root {
+		key = fmt.Sprintf("^%s", key)
 	}
 
 	return key, value, nil
@@ -17,11 +17,15 @@ package cloudtrace_test
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/trace/apiv1/tracepb"
 	"github.com/GoogleCloudPlatform/cloud-trace-data-source-plugin/pkg/plugin/cloudtrace"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestGetTraceName(t *testing.T) {
@@ -96,6 +100,23 @@ func TestGetTraceName(t *testing.T) {
 	}
 }
 
+func TestGetTraceNameWithPrecedence(t *testing.T) {
+	t.Parallel()
+
+	span := &tracepb.TraceSpan{
+		Name: "spanname",
+		Labels: map[string]string{
+			"service.name":        "otelservice",
+			"g.co/gae/app/module": "gaeservice",
+		},
+	}
+
+	require.Equal(t, "otelservice: spanname", cloudtrace.GetTraceName(span))
+	require.Equal(t, "otelservice: spanname", cloudtrace.GetTraceNameWithPrecedence(span, cloudtrace.ServiceNameOTELFirst))
+	require.Equal(t, "gaeservice: spanname", cloudtrace.GetTraceNameWithPrecedence(span, cloudtrace.ServiceNameGAEFirst))
+	require.Equal(t, "otelservice/gaeservice: spanname", cloudtrace.GetTraceNameWithPrecedence(span, cloudtrace.ServiceNameConcat))
+}
+
 func TestGetSpanOperationName(t *testing.T) {
 	t.Parallel()
 
@@ -142,6 +163,55 @@ func TestGetSpanOperationName(t *testing.T) {
 			},
 			expectedSpanOperationName: "HTTP GET spanname",
 		},
+		{
+			name: "Pub/Sub publish span",
+			span: &tracepb.TraceSpan{
+				Name: "orders publish",
+				Labels: map[string]string{
+					"messaging.system":           "gcp_pubsub",
+					"messaging.operation":        "publish",
+					"messaging.destination.name": "orders",
+				},
+			},
+			expectedSpanOperationName: "gcp_pubsub PUBLISH orders",
+		},
+		{
+			name: "Kafka producer span with pre-v1.17 labels",
+			span: &tracepb.TraceSpan{
+				Name: "orders send",
+				Labels: map[string]string{
+					"messaging.system":      "kafka",
+					"messaging.destination": "orders",
+					"span.kind":             "producer",
+				},
+			},
+			expectedSpanOperationName: "kafka SEND orders",
+		},
+		{
+			name: "Kafka consumer span",
+			span: &tracepb.TraceSpan{
+				Name: "orders receive",
+				Labels: map[string]string{
+					"messaging.system":           "kafka",
+					"messaging.destination.name": "orders",
+					"span.kind":                  "consumer",
+				},
+			},
+			expectedSpanOperationName: "kafka RECEIVE orders",
+		},
+		{
+			name: "Messaging span with operation type and no destination",
+			span: &tracepb.TraceSpan{
+				Name: "process",
+				Labels: map[string]string{
+					"messaging.system":         "rabbitmq",
+					"messaging.operation.type": "process",
+					"messaging.operation":      "ack",
+					"http.method":              "POST",
+				},
+			},
+			expectedSpanOperationName: "rabbitmq PROCESS",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -153,21 +223,46 @@ func TestGetSpanOperationName(t *testing.T) {
 	}
 }
 
+func TestGetMessagingDestination(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		labels   map[string]string
+		expected string
+	}{
+		{name: "Destination name", labels: map[string]string{"messaging.destination.name": "orders"}, expected: "orders"},
+		{name: "Pre-v1.17 destination", labels: map[string]string{"messaging.destination": "orders"}, expected: "orders"},
+		{
+			name:     "Both destinations",
+			labels:   map[string]string{"messaging.destination.name": "orders", "messaging.destination": "old"},
+			expected: "orders",
+		},
+		{name: "Not a messaging span", labels: map[string]string{"/http/url": "http://test.com"}, expected: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, cloudtrace.GetMessagingDestination(&tracepb.TraceSpan{Labels: tc.labels}))
+		})
+	}
+}
+
 func TestGetTags(t *testing.T) {
 	t.Parallel()
 
 	testCases := []struct {
 		name                string
 		span                *tracepb.TraceSpan
-		expectedServiceTags []map[string]string
-		expectedSpanTags    []map[string]string
+		expectedServiceTags []map[string]interface{}
+		expectedSpanTags    []map[string]interface{}
 		expectedError       error
 	}{
 		{
 			name:                "Span with no labels",
 			span:                &tracepb.TraceSpan{},
-			expectedServiceTags: []map[string]string{},
-			expectedSpanTags:    []map[string]string{},
+			expectedServiceTags: []map[string]interface{}{},
+			expectedSpanTags:    []map[string]interface{}{},
 			expectedError:       nil,
 		},
 		{
@@ -178,8 +273,8 @@ func TestGetTags(t *testing.T) {
 					"key2": "value2",
 				},
 			},
-			expectedServiceTags: []map[string]string{},
-			expectedSpanTags: []map[string]string{
+			expectedServiceTags: []map[string]interface{}{},
+			expectedSpanTags: []map[string]interface{}{
 				{"key": "key1", "value": "value1"},
 				{"key": "key2", "value": "value2"},
 			},
@@ -193,11 +288,11 @@ func TestGetTags(t *testing.T) {
 					"service.version": "100",
 				},
 			},
-			expectedServiceTags: []map[string]string{
+			expectedServiceTags: []map[string]interface{}{
 				{"key": "service.name", "value": "servicename"},
-				{"key": "service.version", "value": "100"},
+				{"key": "service.version", "value": float64(100)},
 			},
-			expectedSpanTags: []map[string]string{},
+			expectedSpanTags: []map[string]interface{}{},
 			expectedError:    nil,
 		},
 		{
@@ -208,11 +303,11 @@ func TestGetTags(t *testing.T) {
 					"g.co/gae/app/version": "100",
 				},
 			},
-			expectedServiceTags: []map[string]string{
+			expectedServiceTags: []map[string]interface{}{
 				{"key": "g.co/gae/app/module", "value": "servicename"},
-				{"key": "g.co/gae/app/version", "value": "100"},
+				{"key": "g.co/gae/app/version", "value": float64(100)},
 			},
-			expectedSpanTags: []map[string]string{},
+			expectedSpanTags: []map[string]interface{}{},
 			expectedError:    nil,
 		},
 		{
@@ -225,13 +320,13 @@ func TestGetTags(t *testing.T) {
 					"g.co/gae/app/version": "100",
 				},
 			},
-			expectedServiceTags: []map[string]string{
-				{"key": "service.name", "value": "servicename"},
-				{"key": "service.version", "value": "100"},
+			expectedServiceTags: []map[string]interface{}{
 				{"key": "g.co/gae/app/module", "value": "servicename"},
-				{"key": "g.co/gae/app/version", "value": "100"},
+				{"key": "g.co/gae/app/version", "value": float64(100)},
+				{"key": "service.name", "value": "servicename"},
+				{"key": "service.version", "value": float64(100)},
 			},
-			expectedSpanTags: []map[string]string{},
+			expectedSpanTags: []map[string]interface{}{},
 			expectedError:    nil,
 		},
 		{
@@ -246,18 +341,46 @@ func TestGetTags(t *testing.T) {
 					"g.co/gae/app/version": "100",
 				},
 			},
-			expectedServiceTags: []map[string]string{
-				{"key": "service.name", "value": "servicename"},
-				{"key": "service.version", "value": "100"},
+			expectedServiceTags: []map[string]interface{}{
 				{"key": "g.co/gae/app/module", "value": "servicename"},
-				{"key": "g.co/gae/app/version", "value": "100"},
+				{"key": "g.co/gae/app/version", "value": float64(100)},
+				{"key": "service.name", "value": "servicename"},
+				{"key": "service.version", "value": float64(100)},
 			},
-			expectedSpanTags: []map[string]string{
+			expectedSpanTags: []map[string]interface{}{
 				{"key": "key1", "value": "value1"},
 				{"key": "key2", "value": "value2"},
 			},
 			expectedError: nil,
 		},
+		{
+			name: "Span with typed label values",
+			span: &tracepb.TraceSpan{
+				Labels: map[string]string{
+					"service.instance.id": "007",
+					"bool":                "true",
+					"int":                 "-42",
+					"float":               "0.25",
+					"bigInt":              "9007199254740993",
+					"notBool":             "True",
+					"notFloat":            "1e5",
+					"string":              "value",
+				},
+			},
+			expectedServiceTags: []map[string]interface{}{
+				{"key": "service.instance.id", "value": "007"},
+			},
+			expectedSpanTags: []map[string]interface{}{
+				{"key": "bigInt", "value": "9007199254740993"},
+				{"key": "bool", "value": true},
+				{"key": "float", "value": 0.25},
+				{"key": "int", "value": float64(-42)},
+				{"key": "notBool", "value": "True"},
+				{"key": "notFloat", "value": "1e5"},
+				{"key": "string", "value": "value"},
+			},
+			expectedError: nil,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -270,14 +393,15 @@ func TestGetTags(t *testing.T) {
 				require.Nil(t, error)
 			}
 
-			var serviceTagsMap []map[string]string
+			var serviceTagsMap []map[string]interface{}
 			err := json.Unmarshal(serviceTags, &serviceTagsMap)
 			require.NoError(t, err)
-			var spanTagsMap []map[string]string
+			var spanTagsMap []map[string]interface{}
 			err = json.Unmarshal(spanTags, &spanTagsMap)
 			require.NoError(t, err)
-			require.ElementsMatch(t, tc.expectedServiceTags, serviceTagsMap)
-			require.ElementsMatch(t, tc.expectedSpanTags, spanTagsMap)
+			// Tags are sorted by key
+			require.Equal(t, tc.expectedServiceTags, serviceTagsMap)
+			require.Equal(t, tc.expectedSpanTags, spanTagsMap)
 		})
 	}
 }
@@ -333,6 +457,24 @@ func TestGetListTracesFilter(t *testing.T) {
 			expectedFilter: "label:key1",
 			expectedErr:    nil,
 		},
+		{
+			name:           "Query text with HasLabel key and value shorthand",
+			queryText:      "HasLabel:key1=value1",
+			expectedFilter: "key1:value1",
+			expectedErr:    nil,
+		},
+		{
+			name:           "Query text with HasLabel exact key and value shorthand",
+			queryText:      "HasLabel:+key1=value=1",
+			expectedFilter: "+key1:value=1",
+			expectedErr:    nil,
+		},
+		{
+			name:           "Query text with HasLabel shorthand missing key",
+			queryText:      "HasLabel:=value1",
+			expectedFilter: "",
+			expectedErr:    errors.New("bad filter [HasLabel:=value1]. Must be in form HasLabel:[key]=[value]"),
+		},
 		{
 			name:           "Query text with MinLatency filter",
 			queryText:      "MinLatency:100ms",
@@ -435,6 +577,54 @@ func TestGetListTracesFilter(t *testing.T) {
 			expectedFilter: "key1:",
 			expectedErr:    nil,
 		},
+		{
+			name:           "Query text with special + char on key",
+			queryText:      "+span:foo",
+			expectedFilter: "+span:foo",
+			expectedErr:    nil,
+		},
+		{
+			name:           "Query text with special ^ char on keyword key",
+			queryText:      "^RootSpan:foo",
+			expectedFilter: "^root:foo",
+			expectedErr:    nil,
+		},
+		{
+			name:           "Query text with special +^ chars on key",
+			queryText:      "+^span:foo",
+			expectedFilter: "+^span:foo",
+			expectedErr:    nil,
+		},
+		{
+			name:           "Query text with special + char on key and value",
+			queryText:      "+span:+foo",
+			expectedFilter: "+span:foo",
+			expectedErr:    nil,
+		},
+		{
+			name:           "Query text with special ^ char on key and + char on value",
+			queryText:      "^span:+foo",
+			expectedFilter: "+^span:foo",
+			expectedErr:    nil,
+		},
+		{
+			name:           "Query text with special + char on key and ^+ chars on value",
+			queryText:      "+key1:^+value1",
+			expectedFilter: "+^key1:value1",
+			expectedErr:    nil,
+		},
+		{
+			name:           "Query text with special + char on LABEL key",
+			queryText:      "+LABEL:key1:value1",
+			expectedFilter: "+key1:value1",
+			expectedErr:    nil,
+		},
+		{
+			name:           "Query text with special + char on bad filter",
+			queryText:      "+badfilter",
+			expectedFilter: "",
+			expectedErr:    errors.New("bad filter [+badfilter]. Must be in form [key]:[value]"),
+		},
 	}
 
 	for _, tc := range testCases {
@@ -451,3 +641,2024 @@ func TestGetListTracesFilter(t *testing.T) {
 		})
 	}
 }
+
+func TestGetListTracesFilter_KeywordSpecialChars(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		queryText      string
+		expectedFilter string
+	}{
+		{
+			name:           "Exact match on value",
+			queryText:      "%s:+value1",
+			expectedFilter: "+%s:value1",
+		},
+		{
+			name:           "Exact match on key",
+			queryText:      "+%s:value1",
+			expectedFilter: "+%s:value1",
+		},
+		{
+			name:           "Root span on value",
+			queryText:      "%s:^value1",
+			expectedFilter: "^%s:value1",
+		},
+		{
+			name:           "Root span on key",
+			queryText:      "^%s:value1",
+			expectedFilter: "^%s:value1",
+		},
+		{
+			name:           "Both on value",
+			queryText:      "%s:^+value1",
+			expectedFilter: "+^%s:value1",
+		},
+		{
+			name:           "Both on key",
+			queryText:      "^+%s:value1",
+			expectedFilter: "+^%s:value1",
+		},
+		{
+			name:           "Root span on key and exact match on value",
+			queryText:      "^%s:+value1",
+			expectedFilter: "+^%s:value1",
+		},
+		{
+			name:           "Same char on key and value",
+			queryText:      "+%s:+value1",
+			expectedFilter: "+%s:value1",
+		},
+	}
+
+	// Special chars apply to the Cloud Trace API key each keyword is remapped to
+	for _, keyword := range cloudtrace.GetFilterSchema() {
+		if keyword.ClientSide {
+			continue
+		}
+		for _, tc := range testCases {
+			t.Run(keyword.Keyword+"/"+tc.name, func(t *testing.T) {
+				result, err := cloudtrace.GetListTracesFilter(fmt.Sprintf(tc.queryText, keyword.Keyword))
+
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf(tc.expectedFilter, keyword.APIKey), result)
+			})
+		}
+	}
+
+	t.Run("Service with exact match", func(t *testing.T) {
+		result, err := cloudtrace.GetListTracesFilter("Service:+frontend")
+
+		require.NoError(t, err)
+		require.Equal(t, "+g.co/gae/app/module:frontend", result)
+	})
+
+	t.Run("HasLabel with a value and exact match", func(t *testing.T) {
+		result, err := cloudtrace.GetListTracesFilter("HasLabel:+key1=value1")
+
+		require.NoError(t, err)
+		require.Equal(t, "+key1:value1", result)
+	})
+
+	t.Run("LABEL with special chars on the label key", func(t *testing.T) {
+		result, err := cloudtrace.GetListTracesFilter("LABEL:^+key1:value1")
+
+		require.NoError(t, err)
+		require.Equal(t, "+^key1:value1", result)
+	})
+}
+
+func TestGetListTracesFilter_ParseError(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		queryText     string
+		expectedError cloudtrace.FilterParseError
+	}{
+		{
+			name:      "Filter without a key",
+			queryText: "badfilter",
+			expectedError: cloudtrace.FilterParseError{
+				Token:    "badfilter",
+				Expected: "[key]:[value]",
+				Position: 0,
+			},
+		},
+		{
+			name:      "Filter without a key after a good filter",
+			queryText: "LABEL:latency:100ms badfilter",
+			expectedError: cloudtrace.FilterParseError{
+				Token:    "badfilter",
+				Expected: "[key]:[value]",
+				Position: 20,
+			},
+		},
+		{
+			name:      "LABEL filter without a key",
+			queryText: "RootSpan:root1  LABEL:badfilter",
+			expectedError: cloudtrace.FilterParseError{
+				Token:    "LABEL:badfilter",
+				Expected: "LABEL:[key]:[value]",
+				Position: 16,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := cloudtrace.GetListTracesFilter(tc.queryText)
+
+			var parseErr *cloudtrace.FilterParseError
+			require.ErrorAs(t, err, &parseErr)
+			require.Equal(t, tc.expectedError, *parseErr)
+		})
+	}
+}
+
+func TestGetSpanTree(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		spans         []*tracepb.TraceSpan
+		expectedIDs   []uint64
+		expectedDepth []int
+	}{
+		{
+			name:          "No spans",
+			spans:         []*tracepb.TraceSpan{},
+			expectedIDs:   []uint64{},
+			expectedDepth: []int{},
+		},
+		{
+			name: "Three level tree",
+			spans: []*tracepb.TraceSpan{
+				{SpanId: 3, ParentSpanId: 2},
+				{SpanId: 4, ParentSpanId: 1},
+				{SpanId: 1},
+				{SpanId: 2, ParentSpanId: 1},
+			},
+			expectedIDs:   []uint64{1, 4, 2, 3},
+			expectedDepth: []int{0, 1, 1, 2},
+		},
+		{
+			name: "Orphaned span",
+			spans: []*tracepb.TraceSpan{
+				{SpanId: 1},
+				{SpanId: 2, ParentSpanId: 1},
+				{SpanId: 3, ParentSpanId: 99},
+				{SpanId: 4, ParentSpanId: 3},
+			},
+			expectedIDs:   []uint64{1, 2, 3, 4},
+			expectedDepth: []int{0, 1, 0, 1},
+		},
+		{
+			name: "Parent cycle",
+			spans: []*tracepb.TraceSpan{
+				{SpanId: 1, ParentSpanId: 2},
+				{SpanId: 2, ParentSpanId: 1},
+				{SpanId: 3, ParentSpanId: 3},
+			},
+			expectedIDs:   []uint64{3, 1, 2},
+			expectedDepth: []int{0, 0, 1},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nodes := cloudtrace.GetSpanTree(tc.spans)
+
+			ids := []uint64{}
+			depths := []int{}
+			for _, node := range nodes {
+				ids = append(ids, node.Span.GetSpanId())
+				depths = append(depths, node.Depth)
+			}
+			require.Equal(t, tc.expectedIDs, ids)
+			require.Equal(t, tc.expectedDepth, depths)
+		})
+	}
+}
+
+func TestGetDurationOutliers(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name             string
+		durations        []float64
+		stdDevs          float64
+		expectedOutliers []bool
+	}{
+		{
+			name:             "No durations",
+			durations:        []float64{},
+			stdDevs:          2,
+			expectedOutliers: []bool{},
+		},
+		{
+			name:             "Clear outlier",
+			durations:        []float64{10, 10, 10, 10, 10, 1000},
+			stdDevs:          2,
+			expectedOutliers: []bool{false, false, false, false, false, true},
+		},
+		{
+			name:             "Uniform durations",
+			durations:        []float64{5, 5, 5, 5},
+			stdDevs:          2,
+			expectedOutliers: []bool{false, false, false, false},
+		},
+		{
+			name:             "Lower threshold",
+			durations:        []float64{10, 20, 30},
+			stdDevs:          1,
+			expectedOutliers: []bool{false, false, true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := cloudtrace.GetDurationOutliers(tc.durations, tc.stdDevs)
+
+			require.Equal(t, tc.expectedOutliers, result)
+		})
+	}
+}
+
+func TestMergeListTracesFilters(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		defaultFilter  string
+		filter         string
+		expectedFilter string
+	}{
+		{
+			name:           "No default filter",
+			defaultFilter:  "",
+			filter:         "root:span1",
+			expectedFilter: "root:span1",
+		},
+		{
+			name:           "Only default filter",
+			defaultFilter:  "resource.type:gce_instance",
+			filter:         "",
+			expectedFilter: "resource.type:gce_instance",
+		},
+		{
+			name:           "Different keys are combined",
+			defaultFilter:  "resource.type:gce_instance",
+			filter:         "root:span1",
+			expectedFilter: "resource.type:gce_instance root:span1",
+		},
+		{
+			name:           "Filter overrides default with the same key",
+			defaultFilter:  "+resource.type:gce_instance latency:100ms",
+			filter:         "resource.type:k8s_container",
+			expectedFilter: "latency:100ms resource.type:k8s_container",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := cloudtrace.MergeListTracesFilters(tc.defaultFilter, tc.filter)
+
+			require.Equal(t, tc.expectedFilter, result)
+		})
+	}
+}
+
+func TestGetHTTPURLAndHost(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name         string
+		span         *tracepb.TraceSpan
+		expectedURL  string
+		expectedHost string
+	}{
+		{
+			name:         "Span with no labels",
+			span:         &tracepb.TraceSpan{},
+			expectedURL:  "",
+			expectedHost: "",
+		},
+		{
+			name: "Span with Cloud Trace labels",
+			span: &tracepb.TraceSpan{
+				Labels: map[string]string{
+					"/http/url":  "https://www.test.com/path?q=1",
+					"/http/host": "www.test.com",
+				},
+			},
+			expectedURL:  "https://www.test.com/path?q=1",
+			expectedHost: "www.test.com",
+		},
+		{
+			name: "Span with OTEL URL label",
+			span: &tracepb.TraceSpan{
+				Labels: map[string]string{
+					"http.url": "https://api.test.com:8080/path",
+				},
+			},
+			expectedURL:  "https://api.test.com:8080/path",
+			expectedHost: "api.test.com:8080",
+		},
+		{
+			name: "Span with OTEL target and host labels",
+			span: &tracepb.TraceSpan{
+				Labels: map[string]string{
+					"http.target": "/path?q=1",
+					"http.host":   "www.test.com",
+				},
+			},
+			expectedURL:  "/path?q=1",
+			expectedHost: "www.test.com",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expectedURL, cloudtrace.GetHTTPURL(tc.span))
+			require.Equal(t, tc.expectedHost, cloudtrace.GetHTTPHost(tc.span))
+		})
+	}
+}
+
+func TestExtractTracePrefix(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		queryText      string
+		expectedPrefix string
+		expectedRest   string
+	}{
+		{
+			name:           "No prefix",
+			queryText:      "RootSpan:/checkout  MinLatency:1s",
+			expectedPrefix: "",
+			expectedRest:   "RootSpan:/checkout  MinLatency:1s",
+		},
+		{
+			name:           "Prefix only",
+			queryText:      "TracePrefix:4bf92f",
+			expectedPrefix: "4bf92f",
+			expectedRest:   "",
+		},
+		{
+			name:           "Prefix among filters",
+			queryText:      `RootSpan:/checkout TracePrefix:"4bf92f" MinLatency:1s`,
+			expectedPrefix: "4bf92f",
+			expectedRest:   "RootSpan:/checkout MinLatency:1s",
+		},
+		{
+			name:           "Last prefix wins",
+			queryText:      "TracePrefix:abc TracePrefix:def",
+			expectedPrefix: "def",
+			expectedRest:   "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			prefix, rest := cloudtrace.ExtractTracePrefix(tc.queryText)
+
+			require.Equal(t, tc.expectedPrefix, prefix)
+			require.Equal(t, tc.expectedRest, rest)
+		})
+	}
+}
+
+func TestFilterTracesByPrefix(t *testing.T) {
+	t.Parallel()
+
+	first := &tracepb.Trace{TraceId: "4BF92F3577B34DA6A3CE929D0E0E4736"}
+	second := &tracepb.Trace{TraceId: "4bf92fffffffffffffffffffffffffff"}
+	other := &tracepb.Trace{TraceId: "00f067aa0ba902b7a3ce929d0e0e4736"}
+	traces := []*tracepb.Trace{first, second, other}
+
+	require.Equal(t, []*tracepb.Trace{first, second}, cloudtrace.FilterTracesByPrefix(traces, "4bf92f"))
+	require.Equal(t, []*tracepb.Trace{first}, cloudtrace.FilterTracesByPrefix(traces, "4bf92f35"))
+	require.Equal(t, []*tracepb.Trace{}, cloudtrace.FilterTracesByPrefix(traces, "ffff"))
+	require.Equal(t, traces, cloudtrace.FilterTracesByPrefix(traces, ""))
+}
+
+func TestExtractContainsSpan(t *testing.T) {
+	t.Parallel()
+
+	names, rest := cloudtrace.ExtractContainsSpan(`RootSpan:/checkout ContainsSpan:db.query ContainsSpan:"cache get" MinLatency:1s`)
+	require.Equal(t, []string{"db.query", "cache get"}, names)
+	require.Equal(t, "RootSpan:/checkout MinLatency:1s", rest)
+
+	names, rest = cloudtrace.ExtractContainsSpan("SpanName:db.query  MinLatency:1s")
+	require.Empty(t, names)
+	require.Equal(t, "SpanName:db.query  MinLatency:1s", rest)
+}
+
+func TestFilterTracesByContainsSpan(t *testing.T) {
+	t.Parallel()
+
+	trace := func(id string, names ...string) *tracepb.Trace {
+		spans := []*tracepb.TraceSpan{}
+		for i, name := range names {
+			spans = append(spans, &tracepb.TraceSpan{SpanId: uint64(i + 1), ParentSpanId: uint64(i), Name: name})
+		}
+		return &tracepb.Trace{TraceId: id, Spans: spans}
+	}
+	nested := trace("nested", "/checkout", "payments", "db.query")
+	root := trace("root", "db.query")
+	other := trace("other", "/checkout", "payments")
+	traces := []*tracepb.Trace{nested, root, other}
+
+	// A non-root span matches as well as a root span
+	require.Equal(t, []*tracepb.Trace{nested, root}, cloudtrace.FilterTracesByContainsSpan(traces, []string{"db.query"}))
+	require.Equal(t, []*tracepb.Trace{nested, other}, cloudtrace.FilterTracesByContainsSpan(traces, []string{"payments"}))
+	// Every name must be found, and names are matched exactly
+	require.Equal(t, []*tracepb.Trace{nested}, cloudtrace.FilterTracesByContainsSpan(traces, []string{"payments", "db.query"}))
+	require.Equal(t, []*tracepb.Trace{}, cloudtrace.FilterTracesByContainsSpan(traces, []string{"db"}))
+	require.Equal(t, traces, cloudtrace.FilterTracesByContainsSpan(traces, []string{}))
+}
+
+func TestExtractComparisons(t *testing.T) {
+	t.Parallel()
+
+	comparisons, rest := cloudtrace.ExtractComparisons(`LatencyMs:>500 Service:frontend /http/response/size:<=1024.5 retries:>=-1`)
+	require.Equal(t, []cloudtrace.Comparison{
+		{Key: "LatencyMs", Operator: ">", Value: 500},
+		{Key: "/http/response/size", Operator: "<=", Value: 1024.5},
+		{Key: "retries", Operator: ">=", Value: -1},
+	}, comparisons)
+	require.Equal(t, "Service:frontend", rest)
+
+	// Filter keywords compare the labels they filter by
+	comparisons, rest = cloudtrace.ExtractComparisons("Status:>=500 Latency:>100 MinLatency:<=2000 Method:GET")
+	require.Equal(t, []cloudtrace.Comparison{
+		{Key: "/http/status_code", Operator: ">=", Value: 500},
+		{Key: "LatencyMs", Operator: ">", Value: 100},
+		{Key: "LatencyMs", Operator: "<=", Value: 2000},
+	}, comparisons)
+	require.Equal(t, "Method:GET", rest)
+
+	// Non-numeric comparisons are left for the Cloud Trace API
+	comparisons, rest = cloudtrace.ExtractComparisons("Status:>abc MinLatency:500ms")
+	require.Empty(t, comparisons)
+	require.Equal(t, "Status:>abc MinLatency:500ms", rest)
+}
+
+func TestGetOriginalFilterPosition(t *testing.T) {
+	t.Parallel()
+
+	queryText := "TracePrefix:abc RootSpan:/a  LatencyMs:>5 Method:GET"
+	_, rest := cloudtrace.ExtractTracePrefix(queryText)
+	_, rest = cloudtrace.ExtractComparisons(rest)
+	require.Equal(t, "RootSpan:/a Method:GET", rest)
+
+	require.Equal(t, 16, cloudtrace.GetOriginalFilterPosition(queryText, rest, 0))
+	require.Equal(t, 42, cloudtrace.GetOriginalFilterPosition(queryText, rest, 12))
+	// Within a filter part
+	require.Equal(t, 49, cloudtrace.GetOriginalFilterPosition(queryText, rest, 19))
+	// Unchanged query text
+	require.Equal(t, 12, cloudtrace.GetOriginalFilterPosition(rest, rest, 12))
+}
+
+func TestFilterTracesByComparisons(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	trace := func(id string, latency time.Duration, size string) *tracepb.Trace {
+		return &tracepb.Trace{
+			TraceId: id,
+			Spans: []*tracepb.TraceSpan{
+				{SpanId: 1, StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(latency))},
+				{SpanId: 2, ParentSpanId: 1, Labels: map[string]string{"size": size}, StartTime: timestamppb.New(start), EndTime: timestamppb.New(start)},
+			},
+		}
+	}
+	fast := trace("fast", 100*time.Millisecond, "10")
+	limit := trace("limit", 500*time.Millisecond, "500")
+	slow := trace("slow", time.Second, "not a number")
+	traces := []*tracepb.Trace{fast, limit, slow}
+
+	testCases := []struct {
+		name        string
+		comparisons []cloudtrace.Comparison
+		expected    []*tracepb.Trace
+	}{
+		{
+			name:        "Greater than",
+			comparisons: []cloudtrace.Comparison{{Key: "LatencyMs", Operator: ">", Value: 500}},
+			expected:    []*tracepb.Trace{slow},
+		},
+		{
+			name:        "Greater than or equal",
+			comparisons: []cloudtrace.Comparison{{Key: "LatencyMs", Operator: ">=", Value: 500}},
+			expected:    []*tracepb.Trace{limit, slow},
+		},
+		{
+			name:        "Less than",
+			comparisons: []cloudtrace.Comparison{{Key: "size", Operator: "<", Value: 500}},
+			expected:    []*tracepb.Trace{fast},
+		},
+		{
+			name:        "Less than or equal",
+			comparisons: []cloudtrace.Comparison{{Key: "size", Operator: "<=", Value: 500}},
+			expected:    []*tracepb.Trace{fast, limit},
+		},
+		{
+			name: "Every comparison must match",
+			comparisons: []cloudtrace.Comparison{
+				{Key: "LatencyMs", Operator: ">=", Value: 100},
+				{Key: "size", Operator: ">", Value: 10},
+			},
+			expected: []*tracepb.Trace{limit},
+		},
+		{
+			name:        "Missing label",
+			comparisons: []cloudtrace.Comparison{{Key: "missing", Operator: ">", Value: 0}},
+			expected:    []*tracepb.Trace{},
+		},
+		{
+			name:     "No comparisons",
+			expected: traces,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, cloudtrace.FilterTracesByComparisons(traces, tc.comparisons))
+		})
+	}
+}
+
+func TestFilterTracesByComparisons_FilterKeywords(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	trace := func(id string, latency time.Duration, status string) *tracepb.Trace {
+		return &tracepb.Trace{
+			TraceId: id,
+			Spans: []*tracepb.TraceSpan{{
+				SpanId:    1,
+				Labels:    map[string]string{"/http/status_code": status},
+				StartTime: timestamppb.New(start),
+				EndTime:   timestamppb.New(start.Add(latency)),
+			}},
+		}
+	}
+	ok := trace("ok", 50*time.Millisecond, "200")
+	slowError := trace("slowError", time.Second, "503")
+	fastError := trace("fastError", 10*time.Millisecond, "500")
+	traces := []*tracepb.Trace{ok, slowError, fastError}
+
+	comparisons, _ := cloudtrace.ExtractComparisons("Status:>=500")
+	require.Equal(t, []*tracepb.Trace{slowError, fastError}, cloudtrace.FilterTracesByComparisons(traces, comparisons))
+
+	comparisons, _ = cloudtrace.ExtractComparisons("Status:>=500 Latency:>100")
+	require.Equal(t, []*tracepb.Trace{slowError}, cloudtrace.FilterTracesByComparisons(traces, comparisons))
+}
+
+func TestFilterMultiServiceTraces(t *testing.T) {
+	t.Parallel()
+
+	span := func(service string) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{Labels: map[string]string{"service.name": service}}
+	}
+	singleService := &tracepb.Trace{TraceId: "1", Spans: []*tracepb.TraceSpan{span("frontend"), span("frontend")}}
+	multiService := &tracepb.Trace{TraceId: "2", Spans: []*tracepb.TraceSpan{span("frontend"), span("cart")}}
+	// Spans without a service don't count as another service
+	unnamedService := &tracepb.Trace{TraceId: "3", Spans: []*tracepb.TraceSpan{span("frontend"), {Name: "unnamed"}}}
+	noSpans := &tracepb.Trace{TraceId: "4"}
+	traces := []*tracepb.Trace{singleService, multiService, unnamedService, noSpans}
+
+	require.Equal(t, []*tracepb.Trace{multiService}, cloudtrace.FilterMultiServiceTraces(traces, cloudtrace.ServiceNameOTELFirst))
+	require.Equal(t, []*tracepb.Trace{}, cloudtrace.FilterMultiServiceTraces(nil, cloudtrace.ServiceNameOTELFirst))
+}
+
+func TestGetFilterSchema(t *testing.T) {
+	t.Parallel()
+
+	// Every query text keyword, and the key GetListTracesFilter converts it to
+	expectedAPIKeys := map[string]string{
+		"RootSpan":   "root",
+		"SpanName":   "span",
+		"HasLabel":   "label",
+		"MinLatency": "latency",
+		"URL":        "url",
+		"Method":     "method",
+		"Version":    "g.co/gae/app/version",
+		"Service":    "g.co/gae/app/module",
+		"Status":     "/http/status_code",
+		// Matched against the listed traces
+		"TracePrefix":  "",
+		"ContainsSpan": "",
+		"LatencyMs":    "",
+		"Latency":      "",
+	}
+
+	schema := cloudtrace.GetFilterSchema()
+	require.Len(t, schema, len(expectedAPIKeys))
+	for _, keyword := range schema {
+		require.Equal(t, expectedAPIKeys[keyword.Keyword], keyword.APIKey, keyword.Keyword)
+		require.NotEmpty(t, keyword.Description, keyword.Keyword)
+		if keyword.ClientSide {
+			continue
+		}
+
+		filter, err := cloudtrace.GetListTracesFilter(keyword.Keyword + ":value")
+		require.NoError(t, err)
+		require.Equal(t, keyword.APIKey+":value", filter)
+	}
+}
+
+func TestGetListTracesFilterWithMaxTerms(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		queryText      string
+		maxTerms       int
+		expectedFilter string
+		expectedErr    string
+	}{
+		{
+			name:           "Under the limit",
+			queryText:      "SpanName:span1",
+			maxTerms:       2,
+			expectedFilter: "span:span1",
+		},
+		{
+			name:           "At the limit",
+			queryText:      "SpanName:span1 Method:GET",
+			maxTerms:       2,
+			expectedFilter: "span:span1 method:GET",
+		},
+		{
+			name:        "Over the limit",
+			queryText:   "SpanName:span1 Method:GET Status:200",
+			maxTerms:    2,
+			expectedErr: "too many filter terms: query has 3 filter terms, the maximum is 2",
+		},
+		{
+			name:           "Default limit when unset",
+			queryText:      strings.Repeat("key:value ", cloudtrace.DefaultMaxFilterTerms),
+			maxTerms:       0,
+			expectedFilter: strings.TrimSpace(strings.Repeat("key:value ", cloudtrace.DefaultMaxFilterTerms)),
+		},
+		{
+			name:        "Over the default limit",
+			queryText:   strings.Repeat("key:value ", cloudtrace.DefaultMaxFilterTerms+1),
+			maxTerms:    0,
+			expectedErr: "too many filter terms: query has 51 filter terms, the maximum is 50",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := cloudtrace.GetListTracesFilterWithMaxTerms(tc.queryText, tc.maxTerms)
+
+			if tc.expectedErr != "" {
+				require.ErrorIs(t, err, cloudtrace.ErrTooManyFilterTerms)
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedFilter, result)
+		})
+	}
+}
+
+func TestGetServiceNameWithPrecedence(t *testing.T) {
+	t.Parallel()
+
+	bothLabels := &tracepb.TraceSpan{
+		Labels: map[string]string{"service.name": "otelname", "g.co/gae/app/module": "gaename"},
+	}
+	sameLabels := &tracepb.TraceSpan{
+		Labels: map[string]string{"service.name": "name", "g.co/gae/app/module": "name"},
+	}
+	otelLabel := &tracepb.TraceSpan{
+		Labels: map[string]string{"service.name": "otelname"},
+	}
+	gaeLabel := &tracepb.TraceSpan{
+		Labels: map[string]string{"g.co/gae/app/module": "gaename"},
+	}
+	noLabels := &tracepb.TraceSpan{}
+
+	testCases := []struct {
+		name                string
+		span                *tracepb.TraceSpan
+		precedence          cloudtrace.ServiceNamePrecedence
+		expectedServiceName string
+	}{
+		{name: "Both present, OTEL first", span: bothLabels, precedence: cloudtrace.ServiceNameOTELFirst, expectedServiceName: "otelname"},
+		{name: "Both present, GAE first", span: bothLabels, precedence: cloudtrace.ServiceNameGAEFirst, expectedServiceName: "gaename"},
+		{name: "Both present, concat", span: bothLabels, precedence: cloudtrace.ServiceNameConcat, expectedServiceName: "otelname/gaename"},
+		{name: "Both present, unknown precedence", span: bothLabels, precedence: "", expectedServiceName: "otelname"},
+		{name: "Both the same, concat", span: sameLabels, precedence: cloudtrace.ServiceNameConcat, expectedServiceName: "name"},
+		{name: "Only OTEL, GAE first", span: otelLabel, precedence: cloudtrace.ServiceNameGAEFirst, expectedServiceName: "otelname"},
+		{name: "Only OTEL, concat", span: otelLabel, precedence: cloudtrace.ServiceNameConcat, expectedServiceName: "otelname"},
+		{name: "Only GAE, OTEL first", span: gaeLabel, precedence: cloudtrace.ServiceNameOTELFirst, expectedServiceName: "gaename"},
+		{name: "Only GAE, concat", span: gaeLabel, precedence: cloudtrace.ServiceNameConcat, expectedServiceName: "gaename"},
+		{name: "Neither", span: noLabels, precedence: cloudtrace.ServiceNameConcat, expectedServiceName: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := cloudtrace.GetServiceNameWithPrecedence(tc.span, tc.precedence)
+
+			require.Equal(t, tc.expectedServiceName, result)
+		})
+	}
+}
+
+func TestGetTraceLatency(t *testing.T) {
+	t.Parallel()
+
+	start := time.UnixMilli(1660920349373)
+	span := func(id uint64, parentID uint64, startOffset time.Duration, endOffset time.Duration) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start.Add(startOffset)),
+			EndTime:      timestamppb.New(start.Add(endOffset)),
+		}
+	}
+
+	testCases := []struct {
+		name            string
+		spans           []*tracepb.TraceSpan
+		expectedLatency time.Duration
+	}{
+		{
+			name:            "No spans",
+			spans:           []*tracepb.TraceSpan{},
+			expectedLatency: 0,
+		},
+		{
+			name: "Child ends after root",
+			spans: []*tracepb.TraceSpan{
+				span(2, 1, 10*time.Millisecond, 250*time.Millisecond),
+				span(1, 0, 0, 100*time.Millisecond),
+				span(3, 1, 20*time.Millisecond, 50*time.Millisecond),
+			},
+			expectedLatency: 250 * time.Millisecond,
+		},
+		{
+			name: "No root span",
+			spans: []*tracepb.TraceSpan{
+				span(2, 1, 10*time.Millisecond, 30*time.Millisecond),
+				span(3, 1, 5*time.Millisecond, 20*time.Millisecond),
+			},
+			expectedLatency: 25 * time.Millisecond,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := cloudtrace.GetTraceLatency(tc.spans)
+
+			require.Equal(t, tc.expectedLatency, result)
+		})
+	}
+}
+
+func TestGetServiceStats(t *testing.T) {
+	t.Parallel()
+
+	start := time.UnixMilli(1660920349373)
+	span := func(service string, duration time.Duration) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			StartTime: timestamppb.New(start),
+			EndTime:   timestamppb.New(start.Add(duration)),
+			Labels: map[string]string{
+				"service.name": service,
+			},
+		}
+	}
+
+	traces := []*tracepb.Trace{
+		{
+			TraceId: "1",
+			Spans: []*tracepb.TraceSpan{
+				span("frontend", 100*time.Millisecond),
+				span("backend", 10*time.Millisecond),
+				span("backend", 20*time.Millisecond),
+			},
+		},
+		{
+			TraceId: "2",
+			Spans: []*tracepb.TraceSpan{
+				span("frontend", 300*time.Millisecond),
+				span("backend", 30*time.Millisecond),
+				span("backend", 100*time.Millisecond),
+			},
+		},
+	}
+
+	result := cloudtrace.GetServiceStats(traces, cloudtrace.ServiceNameOTELFirst)
+
+	require.Equal(t, []cloudtrace.ServiceStats{
+		{
+			Service:     "backend",
+			SpanCount:   4,
+			AvgDuration: 40 * time.Millisecond,
+			P95Duration: 100 * time.Millisecond,
+		},
+		{
+			Service:     "frontend",
+			SpanCount:   2,
+			AvgDuration: 200 * time.Millisecond,
+			P95Duration: 300 * time.Millisecond,
+		},
+	}, result)
+	require.Empty(t, cloudtrace.GetServiceStats(nil, cloudtrace.ServiceNameOTELFirst))
+}
+
+func TestGetLatencyHistogram(t *testing.T) {
+	t.Parallel()
+
+	boundaries := []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second}
+
+	testCases := []struct {
+		name      string
+		latencies []time.Duration
+		expected  []int64
+	}{
+		{
+			name: "Latencies in each bucket",
+			latencies: []time.Duration{
+				5 * time.Millisecond,
+				50 * time.Millisecond,
+				70 * time.Millisecond,
+				500 * time.Millisecond,
+				3 * time.Second,
+			},
+			expected: []int64{1, 2, 1, 1},
+		},
+		{
+			name:      "Boundaries are in the bucket above",
+			latencies: []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second},
+			expected:  []int64{0, 1, 1, 1},
+		},
+		{
+			name:      "Empty buckets",
+			latencies: []time.Duration{50 * time.Millisecond},
+			expected:  []int64{0, 1, 0, 0},
+		},
+		{
+			name:      "No latencies",
+			latencies: nil,
+			expected:  []int64{0, 0, 0, 0},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, cloudtrace.GetLatencyHistogram(tc.latencies, boundaries))
+		})
+	}
+}
+
+func TestGetTagsWithServicePrefixes(t *testing.T) {
+	t.Parallel()
+
+	span := &tracepb.TraceSpan{
+		Labels: map[string]string{
+			"service.name":         "servicename",
+			"deployment.env":       "prod",
+			"team":                 "payments",
+			"http.method":          "GET",
+			"g.co/gae/app/version": "v1",
+		},
+	}
+
+	testCases := []struct {
+		name                string
+		prefixes            []string
+		expectedServiceTags []map[string]interface{}
+		expectedSpanTags    []map[string]interface{}
+	}{
+		{
+			name:     "Default prefixes when unset",
+			prefixes: nil,
+			expectedServiceTags: []map[string]interface{}{
+				{"key": "service.name", "value": "servicename"},
+				{"key": "g.co/gae/app/version", "value": "v1"},
+			},
+			expectedSpanTags: []map[string]interface{}{
+				{"key": "deployment.env", "value": "prod"},
+				{"key": "team", "value": "payments"},
+				{"key": "http.method", "value": "GET"},
+			},
+		},
+		{
+			name:     "Custom prefixes",
+			prefixes: []string{"deployment.", "team", ""},
+			expectedServiceTags: []map[string]interface{}{
+				{"key": "service.name", "value": "servicename"},
+				{"key": "g.co/gae/app/version", "value": "v1"},
+				{"key": "deployment.env", "value": "prod"},
+				{"key": "team", "value": "payments"},
+			},
+			expectedSpanTags: []map[string]interface{}{
+				{"key": "http.method", "value": "GET"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			serviceTags, spanTags, err := cloudtrace.GetTagsWithServicePrefixes(span, tc.prefixes)
+			require.NoError(t, err)
+
+			var serviceTagsMap []map[string]interface{}
+			require.NoError(t, json.Unmarshal(serviceTags, &serviceTagsMap))
+			var spanTagsMap []map[string]interface{}
+			require.NoError(t, json.Unmarshal(spanTags, &spanTagsMap))
+			require.ElementsMatch(t, tc.expectedServiceTags, serviceTagsMap)
+			require.ElementsMatch(t, tc.expectedSpanTags, spanTagsMap)
+		})
+	}
+}
+
+func TestGetSpanEdges(t *testing.T) {
+	t.Parallel()
+
+	span := func(id uint64, parentID uint64, kind tracepb.TraceSpan_SpanKind, service string) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			Kind:         kind,
+			Labels:       map[string]string{"service.name": service},
+		}
+	}
+	root := span(1, 0, tracepb.TraceSpan_RPC_SERVER, "frontend")
+	client := span(2, 1, tracepb.TraceSpan_RPC_CLIENT, "frontend")
+	server := span(3, 2, tracepb.TraceSpan_RPC_SERVER, "backend")
+	unmatchedClient := span(4, 1, tracepb.TraceSpan_RPC_CLIENT, "frontend")
+	internal := span(5, 4, tracepb.TraceSpan_SPAN_KIND_UNSPECIFIED, "frontend")
+
+	testCases := []struct {
+		name          string
+		spans         []*tracepb.TraceSpan
+		expectedEdges []cloudtrace.SpanEdge
+	}{
+		{
+			name:          "No spans",
+			spans:         []*tracepb.TraceSpan{},
+			expectedEdges: []cloudtrace.SpanEdge{},
+		},
+		{
+			name:  "Client and server pair",
+			spans: []*tracepb.TraceSpan{server, root, client},
+			expectedEdges: []cloudtrace.SpanEdge{
+				{Client: client, Server: server, Edge: "frontend->backend"},
+			},
+		},
+		{
+			name:  "Unmatched client",
+			spans: []*tracepb.TraceSpan{root, client, server, unmatchedClient, internal},
+			expectedEdges: []cloudtrace.SpanEdge{
+				{Client: client, Server: server, Edge: "frontend->backend"},
+				{Client: unmatchedClient},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := cloudtrace.GetSpanEdges(tc.spans, cloudtrace.ServiceNameOTELFirst)
+
+			require.Equal(t, tc.expectedEdges, result)
+		})
+	}
+}
+
+func TestGetWarningCount(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		labels        map[string]string
+		expectedCount int64
+	}{
+		{
+			name:          "No labels",
+			labels:        nil,
+			expectedCount: 0,
+		},
+		{
+			name: "No warning or error labels",
+			labels: map[string]string{
+				"http.method":       "GET",
+				"/http/status_code": "200",
+				"error":             "false",
+				"otel.status_code":  "OK",
+			},
+			expectedCount: 0,
+		},
+		{
+			name: "Error and warning labels",
+			labels: map[string]string{
+				"/error/message":   "connection reset",
+				"exception.type":   "IOException",
+				"otel.status_code": "ERROR",
+				"level":            "Warning",
+				"http.method":      "GET",
+			},
+			expectedCount: 4,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := cloudtrace.GetWarningCount(&tracepb.TraceSpan{Labels: tc.labels})
+
+			require.Equal(t, tc.expectedCount, result)
+		})
+	}
+}
+
+func TestFilterSpans(t *testing.T) {
+	t.Parallel()
+
+	span := func(id uint64, parentID uint64, name string, service string) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			Name:         name,
+			Labels:       map[string]string{"service.name": service},
+		}
+	}
+	root := span(1, 0, "/checkout", "frontend")
+	cart := span(2, 1, "GetCart", "cart")
+	cartDB := span(3, 2, "SELECT carts", "cartdb")
+	payment := span(4, 1, "Charge", "payment")
+	paymentDB := span(5, 4, "SELECT cards", "paymentdb")
+	spans := []*tracepb.TraceSpan{root, cart, cartDB, payment, paymentDB}
+
+	testCases := []struct {
+		name          string
+		filter        string
+		expectedSpans []*tracepb.TraceSpan
+	}{
+		{
+			name:          "No filter",
+			filter:        " ",
+			expectedSpans: spans,
+		},
+		{
+			name:          "Name substring keeps ancestors",
+			filter:        "select CARDS",
+			expectedSpans: []*tracepb.TraceSpan{root, payment, paymentDB},
+		},
+		{
+			name:          "Name substring matching several spans",
+			filter:        "select",
+			expectedSpans: []*tracepb.TraceSpan{root, cart, cartDB, payment, paymentDB},
+		},
+		{
+			name:          "Service",
+			filter:        "service:Cart",
+			expectedSpans: []*tracepb.TraceSpan{root, cart},
+		},
+		{
+			name:          "No matches",
+			filter:        "missing",
+			expectedSpans: []*tracepb.TraceSpan{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := cloudtrace.FilterSpans(spans, tc.filter, cloudtrace.ServiceNameOTELFirst)
+
+			require.Equal(t, tc.expectedSpans, result)
+		})
+	}
+}
+
+func TestFilterSpansByDuration(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := func(id uint64, parentID uint64, duration time.Duration) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start),
+			EndTime:      timestamppb.New(start.Add(duration)),
+		}
+	}
+	// The root's duration doesn't matter, it's kept as an ancestor of slow spans
+	root := span(1, 0, time.Millisecond)
+	fastParent := span(2, 1, 2*time.Millisecond)
+	slowChild := span(3, 2, 50*time.Millisecond)
+	fastLeaf := span(4, 1, time.Millisecond)
+	spans := []*tracepb.TraceSpan{root, fastParent, slowChild, fastLeaf}
+
+	testCases := []struct {
+		name          string
+		minDuration   time.Duration
+		expectedSpans []*tracepb.TraceSpan
+	}{
+		{
+			name:          "No threshold",
+			minDuration:   0,
+			expectedSpans: spans,
+		},
+		{
+			name:          "Threshold keeps the parent chain of slow spans",
+			minDuration:   10 * time.Millisecond,
+			expectedSpans: []*tracepb.TraceSpan{root, fastParent, slowChild},
+		},
+		{
+			name:          "Threshold is inclusive",
+			minDuration:   2 * time.Millisecond,
+			expectedSpans: []*tracepb.TraceSpan{root, fastParent, slowChild},
+		},
+		{
+			name:          "Threshold above every span",
+			minDuration:   time.Second,
+			expectedSpans: []*tracepb.TraceSpan{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := cloudtrace.FilterSpansByDuration(spans, tc.minDuration)
+
+			require.Equal(t, tc.expectedSpans, result)
+		})
+	}
+}
+
+func TestGetCriticalPath(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := func(id uint64, parentID uint64, startMs int, endMs int) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start.Add(time.Duration(startMs) * time.Millisecond)),
+			EndTime:      timestamppb.New(start.Add(time.Duration(endMs) * time.Millisecond)),
+		}
+	}
+
+	t.Run("Branching trace", func(t *testing.T) {
+		spans := []*tracepb.TraceSpan{
+			span(1, 0, 0, 100),
+			// The longest child isn't the one ending last, but it's still on the path after it
+			span(2, 1, 0, 70),
+			span(3, 1, 90, 100),
+			// Overlaps the longest child, so it doesn't add to the duration
+			span(4, 1, 20, 50),
+			// Sequential children of the longest child are both on the path
+			span(5, 2, 0, 30),
+			span(6, 2, 35, 70),
+			// A parallel child ending earlier isn't
+			span(7, 2, 35, 40),
+		}
+
+		require.Equal(t, map[uint64]bool{1: true, 2: true, 3: true, 5: true, 6: true}, cloudtrace.GetCriticalPath(spans))
+	})
+
+	t.Run("Child outliving its parent", func(t *testing.T) {
+		spans := []*tracepb.TraceSpan{
+			span(1, 0, 0, 100),
+			// Ends after the root, so it's clamped and on the path
+			span(2, 1, 50, 150),
+			span(3, 1, 0, 40),
+			// Ends after its clamped parent ends, so it's clamped too
+			span(4, 2, 60, 150),
+		}
+
+		require.Equal(t, map[uint64]bool{1: true, 2: true, 3: true, 4: true}, cloudtrace.GetCriticalPath(spans))
+	})
+
+	t.Run("Empty trace", func(t *testing.T) {
+		require.Empty(t, cloudtrace.GetCriticalPath(nil))
+	})
+}
+
+func TestFilterSpansByWindow(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	span := func(id uint64, parentID uint64, from int, to int) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(at(from)),
+			EndTime:      timestamppb.New(at(to)),
+		}
+	}
+	root := span(1, 0, 0, 100)
+	early := span(2, 1, 10, 20)
+	middle := span(3, 1, 40, 60)
+	nested := span(4, 3, 45, 50)
+	late := span(5, 1, 80, 90)
+	spans := []*tracepb.TraceSpan{root, early, middle, nested, late}
+
+	testCases := []struct {
+		name          string
+		from          time.Time
+		to            time.Time
+		expectedSpans []*tracepb.TraceSpan
+	}{
+		{
+			name:          "Spans inside the window",
+			from:          at(41),
+			to:            at(49),
+			expectedSpans: []*tracepb.TraceSpan{root, middle, nested},
+		},
+		{
+			name:          "Spans outside the window",
+			from:          at(61),
+			to:            at(79),
+			expectedSpans: []*tracepb.TraceSpan{root},
+		},
+		{
+			name:          "Spans overlapping the window",
+			from:          at(15),
+			to:            at(42),
+			expectedSpans: []*tracepb.TraceSpan{root, early, middle},
+		},
+		{
+			name:          "Window bounds are inclusive",
+			from:          at(20),
+			to:            at(40),
+			expectedSpans: []*tracepb.TraceSpan{root, early, middle},
+		},
+		{
+			name:          "Open ended window",
+			from:          at(85),
+			expectedSpans: []*tracepb.TraceSpan{root, late},
+		},
+		{
+			name:          "Window after the trace",
+			from:          at(200),
+			expectedSpans: []*tracepb.TraceSpan{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := cloudtrace.FilterSpansByWindow(spans, tc.from, tc.to)
+
+			require.Equal(t, tc.expectedSpans, result)
+		})
+	}
+}
+
+func TestCollapseRetries(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := func(id uint64, parentID uint64, name string, service string, startMs int, endMs int) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			Name:         name,
+			StartTime:    timestamppb.New(start.Add(time.Duration(startMs) * time.Millisecond)),
+			EndTime:      timestamppb.New(start.Add(time.Duration(endMs) * time.Millisecond)),
+			Labels:       map[string]string{"service.name": service},
+		}
+	}
+
+	t.Run("Retry sequence", func(t *testing.T) {
+		root := span(1, 0, "/checkout", "frontend", 0, 100)
+		// Retries listed out of start order, with a child under the second attempt
+		retry2 := span(3, 1, "GetCart", "cart", 20, 30)
+		retry1 := span(2, 1, "GetCart", "cart", 0, 10)
+		retry3 := span(4, 1, "GetCart", "cart", 40, 50)
+		retryChild := span(5, 3, "SELECT", "cartdb", 21, 29)
+		after := span(6, 1, "Charge", "payment", 60, 70)
+		spans := []*tracepb.TraceSpan{root, retry2, retry1, retry3, retryChild, after}
+
+		result := cloudtrace.CollapseRetries(spans, cloudtrace.ServiceNameOTELFirst)
+
+		require.Len(t, result, 4)
+		require.Equal(t, root, result[0])
+		collapsed := result[1]
+		require.Equal(t, uint64(2), collapsed.GetSpanId())
+		require.Equal(t, "3", collapsed.GetLabels()[cloudtrace.RetryCountLabel])
+		require.Equal(t, start, collapsed.GetStartTime().AsTime())
+		require.Equal(t, start.Add(50*time.Millisecond), collapsed.GetEndTime().AsTime())
+		require.Equal(t, uint64(5), result[2].GetSpanId())
+		require.Equal(t, uint64(2), result[2].GetParentSpanId())
+		require.Equal(t, after, result[3])
+
+		// The original spans are unchanged
+		require.NotContains(t, retry1.GetLabels(), cloudtrace.RetryCountLabel)
+		require.Equal(t, uint64(3), retryChild.GetParentSpanId())
+	})
+
+	t.Run("Non-collapsible spans", func(t *testing.T) {
+		spans := []*tracepb.TraceSpan{
+			span(1, 0, "/checkout", "frontend", 0, 100),
+			span(2, 1, "GetCart", "cart", 0, 10),
+			// Same name from another service
+			span(3, 1, "GetCart", "cart-v2", 10, 20),
+			span(4, 1, "Charge", "payment", 20, 30),
+			// Same name and service, but not consecutive
+			span(5, 1, "GetCart", "cart", 30, 40),
+			// Same name and service, but not siblings
+			span(6, 2, "GetCart", "cart", 1, 9),
+		}
+
+		result := cloudtrace.CollapseRetries(spans, cloudtrace.ServiceNameOTELFirst)
+
+		require.Equal(t, spans, result)
+	})
+
+	t.Run("Parallel siblings", func(t *testing.T) {
+		// Overlapping calls with the same name and service, like a fan-out
+		spans := []*tracepb.TraceSpan{
+			span(1, 0, "/checkout", "frontend", 0, 100),
+			span(2, 1, "GetPrice", "pricing", 0, 30),
+			span(3, 1, "GetPrice", "pricing", 5, 35),
+			span(4, 1, "GetPrice", "pricing", 10, 40),
+		}
+
+		result := cloudtrace.CollapseRetries(spans, cloudtrace.ServiceNameOTELFirst)
+
+		require.Equal(t, spans, result)
+		for _, s := range result {
+			require.NotContains(t, s.GetLabels(), cloudtrace.RetryCountLabel)
+		}
+	})
+}
+
+func TestGetBaggageTags(t *testing.T) {
+	t.Parallel()
+
+	span := &tracepb.TraceSpan{
+		Labels: map[string]string{
+			"service.name":       "servicename",
+			"http.method":        "GET",
+			"baggage.user_id":    "42",
+			"baggage.session.id": "abc",
+			"mybaggage.key":      "value",
+		},
+	}
+
+	serviceTags, spanTags, err := cloudtrace.GetTags(span)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"key":"service.name","value":"servicename"}]`, string(serviceTags))
+	// Only labels starting with the baggage prefix are baggage
+	require.ElementsMatch(t, []map[string]interface{}{
+		{"key": "http.method", "value": "GET"},
+		{"key": "mybaggage.key", "value": "value"},
+	}, unmarshalTags(t, spanTags))
+
+	baggageTags, err := cloudtrace.GetBaggageTags(span, cloudtrace.TagOptions{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []map[string]interface{}{
+		{"key": "user_id", "value": float64(42)},
+		{"key": "session.id", "value": "abc"},
+	}, unmarshalTags(t, baggageTags))
+
+	// Baggage labels are filtered like other labels
+	baggageTags, err = cloudtrace.GetBaggageTags(span, cloudtrace.TagOptions{Exclude: []string{"baggage.user_id"}})
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"key":"session.id","value":"abc"}]`, string(baggageTags))
+
+	baggageTags, err = cloudtrace.GetBaggageTags(&tracepb.TraceSpan{}, cloudtrace.TagOptions{})
+	require.NoError(t, err)
+	require.JSONEq(t, `[]`, string(baggageTags))
+}
+
+func TestGetGRPCStatus(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		labels   map[string]string
+		expected string
+	}{
+		{name: "OK", labels: map[string]string{"rpc.grpc.status_code": "0"}, expected: "OK"},
+		{name: "Not found", labels: map[string]string{"rpc.grpc.status_code": "5"}, expected: "NOT_FOUND"},
+		{name: "Unauthenticated", labels: map[string]string{"rpc.grpc.status_code": "16"}, expected: "UNAUTHENTICATED"},
+		{name: "Unknown code", labels: map[string]string{"rpc.grpc.status_code": "17"}, expected: "17"},
+		{name: "Negative code", labels: map[string]string{"rpc.grpc.status_code": "-1"}, expected: "-1"},
+		{name: "Non-numeric code", labels: map[string]string{"rpc.grpc.status_code": "NOT_FOUND"}, expected: "NOT_FOUND"},
+		{name: "Not a gRPC span", labels: map[string]string{"/http/status_code": "200"}, expected: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, cloudtrace.GetGRPCStatus(&tracepb.TraceSpan{Labels: tc.labels}))
+		})
+	}
+}
+
+func TestGetSpanStatus(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		labels   map[string]string
+		expected string
+	}{
+		{name: "OTEL OK", labels: map[string]string{"otel.status_code": "OK"}, expected: "OK"},
+		{name: "OTEL error", labels: map[string]string{"otel.status_code": "ERROR"}, expected: "ERROR"},
+		{name: "HTTP server error", labels: map[string]string{"/http/status_code": "500"}, expected: "ERROR"},
+		{name: "HTTP client error", labels: map[string]string{"/http/status_code": "404"}, expected: "UNSET"},
+		{name: "No status", labels: nil, expected: "UNSET"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, cloudtrace.GetSpanStatus(&tracepb.TraceSpan{Labels: tc.labels}))
+		})
+	}
+}
+
+func TestGetSelfTimes(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := func(id uint64, parentID uint64, startMs int, endMs int) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start.Add(time.Duration(startMs) * time.Millisecond)),
+			EndTime:      timestamppb.New(start.Add(time.Duration(endMs) * time.Millisecond)),
+		}
+	}
+
+	t.Run("Non-overlapping children", func(t *testing.T) {
+		spans := []*tracepb.TraceSpan{
+			span(1, 0, 0, 100),
+			span(2, 1, 10, 30),
+			span(3, 1, 40, 70),
+			// Grandchildren only count against their own parent
+			span(4, 3, 45, 55),
+		}
+
+		require.Equal(t, map[uint64]time.Duration{
+			1: 50 * time.Millisecond,
+			2: 20 * time.Millisecond,
+			3: 20 * time.Millisecond,
+			4: 10 * time.Millisecond,
+		}, cloudtrace.GetSelfTimes(spans))
+	})
+
+	t.Run("Overlapping children", func(t *testing.T) {
+		spans := []*tracepb.TraceSpan{
+			span(1, 0, 0, 100),
+			// Concurrent children lasting longer than the parent in total
+			span(2, 1, 0, 60),
+			span(3, 1, 10, 90),
+			// A skewed child doesn't add self time
+			span(4, 1, 50, 40),
+		}
+
+		selfTimes := cloudtrace.GetSelfTimes(spans)
+		require.Equal(t, time.Duration(0), selfTimes[1])
+		require.Equal(t, time.Duration(0), selfTimes[4])
+	})
+}
+
+func TestGetSkewedSpans(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := func(id uint64, parentID uint64, startMs int) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start.Add(time.Duration(startMs) * time.Millisecond)),
+			EndTime:      timestamppb.New(start.Add(time.Duration(startMs+10) * time.Millisecond)),
+		}
+	}
+
+	spans := []*tracepb.TraceSpan{
+		span(1, 0, 100),
+		// Starts before its parent
+		span(2, 1, 90),
+		// Starts with its parent
+		span(3, 1, 100),
+		// Starts after its parent, though before its grandparent
+		span(4, 2, 95),
+		// Parent isn't in the trace
+		span(5, 9, 0),
+	}
+
+	require.Equal(t, []uint64{2}, cloudtrace.GetSkewedSpans(spans))
+	require.Empty(t, cloudtrace.GetSkewedSpans(spans[2:]))
+}
+
+func TestAddMissingParents(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := func(id uint64, parentID uint64, from time.Duration, to time.Duration) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start.Add(from)),
+			EndTime:      timestamppb.New(start.Add(to)),
+		}
+	}
+
+	t.Run("Dangling parent reference", func(t *testing.T) {
+		spans := []*tracepb.TraceSpan{
+			span(1, 0, 0, 10*time.Second),
+			span(2, 8, time.Second, 2*time.Second),
+			span(3, 9, 3*time.Second, 4*time.Second),
+			span(4, 8, 1500*time.Millisecond, 5*time.Second),
+			span(5, 2, time.Second, 2*time.Second),
+		}
+
+		result, orphans := cloudtrace.AddMissingParents(spans)
+
+		require.Equal(t, 3, orphans)
+		require.Len(t, result, 7)
+		require.Equal(t, spans, result[:5])
+		// One placeholder for each missing parent, under the root and spanning its children
+		for i, expected := range []*tracepb.TraceSpan{
+			span(8, 1, time.Second, 5*time.Second),
+			span(9, 1, 3*time.Second, 4*time.Second),
+		} {
+			placeholder := result[5+i]
+			require.Equal(t, expected.GetSpanId(), placeholder.GetSpanId())
+			require.Equal(t, expected.GetParentSpanId(), placeholder.GetParentSpanId())
+			require.Equal(t, cloudtrace.MissingSpanName, placeholder.GetName())
+			require.Equal(t, expected.GetStartTime().AsTime(), placeholder.GetStartTime().AsTime())
+			require.Equal(t, expected.GetEndTime().AsTime(), placeholder.GetEndTime().AsTime())
+		}
+	})
+
+	t.Run("Missing root span", func(t *testing.T) {
+		spans := []*tracepb.TraceSpan{span(2, 1, 0, time.Second)}
+
+		result, orphans := cloudtrace.AddMissingParents(spans)
+
+		require.Equal(t, 1, orphans)
+		require.Len(t, result, 2)
+		require.Equal(t, uint64(1), result[1].GetSpanId())
+		require.Equal(t, uint64(0), result[1].GetParentSpanId())
+	})
+
+	t.Run("Complete trace", func(t *testing.T) {
+		spans := []*tracepb.TraceSpan{span(1, 0, 0, time.Second), span(2, 1, 0, time.Second)}
+
+		result, orphans := cloudtrace.AddMissingParents(spans)
+
+		require.Equal(t, 0, orphans)
+		require.Equal(t, spans, result)
+	})
+}
+
+func TestLimitSpans(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := func(id uint64, offset time.Duration) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{SpanId: id, StartTime: timestamppb.New(start.Add(offset))}
+	}
+	spans := []*tracepb.TraceSpan{span(1, 0), span(2, 3*time.Second), span(3, time.Second), span(4, 2*time.Second)}
+
+	t.Run("Over the limit", func(t *testing.T) {
+		result := cloudtrace.LimitSpans(spans, 3)
+
+		require.Equal(t, []*tracepb.TraceSpan{spans[0], spans[2], spans[3]}, result)
+	})
+
+	t.Run("Within the limit", func(t *testing.T) {
+		require.Equal(t, spans, cloudtrace.LimitSpans(spans, 4))
+	})
+
+	t.Run("Zero limit", func(t *testing.T) {
+		require.Empty(t, cloudtrace.LimitSpans(spans, 0))
+	})
+}
+
+func TestExcludeServices(t *testing.T) {
+	t.Parallel()
+
+	span := func(id uint64, parentID uint64, service string) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			Labels:       map[string]string{"service.name": service},
+		}
+	}
+
+	t.Run("Excluded service", func(t *testing.T) {
+		root := span(1, 0, "frontend")
+		// Sidecars both sides of the call to cart, nested under each other
+		outboundProxy := span(2, 1, "istio-proxy")
+		inboundProxy := span(3, 2, "Istio-Proxy")
+		cart := span(4, 3, "cart")
+		db := span(5, 4, "cartdb")
+		payment := span(6, 1, "payment")
+		spans := []*tracepb.TraceSpan{root, outboundProxy, inboundProxy, cart, db, payment}
+
+		result := cloudtrace.ExcludeServices(spans, []string{"istio-proxy"}, cloudtrace.ServiceNameOTELFirst)
+
+		require.Len(t, result, 4)
+		require.Equal(t, root, result[0])
+		require.Equal(t, uint64(4), result[1].GetSpanId())
+		require.Equal(t, uint64(1), result[1].GetParentSpanId())
+		require.Equal(t, db, result[2])
+		require.Equal(t, payment, result[3])
+
+		// The original spans are unchanged
+		require.Equal(t, uint64(3), cart.GetParentSpanId())
+	})
+
+	t.Run("Excluded root", func(t *testing.T) {
+		spans := []*tracepb.TraceSpan{span(1, 0, "istio-proxy"), span(2, 1, "frontend")}
+
+		result := cloudtrace.ExcludeServices(spans, []string{"istio-proxy"}, cloudtrace.ServiceNameOTELFirst)
+
+		require.Len(t, result, 1)
+		require.Equal(t, uint64(2), result[0].GetSpanId())
+		require.Equal(t, uint64(0), result[0].GetParentSpanId())
+	})
+
+	t.Run("No excluded services", func(t *testing.T) {
+		spans := []*tracepb.TraceSpan{span(1, 0, "frontend"), span(2, 1, "cart")}
+
+		require.Equal(t, spans, cloudtrace.ExcludeServices(spans, nil, cloudtrace.ServiceNameOTELFirst))
+		require.Equal(t, spans, cloudtrace.ExcludeServices(spans, []string{"istio-proxy"}, cloudtrace.ServiceNameOTELFirst))
+	})
+}
+
+func TestMergeTraces(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := func(id uint64, parentID uint64, offset time.Duration, duration time.Duration) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start.Add(offset)),
+			EndTime:      timestamppb.New(start.Add(offset + duration)),
+		}
+	}
+
+	t.Run("Two traces", func(t *testing.T) {
+		// An async job traced separately, starting after the request that queued it ends
+		request := &tracepb.Trace{ProjectId: "p", TraceId: "a", Spans: []*tracepb.TraceSpan{
+			span(1, 0, 0, time.Second),
+			span(2, 1, 100*time.Millisecond, 500*time.Millisecond),
+		}}
+		job := &tracepb.Trace{ProjectId: "p", TraceId: "b", Spans: []*tracepb.TraceSpan{
+			span(1, 0, 2*time.Second, 3*time.Second),
+			span(2, 1, 3*time.Second, time.Second),
+		}}
+
+		merged := cloudtrace.MergeTraces([]*tracepb.Trace{request, job})
+
+		require.Equal(t, "p", merged.GetProjectId())
+		require.Equal(t, "a+b", merged.GetTraceId())
+		spans := merged.GetSpans()
+		require.Len(t, spans, 5)
+
+		root := spans[0]
+		require.Equal(t, cloudtrace.MergedRootSpanName, root.GetName())
+		require.Equal(t, uint64(0), root.GetParentSpanId())
+		require.Equal(t, start, root.GetStartTime().AsTime())
+		require.Equal(t, start.Add(5*time.Second), root.GetEndTime().AsTime())
+
+		// Both traces hang off the synthetic root, with clashing span IDs renumbered
+		ids := []uint64{}
+		parentIDs := []uint64{}
+		traceIDs := []string{}
+		for _, s := range spans[1:] {
+			ids = append(ids, s.GetSpanId())
+			parentIDs = append(parentIDs, s.GetParentSpanId())
+			traceIDs = append(traceIDs, s.GetLabels()[cloudtrace.MergedTraceLabel])
+		}
+		require.Equal(t, []uint64{1, 2, 4, 5}, ids)
+		require.Equal(t, []uint64{root.GetSpanId(), 1, root.GetSpanId(), 4}, parentIDs)
+		require.Equal(t, []string{"a", "a", "b", "b"}, traceIDs)
+
+		// Spans keep their own timestamps
+		require.Equal(t, start.Add(2*time.Second), spans[3].GetStartTime().AsTime())
+
+		// The original spans are unchanged
+		require.Equal(t, uint64(1), job.GetSpans()[0].GetSpanId())
+		require.Equal(t, uint64(0), job.GetSpans()[0].GetParentSpanId())
+		require.Empty(t, job.GetSpans()[0].GetLabels())
+	})
+
+	t.Run("Orphaned span", func(t *testing.T) {
+		trace := &tracepb.Trace{TraceId: "a", Spans: []*tracepb.TraceSpan{span(2, 7, 0, time.Second)}}
+
+		spans := cloudtrace.MergeTraces([]*tracepb.Trace{trace}).GetSpans()
+
+		require.Len(t, spans, 2)
+		require.Equal(t, spans[0].GetSpanId(), spans[1].GetParentSpanId())
+	})
+
+	t.Run("No traces", func(t *testing.T) {
+		require.Empty(t, cloudtrace.MergeTraces(nil).GetSpans())
+	})
+}
+
+func TestGetTagsWithOptions_DisplayKeys(t *testing.T) {
+	t.Parallel()
+
+	span := &tracepb.TraceSpan{
+		Labels: map[string]string{
+			"/http/url":       "http://www.test.com/index",
+			"/http/method":    "GET",
+			"g.co/gae/app/id": "app",
+			"baggage.user_id": "42",
+		},
+	}
+	opts := cloudtrace.TagOptions{
+		DisplayKeys: map[string]string{
+			"/http/url":       "http.url",
+			"g.co/gae/app/id": "app.id",
+			"baggage.user_id": "user",
+			"/http/missing":   "http.missing",
+		},
+		// Filters still match the raw label keys
+		Exclude: []string{"/http/method"},
+	}
+
+	serviceTags, spanTags, err := cloudtrace.GetTagsWithOptions(span, opts)
+	require.NoError(t, err)
+	// Mapped keys are still grouped by their raw keys
+	require.JSONEq(t, `[{"key":"app.id","value":"app"}]`, string(serviceTags))
+	require.JSONEq(t, `[{"key":"http.url","value":"http://www.test.com/index"}]`, string(spanTags))
+
+	baggageTags, err := cloudtrace.GetBaggageTags(span, opts)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"key":"user","value":42}]`, string(baggageTags))
+
+	// Unmapped keys are unchanged
+	_, spanTags, err = cloudtrace.GetTagsWithOptions(span, cloudtrace.TagOptions{Include: []string{"/http/*"}})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []map[string]interface{}{
+		{"key": "/http/url", "value": "http://www.test.com/index"},
+		{"key": "/http/method", "value": "GET"},
+	}, unmarshalTags(t, spanTags))
+}
+
+func TestGetTagsWithOptions_SortedByKey(t *testing.T) {
+	t.Parallel()
+
+	span := &tracepb.TraceSpan{
+		Labels: map[string]string{
+			"b.key":               "b",
+			"zeta":                "z",
+			"a.key":               "a",
+			"service.name":        "servicename",
+			"g.co/gae/app/module": "module",
+			"baggage.z":           "z",
+			"baggage.a":           "a",
+		},
+	}
+	// Tags are sorted by the keys they're shown with
+	opts := cloudtrace.TagOptions{DisplayKeys: map[string]string{"zeta": "alpha"}}
+
+	// The order is the same every time, whatever the map order
+	for i := 0; i < 10; i++ {
+		serviceTags, spanTags, err := cloudtrace.GetTagsWithOptions(span, opts)
+		require.NoError(t, err)
+		require.Equal(t, `[{"key":"g.co/gae/app/module","value":"module"},{"key":"service.name","value":"servicename"}]`, string(serviceTags))
+		require.Equal(t, `[{"key":"a.key","value":"a"},{"key":"alpha","value":"z"},{"key":"b.key","value":"b"}]`, string(spanTags))
+
+		baggageTags, err := cloudtrace.GetBaggageTags(span, opts)
+		require.NoError(t, err)
+		require.Equal(t, `[{"key":"a","value":"a"},{"key":"z","value":"z"}]`, string(baggageTags))
+	}
+}
+
+func TestGetTagsWithOptions_MaxTags(t *testing.T) {
+	t.Parallel()
+
+	span := &tracepb.TraceSpan{
+		Labels: map[string]string{
+			"service.name":      "servicename",
+			"http.method":       "GET",
+			"http.url":          "http://www.test.com/index",
+			"/http/status_code": "200",
+			"g.co/agent":        "agent",
+			"db.statement":      "SELECT 1",
+			"baggage.user_id":   "42",
+		},
+	}
+
+	t.Run("Under the limit", func(t *testing.T) {
+		serviceTags, spanTags, err := cloudtrace.GetTagsWithOptions(span, cloudtrace.TagOptions{MaxTags: 6})
+		require.NoError(t, err)
+
+		// Baggage labels don't count towards the limit
+		require.JSONEq(t, `[{"key":"service.name","value":"servicename"}]`, string(serviceTags))
+		require.JSONEq(t, `[
+			{"key":"/http/status_code","value":200},
+			{"key":"db.statement","value":"SELECT 1"},
+			{"key":"g.co/agent","value":"agent"},
+			{"key":"http.method","value":"GET"},
+			{"key":"http.url","value":"http://www.test.com/index"}
+		]`, string(spanTags))
+	})
+
+	t.Run("Over the limit", func(t *testing.T) {
+		// The same tags are kept every time, whatever the map order
+		for i := 0; i < 10; i++ {
+			serviceTags, spanTags, err := cloudtrace.GetTagsWithOptions(span, cloudtrace.TagOptions{MaxTags: 3})
+			require.NoError(t, err)
+
+			require.JSONEq(t, `[]`, string(serviceTags))
+			require.JSONEq(t, `[
+				{"key":"/http/status_code","value":200},
+				{"key":"db.statement","value":"SELECT 1"},
+				{"key":"g.co/agent","value":"agent"},
+				{"key":"_truncated_tags","value":3}
+			]`, string(spanTags))
+		}
+	})
+
+	t.Run("Limit applied after filtering", func(t *testing.T) {
+		serviceTags, spanTags, err := cloudtrace.GetTagsWithOptions(span, cloudtrace.TagOptions{
+			Include: []string{"http.*", "service.*"},
+			MaxTags: 2,
+		})
+		require.NoError(t, err)
+
+		require.JSONEq(t, `[]`, string(serviceTags))
+		require.JSONEq(t, `[
+			{"key":"http.method","value":"GET"},
+			{"key":"http.url","value":"http://www.test.com/index"},
+			{"key":"_truncated_tags","value":1}
+		]`, string(spanTags))
+	})
+}
+
+func unmarshalTags(t *testing.T, tags json.RawMessage) []map[string]interface{} {
+	t.Helper()
+	var result []map[string]interface{}
+	require.NoError(t, json.Unmarshal(tags, &result))
+	return result
+}
+
+func TestGetTagsWithOptions(t *testing.T) {
+	t.Parallel()
+
+	span := &tracepb.TraceSpan{
+		Labels: map[string]string{
+			"service.name":      "servicename",
+			"http.method":       "GET",
+			"http.url":          "http://www.test.com/index",
+			"/http/status_code": "200",
+			"g.co/agent":        "agent",
+			"db.statement":      "SELECT 1",
+		},
+	}
+
+	testCases := []struct {
+		name            string
+		opts            cloudtrace.TagOptions
+		expectedTagKeys []string
+	}{
+		{
+			name:            "No filtering",
+			opts:            cloudtrace.TagOptions{},
+			expectedTagKeys: []string{"service.name", "http.method", "http.url", "/http/status_code", "g.co/agent", "db.statement"},
+		},
+		{
+			name:            "Include only",
+			opts:            cloudtrace.TagOptions{Include: []string{"http.*", "*/status_cod?"}},
+			expectedTagKeys: []string{"http.method", "http.url", "/http/status_code"},
+		},
+		{
+			name:            "Exclude only",
+			opts:            cloudtrace.TagOptions{Exclude: []string{"g.co/*", "db.statement"}},
+			expectedTagKeys: []string{"service.name", "http.method", "http.url", "/http/status_code"},
+		},
+		{
+			name: "Exclude applied after include",
+			opts: cloudtrace.TagOptions{
+				Include: []string{"http.*", "service.*"},
+				Exclude: []string{"*.url"},
+			},
+			expectedTagKeys: []string{"service.name", "http.method"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			serviceTags, spanTags, err := cloudtrace.GetTagsWithOptions(span, tc.opts)
+			require.NoError(t, err)
+
+			var tags []map[string]interface{}
+			require.NoError(t, json.Unmarshal(serviceTags, &tags))
+			var spanTagsMap []map[string]interface{}
+			require.NoError(t, json.Unmarshal(spanTags, &spanTagsMap))
+			tags = append(tags, spanTagsMap...)
+
+			tagKeys := []string{}
+			for _, tag := range tags {
+				tagKeys = append(tagKeys, tag["key"].(string))
+			}
+			require.ElementsMatch(t, tc.expectedTagKeys, tagKeys)
+		})
+	}
+}
+
+func TestParseTraceIDs(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{
+			name:     "Comma separated",
+			text:     "abc, def,ghi",
+			expected: []string{"abc", "def", "ghi"},
+		},
+		{
+			name:     "Multi-value variable",
+			text:     "{abc,def}",
+			expected: []string{"abc", "def"},
+		},
+		{
+			name:     "JSON list",
+			text:     `["abc","def"]`,
+			expected: []string{"abc", "def"},
+		},
+		{
+			name:     "Pipe separated",
+			text:     "abc|def",
+			expected: []string{"abc", "def"},
+		},
+		{
+			name:     "Cloud Logging trace fields",
+			text:     "projects/my-project/traces/abc\nprojects/my-project/traces/def",
+			expected: []string{"abc", "def"},
+		},
+		{
+			name:     "Repeated IDs",
+			text:     "abc def abc",
+			expected: []string{"abc", "def"},
+		},
+		{
+			name:     "Empty",
+			text:     " , ",
+			expected: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, cloudtrace.ParseTraceIDs(tc.text))
+		})
+	}
+}
+
+func TestParseTraceReference(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name              string
+		text              string
+		expectedProjectID string
+		expectedTraceID   string
+	}{
+		{
+			name:              "Cloud Logging trace field",
+			text:              "projects/my-project/traces/0123456789abcdef0123456789abcdef",
+			expectedProjectID: "my-project",
+			expectedTraceID:   "0123456789abcdef0123456789abcdef",
+		},
+		{
+			name:              "Pasted log line",
+			text:              `2023-01-01T00:00:00Z INFO request done trace="projects/my-project/traces/abc123" spanId=456`,
+			expectedProjectID: "my-project",
+			expectedTraceID:   "abc123",
+		},
+		{
+			name:              "Plain trace ID",
+			text:              " abc123 ",
+			expectedProjectID: "",
+			expectedTraceID:   "abc123",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			projectID, traceID := cloudtrace.ParseTraceReference(tc.text)
+
+			require.Equal(t, tc.expectedProjectID, projectID)
+			require.Equal(t, tc.expectedTraceID, traceID)
+		})
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudtrace
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/trace/apiv1/tracepb"
+)
+
+// OTLP span kinds and status codes, as numbered in the OTLP protocol
+const (
+	otlpSpanKindUnspecified = 0
+	otlpSpanKindInternal    = 1
+	otlpSpanKindServer      = 2
+	otlpSpanKindClient      = 3
+	otlpSpanKindProducer    = 4
+	otlpSpanKindConsumer    = 5
+
+	otlpStatusUnset = 0
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+// Span labels written by OpenTelemetry exporters and Cloud Trace agents
+// that carry the OTLP fields v1 spans have no place for
+const (
+	otelSpanKindKey          = "span.kind"
+	otelStatusCodeKey        = "otel.status_code"
+	otelStatusDescriptionKey = "otel.status_description"
+	httpStatusCodeKey        = "/http/status_code"
+)
+
+// OTLPTracesData is a trace in the OTLP JSON encoding, with a resource for each service
+type OTLPTracesData struct {
+	ResourceSpans []OTLPResourceSpans `json:"resourceSpans"`
+}
+
+// OTLPResourceSpans is the spans of a single service
+type OTLPResourceSpans struct {
+	Resource   OTLPResource     `json:"resource"`
+	ScopeSpans []OTLPScopeSpans `json:"scopeSpans"`
+}
+
+// OTLPResource describes the service spans are from
+type OTLPResource struct {
+	Attributes []OTLPKeyValue `json:"attributes"`
+}
+
+// OTLPScopeSpans is the spans of a single instrumentation scope. Cloud Trace
+// doesn't record scopes, so all of a service's spans share one
+type OTLPScopeSpans struct {
+	Spans []OTLPSpan `json:"spans"`
+}
+
+// OTLPSpan is a span in the OTLP JSON encoding. IDs are hex and times are
+// nanoseconds since the epoch, encoded as strings like other 64-bit integers
+type OTLPSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []OTLPKeyValue `json:"attributes"`
+	Status            OTLPStatus     `json:"status"`
+}
+
+// OTLPStatus is the status of a span
+type OTLPStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// OTLPKeyValue is an attribute
+type OTLPKeyValue struct {
+	Key   string       `json:"key"`
+	Value OTLPAnyValue `json:"value"`
+}
+
+// OTLPAnyValue is an attribute value, with only the field of its type set
+type OTLPAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// ToOTLP converts a v1 trace to OTLP, grouping its spans by service. Span labels
+// become attributes, typed like span tags, and the span kind and status are read
+// from the labels OpenTelemetry exporters write when v1 spans have none
+func ToOTLP(trace *tracepb.Trace, precedence ServiceNamePrecedence) OTLPTracesData {
+	traceID := strings.ToLower(trace.GetTraceId())
+
+	spansByService := map[string][]OTLPSpan{}
+	for _, s := range trace.GetSpans() {
+		service := GetServiceNameWithPrecedence(s, precedence)
+		spansByService[service] = append(spansByService[service], toOTLPSpan(traceID, s))
+	}
+
+	services := make([]string, 0, len(spansByService))
+	for service := range spansByService {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	data := OTLPTracesData{ResourceSpans: []OTLPResourceSpans{}}
+	for _, service := range services {
+		resource := OTLPResource{Attributes: []OTLPKeyValue{}}
+		if service != "" {
+			resource.Attributes = append(resource.Attributes, toOTLPKeyValue(otelServiceKey, service))
+		}
+		data.ResourceSpans = append(data.ResourceSpans, OTLPResourceSpans{
+			Resource:   resource,
+			ScopeSpans: []OTLPScopeSpans{{Spans: spansByService[service]}},
+		})
+	}
+	return data
+}
+
+func toOTLPSpan(traceID string, s *tracepb.TraceSpan) OTLPSpan {
+	span := OTLPSpan{
+		TraceID:           traceID,
+		SpanID:            SpanID(s.GetSpanId()).Hex(),
+		Name:              s.GetName(),
+		Kind:              getOTLPSpanKind(s),
+		StartTimeUnixNano: strconv.FormatInt(s.GetStartTime().AsTime().UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.GetEndTime().AsTime().UnixNano(), 10),
+		Attributes:        []OTLPKeyValue{},
+		Status:            getOTLPStatus(s),
+	}
+	if s.GetParentSpanId() != 0 {
+		span.ParentSpanID = SpanID(s.GetParentSpanId()).Hex()
+	}
+
+	labels := s.GetLabels()
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		span.Attributes = append(span.Attributes, toOTLPKeyValue(key, labels[key]))
+	}
+	return span
+}
+
+// getOTLPSpanKind returns the OTLP kind of a span, from its kind or its span.kind label
+func getOTLPSpanKind(s *tracepb.TraceSpan) int {
+	switch s.GetKind() {
+	case tracepb.TraceSpan_RPC_SERVER:
+		return otlpSpanKindServer
+	case tracepb.TraceSpan_RPC_CLIENT:
+		return otlpSpanKindClient
+	}
+
+	switch strings.ToLower(s.GetLabels()[otelSpanKindKey]) {
+	case "internal":
+		return otlpSpanKindInternal
+	case "server":
+		return otlpSpanKindServer
+	case "client":
+		return otlpSpanKindClient
+	case "producer":
+		return otlpSpanKindProducer
+	case "consumer":
+		return otlpSpanKindConsumer
+	default:
+		return otlpSpanKindUnspecified
+	}
+}
+
+// getOTLPStatus returns the OTLP status of a span, from its OpenTelemetry status
+// labels, or an error for HTTP 5xx status codes
+func getOTLPStatus(s *tracepb.TraceSpan) OTLPStatus {
+	labels := s.GetLabels()
+	switch strings.ToUpper(labels[otelStatusCodeKey]) {
+	case "OK":
+		return OTLPStatus{Code: otlpStatusOK}
+	case "ERROR":
+		return OTLPStatus{Code: otlpStatusError, Message: labels[otelStatusDescriptionKey]}
+	}
+
+	if code, err := strconv.Atoi(labels[httpStatusCodeKey]); err == nil && code >= 500 {
+		return OTLPStatus{Code: otlpStatusError}
+	}
+	return OTLPStatus{Code: otlpStatusUnset}
+}
+
+// toOTLPKeyValue creates an attribute from a label, typed like span tags
+func toOTLPKeyValue(key string, value string) OTLPKeyValue {
+	kv := OTLPKeyValue{Key: key}
+	switch v := getTypedTagValue(value).(type) {
+	case bool:
+		kv.Value.BoolValue = &v
+	case int64:
+		i := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &i
+	case float64:
+		kv.Value.DoubleValue = &v
+	default:
+		kv.Value.StringValue = &value
+	}
+	return kv
+}
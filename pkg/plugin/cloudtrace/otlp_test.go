@@ -0,0 +1,157 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudtrace_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/trace/apiv1/tracepb"
+	"github.com/GoogleCloudPlatform/cloud-trace-data-source-plugin/pkg/plugin/cloudtrace"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestToOTLP(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1700000000, 0)
+	trace := &tracepb.Trace{
+		TraceId: "0123456789ABCDEF0123456789ABCDEF",
+		Spans: []*tracepb.TraceSpan{
+			{
+				SpanId:    1,
+				Name:      "/checkout",
+				Kind:      tracepb.TraceSpan_RPC_SERVER,
+				StartTime: timestamppb.New(start),
+				EndTime:   timestamppb.New(start.Add(time.Second)),
+				Labels:    map[string]string{"service.name": "frontend", "/http/status_code": "503"},
+			},
+			{
+				SpanId:       255,
+				ParentSpanId: 1,
+				Name:         "GetCart",
+				StartTime:    timestamppb.New(start),
+				EndTime:      timestamppb.New(start.Add(time.Millisecond)),
+				Labels: map[string]string{
+					"service.name":            "cart",
+					"span.kind":               "producer",
+					"otel.status_code":        "ERROR",
+					"otel.status_description": "cart missing",
+					"retry":                   "true",
+					"size":                    "3",
+					"ratio":                   "0.5",
+				},
+			},
+		},
+	}
+
+	result, err := json.Marshal(cloudtrace.ToOTLP(trace, cloudtrace.ServiceNameOTELFirst))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"resourceSpans": [
+		{
+			"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "cart"}}]},
+			"scopeSpans": [{"spans": [{
+				"traceId": "0123456789abcdef0123456789abcdef",
+				"spanId": "00000000000000ff",
+				"parentSpanId": "0000000000000001",
+				"name": "GetCart",
+				"kind": 4,
+				"startTimeUnixNano": "1700000000000000000",
+				"endTimeUnixNano": "1700000000001000000",
+				"attributes": [
+					{"key": "otel.status_code", "value": {"stringValue": "ERROR"}},
+					{"key": "otel.status_description", "value": {"stringValue": "cart missing"}},
+					{"key": "ratio", "value": {"doubleValue": 0.5}},
+					{"key": "retry", "value": {"boolValue": true}},
+					{"key": "service.name", "value": {"stringValue": "cart"}},
+					{"key": "size", "value": {"intValue": "3"}},
+					{"key": "span.kind", "value": {"stringValue": "producer"}}
+				],
+				"status": {"code": 2, "message": "cart missing"}
+			}]}]
+		},
+		{
+			"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "frontend"}}]},
+			"scopeSpans": [{"spans": [{
+				"traceId": "0123456789abcdef0123456789abcdef",
+				"spanId": "0000000000000001",
+				"name": "/checkout",
+				"kind": 2,
+				"startTimeUnixNano": "1700000000000000000",
+				"endTimeUnixNano": "1700000001000000000",
+				"attributes": [
+					{"key": "/http/status_code", "value": {"intValue": "503"}},
+					{"key": "service.name", "value": {"stringValue": "frontend"}}
+				],
+				"status": {"code": 2}
+			}]}]
+		}
+	]}`, string(result))
+}
+
+func TestToOTLP_SpanKindAndStatus(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		span           *tracepb.TraceSpan
+		expectedKind   int
+		expectedStatus cloudtrace.OTLPStatus
+	}{
+		{
+			name:         "Unspecified",
+			span:         &tracepb.TraceSpan{},
+			expectedKind: 0,
+		},
+		{
+			name:         "RPC client",
+			span:         &tracepb.TraceSpan{Kind: tracepb.TraceSpan_RPC_CLIENT},
+			expectedKind: 3,
+		},
+		{
+			name:         "Kind takes precedence over the label",
+			span:         &tracepb.TraceSpan{Kind: tracepb.TraceSpan_RPC_SERVER, Labels: map[string]string{"span.kind": "client"}},
+			expectedKind: 2,
+		},
+		{
+			name:         "Internal label",
+			span:         &tracepb.TraceSpan{Labels: map[string]string{"span.kind": "INTERNAL"}},
+			expectedKind: 1,
+		},
+		{
+			name:           "OK status",
+			span:           &tracepb.TraceSpan{Labels: map[string]string{"otel.status_code": "OK", "/http/status_code": "500"}},
+			expectedStatus: cloudtrace.OTLPStatus{Code: 1},
+		},
+		{
+			name:           "Client error HTTP status is unset",
+			span:           &tracepb.TraceSpan{Labels: map[string]string{"/http/status_code": "404"}},
+			expectedStatus: cloudtrace.OTLPStatus{Code: 0},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := cloudtrace.ToOTLP(&tracepb.Trace{Spans: []*tracepb.TraceSpan{tc.span}}, cloudtrace.ServiceNameOTELFirst)
+
+			require.Len(t, result.ResourceSpans, 1)
+			span := result.ResourceSpans[0].ScopeSpans[0].Spans[0]
+			require.Equal(t, tc.expectedKind, span.Kind)
+			require.Equal(t, tc.expectedStatus, span.Status)
+		})
+	}
+}
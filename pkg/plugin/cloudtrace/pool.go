@@ -0,0 +1,99 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudtrace
+
+import (
+	"sync"
+)
+
+// sharedTraceServices holds the trace API connections shared between Clients
+var sharedTraceServices = newTraceServicePool()
+
+// traceServicePool shares trace services between Clients with the same key,
+// closing each one only once every Client using it has been closed
+type traceServicePool struct {
+	mu       sync.Mutex
+	services map[string]*pooledTraceService
+}
+
+// pooledTraceService is a shared trace service and how many Clients use it
+type pooledTraceService struct {
+	service traceService
+	refs    int
+}
+
+func newTraceServicePool() *traceServicePool {
+	return &traceServicePool{
+		services: map[string]*pooledTraceService{},
+	}
+}
+
+// acquire returns the trace service for key, using create to make it if
+// there isn't one yet. Closing the returned service releases it
+func (p *traceServicePool) acquire(key string, create func() (traceService, error)) (traceService, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pooled, ok := p.services[key]
+	if !ok {
+		service, err := create()
+		if err != nil {
+			return nil, err
+		}
+		pooled = &pooledTraceService{service: service}
+		p.services[key] = pooled
+	}
+	pooled.refs++
+
+	return &sharedTraceService{
+		traceService: pooled.service,
+		release: func() error {
+			return p.release(key, pooled)
+		},
+	}, nil
+}
+
+// release drops a reference to a pooled service, closing it if it was the last one
+func (p *traceServicePool) release(key string, pooled *pooledTraceService) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pooled.refs--
+	if pooled.refs > 0 {
+		return nil
+	}
+
+	if p.services[key] == pooled {
+		delete(p.services, key)
+	}
+	return pooled.service.Close()
+}
+
+// sharedTraceService is a Client's handle on a pooled trace service
+type sharedTraceService struct {
+	traceService
+	release func() error
+	once    sync.Once
+}
+
+// Close releases the handle, only closing the underlying service
+// once all handles on it are closed
+func (s *sharedTraceService) Close() error {
+	var err error
+	s.once.Do(func() {
+		err = s.release()
+	})
+	return err
+}
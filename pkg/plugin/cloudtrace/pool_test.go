@@ -0,0 +1,68 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudtrace
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceServicePool(t *testing.T) {
+	pool := newTraceServicePool()
+	created := []*fakeTraceService{}
+	create := func() (traceService, error) {
+		service := &fakeTraceService{}
+		created = append(created, service)
+		return service, nil
+	}
+
+	// Identical keys reuse the same service
+	first, err := pool.acquire("creds", create)
+	require.NoError(t, err)
+	second, err := pool.acquire("creds", create)
+	require.NoError(t, err)
+	require.Len(t, created, 1)
+
+	// Different keys get their own service
+	other, err := pool.acquire("other creds", create)
+	require.NoError(t, err)
+	require.Len(t, created, 2)
+
+	// Closing one user, even repeatedly, doesn't close the shared service
+	require.NoError(t, first.Close())
+	require.NoError(t, first.Close())
+	require.Equal(t, 0, created[0].closed)
+
+	// Closing the last user closes it
+	require.NoError(t, second.Close())
+	require.Equal(t, 1, created[0].closed)
+	require.NoError(t, other.Close())
+	require.Equal(t, 1, created[1].closed)
+
+	// A closed service isn't reused
+	third, err := pool.acquire("creds", create)
+	require.NoError(t, err)
+	require.Len(t, created, 3)
+	require.NoError(t, third.Close())
+}
+
+func TestClientSettings_PoolKey(t *testing.T) {
+	require.Equal(t, "creds", newClientSettings(nil).poolKey("creds"))
+	require.Equal(t, newClientSettings(nil).poolKey("creds"),
+		newClientSettings([]ClientOption{WithSharedConnection()}).poolKey("creds"))
+	require.NotEqual(t, newClientSettings(nil).poolKey("creds"),
+		newClientSettings(nil).poolKey("other creds"))
+}
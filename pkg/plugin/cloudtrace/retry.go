@@ -0,0 +1,102 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudtrace
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	defaultProjectsRetryAttempts = 3
+	defaultProjectsRetryDuration = time.Second * 10
+	retryInitialBackoff          = time.Millisecond * 250
+	retryMaxBackoff              = time.Second * 4
+)
+
+// retryPolicy retries requests failing with transient errors, with exponential backoff.
+// Retries stop after maxAttempts attempts, or when the next would start after maxDuration
+type retryPolicy struct {
+	maxAttempts int
+	maxDuration time.Duration
+	now         func() time.Time
+	// sleep waits for the backoff, or returns early with an error when ctx is done
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newRetryPolicy(maxAttempts int, maxDuration time.Duration) *retryPolicy {
+	return &retryPolicy{
+		maxAttempts: maxAttempts,
+		maxDuration: maxDuration,
+		now:         time.Now,
+		sleep:       sleepContext,
+	}
+}
+
+// do calls fn until it succeeds, fails with an error that isn't transient, or the
+// attempts or duration run out, returning its last error. A nil policy calls fn once
+func (p *retryPolicy) do(ctx context.Context, name string, fn func() error) error {
+	if p == nil {
+		return fn()
+	}
+
+	start := p.now()
+	backoff := retryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryable(err) || attempt >= p.maxAttempts {
+			return err
+		}
+		if p.now().Add(backoff).Sub(start) > p.maxDuration {
+			return err
+		}
+
+		log.DefaultLogger.Debug("Retrying request", "request", name, "attempt", attempt, "backoff", backoff.String(), "error", err)
+		if sleepErr := p.sleep(ctx, backoff); sleepErr != nil {
+			return err
+		}
+		backoff *= 2
+		if backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// isRetryable reports whether an error is transient: rate limiting, a server error,
+// or the request timing out
+func isRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+	}
+	return isDownstreamError(err)
+}
+
+// sleepContext waits for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudtrace
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	resourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// newTestRetryPolicy returns a retry policy whose sleeps advance a fake clock, recording the backoffs
+func newTestRetryPolicy(maxAttempts int, maxDuration time.Duration) (*retryPolicy, *[]time.Duration) {
+	now := time.Now()
+	backoffs := []time.Duration{}
+	policy := newRetryPolicy(maxAttempts, maxDuration)
+	policy.now = func() time.Time { return now }
+	policy.sleep = func(_ context.Context, d time.Duration) error {
+		backoffs = append(backoffs, d)
+		now = now.Add(d)
+		return nil
+	}
+	return policy, &backoffs
+}
+
+func TestRetryPolicy(t *testing.T) {
+	transientErr := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "unavailable"}
+
+	t.Run("Success on retry", func(t *testing.T) {
+		policy, backoffs := newTestRetryPolicy(5, time.Minute)
+		calls := 0
+		err := policy.do(context.Background(), "test", func() error {
+			calls++
+			if calls < 3 {
+				return transientErr
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, calls)
+		require.Equal(t, []time.Duration{250 * time.Millisecond, 500 * time.Millisecond}, *backoffs)
+	})
+
+	t.Run("Gives up after the maximum attempts", func(t *testing.T) {
+		policy, _ := newTestRetryPolicy(3, time.Minute)
+		calls := 0
+		err := policy.do(context.Background(), "test", func() error {
+			calls++
+			return transientErr
+		})
+		require.Equal(t, transientErr, err)
+		require.Equal(t, 3, calls)
+	})
+
+	t.Run("Gives up after the maximum duration", func(t *testing.T) {
+		// The backoffs of 250ms and 500ms fit in a second, the next 1s doesn't
+		policy, backoffs := newTestRetryPolicy(10, time.Second)
+		calls := 0
+		err := policy.do(context.Background(), "test", func() error {
+			calls++
+			return transientErr
+		})
+		require.Equal(t, transientErr, err)
+		require.Equal(t, 3, calls)
+		require.Len(t, *backoffs, 2)
+	})
+
+	t.Run("Backoff is capped", func(t *testing.T) {
+		policy, backoffs := newTestRetryPolicy(8, time.Minute)
+		_ = policy.do(context.Background(), "test", func() error { return transientErr })
+		require.Equal(t, retryMaxBackoff, (*backoffs)[len(*backoffs)-1])
+	})
+
+	t.Run("Non-transient errors aren't retried", func(t *testing.T) {
+		policy, _ := newTestRetryPolicy(5, time.Minute)
+		calls := 0
+		permissionErr := &googleapi.Error{Code: http.StatusForbidden, Message: "permission denied"}
+		err := policy.do(context.Background(), "test", func() error {
+			calls++
+			return permissionErr
+		})
+		require.Equal(t, permissionErr, err)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("Cancelled context stops retrying", func(t *testing.T) {
+		policy := newRetryPolicy(5, time.Minute)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		calls := 0
+		err := policy.do(ctx, "test", func() error {
+			calls++
+			return transientErr
+		})
+		require.Equal(t, transientErr, err)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("Nil policy calls once", func(t *testing.T) {
+		var policy *retryPolicy
+		calls := 0
+		err := policy.do(context.Background(), "test", func() error {
+			calls++
+			return transientErr
+		})
+		require.Equal(t, transientErr, err)
+		require.Equal(t, 1, calls)
+	})
+}
+
+func TestListProjects_Retry(t *testing.T) {
+	transientErr := &googleapi.Error{Code: http.StatusTooManyRequests, Message: "rate limited"}
+
+	t.Run("Success on retry", func(t *testing.T) {
+		service := &fakeProjectService{
+			projects: []*resourcemanager.Project{{ProjectId: "active", LifecycleState: "ACTIVE"}},
+			err:      transientErr,
+			failures: 2,
+		}
+		policy, _ := newTestRetryPolicy(3, time.Minute)
+		client := &Client{rClient: service, projectsRetry: policy}
+
+		projects, err := client.ListProjects(context.Background(), &ProjectsQuery{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"active"}, projects)
+		require.Equal(t, 3, service.calls)
+	})
+
+	t.Run("Gives up", func(t *testing.T) {
+		service := &fakeProjectService{err: transientErr}
+		policy, _ := newTestRetryPolicy(3, time.Minute)
+		client := &Client{rClient: service, projectsRetry: policy}
+
+		_, err := client.ListProjects(context.Background(), &ProjectsQuery{})
+		require.True(t, errors.Is(err, transientErr))
+		require.Equal(t, 3, service.calls)
+	})
+
+	t.Run("No retry", func(t *testing.T) {
+		service := &fakeProjectService{err: transientErr}
+		policy, _ := newTestRetryPolicy(3, time.Minute)
+		client := &Client{rClient: service, projectsRetry: policy}
+
+		_, err := client.ListProjects(context.Background(), &ProjectsQuery{NoRetry: true})
+		require.True(t, errors.Is(err, transientErr))
+		require.Equal(t, 1, service.calls)
+	})
+}
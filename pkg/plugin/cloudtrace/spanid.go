@@ -0,0 +1,67 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudtrace
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SpanID is a span ID, which the v1 API represents as a uint64 and the v2 API and OTEL
+// as a 16 character hex string. Both representations convert to the same SpanID
+type SpanID uint64
+
+// ParseSpanID parses a span ID in either representation. IDs prefixed with 0x are hex.
+// Otherwise, 16 character IDs are hex like v2 API span IDs, unless they're all digits
+// without a leading zero, which is how a 16 digit decimal v1 API span ID is written.
+// Anything else is a decimal v1 API span ID
+func ParseSpanID(id string) (SpanID, error) {
+	digits, base := id, 10
+	if strings.HasPrefix(id, "0x") || strings.HasPrefix(id, "0X") {
+		digits, base = id[2:], 16
+	} else if len(id) == 16 && !isDecimalSpanID(id) {
+		base = 16
+	}
+	parsed, err := strconv.ParseUint(digits, base, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid span ID %q: %w", id, err)
+	}
+	return SpanID(parsed), nil
+}
+
+// isDecimalSpanID reports whether id is written like a v1 API span ID: decimal digits
+// without leading zeros
+func isDecimalSpanID(id string) bool {
+	if id == "" || id[0] == '0' {
+		return false
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the span ID in decimal, as shown in span frames
+func (id SpanID) String() string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// Hex returns the span ID as a 16 character hex string, like v2 API and OTEL span IDs
+func (id SpanID) Hex() string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
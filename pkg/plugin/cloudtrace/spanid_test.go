@@ -0,0 +1,101 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudtrace_test
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-trace-data-source-plugin/pkg/plugin/cloudtrace"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSpanID(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		id            string
+		expected      cloudtrace.SpanID
+		expectedError bool
+	}{
+		{
+			name:     "Numeric v1 span ID",
+			id:       "12345678901234567890",
+			expected: cloudtrace.SpanID(12345678901234567890),
+		},
+		{
+			name:     "Hex v2 span ID",
+			id:       "ab54a98ceb1f0ad2",
+			expected: cloudtrace.SpanID(0xab54a98ceb1f0ad2),
+		},
+		{
+			name:     "Hex v2 span ID with leading zeros",
+			id:       "000000000000004a",
+			expected: cloudtrace.SpanID(74),
+		},
+		{
+			name:     "16 digit numeric v1 span ID",
+			id:       "1234567890123456",
+			expected: cloudtrace.SpanID(1234567890123456),
+		},
+		{
+			name:     "Hex span ID with 0x prefix",
+			id:       "0x1234567890123456",
+			expected: cloudtrace.SpanID(0x1234567890123456),
+		},
+		{
+			name:     "Short numeric span ID",
+			id:       "74",
+			expected: cloudtrace.SpanID(74),
+		},
+		{
+			name:          "Invalid hex span ID",
+			id:            "zz54a98ceb1f0ad2",
+			expectedError: true,
+		},
+		{
+			name:          "Empty span ID",
+			id:            "",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			id, err := cloudtrace.ParseSpanID(tc.id)
+			if tc.expectedError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, id)
+		})
+	}
+}
+
+func TestSpanID_Representations(t *testing.T) {
+	t.Parallel()
+
+	// The numeric and hex forms of an ID are the same span ID
+	numeric, err := cloudtrace.ParseSpanID("74")
+	require.NoError(t, err)
+	hex, err := cloudtrace.ParseSpanID("000000000000004a")
+	require.NoError(t, err)
+	require.Equal(t, numeric, hex)
+
+	require.Equal(t, "74", hex.String())
+	require.Equal(t, "000000000000004a", numeric.Hex())
+	require.Equal(t, "0", cloudtrace.SpanID(0).String())
+}
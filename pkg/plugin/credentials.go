@@ -0,0 +1,172 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/cloud-trace-data-source-plugin/pkg/plugin/cloudtrace"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// serviceAccounts caches the service account JSON created for each datasource
+var serviceAccounts = newServiceAccountCache()
+
+// serviceAccountCache holds the latest service account JSON created for each
+// datasource, so creating its instance again with unchanged settings doesn't
+// rebuild it. Each datasource keeps only its latest entry, which is replaced once
+// its settings or private key change, and removed when its instance is disposed
+// so private keys aren't kept for datasources that changed or were deleted
+type serviceAccountCache struct {
+	mu      sync.Mutex
+	entries map[string]serviceAccountCacheEntry
+}
+
+// serviceAccountCacheEntry is a service account JSON and the hash of what it was created from
+type serviceAccountCacheEntry struct {
+	hash           string
+	serviceAccount []byte
+}
+
+func newServiceAccountCache() *serviceAccountCache {
+	return &serviceAccountCache{
+		entries: map[string]serviceAccountCacheEntry{},
+	}
+}
+
+// get returns the cached service account JSON of a datasource, if it was created from the same hash
+func (c *serviceAccountCache) get(datasourceUID string, hash string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[datasourceUID]
+	if !ok || entry.hash != hash {
+		return nil, false
+	}
+	return append([]byte{}, entry.serviceAccount...), true
+}
+
+// set caches the service account JSON of a datasource, replacing any previous entry
+func (c *serviceAccountCache) set(datasourceUID string, hash string, serviceAccount []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[datasourceUID] = serviceAccountCacheEntry{
+		hash:           hash,
+		serviceAccount: append([]byte{}, serviceAccount...),
+	}
+}
+
+// remove removes the cached service account JSON of a datasource
+func (c *serviceAccountCache) remove(datasourceUID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, datasourceUID)
+}
+
+// serviceAccountHash hashes everything the service account JSON is created from
+func serviceAccountHash(conf config, privateKey string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		conf.DefaultProject,
+		conf.ClientEmail,
+		conf.TokenURI,
+		privateKey,
+	}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// errUnknownCredentialRef is returned for queries referencing a credential set that isn't configured
+var errUnknownCredentialRef = errors.New("unknown credential set")
+
+// credentialSets holds the extra service accounts a datasource can read traces with,
+// e.g. to read traces from projects in another organization. A client is created
+// for each set the first time a query references it, then reused
+type credentialSets struct {
+	mu              sync.Mutex
+	serviceAccounts map[string][]byte
+	clients         map[string]cloudtrace.API
+	newClient       func(ctx context.Context, serviceAccount []byte) (cloudtrace.API, error)
+}
+
+// newCredentialSets parses the credential sets from the secure JSON data,
+// where they're stored as a JSON object of service account JSON keyed by name
+func newCredentialSets(conf config, secureJSONData map[string]string) (*credentialSets, error) {
+	sets := &credentialSets{
+		serviceAccounts: map[string][]byte{},
+		clients:         map[string]cloudtrace.API{},
+		newClient: func(ctx context.Context, serviceAccount []byte) (cloudtrace.API, error) {
+			return cloudtrace.NewClient(ctx, serviceAccount, conf.clientOptions()...)
+		},
+	}
+
+	raw := secureJSONData[credentialSetsKey]
+	if raw == "" {
+		return sets, nil
+	}
+
+	var serviceAccounts map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &serviceAccounts); err != nil {
+		return nil, fmt.Errorf("unmarshal credential sets: %w", err)
+	}
+	for ref, serviceAccount := range serviceAccounts {
+		sets.serviceAccounts[ref] = serviceAccount
+	}
+	return sets, nil
+}
+
+// client returns the client for the named credential set, creating it if needed.
+// Clients outlive the query that creates them, so they aren't created with its context,
+// which their token sources would keep using to refresh tokens
+func (c *credentialSets) client(ref string) (cloudtrace.API, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client, ok := c.clients[ref]; ok {
+		return client, nil
+	}
+
+	serviceAccount, ok := c.serviceAccounts[ref]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnknownCredentialRef, ref)
+	}
+
+	client, err := c.newClient(context.Background(), serviceAccount)
+	if err != nil {
+		return nil, fmt.Errorf("create client for credential set %s: %w", ref, err)
+	}
+	c.clients[ref] = client
+	return client, nil
+}
+
+// close closes every client created for the credential sets
+func (c *credentialSets) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for ref, client := range c.clients {
+		if err := client.Close(); err != nil {
+			log.DefaultLogger.Error("failed closing client", "credentialSet", ref, "error", err)
+		}
+	}
+	c.clients = map[string]cloudtrace.API{}
+}
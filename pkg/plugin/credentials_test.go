@@ -0,0 +1,93 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-trace-data-source-plugin/pkg/plugin/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetServiceAccountJSON_Cache(t *testing.T) {
+	defer func(original *serviceAccountCache) {
+		serviceAccounts = original
+	}(serviceAccounts)
+	serviceAccounts = newServiceAccountCache()
+
+	conf := config{DefaultProject: "p", ClientEmail: "e", TokenURI: "u", datasourceUID: "uid"}
+	secureJSONData := map[string]string{privateKeyKey: "key"}
+
+	serviceAccount, err := getServiceAccountJSON(context.Background(), conf, secureJSONData)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type":"service_account","project_id":"p","private_key":"key","client_email":"e","token_uri":"u"}`, string(serviceAccount))
+
+	// Replace the cached entry to tell whether it's used
+	hash := serviceAccountHash(conf, "key")
+	serviceAccounts.set("uid", hash, []byte(`{"cached":true}`))
+
+	serviceAccount, err = getServiceAccountJSON(context.Background(), conf, secureJSONData)
+	require.NoError(t, err)
+	require.Equal(t, `{"cached":true}`, string(serviceAccount))
+
+	// A changed private key invalidates the cached entry
+	serviceAccount, err = getServiceAccountJSON(context.Background(), conf, map[string]string{privateKeyKey: "new key"})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type":"service_account","project_id":"p","private_key":"new key","client_email":"e","token_uri":"u"}`, string(serviceAccount))
+
+	// Only the latest entry of each datasource is kept
+	_, ok := serviceAccounts.get("uid", hash)
+	require.False(t, ok)
+	_, ok = serviceAccounts.get("uid", serviceAccountHash(conf, "new key"))
+	require.True(t, ok)
+
+	// Changed settings also invalidate it
+	changedConf := conf
+	changedConf.ClientEmail = "other"
+	serviceAccount, err = getServiceAccountJSON(context.Background(), changedConf, map[string]string{privateKeyKey: "new key"})
+	require.NoError(t, err)
+	require.Contains(t, string(serviceAccount), `"client_email":"other"`)
+}
+
+func TestDispose_RemovesCachedServiceAccount(t *testing.T) {
+	defer func(original *serviceAccountCache) {
+		serviceAccounts = original
+	}(serviceAccounts)
+	serviceAccounts = newServiceAccountCache()
+	serviceAccounts.set("uid", "hash", []byte(`{"private_key":"key"}`))
+	serviceAccounts.set("other", "hash", []byte(`{"private_key":"other key"}`))
+
+	client := mocks.NewAPI(t)
+	client.On("Close").Return(nil)
+	ds := &CloudTraceDatasource{client: client, conf: config{datasourceUID: "uid"}}
+	ds.Dispose()
+
+	// Only the disposed datasource's private key is removed
+	_, ok := serviceAccounts.get("uid", "hash")
+	require.False(t, ok)
+	_, ok = serviceAccounts.get("other", "hash")
+	require.True(t, ok)
+}
+
+func TestNewCredentialSets(t *testing.T) {
+	credentials, err := newCredentialSets(config{}, map[string]string{})
+	require.NoError(t, err)
+	_, err = credentials.client("missing")
+	require.ErrorIs(t, err, errUnknownCredentialRef)
+
+	_, err = newCredentialSets(config{}, map[string]string{credentialSetsKey: "not json"})
+	require.ErrorContains(t, err, "unmarshal credential sets")
+}
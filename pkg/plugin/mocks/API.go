@@ -91,13 +91,36 @@ func (_m *API) GetTrace(_a0 context.Context, _a1 *cloudtrace.TraceQuery) (*trace
 	return r0, r1
 }
 
-// ListProjects provides a mock function with given fields: _a0
-func (_m *API) ListProjects(_a0 context.Context) ([]string, error) {
-	ret := _m.Called(_a0)
+// GetTraces provides a mock function with given fields: _a0, _a1
+func (_m *API) GetTraces(_a0 context.Context, _a1 *cloudtrace.TracesBatchQuery) ([]*trace.Trace, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 []*trace.Trace
+	if rf, ok := ret.Get(0).(func(context.Context, *cloudtrace.TracesBatchQuery) []*trace.Trace); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*trace.Trace)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *cloudtrace.TracesBatchQuery) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListProjects provides a mock function with given fields: _a0, _a1
+func (_m *API) ListProjects(_a0 context.Context, _a1 *cloudtrace.ProjectsQuery) ([]string, error) {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 []string
-	if rf, ok := ret.Get(0).(func(context.Context) []string); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, *cloudtrace.ProjectsQuery) []string); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]string)
@@ -105,8 +128,8 @@ func (_m *API) ListProjects(_a0 context.Context) ([]string, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
-		r1 = rf(_a0)
+	if rf, ok := ret.Get(1).(func(context.Context, *cloudtrace.ProjectsQuery) error); ok {
+		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -115,17 +138,24 @@ func (_m *API) ListProjects(_a0 context.Context) ([]string, error) {
 }
 
 // TestConnection provides a mock function with given fields: ctx, projectID
-func (_m *API) TestConnection(ctx context.Context, projectID string) error {
+func (_m *API) TestConnection(ctx context.Context, projectID string) (int, error) {
 	ret := _m.Called(ctx, projectID)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context, string) int); ok {
 		r0 = rf(ctx, projectID)
 	} else {
-		r0 = ret.Error(0)
+		r0 = ret.Get(0).(int)
 	}
 
-	return r0
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, projectID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
 type mockConstructorTestingTNewAPI interface {
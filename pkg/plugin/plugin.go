@@ -20,8 +20,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/trace/apiv1/tracepb"
@@ -31,20 +33,83 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 // Make sure CloudTraceDatasource implements required interfaces
 var (
-	_                     backend.QueryDataHandler      = (*CloudTraceDatasource)(nil)
-	_                     backend.CheckHealthHandler    = (*CloudTraceDatasource)(nil)
-	_                     instancemgmt.InstanceDisposer = (*CloudTraceDatasource)(nil)
-	errMissingCredentials                               = errors.New("missing credentials")
+	_                         backend.QueryDataHandler      = (*CloudTraceDatasource)(nil)
+	_                         backend.CheckHealthHandler    = (*CloudTraceDatasource)(nil)
+	_                         instancemgmt.InstanceDisposer = (*CloudTraceDatasource)(nil)
+	errMissingCredentials                                   = errors.New("missing credentials")
+	errInvalidEstimateRequest                               = errors.New("invalid estimate request")
+	errMissingProjectIDs                                    = errors.New("missing projectIds")
+	errNoTracesFound                                        = errors.New("no traces found")
+	errNonErrorStatus                                       = errors.New("errors queries only match 5xx statuses")
+
+	// accessSecret reads a Secret Manager secret, replaced in tests
+	accessSecret = cloudtrace.AccessSecret
+
+	// timeNow is the current time, replaced in tests
+	timeNow = time.Now
+
+	// gceDefaultProject reads the project from the GCE metadata server, replaced in tests
+	gceDefaultProject = utils.GCEDefaultProject
+
+	// defaultLatencyBucketsMs are the latency histogram bucket boundaries of queries without their own
+	defaultLatencyBucketsMs = []float64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
 )
 
 const (
 	privateKeyKey     = "privateKey"
+	credentialSetsKey = "credentialSets"
 	gceAuthentication = "gce"
 	jwtAuthentication = "jwt"
+	latencyUnitAuto   = "auto"
+	// spanFrameNameTraceName names span frames by their trace name rather than trace ID
+	spanFrameNameTraceName = "traceName"
+
+	defaultOutlierStdDevs = 2.0
+	defaultTracesLimit    = 100
+	keepaliveTimeout      = time.Second * 20
+
+	// defaultMaxRecvMsgSizeMB raises the gRPC default of 4MB, which large traces exceed
+	defaultMaxRecvMsgSizeMB = 32
+
+	// gceMetadataTimeout is how long creating a data source waits for the GCE metadata server,
+	// which is unreachable (or slow) outside GCE
+	gceMetadataTimeout = time.Second * 3
+
+	// metadataTracesLimit and metadataTimeWindow are the recent traces label keys and methods are read from
+	metadataTracesLimit = 50
+	metadataTimeWindow  = time.Hour
+
+	// estimateSampleLimit is the number of traces listed to estimate a query's result size,
+	// and estimateWarningThreshold the estimated number of traces that's warned about
+	estimateSampleLimit      = 100
+	estimateWarningThreshold = 10000
+	// errorsFilter is the Cloud Trace API filter of errors queries, the equivalent of
+	// Status:5 matching any 5xx HTTP status code
+	errorsFilter = "/http/status_code:5"
+	// clockSkewNoticeMaxSpans is the most span IDs listed in a clock skew notice
+	clockSkewNoticeMaxSpans = 5
+	// projectsHealthConcurrency is the most projects tested at once by the projectsHealth resource
+	projectsHealthConcurrency = 8
+	// defaultMaxFrameCells is the most cells (rows times fields) of a span or traces table frame,
+	// so a pathological query can't build frames larger than the backend's memory
+	defaultMaxFrameCells = 5000000
+	// tracesTableFieldCount is the number of fields of the traces table
+	tracesTableFieldCount = 6
+	// traceLinkTraceIDPlaceholder and traceLinkProjectIDPlaceholder are replaced in trace link templates
+	traceLinkTraceIDPlaceholder   = "{traceId}"
+	traceLinkProjectIDPlaceholder = "{projectId}"
+
+	// serviceAccountDomain is the email domain of user-managed service accounts, after their project
+	serviceAccountDomain = ".iam.gserviceaccount.com"
+
+	// otlpResourcePrefix is the resource path prefix of traces converted to OTLP JSON, followed by the trace ID
+	otlpResourcePrefix = "otlp/"
 )
 
 // config is the fields parsed from the front end
@@ -55,6 +120,227 @@ type config struct {
 	TokenURI                    string `json:"tokenUri"`
 	ServiceAccountToImpersonate string `json:"serviceAccountToImpersonate"`
 	UsingImpersonation          bool   `json:"usingImpersonation"`
+	// LatencyUnit is "auto" to scale the table latency unit to the results, otherwise ms is used
+	LatencyUnit string `json:"latencyUnit"`
+	// SpanFrameName is "traceName" to name trace span frames by the name of the trace's root
+	// span (as in the traces table), for panels keyed by frame name. Otherwise the trace ID is used
+	SpanFrameName string `json:"spanFrameName"`
+	// SecretManagerResource is a Secret Manager secret holding the service account JSON,
+	// used instead of the uploaded private key when set
+	SecretManagerResource string `json:"secretManagerResource"`
+	// OutlierStdDevs is how many standard deviations above the mean a span's
+	// duration must be to be flagged as an outlier
+	OutlierStdDevs float64 `json:"outlierStdDevs"`
+	// KeepaliveSeconds is the interval of gRPC keepalive pings to the trace API, disabled if unset
+	KeepaliveSeconds int `json:"keepaliveSeconds"`
+	// MaxRecvMsgSizeMB is the largest trace API response in megabytes, 32 if unset
+	MaxRecvMsgSizeMB int `json:"maxRecvMsgSizeMB"`
+	// Region queries the regional trace API endpoint of a region (e.g. "europe-west4")
+	// for traces stored there for data residency, rather than the global endpoint
+	Region string `json:"region"`
+	// RequestReason is sent with every GCP request and recorded in Cloud Audit Logs,
+	// to attribute the plugin's requests
+	RequestReason string `json:"requestReason"`
+	// ProjectsRetryAttempts is the most attempts at listing projects when Resource Manager
+	// fails with transient errors, 3 if unset
+	ProjectsRetryAttempts int `json:"projectsRetryAttempts"`
+	// DefaultOrderBy is the trace order used when a query doesn't set one
+	DefaultOrderBy string `json:"defaultOrderBy"`
+	// DefaultFilter is query text applied to every traces query, overridden by
+	// query filters with the same key
+	DefaultFilter string `json:"defaultFilter"`
+	// DefaultQueryText pre-populates the query text of new queries, and is used
+	// by queries with no query text
+	DefaultQueryText string `json:"defaultQueryText"`
+	// MaxFilterTerms is the maximum number of filter parts allowed in query text
+	MaxFilterTerms int `json:"maxFilterTerms"`
+	// SharedConnection shares the trace API connection with other datasources using the same credentials
+	SharedConnection bool `json:"sharedConnection"`
+	// ServiceNamePrecedence is "otel" (default), "gae" or "concat", choosing the
+	// service name of spans with both OTEL and GAE service labels
+	ServiceNamePrecedence string `json:"serviceNamePrecedence"`
+	// PageSize is the page size of trace list requests, otherwise based on the query limit
+	PageSize int32 `json:"pageSize"`
+	// MaxTimeRangeHours is the longest time range queried for traces, longer ranges are
+	// shortened to protect API quota. Unlimited if unset
+	MaxTimeRangeHours int `json:"maxTimeRangeHours"`
+	// MaxLookbackHours is how far back the traces table can query, earlier start times
+	// are moved forward to protect API quota. Unlimited if unset
+	MaxLookbackHours int `json:"maxLookbackHours"`
+	// ServiceTagPrefixes are label key prefixes grouped with the service tags of spans,
+	// in addition to the OTEL and GAE service prefixes
+	ServiceTagPrefixes []string `json:"serviceTagPrefixes"`
+	// DefaultLimit is the number of traces listed when a query has no max data points
+	DefaultLimit int64 `json:"defaultLimit"`
+	// TagInclude are glob patterns of the label keys shown as span tags, all labels if empty
+	TagInclude []string `json:"tagInclude"`
+	// TagExclude are glob patterns of label keys not shown as span tags, applied after TagInclude
+	TagExclude []string `json:"tagExclude"`
+	// ClampNegativeDurations shows spans ending before they start (from clock skew) as
+	// lasting zero ms, rather than with a negative duration
+	ClampNegativeDurations bool `json:"clampNegativeDurations"`
+	// CollapseRetries collapses consecutive sibling spans with the same name and service,
+	// like retries, into one span of a trace tagged with their count
+	CollapseRetries bool `json:"collapseRetries"`
+	// ExcludeServices are services, like noisy sidecars, whose spans are dropped from traces.
+	// Their children are shown under the nearest kept ancestor
+	ExcludeServices []string `json:"excludeServices"`
+	// HealthCheckWindowDays and HealthCheckPageSize widen the test query of the health
+	// check, for projects without recent traces. 30 days and 1 trace if unset
+	HealthCheckWindowDays int   `json:"healthCheckWindowDays"`
+	HealthCheckPageSize   int32 `json:"healthCheckPageSize"`
+	// HealthCheckAllowNoTraces passes the health check when the connection works but
+	// the test query finds no traces
+	HealthCheckAllowNoTraces bool `json:"healthCheckAllowNoTraces"`
+	// HealthCheckProject is the project the health check queries, rather than the default project
+	HealthCheckProject string `json:"healthCheckProject"`
+	// HealthCheckTimeoutSeconds is how long the health check waits for the test query, 15 if unset
+	HealthCheckTimeoutSeconds int `json:"healthCheckTimeoutSeconds"`
+	// LabelDisplayMap maps span label keys to the keys their tags are shown with,
+	// e.g. "/http/url" to "http.url". Values are unchanged
+	LabelDisplayMap map[string]string `json:"labelDisplayMap"`
+	// MaxTagsPerSpan limits the tags of each span, for spans with hundreds of labels. The first
+	// label keys alphabetically are kept, with a "_truncated_tags" tag counting the rest
+	MaxTagsPerSpan int `json:"maxTagsPerSpan"`
+	// SpanFieldOrder lists span frame fields to emit first, in that order, for panels
+	// needing a different order. Fields not listed follow in their default order
+	SpanFieldOrder []string `json:"spanFieldOrder"`
+	// ErrorOnEmpty fails trace queries returning no traces, or a trace with no spans, so
+	// broken instrumentation is noticed. Otherwise they return an empty frame
+	ErrorOnEmpty bool `json:"errorOnEmpty"`
+	// TraceLinkTemplate is the URL of an external link from each trace ID of the traces table, like
+	// another tracing UI, with {traceId} replaced by the trace ID and {projectId} by its project
+	TraceLinkTemplate string `json:"traceLinkTemplate"`
+	// MaxFrameCells is the most cells (rows times fields) of a span or traces table frame,
+	// beyond which rows are dropped with a notice. Unset uses the default
+	MaxFrameCells int `json:"maxFrameCells"`
+	// DebugMode attaches the raw trace to span frames for diagnosing mapping issues
+	DebugMode bool `json:"debugMode"`
+
+	// datasourceUID and datasourceName identify the datasource, for links back to it
+	datasourceUID  string
+	datasourceName string
+}
+
+// clientOptions returns the optional Client settings from the config
+func (c config) clientOptions() []cloudtrace.ClientOption {
+	opts := []cloudtrace.ClientOption{}
+	if c.KeepaliveSeconds > 0 {
+		opts = append(opts, cloudtrace.WithKeepalive(keepalive.ClientParameters{
+			Time:                time.Duration(c.KeepaliveSeconds) * time.Second,
+			Timeout:             keepaliveTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+	if c.SharedConnection {
+		opts = append(opts, cloudtrace.WithSharedConnection())
+	}
+	if c.PageSize > 0 {
+		opts = append(opts, cloudtrace.WithPageSize(c.PageSize))
+	}
+	if c.MaxTimeRangeHours > 0 {
+		opts = append(opts, cloudtrace.WithMaxTimeRange(time.Duration(c.MaxTimeRangeHours)*time.Hour))
+	}
+	maxRecvMsgSizeMB := c.MaxRecvMsgSizeMB
+	if maxRecvMsgSizeMB <= 0 {
+		maxRecvMsgSizeMB = defaultMaxRecvMsgSizeMB
+	}
+	opts = append(opts, cloudtrace.WithMaxRecvMsgSize(maxRecvMsgSizeMB*1024*1024))
+	if c.HealthCheckWindowDays > 0 || c.HealthCheckPageSize > 0 {
+		opts = append(opts, cloudtrace.WithConnectionTest(time.Duration(c.HealthCheckWindowDays)*24*time.Hour, c.HealthCheckPageSize))
+	}
+	if c.HealthCheckTimeoutSeconds > 0 {
+		opts = append(opts, cloudtrace.WithConnectionTestTimeout(time.Duration(c.HealthCheckTimeoutSeconds)*time.Second))
+	}
+	if c.RequestReason != "" {
+		opts = append(opts, cloudtrace.WithRequestReason(c.RequestReason))
+	}
+	if c.ProjectsRetryAttempts > 0 {
+		opts = append(opts, cloudtrace.WithProjectsRetryAttempts(c.ProjectsRetryAttempts))
+	}
+	if c.Region != "" {
+		opts = append(opts, cloudtrace.WithRegion(c.Region))
+	}
+	return opts
+}
+
+// setImpersonationDefaultProject defaults the default project to the project of the
+// impersonated service account, when impersonating with no default project set
+func (c *config) setImpersonationDefaultProject() {
+	if c.DefaultProject != "" || !c.UsingImpersonation {
+		return
+	}
+	if project, ok := projectFromServiceAccountEmail(c.ServiceAccountToImpersonate); ok {
+		c.DefaultProject = project
+	}
+}
+
+// setGCEDefaultProject defaults the default project to the project Grafana runs in, from
+// the GCE metadata server, when using GCE authentication with no default project set.
+// Outside GCE the metadata server is unreachable, and the default project is left empty
+// after at most gceMetadataTimeout
+func (c *config) setGCEDefaultProject(ctx context.Context) {
+	if c.DefaultProject != "" || c.AuthType != gceAuthentication {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, gceMetadataTimeout)
+	defer cancel()
+	project, err := gceDefaultProject(ctx, "")
+	if err != nil {
+		log.DefaultLogger.Debug("couldn't read the default project from GCE metadata", "error", err)
+		return
+	}
+	c.DefaultProject = project
+}
+
+// projectFromServiceAccountEmail returns the project of a user-managed service account,
+// from its email in the form [name]@[project].iam.gserviceaccount.com
+func projectFromServiceAccountEmail(email string) (string, bool) {
+	parts := strings.Split(strings.TrimSpace(email), "@")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", false
+	}
+	project := strings.TrimSuffix(parts[1], serviceAccountDomain)
+	if project == parts[1] || project == "" || strings.Contains(project, ".") {
+		return "", false
+	}
+	return project, true
+}
+
+// maxLookback returns how far back the traces table can query, or 0 if unlimited
+func (c config) maxLookback() time.Duration {
+	return time.Duration(c.MaxLookbackHours) * time.Hour
+}
+
+// tracesLimit returns the number of traces to list for a query with the given max data points
+func (c config) tracesLimit(maxDataPoints int64) int64 {
+	if maxDataPoints > 0 {
+		return maxDataPoints
+	}
+	if c.DefaultLimit > 0 {
+		return c.DefaultLimit
+	}
+	return defaultTracesLimit
+}
+
+// outlierStdDevs returns the configured outlier threshold, or the default if unset
+func (c config) outlierStdDevs() float64 {
+	if c.OutlierStdDevs <= 0 {
+		return defaultOutlierStdDevs
+	}
+	return c.OutlierStdDevs
+}
+
+// frameRowLimit returns the most rows of a frame with the given number of fields within the cell budget
+func (c config) frameRowLimit(fieldCount int) int {
+	maxCells := c.MaxFrameCells
+	if maxCells <= 0 {
+		maxCells = defaultMaxFrameCells
+	}
+	if fieldCount <= 0 {
+		return maxCells
+	}
+	return maxCells / fieldCount
 }
 
 // toServiceAccountJSON creates the serviceAccountJSON bytes from the config fields
@@ -78,6 +364,39 @@ type serviceAccountJSON struct {
 	TokenURI    string `json:"token_uri"`
 }
 
+// getServiceAccountJSON returns the service account credentials, read from
+// Secret Manager if configured, otherwise built from the uploaded private key.
+// Secrets are always read so rotations are picked up, but built credentials are cached
+func getServiceAccountJSON(ctx context.Context, conf config, secureJSONData map[string]string) ([]byte, error) {
+	if conf.SecretManagerResource != "" {
+		serviceAccount, err := accessSecret(ctx, conf.SecretManagerResource)
+		if err != nil {
+			return nil, fmt.Errorf("access secret %s: %w", conf.SecretManagerResource, err)
+		}
+		if !json.Valid(serviceAccount) {
+			return nil, fmt.Errorf("secret %s does not contain service account JSON", conf.SecretManagerResource)
+		}
+		return serviceAccount, nil
+	}
+
+	privateKey, ok := secureJSONData[privateKeyKey]
+	if !ok || privateKey == "" {
+		return nil, errMissingCredentials
+	}
+
+	hash := serviceAccountHash(conf, privateKey)
+	if serviceAccount, ok := serviceAccounts.get(conf.datasourceUID, hash); ok {
+		return serviceAccount, nil
+	}
+
+	serviceAccount, err := conf.toServiceAccountJSON(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("create credentials: %w", err)
+	}
+	serviceAccounts.set(conf.datasourceUID, hash, serviceAccount)
+	return serviceAccount, nil
+}
+
 // NewCloudTraceDatasource creates a new datasource instance.
 func NewCloudTraceDatasource(settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
 	var conf config
@@ -85,41 +404,58 @@ func NewCloudTraceDatasource(settings backend.DataSourceInstanceSettings) (insta
 		return nil, fmt.Errorf("unmarshal: %w", err)
 	}
 
+	conf.datasourceUID = settings.UID
+	conf.datasourceName = settings.Name
+
+	if _, err := orderFields(createDefaultSpanFields(nil, conf), conf.SpanFieldOrder); err != nil {
+		return nil, fmt.Errorf("invalid span field order: %w", err)
+	}
+	if conf.Region != "" {
+		if _, err := cloudtrace.RegionalEndpoint(conf.Region); err != nil {
+			return nil, err
+		}
+	}
+
 	if conf.AuthType == "" {
 		conf.AuthType = jwtAuthentication
 	}
+	conf.setImpersonationDefaultProject()
+	conf.setGCEDefaultProject(context.TODO())
 
 	var client_err error
 	var client *cloudtrace.Client
 
 	if conf.AuthType == jwtAuthentication {
-		privateKey, ok := settings.DecryptedSecureJSONData[privateKeyKey]
-		if !ok || privateKey == "" {
-			return nil, errMissingCredentials
-		}
-
-		serviceAccount, err := conf.toServiceAccountJSON(privateKey)
+		serviceAccount, err := getServiceAccountJSON(context.TODO(), conf, settings.DecryptedSecureJSONData)
 		if err != nil {
-			return nil, fmt.Errorf("create credentials: %w", err)
+			return nil, err
 		}
 		if conf.UsingImpersonation {
-			client, client_err = cloudtrace.NewClientWithImpersonation(context.TODO(), serviceAccount, conf.ServiceAccountToImpersonate)
+			client, client_err = cloudtrace.NewClientWithImpersonation(context.TODO(), serviceAccount, conf.ServiceAccountToImpersonate, conf.clientOptions()...)
 		} else {
-			client, client_err = cloudtrace.NewClient(context.TODO(), serviceAccount)
+			client, client_err = cloudtrace.NewClient(context.TODO(), serviceAccount, conf.clientOptions()...)
 		}
 	} else {
 		if conf.UsingImpersonation {
-			client, client_err = cloudtrace.NewClientWithImpersonation(context.TODO(), nil, conf.ServiceAccountToImpersonate)
+			client, client_err = cloudtrace.NewClientWithImpersonation(context.TODO(), nil, conf.ServiceAccountToImpersonate, conf.clientOptions()...)
 		} else {
-			client, client_err = cloudtrace.NewClientWithGCE(context.TODO())
+			client, client_err = cloudtrace.NewClientWithGCE(context.TODO(), conf.clientOptions()...)
 		}
 	}
 	if client_err != nil {
 		return nil, client_err
 	}
 
+	credentials, err := newCredentialSets(conf, settings.DecryptedSecureJSONData)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
 	return &CloudTraceDatasource{
-		client: client,
+		client:      client,
+		conf:        conf,
+		credentials: credentials,
 	}, nil
 }
 
@@ -127,6 +463,9 @@ func NewCloudTraceDatasource(settings backend.DataSourceInstanceSettings) (insta
 // its health and has streaming skills.
 type CloudTraceDatasource struct {
 	client cloudtrace.API
+	conf   config
+	// credentials are the extra credential sets queries can select with CredentialRef
+	credentials *credentialSets
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
@@ -136,21 +475,42 @@ func (d *CloudTraceDatasource) Dispose() {
 	if err := d.client.Close(); err != nil {
 		log.DefaultLogger.Error("failed closing client", "error", err)
 	}
+	if d.credentials != nil {
+		d.credentials.close()
+	}
+	serviceAccounts.remove(d.conf.datasourceUID)
+}
+
+// withCredentials returns a copy of the datasource that queries with the named credential set
+func (d *CloudTraceDatasource) withCredentials(ref string) (*CloudTraceDatasource, error) {
+	if d.credentials == nil {
+		return nil, fmt.Errorf("%w: %s", errUnknownCredentialRef, ref)
+	}
+	client, err := d.credentials.client(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	scoped := *d
+	scoped.client = client
+	return &scoped, nil
 }
 
 // CallResource fetches some resource from GCP using the data source's credentials
 //
-// Currently only projects are fetched, other requests receive a 404
+// Currently only projects, the GCE default project and the filter schema
+// are fetched, other requests receive a 404
 func (d *CloudTraceDatasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
 	// log.DefaultLogger.Info("CallResource called")
 
 	var body []byte
 
-	// Right now we only support calls to `gceDefaultProject` and `/projects`
+	// Right now we only support calls to `gceDefaultProject`, `filterSchema`, `metadata`, `estimate`,
+	// `otlp/{traceId}`, `projectsHealth`, `defaults` and `/projects`
 	resource := req.Path
 
 	if resource == "gceDefaultProject" {
-		proj, err := utils.GCEDefaultProject(ctx, "")
+		proj, err := gceDefaultProject(ctx, "")
 		if err != nil {
 			log.DefaultLogger.Warn("problem getting GCE default project", "error", err)
 		}
@@ -161,18 +521,120 @@ func (d *CloudTraceDatasource) CallResource(ctx context.Context, req *backend.Ca
 				Body:   []byte(`Unable to create response`),
 			})
 		}
+	} else if resource == "filterSchema" {
+		var err error
+		body, err = json.Marshal(cloudtrace.GetFilterSchema())
+		if err != nil {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusInternalServerError,
+				Body:   []byte(`Unable to create response`),
+			})
+		}
+	} else if resource == "metadata" {
+		metadata, err := d.getMetadata(ctx, req.URL)
+		if err != nil {
+			log.DefaultLogger.Warn("problem getting metadata", "error", err)
+		}
+		body, err = json.Marshal(metadata)
+		if err != nil {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusInternalServerError,
+				Body:   []byte(`Unable to create response`),
+			})
+		}
+	} else if resource == "estimate" {
+		estimate, err := d.getTraceEstimate(ctx, req.URL)
+		if errors.Is(err, errInvalidEstimateRequest) {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusBadRequest,
+				Body:   []byte(err.Error()),
+			})
+		}
+		if err != nil {
+			log.DefaultLogger.Warn("problem estimating traces", "error", err)
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusInternalServerError,
+				Body:   []byte(`Unable to estimate traces`),
+			})
+		}
+		body, err = json.Marshal(estimate)
+		if err != nil {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusInternalServerError,
+				Body:   []byte(`Unable to create response`),
+			})
+		}
+	} else if resource == "defaults" {
+		var err error
+		body, err = json.Marshal(queryDefaults{QueryText: d.conf.DefaultQueryText})
+		if err != nil {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusInternalServerError,
+				Body:   []byte(`Unable to create response`),
+			})
+		}
+	} else if resource == "projectsHealth" {
+		health, err := d.getProjectsHealth(ctx, req.URL)
+		if err != nil {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusBadRequest,
+				Body:   []byte(err.Error()),
+			})
+		}
+		body, err = json.Marshal(health)
+		if err != nil {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusInternalServerError,
+				Body:   []byte(`Unable to create response`),
+			})
+		}
+	} else if strings.HasPrefix(resource, otlpResourcePrefix) {
+		traceID := strings.TrimPrefix(resource, otlpResourcePrefix)
+		projectID := getParam(req.URL, "projectId")
+		if projectID == "" {
+			projectID = d.conf.DefaultProject
+		}
+		if traceID == "" || projectID == "" {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusBadRequest,
+				Body:   []byte(`Missing trace or project ID`),
+			})
+		}
+
+		trace, err := d.client.GetTrace(ctx, &cloudtrace.TraceQuery{ProjectID: projectID, TraceID: traceID})
+		if err != nil {
+			log.DefaultLogger.Warn("problem getting trace", "error", err)
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusInternalServerError,
+				Body:   []byte(`Unable to get trace`),
+			})
+		}
+		body, err = json.Marshal(cloudtrace.ToOTLP(trace, cloudtrace.ServiceNamePrecedence(d.conf.ServiceNamePrecedence)))
+		if err != nil {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusInternalServerError,
+				Body:   []byte(`Unable to create response`),
+			})
+		}
 	} else if strings.ToLower(resource) != "projects" {
 		return sender.Send(&backend.CallResourceResponse{
 			Status: http.StatusNotFound,
 			Body:   []byte(`No such path`),
 		})
 	} else {
-		projects, err := d.client.ListProjects(ctx)
+		projects, err := d.client.ListProjects(ctx, &cloudtrace.ProjectsQuery{
+			IncludeDeleted: getBoolParam(req.URL, "includeDeleted"),
+		})
 		if err != nil {
 			log.DefaultLogger.Warn("problem listing projects", "error", err)
 		}
 
-		body, err = json.Marshal(projects)
+		// Tell the config page why there are no projects, rather than just returning none
+		if errors.Is(err, cloudtrace.ErrResourceManagerDisabled) {
+			body, err = json.Marshal(projectsHint{Projects: projects, Hint: cloudtrace.ResourceManagerDisabledHint})
+		} else {
+			body, err = json.Marshal(projects)
+		}
 		if err != nil {
 			return sender.Send(&backend.CallResourceResponse{
 				Status: http.StatusInternalServerError,
@@ -197,10 +659,21 @@ func (d *CloudTraceDatasource) QueryData(ctx context.Context, req *backend.Query
 	// create response struct
 	response := backend.NewQueryDataResponse()
 
+	// Log which user ran the queries for auditing
+	if user := req.PluginContext.User; user != nil {
+		ctx = cloudtrace.ContextWithUser(ctx, user.Login)
+	}
+
 	// loop over queries and execute them individually.
 	for _, q := range req.Queries {
 		res := d.query(ctx, req.PluginContext, q)
 
+		// The error message alone can't tell the query editor where the bad filter part is
+		var parseErr *cloudtrace.FilterParseError
+		if errors.As(res.Error, &parseErr) {
+			res.Frames = append(res.Frames, createFilterParseErrorFrame(q.RefID, parseErr))
+		}
+
 		// save the response in a hashmap
 		// based on with RefID as identifier
 		response.Responses[q.RefID] = res
@@ -209,6 +682,227 @@ func (d *CloudTraceDatasource) QueryData(ctx context.Context, req *backend.Query
 	return response, nil
 }
 
+// projectsHint is the projects response when projects can't be listed, explaining how to fix it
+type projectsHint struct {
+	Projects []string `json:"projects"`
+	Hint     string   `json:"hint"`
+}
+
+// metadata is the projects, and label keys and HTTP methods of a project,
+// returned together so the config page can load them in one request
+type metadata struct {
+	Projects  []string `json:"projects"`
+	LabelKeys []string `json:"labelKeys,omitempty"`
+	Methods   []string `json:"methods,omitempty"`
+}
+
+// getMetadata lists projects and, if the request URL has a projectId param, the
+// label keys and HTTP methods seen in that project's recent traces
+func (d *CloudTraceDatasource) getMetadata(ctx context.Context, rawURL string) (metadata, error) {
+	projects, err := d.client.ListProjects(ctx, &cloudtrace.ProjectsQuery{})
+	if err != nil {
+		return metadata{Projects: []string{}}, fmt.Errorf("list projects: %w", err)
+	}
+	result := metadata{Projects: projects}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return result, fmt.Errorf("parse url: %w", err)
+	}
+	projectID := u.Query().Get("projectId")
+	if projectID == "" {
+		return result, nil
+	}
+
+	now := time.Now()
+	traces, err := d.client.ListTraces(ctx, &cloudtrace.TracesQuery{
+		ProjectID: projectID,
+		Limit:     metadataTracesLimit,
+		TimeRange: cloudtrace.TimeRange{
+			From: now.Add(-metadataTimeWindow),
+			To:   now,
+		},
+		CompleteView: true,
+	})
+	if err != nil {
+		return result, fmt.Errorf("list traces: %w", err)
+	}
+	result.LabelKeys, result.Methods = cloudtrace.GetLabelKeysAndMethods(traces)
+
+	return result, nil
+}
+
+// queryDefaults are the values the query editor pre-populates new queries with
+type queryDefaults struct {
+	QueryText string `json:"queryText"`
+}
+
+// projectHealth is the result of testing the connection to a single project
+type projectHealth struct {
+	ProjectID string `json:"projectId"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+}
+
+// getProjectsHealth tests the connection to each project in the request URL's projectIds
+// param, which may be repeated or comma separated, concurrently
+func (d *CloudTraceDatasource) getProjectsHealth(ctx context.Context, rawURL string) ([]projectHealth, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+	projectIDs := []string{}
+	for _, value := range u.Query()["projectIds"] {
+		for _, projectID := range strings.Split(value, ",") {
+			if projectID = strings.TrimSpace(projectID); projectID != "" {
+				projectIDs = append(projectIDs, projectID)
+			}
+		}
+	}
+	if len(projectIDs) == 0 {
+		return nil, errMissingProjectIDs
+	}
+
+	results := make([]projectHealth, len(projectIDs))
+	sem := make(chan struct{}, projectsHealthConcurrency)
+	var wg sync.WaitGroup
+	for i, projectID := range projectIDs {
+		wg.Add(1)
+		go func(i int, projectID string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] = projectHealth{ProjectID: projectID, OK: true}
+			_, err := d.client.TestConnection(ctx, projectID)
+			if errors.Is(err, cloudtrace.ErrNoTraces) && d.conf.HealthCheckAllowNoTraces {
+				err = nil
+			}
+			if err != nil {
+				results[i] = projectHealth{ProjectID: projectID, Error: err.Error()}
+			}
+		}(i, projectID)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// traceEstimate is the estimated number of traces a query would return over its whole time range
+type traceEstimate struct {
+	EstimatedTraces int64 `json:"estimatedTraces"`
+	// Exact is whether every matching trace was listed, rather than extrapolated from a sample
+	Exact   bool   `json:"exact"`
+	Warning string `json:"warning,omitempty"`
+}
+
+// getTraceEstimate lists a sample of the newest traces matching the projectId and queryText
+// params between the from and to params (in epoch milliseconds, the last hour by default),
+// and extrapolates how many traces match over the whole time range
+func (d *CloudTraceDatasource) getTraceEstimate(ctx context.Context, rawURL string) (traceEstimate, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return traceEstimate{}, fmt.Errorf("%w: %s", errInvalidEstimateRequest, err)
+	}
+	params := u.Query()
+
+	projectID := params.Get("projectId")
+	if projectID == "" {
+		return traceEstimate{}, fmt.Errorf("%w: missing projectId", errInvalidEstimateRequest)
+	}
+
+	to := timeNow()
+	from := to.Add(-time.Hour)
+	if value := params.Get("from"); value != "" {
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return traceEstimate{}, fmt.Errorf("%w: invalid from %s", errInvalidEstimateRequest, value)
+		}
+		from = time.Unix(0, millis*int64(time.Millisecond))
+	}
+	if value := params.Get("to"); value != "" {
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return traceEstimate{}, fmt.Errorf("%w: invalid to %s", errInvalidEstimateRequest, value)
+		}
+		to = time.Unix(0, millis*int64(time.Millisecond))
+	}
+
+	q := queryModel{QueryText: params.Get("queryText")}
+	filter, err := d.getListTracesFilter(q)
+	if err != nil {
+		return traceEstimate{}, fmt.Errorf("%w: %s", errInvalidEstimateRequest, err)
+	}
+
+	timeRange := cloudtrace.TimeRange{From: from, To: to}
+	traces, err := d.client.ListTraces(ctx, &cloudtrace.TracesQuery{
+		ProjectID:    projectID,
+		Filter:       filter,
+		Limit:        estimateSampleLimit,
+		TimeRange:    timeRange,
+		CompleteView: listsCompleteTraces(q),
+	})
+	if err != nil {
+		return traceEstimate{}, fmt.Errorf("list traces: %w", err)
+	}
+	matches := int64(len(filterListedTraces(traces, q)))
+
+	return estimateTraceCount(traces, matches, estimateSampleLimit, timeRange), nil
+}
+
+// estimateTraceCount extrapolates the number of traces over a time range from a sample
+// of the newest traces in it, of which matches also match the filters applied after listing.
+// If the sample is smaller than the limit, it's every trace
+func estimateTraceCount(traces []*tracepb.Trace, matches int64, limit int64, timeRange cloudtrace.TimeRange) traceEstimate {
+	count := int64(len(traces))
+	if count < limit {
+		return traceEstimate{EstimatedTraces: matches, Exact: true}
+	}
+
+	// The sample covers the time from its oldest trace to the end of the range
+	var oldest time.Time
+	for _, t := range traces {
+		for _, s := range t.GetSpans() {
+			if s.GetStartTime() == nil {
+				continue
+			}
+			if start := s.GetStartTime().AsTime(); oldest.IsZero() || start.Before(oldest) {
+				oldest = start
+			}
+		}
+	}
+	sampled := timeRange.To.Sub(oldest)
+	if oldest.IsZero() || sampled < time.Millisecond {
+		sampled = time.Millisecond
+	}
+
+	estimate := traceEstimate{
+		EstimatedTraces: int64(float64(matches) * float64(timeRange.To.Sub(timeRange.From)) / float64(sampled)),
+	}
+	if estimate.EstimatedTraces < matches {
+		estimate.EstimatedTraces = matches
+	}
+	if estimate.EstimatedTraces > estimateWarningThreshold {
+		estimate.Warning = fmt.Sprintf("about %d traces match, consider a narrower filter or time range", estimate.EstimatedTraces)
+	}
+	return estimate
+}
+
+// getParam returns a query param of a resource request URL, or "" if it isn't set
+func getParam(rawURL string, param string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get(param)
+}
+
+// getBoolParam returns whether a resource request URL has a query param set to true
+func getBoolParam(rawURL string, param string) bool {
+	value, err := strconv.ParseBool(getParam(rawURL, param))
+	return err == nil && value
+}
+
 // queryModel is the fields needed to query from Grafana
 type queryModel struct {
 	TraceID       string `json:"traceId"`
@@ -216,6 +910,37 @@ type queryModel struct {
 	QueryType     string `json:"queryType"`
 	ProjectID     string `json:"projectId"`
 	MaxDataPoints int    `json:"MaxDataPoints"`
+	OrderBy       string `json:"orderBy"`
+	BypassCache   bool   `json:"bypassCache"`
+	// RawFilter sends QueryText to the Cloud Trace API as the filter without translating it
+	RawFilter bool `json:"rawFilter"`
+	// SpanFilter limits the spans of a trace to those matching it (and their ancestors).
+	// It's applied after fetching the trace, so the whole trace is still fetched
+	SpanFilter string `json:"spanFilter"`
+	// MinSpanDuration hides spans of a trace faster than it (keeping ancestors of slower spans),
+	// as a Go duration like "10ms"
+	MinSpanDuration string `json:"minSpanDuration"`
+	// SpanWindowFrom and SpanWindowTo limit the spans of a trace to those active during a window
+	// (keeping their ancestors), as Go durations like "1.5s" from the start of the trace.
+	// Either may be left out for a window open at that end
+	SpanWindowFrom string `json:"spanWindowFrom"`
+	SpanWindowTo   string `json:"spanWindowTo"`
+	// CredentialRef names the credential set to query with, instead of the datasource's own credentials
+	CredentialRef string `json:"credentialRef"`
+	// Sampled lists traces spread evenly across the time range instead of only the newest,
+	// at the cost of several API calls
+	Sampled bool `json:"sampled"`
+	// ErrorAttribution lists every span of each trace, so the error service of the traces
+	// table is the downstream service errors originate in rather than the root span's
+	ErrorAttribution bool `json:"errorAttribution"`
+	// MultiService only shows traces with spans from more than one service. Every span of
+	// each trace is listed to find them, and they're filtered after the query limit is applied
+	MultiService bool `json:"multiService"`
+	// LatencyBuckets are the ascending bucket boundaries of a latency histogram query, in milliseconds
+	LatencyBuckets []float64 `json:"latencyBuckets"`
+	// TraceIDs are the traces of a merged traces query, stitched into one waterfall, or of an
+	// exemplars query. For exemplars each may be a list of IDs, like an interpolated variable
+	TraceIDs []string `json:"traceIds"`
 }
 
 func (d *CloudTraceDatasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
@@ -227,6 +952,25 @@ func (d *CloudTraceDatasource) query(ctx context.Context, pCtx backend.PluginCon
 		return response
 	}
 
+	// The trace ID may be a pasted log line with the trace's project in it
+	if projectID, traceID := cloudtrace.ParseTraceReference(q.TraceID); projectID != "" {
+		q.ProjectID, q.TraceID = projectID, traceID
+	}
+
+	// Raw filters aren't in query text syntax, so never get the default query text
+	if strings.TrimSpace(q.QueryText) == "" && !q.RawFilter {
+		q.QueryText = d.conf.DefaultQueryText
+	}
+
+	if q.CredentialRef != "" {
+		scoped, err := d.withCredentials(q.CredentialRef)
+		if err != nil {
+			response.Error = err
+			return response
+		}
+		d = scoped
+	}
+
 	if q.QueryType == "traceID" && strings.TrimSpace(q.TraceID) != "" {
 		f, err := d.getTraceSpanFrame(ctx, q)
 		if err != nil {
@@ -237,41 +981,486 @@ func (d *CloudTraceDatasource) query(ctx context.Context, pCtx backend.PluginCon
 		response.Frames = append(response.Frames, f)
 	}
 
-	if q.QueryType == "" {
-		f, err := d.getTracesTableFrame(ctx, q, query)
+	if q.QueryType == "mergedTraces" && len(q.TraceIDs) > 0 {
+		f, err := d.getMergedTracesFrame(ctx, q)
 		if err != nil {
-			response.Error = fmt.Errorf("filter query: %w", err)
+			response.Error = fmt.Errorf("merged traces query: %w", err)
 			return response
 		}
 
 		response.Frames = append(response.Frames, f)
 	}
 
-	return response
-}
+	if q.QueryType == "exemplars" {
+		f, err := d.getExemplarsFrame(ctx, q)
+		if err != nil {
+			response.Error = fmt.Errorf("exemplars query: %w", err)
+			return response
+		}
 
-func (d *CloudTraceDatasource) getTraceSpanFrame(ctx context.Context, q queryModel) (*data.Frame, error) {
-	clientRequest := cloudtrace.TraceQuery{
-		ProjectID: q.ProjectID,
-		TraceID:   q.TraceID,
+		response.Frames = append(response.Frames, f)
 	}
 
-	trace, err := d.client.GetTrace(ctx, &clientRequest)
-	if err != nil {
-		return nil, err
-	}
+	if q.QueryType == "spanTree" && strings.TrimSpace(q.TraceID) != "" {
+		f, err := d.getSpanTreeFrame(ctx, q)
+		if err != nil {
+			response.Error = fmt.Errorf("span tree query: %w", err)
+			return response
+		}
 
-	f := createTraceSpanFrame(trace)
+		response.Frames = append(response.Frames, f)
+	}
 
-	return f, nil
-}
+	// Errors queries are filter queries that only match server errors
+	if q.QueryType == "" || q.QueryType == "errors" {
+		f, err := d.getTracesTableFrame(ctx, q, query)
+		if err != nil {
+			response.Error = fmt.Errorf("filter query: %w", err)
+			return response
+		}
+
+		response.Frames = append(response.Frames, f)
+	}
+
+	if q.QueryType == "serviceStats" {
+		f, err := d.getServiceStatsFrame(ctx, q, query)
+		if err != nil {
+			response.Error = fmt.Errorf("service stats query: %w", err)
+			return response
+		}
+
+		response.Frames = append(response.Frames, f)
+	}
+
+	if q.QueryType == "spansTable" {
+		f, err := d.getSpansTableFrame(ctx, q, query)
+		if err != nil {
+			response.Error = fmt.Errorf("spans table query: %w", err)
+			return response
+		}
+
+		response.Frames = append(response.Frames, f)
+	}
+
+	if q.QueryType == "latencyHistogram" {
+		f, err := d.getLatencyHistogramFrame(ctx, q, query)
+		if err != nil {
+			response.Error = fmt.Errorf("latency histogram query: %w", err)
+			return response
+		}
+
+		response.Frames = append(response.Frames, f)
+	}
+
+	if q.QueryType == "explain" {
+		f, err := d.getExplainFrame(q, query)
+		if err != nil {
+			response.Error = fmt.Errorf("explain query: %w", err)
+			return response
+		}
+
+		response.Frames = append(response.Frames, f)
+	}
+
+	if q.QueryType == "roots" {
+		f, err := d.getRootSpansFrame(ctx, q, query)
+		if err != nil {
+			response.Error = fmt.Errorf("root spans query: %w", err)
+			return response
+		}
+
+		response.Frames = append(response.Frames, f)
+	}
+
+	// Return the traces table and, if a trace is selected, its spans
+	// so Explore can drill in without re-querying
+	if q.QueryType == "tableAndTrace" {
+		f, err := d.getTracesTableFrame(ctx, q, query)
+		if err != nil {
+			response.Error = fmt.Errorf("filter query: %w", err)
+			return response
+		}
+
+		response.Frames = append(response.Frames, f)
+
+		if strings.TrimSpace(q.TraceID) != "" {
+			f, err := d.getTraceSpanFrame(ctx, q)
+			if err != nil {
+				response.Error = fmt.Errorf("trace query: %w", err)
+				return response
+			}
+
+			response.Frames = append(response.Frames, f)
+		}
+	}
+
+	return response
+}
+
+func (d *CloudTraceDatasource) getTraceSpanFrame(ctx context.Context, q queryModel) (*data.Frame, error) {
+	clientRequest := cloudtrace.TraceQuery{
+		ProjectID: q.ProjectID,
+		TraceID:   q.TraceID,
+	}
+
+	minSpanDuration, err := getMinSpanDuration(q)
+	if err != nil {
+		return nil, err
+	}
+	window, err := getSpanWindow(q)
+	if err != nil {
+		return nil, err
+	}
+
+	trace, err := d.client.GetTrace(ctx, &clientRequest)
+	if err != nil {
+		return nil, err
+	}
+	if d.conf.ErrorOnEmpty && len(trace.GetSpans()) == 0 {
+		return nil, fmt.Errorf("%w: trace %s has no spans", errNoTracesFound, q.TraceID)
+	}
+
+	f := createTraceSpanFrame(trace, d.conf, q.SpanFilter, minSpanDuration, window)
+
+	return f, nil
+}
+
+// getMergedTracesFrame fetches several traces and stitches them into one span frame under a
+// synthetic root span. If only some traces can be fetched, the rest are merged with a warning
+func (d *CloudTraceDatasource) getMergedTracesFrame(ctx context.Context, q queryModel) (*data.Frame, error) {
+	traceIDs := make([]string, 0, len(q.TraceIDs))
+	for _, traceID := range q.TraceIDs {
+		if traceID = strings.TrimSpace(traceID); traceID != "" {
+			traceIDs = append(traceIDs, traceID)
+		}
+	}
+	if len(traceIDs) == 0 {
+		return nil, errors.New("no trace IDs to merge")
+	}
+
+	minSpanDuration, err := getMinSpanDuration(q)
+	if err != nil {
+		return nil, err
+	}
+	window, err := getSpanWindow(q)
+	if err != nil {
+		return nil, err
+	}
+
+	traces, err := d.client.GetTraces(ctx, &cloudtrace.TracesBatchQuery{
+		ProjectID: q.ProjectID,
+		TraceIDs:  traceIDs,
+	})
+	if err != nil && len(traces) == 0 {
+		return nil, err
+	}
+
+	merged := cloudtrace.MergeTraces(traces)
+	if d.conf.ErrorOnEmpty && len(merged.GetSpans()) <= 1 {
+		return nil, fmt.Errorf("%w: traces %s have no spans", errNoTracesFound, strings.Join(traceIDs, ", "))
+	}
+
+	f := createTraceSpanFrame(merged, d.conf, q.SpanFilter, minSpanDuration, window)
+	if err != nil {
+		f.Meta.Notices = append(f.Meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     err.Error(),
+		})
+	}
+
+	return f, nil
+}
+
+// getExemplarsFrame fetches the traces of a metrics panel's exemplars and summarizes them in a
+// traces table, one row per trace. If only some traces can be fetched, the rest are shown with a warning
+func (d *CloudTraceDatasource) getExemplarsFrame(ctx context.Context, q queryModel) (*data.Frame, error) {
+	traceIDs := cloudtrace.ParseTraceIDs(strings.Join(q.TraceIDs, ","))
+	if len(traceIDs) == 0 {
+		return nil, errors.New("no exemplar trace IDs")
+	}
+
+	traces, err := d.client.GetTraces(ctx, &cloudtrace.TracesBatchQuery{
+		ProjectID: q.ProjectID,
+		TraceIDs:  traceIDs,
+	})
+	if err != nil && len(traces) == 0 {
+		return nil, err
+	}
+	if d.conf.ErrorOnEmpty && len(traces) == 0 {
+		return nil, errNoTracesFound
+	}
+
+	f := createTracesTableFrame(traces, q.ProjectID, d.conf)
+	if err != nil {
+		f.Meta.Notices = append(f.Meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     err.Error(),
+		})
+	}
+
+	return f, nil
+}
+
+// spanWindow is a time window within a trace, as offsets from its start. A zero To leaves it open ended
+type spanWindow struct {
+	From time.Duration
+	To   time.Duration
+}
+
+// isSet returns whether the window limits the spans of a trace at all
+func (w spanWindow) isSet() bool {
+	return w.From > 0 || w.To > 0
+}
+
+// getSpanWindow parses and validates the span window of a query, if it has one
+func getSpanWindow(q queryModel) (spanWindow, error) {
+	window := spanWindow{}
+	if q.SpanWindowFrom != "" {
+		from, err := time.ParseDuration(q.SpanWindowFrom)
+		if err != nil {
+			return window, fmt.Errorf("invalid span window start %s: %w", q.SpanWindowFrom, err)
+		}
+		if from < 0 {
+			return window, fmt.Errorf("invalid span window start %s: must not be negative", q.SpanWindowFrom)
+		}
+		window.From = from
+	}
+	if q.SpanWindowTo != "" {
+		to, err := time.ParseDuration(q.SpanWindowTo)
+		if err != nil {
+			return window, fmt.Errorf("invalid span window end %s: %w", q.SpanWindowTo, err)
+		}
+		if to <= window.From {
+			return window, fmt.Errorf("invalid span window end %s: must be after the start", q.SpanWindowTo)
+		}
+		window.To = to
+	}
+	return window, nil
+}
+
+// getMinSpanDuration parses the min span duration of a query, if it has one
+func getMinSpanDuration(q queryModel) (time.Duration, error) {
+	if q.MinSpanDuration == "" {
+		return 0, nil
+	}
+	minSpanDuration, err := time.ParseDuration(q.MinSpanDuration)
+	if err != nil {
+		return 0, fmt.Errorf("invalid min span duration %s: %w", q.MinSpanDuration, err)
+	}
+	return minSpanDuration, nil
+}
 
-func createTraceSpanFrame(trace *tracepb.Trace) *data.Frame {
+func createTraceSpanFrame(trace *tracepb.Trace, conf config, spanFilter string, minSpanDuration time.Duration, window spanWindow) *data.Frame {
 	// Create one frame for all trace/spans
-	f := data.NewFrame(trace.GetTraceId())
+	f := data.NewFrame(getSpanFrameName(trace, conf))
 	f.Meta = &data.FrameMeta{}
 	f.Meta.PreferredVisualization = data.VisTypeTrace
+	custom := map[string]interface{}{
+		"traceLatencyMs": float64(cloudtrace.GetTraceLatency(trace.GetSpans()).Microseconds()) / 1000,
+	}
+	// The raw trace can be large, so only include it when debugging
+	if conf.DebugMode {
+		rawTrace, err := protojson.Marshal(trace)
+		if err != nil {
+			log.DefaultLogger.Warn("failed marshaling raw trace", "error", err)
+		} else {
+			custom["rawTrace"] = json.RawMessage(rawTrace)
+		}
+	}
+	f.Meta.Custom = custom
+
+	// Partial traces can reference parent spans they don't have, which break the waterfall
+	allSpans, orphans := cloudtrace.AddMissingParents(trace.GetSpans())
+	if orphans > 0 {
+		f.Meta.Notices = append(f.Meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d spans have parent spans missing from the trace, shown as %q spans", orphans, cloudtrace.MissingSpanName),
+		})
+	}
+
+	// Filter spans client side, so the trace latency above is still of the whole trace
+	filteredSpans := cloudtrace.FilterSpans(allSpans, spanFilter, cloudtrace.ServiceNamePrecedence(conf.ServiceNamePrecedence))
+	filteredSpans = cloudtrace.FilterSpansByDuration(filteredSpans, minSpanDuration)
+	if window.isSet() {
+		// The window is relative to the start of the whole trace, not of the filtered spans
+		traceStart := cloudtrace.GetTraceStart(trace.GetSpans())
+		var windowEnd time.Time
+		if window.To > 0 {
+			windowEnd = traceStart.Add(window.To)
+		}
+		filteredSpans = cloudtrace.FilterSpansByWindow(filteredSpans, traceStart.Add(window.From), windowEnd)
+	}
+	filteredSpans = cloudtrace.ExcludeServices(filteredSpans, conf.ExcludeServices, cloudtrace.ServiceNamePrecedence(conf.ServiceNamePrecedence))
+	if conf.CollapseRetries {
+		filteredSpans = cloudtrace.CollapseRetries(filteredSpans, cloudtrace.ServiceNamePrecedence(conf.ServiceNamePrecedence))
+	}
+	if limit := conf.frameRowLimit(len(createDefaultSpanFields(nil, conf))); len(filteredSpans) > limit {
+		f.Meta.Notices = append(f.Meta.Notices, getTruncatedNotice(limit, len(filteredSpans), "spans", conf))
+		filteredSpans = cloudtrace.LimitSpans(filteredSpans, limit)
+	}
+	spans := make([]traceSpan, 0, len(filteredSpans))
+	for _, s := range filteredSpans {
+		spans = append(spans, traceSpan{traceID: trace.GetTraceId(), span: s})
+	}
+	f.Fields = createSpanFields(spans, conf)
+	if notice := getClockSkewNotice(filteredSpans); notice != nil {
+		f.Meta.Notices = append(f.Meta.Notices, *notice)
+	}
+
+	return f
+}
+
+// filterParseErrorMeta is the frame metadata of a query with a bad filter part in its query text
+type filterParseErrorMeta struct {
+	FilterParseError filterParseErrorDetails `json:"filterParseError"`
+}
+
+// filterParseErrorDetails locates the bad filter part, as a byte offset within the query text
+type filterParseErrorDetails struct {
+	Token    string `json:"token"`
+	Expected string `json:"expected"`
+	Position int    `json:"position"`
+}
+
+// createFilterParseErrorFrame creates an empty frame describing a filter parse error in its
+// metadata, so the query editor can highlight the bad filter part
+func createFilterParseErrorFrame(refID string, parseErr *cloudtrace.FilterParseError) *data.Frame {
+	f := data.NewFrame(refID)
+	f.Meta = &data.FrameMeta{
+		Custom: filterParseErrorMeta{
+			FilterParseError: filterParseErrorDetails{
+				Token:    parseErr.Token,
+				Expected: parseErr.Expected,
+				Position: parseErr.Position,
+			},
+		},
+		Notices: []data.Notice{{
+			Severity: data.NoticeSeverityError,
+			Text:     parseErr.Error(),
+		}},
+	}
+	return f
+}
+
+// getTruncatedNotice warns that a frame only has some of its rows, to keep it within the cell budget
+func getTruncatedNotice(shown int, total int, rows string, conf config) data.Notice {
+	maxCells := conf.MaxFrameCells
+	if maxCells <= 0 {
+		maxCells = defaultMaxFrameCells
+	}
+	return data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     fmt.Sprintf("Showing %d of %d %s, as frames are limited to %d cells", shown, total, rows, maxCells),
+	}
+}
+
+// getSpanFrameName returns the name of a trace's span frame: its trace ID, or if configured its
+// trace name, falling back to the trace ID if the trace has no spans to name it by
+func getSpanFrameName(trace *tracepb.Trace, conf config) string {
+	if conf.SpanFrameName != spanFrameNameTraceName {
+		return trace.GetTraceId()
+	}
+	root := cloudtrace.GetRootSpan(trace)
+	if root == nil {
+		return trace.GetTraceId()
+	}
+	if name := cloudtrace.GetTraceNameWithPrecedence(root, cloudtrace.ServiceNamePrecedence(conf.ServiceNamePrecedence)); name != "" {
+		return name
+	}
+	return trace.GetTraceId()
+}
+
+// getClockSkewNotice warns of clock skew between services if any spans start before their
+// parent, which makes the waterfall look wrong, listing the first few affected spans
+func getClockSkewNotice(spans []*tracepb.TraceSpan) *data.Notice {
+	skewed := cloudtrace.GetSkewedSpans(spans)
+	if len(skewed) == 0 {
+		return nil
+	}
+
+	ids := []string{}
+	for i, id := range skewed {
+		if i == clockSkewNoticeMaxSpans {
+			ids = append(ids, fmt.Sprintf("and %d more", len(skewed)-i))
+			break
+		}
+		ids = append(ids, cloudtrace.SpanID(id).String())
+	}
+	return &data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text: fmt.Sprintf("%d spans start before their parent span, likely due to clock skew between services: %s",
+			len(skewed), strings.Join(ids, ", ")),
+	}
+}
+
+// getSpanDuration returns the duration of a span in ms. Clock skew between services
+// can end spans before they start, which is logged, and clamped to zero if configured
+func getSpanDuration(traceID string, s *tracepb.TraceSpan, conf config) float64 {
+	duration := float64(s.GetEndTime().AsTime().UnixMicro()-s.GetStartTime().AsTime().UnixMicro()) / 1000
+	if duration >= 0 {
+		return duration
+	}
+
+	log.DefaultLogger.Warn("span ends before it starts, likely due to clock skew",
+		"traceID", traceID, "spanID", s.GetSpanId(), "skewMs", -duration, "clamped", conf.ClampNegativeDurations)
+	if conf.ClampNegativeDurations {
+		return 0
+	}
+	return duration
+}
+
+// traceSpan is a span along with the ID of the trace it belongs to
+type traceSpan struct {
+	traceID string
+	span    *tracepb.TraceSpan
+}
+
+// createSpanFields creates the fields of a trace visualization frame with a row for each span,
+// in the configured order
+func createSpanFields(spans []traceSpan, conf config) data.Fields {
+	fields := createDefaultSpanFields(spans, conf)
+	// The order is validated when the datasource is created
+	if ordered, err := orderFields(fields, conf.SpanFieldOrder); err == nil {
+		fields = ordered
+	}
+	return fields
+}
+
+// orderFields returns the fields with those named in order first, in that order,
+// followed by the rest in their original order. Unknown or repeated names are an error
+func orderFields(fields data.Fields, order []string) (data.Fields, error) {
+	if len(order) == 0 {
+		return fields, nil
+	}
+
+	byName := make(map[string]*data.Field, len(fields))
+	for _, field := range fields {
+		byName[field.Name] = field
+	}
+
+	ordered := make(data.Fields, 0, len(fields))
+	listed := make(map[string]bool, len(order))
+	for _, name := range order {
+		field, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %s", name)
+		}
+		if listed[name] {
+			return nil, fmt.Errorf("field %s is listed more than once", name)
+		}
+		listed[name] = true
+		ordered = append(ordered, field)
+	}
+	for _, field := range fields {
+		if !listed[field.Name] {
+			ordered = append(ordered, field)
+		}
+	}
+	return ordered, nil
+}
 
+// createDefaultSpanFields creates the span frame fields in their default order
+func createDefaultSpanFields(spans []traceSpan, conf config) data.Fields {
 	// Create one set of fields for all trace/spans
 	traceIDField := data.NewField("traceID", nil, []string{})
 	spanIDField := data.NewField("spanID", nil, []string{})
@@ -282,28 +1471,81 @@ func createTraceSpanFrame(trace *tracepb.Trace) *data.Frame {
 	startTimeField := data.NewField("startTime", nil, []time.Time{})
 	durationField := data.NewField("duration", nil, []float64{})
 	tagsField := data.NewField("tags", nil, []json.RawMessage{})
+	baggageTagsField := data.NewField("baggageTags", nil, []json.RawMessage{})
+	urlField := data.NewField("url", nil, []string{})
+	hostField := data.NewField("host", nil, []string{})
+	warningsField := data.NewField("warnings", nil, []int64{})
+	percentOfParentField := data.NewField("percentOfParent", nil, []*float64{})
+	onCriticalPathField := data.NewField("onCriticalPath", nil, []bool{})
+	selfTimeField := data.NewField("selfTime", nil, []float64{})
+	grpcStatusField := data.NewField("grpcStatus", nil, []string{})
+	messagingDestinationField := data.NewField("messagingDestination", nil, []string{})
+
+	// Parents are looked up by trace too, as spans may be from several traces
+	type spanKey struct {
+		traceID string
+		spanID  uint64
+	}
+	spansByKey := make(map[spanKey]*tracepb.TraceSpan, len(spans))
+	traceSpans := map[string][]*tracepb.TraceSpan{}
+	for _, ts := range spans {
+		spansByKey[spanKey{ts.traceID, ts.span.GetSpanId()}] = ts.span
+		traceSpans[ts.traceID] = append(traceSpans[ts.traceID], ts.span)
+	}
+	criticalPaths := make(map[string]map[uint64]bool, len(traceSpans))
+	selfTimes := make(map[string]map[uint64]time.Duration, len(traceSpans))
+	for traceID, s := range traceSpans {
+		criticalPaths[traceID] = cloudtrace.GetCriticalPath(s)
+		selfTimes[traceID] = cloudtrace.GetSelfTimes(s)
+	}
 
 	// Add values to each field for each span
-	for _, s := range trace.Spans {
-		serviceTags, spanTags, err := cloudtrace.GetTags(s)
+	durations := []float64{}
+	for _, ts := range spans {
+		s := ts.span
+		tagOptions := cloudtrace.TagOptions{
+			ServicePrefixes: conf.ServiceTagPrefixes,
+			Include:         conf.TagInclude,
+			Exclude:         conf.TagExclude,
+			DisplayKeys:     conf.LabelDisplayMap,
+			MaxTags:         conf.MaxTagsPerSpan,
+		}
+		serviceTags, spanTags, err := cloudtrace.GetTagsWithOptions(s, tagOptions)
 		if err != nil {
 			log.DefaultLogger.Warn("failed getting span tags", "error", err)
 			continue
 		}
+		baggageTags, err := cloudtrace.GetBaggageTags(s, tagOptions)
+		if err != nil {
+			log.DefaultLogger.Warn("failed getting span baggage tags", "error", err)
+			continue
+		}
 		tagsField.Append(spanTags)
 		serviceTagsField.Append(serviceTags)
+		baggageTagsField.Append(baggageTags)
 
-		traceIDField.Append(trace.GetTraceId())
-		spanIDField.Append(strconv.FormatUint(s.GetSpanId(), 10))
-		parentSpanIDField.Append(strconv.FormatUint(s.GetParentSpanId(), 10))
+		traceIDField.Append(ts.traceID)
+		spanIDField.Append(cloudtrace.SpanID(s.GetSpanId()).String())
+		parentSpanIDField.Append(cloudtrace.SpanID(s.GetParentSpanId()).String())
 		operationNameField.Append(cloudtrace.GetSpanOperationName(s))
-		serviceNameField.Append(cloudtrace.GetServiceName(s))
+		serviceNameField.Append(cloudtrace.GetServiceNameWithPrecedence(s, cloudtrace.ServiceNamePrecedence(conf.ServiceNamePrecedence)))
 		startTimeField.Append(s.GetStartTime().AsTime())
-		duration := float64(s.GetEndTime().AsTime().UnixMicro()-s.GetStartTime().AsTime().UnixMicro()) / 1000
+		duration := getSpanDuration(ts.traceID, s, conf)
 		durationField.Append(duration)
+		durations = append(durations, duration)
+		urlField.Append(cloudtrace.GetHTTPURL(s))
+		hostField.Append(cloudtrace.GetHTTPHost(s))
+		warningsField.Append(cloudtrace.GetWarningCount(s))
+		percentOfParentField.Append(getPercentOfParent(s, spansByKey[spanKey{ts.traceID, s.GetParentSpanId()}]))
+		onCriticalPathField.Append(criticalPaths[ts.traceID][s.GetSpanId()])
+		selfTimeField.Append(float64(selfTimes[ts.traceID][s.GetSpanId()].Microseconds()) / 1000)
+		grpcStatusField.Append(cloudtrace.GetGRPCStatus(s))
+		messagingDestinationField.Append(cloudtrace.GetMessagingDestination(s))
 	}
 
-	f.Fields = append(f.Fields,
+	outlierField := data.NewField("outlier", nil, cloudtrace.GetDurationOutliers(durations, conf.outlierStdDevs()))
+
+	return data.Fields{
 		traceIDField,
 		parentSpanIDField,
 		spanIDField,
@@ -311,40 +1553,563 @@ func createTraceSpanFrame(trace *tracepb.Trace) *data.Frame {
 		operationNameField,
 		serviceTagsField,
 		tagsField,
+		baggageTagsField,
 		startTimeField,
 		durationField,
+		outlierField,
+		urlField,
+		hostField,
+		warningsField,
+		percentOfParentField,
+		onCriticalPathField,
+		selfTimeField,
+		grpcStatusField,
+		messagingDestinationField,
+	}
+}
+
+// getPercentOfParent returns the duration of a span as a percentage of its parent's
+// duration, or nil if it has no parent in the trace or the parent has no duration
+func getPercentOfParent(s *tracepb.TraceSpan, parent *tracepb.TraceSpan) *float64 {
+	if parent == nil || s.GetParentSpanId() == 0 {
+		return nil
+	}
+	parentDuration := parent.GetEndTime().AsTime().Sub(parent.GetStartTime().AsTime())
+	if parentDuration <= 0 {
+		return nil
+	}
+	percent := float64(s.GetEndTime().AsTime().Sub(s.GetStartTime().AsTime())) / float64(parentDuration) * 100
+	return &percent
+}
+
+func (d *CloudTraceDatasource) getRootSpansFrame(ctx context.Context, q queryModel, dQuery backend.DataQuery) (*data.Frame, error) {
+	clientRequest, err := d.newTracesQuery(q, dQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	traces, err := d.listTraces(ctx, q, clientRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	f := createRootSpansFrame(traces, d.conf)
+
+	return f, nil
+}
+
+// createRootSpansFrame creates a trace visualization frame with a row
+// for the root span of each trace, in the same layout as a single trace
+func createRootSpansFrame(traces []*tracepb.Trace, conf config) *data.Frame {
+	f := data.NewFrame("roots")
+	f.Meta = &data.FrameMeta{}
+	f.Meta.PreferredVisualization = data.VisTypeTrace
+
+	spans := make([]traceSpan, 0, len(traces))
+	for _, t := range traces {
+		// Listed traces usually only contain their root span, but filters applied after
+		// listing may need every span, in no particular order
+		rootSpan := cloudtrace.GetRootSpan(t)
+		if rootSpan == nil {
+			log.DefaultLogger.Warn("failed getting trace spans", "traceID", t.TraceId)
+			continue
+		}
+		spans = append(spans, traceSpan{traceID: t.GetTraceId(), span: rootSpan})
+	}
+	f.Fields = createSpanFields(spans, conf)
+
+	return f
+}
+
+func (d *CloudTraceDatasource) getSpanTreeFrame(ctx context.Context, q queryModel) (*data.Frame, error) {
+	clientRequest := cloudtrace.TraceQuery{
+		ProjectID: q.ProjectID,
+		TraceID:   q.TraceID,
+	}
+
+	trace, err := d.client.GetTrace(ctx, &clientRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	f := createSpanTreeFrame(trace, d.conf)
+
+	return f, nil
+}
+
+func createSpanTreeFrame(trace *tracepb.Trace, conf config) *data.Frame {
+	// Create one frame for all spans, ordered so each span follows its parent
+	f := data.NewFrame(trace.GetTraceId())
+	f.Meta = &data.FrameMeta{}
+	f.Meta.PreferredVisualization = data.VisTypeTable
+
+	traceIDField := data.NewField("traceID", nil, []string{})
+	spanIDField := data.NewField("spanID", nil, []string{})
+	parentSpanIDField := data.NewField("parentSpanID", nil, []string{})
+	operationNameField := data.NewField("operationName", nil, []string{})
+	serviceNameField := data.NewField("serviceName", nil, []string{})
+	startTimeField := data.NewField("startTime", nil, []time.Time{})
+	durationField := data.NewField("duration", nil, []float64{})
+	depthField := data.NewField("depth", nil, []int64{})
+
+	for _, node := range cloudtrace.GetSpanTree(trace.GetSpans()) {
+		s := node.Span
+		traceIDField.Append(trace.GetTraceId())
+		spanIDField.Append(cloudtrace.SpanID(s.GetSpanId()).String())
+		parentSpanIDField.Append(cloudtrace.SpanID(s.GetParentSpanId()).String())
+		operationNameField.Append(cloudtrace.GetSpanOperationName(s))
+		serviceNameField.Append(cloudtrace.GetServiceNameWithPrecedence(s, cloudtrace.ServiceNamePrecedence(conf.ServiceNamePrecedence)))
+		startTimeField.Append(s.GetStartTime().AsTime())
+		durationField.Append(getSpanDuration(trace.GetTraceId(), s, conf))
+		depthField.Append(int64(node.Depth))
+	}
+
+	f.Fields = append(f.Fields,
+		traceIDField,
+		parentSpanIDField,
+		spanIDField,
+		serviceNameField,
+		operationNameField,
+		startTimeField,
+		durationField,
+		depthField,
 	)
 
 	return f
 }
 
 func (d *CloudTraceDatasource) getTracesTableFrame(ctx context.Context, q queryModel, dQuery backend.DataQuery) (*data.Frame, error) {
-	filter, err := cloudtrace.GetListTracesFilter(q.QueryText)
+	clientRequest, notice, err := d.newTracesTableQuery(q, dQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	traces, err := d.listTraces(ctx, q, clientRequest)
+	if err != nil {
+		return nil, err
+	}
+	if q.MultiService {
+		traces = cloudtrace.FilterMultiServiceTraces(traces, cloudtrace.ServiceNamePrecedence(d.conf.ServiceNamePrecedence))
+	}
+	if d.conf.ErrorOnEmpty && len(traces) == 0 {
+		return nil, errNoTracesFound
+	}
+
+	f := createTracesTableFrame(traces, q.ProjectID, d.conf)
+	if notice != nil {
+		f.Meta.Notices = append(f.Meta.Notices, *notice)
+	}
+
+	return f, nil
+}
+
+// newTracesTableQuery creates the client request listing the traces of a traces table query,
+// with its time range clamped to the maximum lookback (and a notice if it was), and listing
+// every span of each trace if the table needs them
+func (d *CloudTraceDatasource) newTracesTableQuery(q queryModel, dQuery backend.DataQuery) (*cloudtrace.TracesQuery, *data.Notice, error) {
+	clientRequest, err := d.newTracesQuery(q, dQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notice := clampLookback(clientRequest, d.conf.maxLookback(), timeNow())
+	if q.MultiService || q.ErrorAttribution {
+		clientRequest.CompleteView = true
+	}
+	return clientRequest, notice, nil
+}
+
+// listTraces lists the traces of a query's client request, keeping those matching the filters
+// of the query text that are applied after listing, so every query type honours them
+func (d *CloudTraceDatasource) listTraces(ctx context.Context, q queryModel, clientRequest *cloudtrace.TracesQuery) ([]*tracepb.Trace, error) {
+	traces, err := d.client.ListTraces(ctx, clientRequest)
+	if err != nil {
+		return nil, err
+	}
+	return filterListedTraces(traces, q), nil
+}
+
+// filterListedTraces returns the traces matching the filters of a query's text that the
+// Cloud Trace API can't apply, which getQueryFilter leaves out of the API filter
+func filterListedTraces(traces []*tracepb.Trace, q queryModel) []*tracepb.Trace {
+	if q.RawFilter {
+		return traces
+	}
+	if prefix, _ := cloudtrace.ExtractTracePrefix(q.QueryText); prefix != "" {
+		traces = cloudtrace.FilterTracesByPrefix(traces, prefix)
+	}
+	comparisons, _ := cloudtrace.ExtractComparisons(q.QueryText)
+	traces = cloudtrace.FilterTracesByComparisons(traces, comparisons)
+	spanNames, _ := cloudtrace.ExtractContainsSpan(q.QueryText)
+	return cloudtrace.FilterTracesByContainsSpan(traces, spanNames)
+}
+
+// listsCompleteTraces reports whether the filters of a query's text applied after listing
+// need every span of each trace: labels of every span are needed to compare them, and the
+// latency of the whole trace. Names of every span are needed to find spans other than the root span
+func listsCompleteTraces(q queryModel) bool {
+	if q.RawFilter {
+		return false
+	}
+	comparisons, _ := cloudtrace.ExtractComparisons(q.QueryText)
+	spanNames, _ := cloudtrace.ExtractContainsSpan(q.QueryText)
+	return len(comparisons) > 0 || len(spanNames) > 0
+}
+
+// clampLookback moves the start of a query's time range forward to at most maxLookback
+// before now, returning a notice for the user if it was moved. A maxLookback of 0 is unlimited
+func clampLookback(q *cloudtrace.TracesQuery, maxLookback time.Duration, now time.Time) *data.Notice {
+	if maxLookback <= 0 {
+		return nil
+	}
+	earliest := now.Add(-maxLookback)
+	if !q.TimeRange.From.Before(earliest) {
+		return nil
+	}
+
+	q.TimeRange.From = earliest
+	// Keep the range valid if it ends before the earliest start too
+	if q.TimeRange.To.Before(earliest) {
+		q.TimeRange.From = q.TimeRange.To
+	}
+	return &data.Notice{
+		Severity: data.NoticeSeverityInfo,
+		Text:     fmt.Sprintf("Traces are only queried from the last %s, as configured in the data source", maxLookback),
+	}
+}
+
+func (d *CloudTraceDatasource) getServiceStatsFrame(ctx context.Context, q queryModel, dQuery backend.DataQuery) (*data.Frame, error) {
+	clientRequest, err := d.newTracesQuery(q, dQuery)
+	if err != nil {
+		return nil, err
+	}
+	clientRequest.CompleteView = true
+
+	traces, err := d.listTraces(ctx, q, clientRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	f := createServiceStatsFrame(traces, d.conf)
+
+	return f, nil
+}
+
+func (d *CloudTraceDatasource) getSpansTableFrame(ctx context.Context, q queryModel, dQuery backend.DataQuery) (*data.Frame, error) {
+	clientRequest, err := d.newTracesQuery(q, dQuery)
+	if err != nil {
+		return nil, err
+	}
+	clientRequest.CompleteView = true
+
+	traces, err := d.listTraces(ctx, q, clientRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	// The query limit caps the number of spans, as well as the traces they're listed from
+	f := createSpansTableFrame(traces, clientRequest.Limit, d.conf)
+
+	return f, nil
+}
+
+// createSpansTableFrame flattens the spans of several traces into one table, one row per span,
+// with at most maxSpans rows
+func createSpansTableFrame(traces []*tracepb.Trace, maxSpans int64, conf config) *data.Frame {
+	f := data.NewFrame("spansTable")
+	f.Meta = &data.FrameMeta{}
+	f.Meta.PreferredVisualization = data.VisTypeTable
+
+	traceIDField := data.NewField("Trace ID", nil, []string{})
+	spanIDField := data.NewField("Span ID", nil, []string{})
+	serviceField := data.NewField("Service", nil, []string{})
+	operationField := data.NewField("Operation", nil, []string{})
+	durationField := data.NewField("Duration", nil, []float64{})
+	durationField.Config = &data.FieldConfig{
+		Unit: "ms",
+	}
+	statusField := data.NewField("Status", nil, []string{})
+
+	var total int64
+	for _, t := range traces {
+		for _, s := range t.GetSpans() {
+			total++
+			if total > maxSpans {
+				continue
+			}
+			traceIDField.Append(t.GetTraceId())
+			spanIDField.Append(cloudtrace.SpanID(s.GetSpanId()).String())
+			serviceField.Append(cloudtrace.GetServiceNameWithPrecedence(s, cloudtrace.ServiceNamePrecedence(conf.ServiceNamePrecedence)))
+			operationField.Append(cloudtrace.GetSpanOperationName(s))
+			durationField.Append(getSpanDuration(t.GetTraceId(), s, conf))
+			statusField.Append(cloudtrace.GetSpanStatus(s))
+		}
+	}
+	if total > maxSpans {
+		f.Meta.Notices = append(f.Meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("Showing the first %d of %d spans, as limited by the query", maxSpans, total),
+		})
+	}
+
+	f.Fields = append(f.Fields,
+		traceIDField,
+		spanIDField,
+		serviceField,
+		operationField,
+		durationField,
+		statusField,
+	)
+
+	return f
+}
+
+func (d *CloudTraceDatasource) getLatencyHistogramFrame(ctx context.Context, q queryModel, dQuery backend.DataQuery) (*data.Frame, error) {
+	boundariesMs := q.LatencyBuckets
+	if len(boundariesMs) == 0 {
+		boundariesMs = defaultLatencyBucketsMs
+	}
+	for i, boundary := range boundariesMs {
+		if boundary <= 0 || (i > 0 && boundary <= boundariesMs[i-1]) {
+			return nil, fmt.Errorf("invalid latency buckets %v: must be positive and ascending", boundariesMs)
+		}
+	}
+
+	clientRequest, err := d.newTracesQuery(q, dQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	traces, err := d.listTraces(ctx, q, clientRequest)
 	if err != nil {
 		return nil, err
 	}
 
+	f := createLatencyHistogramFrame(traces, boundariesMs)
+
+	return f, nil
+}
+
+// createLatencyHistogramFrame counts the root span latencies of traces into buckets with the
+// given boundaries in milliseconds, as a histogram frame. The last bucket has no upper bound
+func createLatencyHistogramFrame(traces []*tracepb.Trace, boundariesMs []float64) *data.Frame {
+	latencies := make([]time.Duration, 0, len(traces))
+	for _, t := range traces {
+		root := cloudtrace.GetRootSpan(t)
+		if root == nil {
+			continue
+		}
+		latencies = append(latencies, root.GetEndTime().AsTime().Sub(root.GetStartTime().AsTime()))
+	}
+	boundaries := make([]time.Duration, 0, len(boundariesMs))
+	for _, boundary := range boundariesMs {
+		boundaries = append(boundaries, time.Duration(boundary*float64(time.Millisecond)))
+	}
+	counts := cloudtrace.GetLatencyHistogram(latencies, boundaries)
+
+	f := data.NewFrame("latencyHistogram")
+	xMinField := data.NewField("xMin", nil, []float64{})
+	xMinField.Config = &data.FieldConfig{
+		Unit: "ms",
+	}
+	xMaxField := data.NewField("xMax", nil, []*float64{})
+	xMaxField.Config = &data.FieldConfig{
+		Unit: "ms",
+	}
+	countField := data.NewField("Count", nil, counts)
+
+	for i := range counts {
+		var xMin float64
+		if i > 0 {
+			xMin = boundariesMs[i-1]
+		}
+		xMinField.Append(xMin)
+		var xMax *float64
+		if i < len(boundariesMs) {
+			boundary := boundariesMs[i]
+			xMax = &boundary
+		}
+		xMaxField.Append(xMax)
+	}
+
+	f.Fields = append(f.Fields, xMinField, xMaxField, countField)
+
+	return f
+}
+
+func createServiceStatsFrame(traces []*tracepb.Trace, conf config) *data.Frame {
+	f := data.NewFrame("serviceStats")
+	f.Meta = &data.FrameMeta{}
+	f.Meta.PreferredVisualization = data.VisTypeTable
+
+	serviceField := data.NewField("Service", nil, []string{})
+	spanCountField := data.NewField("Span count", nil, []int64{})
+	avgDurationField := data.NewField("Average duration", nil, []float64{})
+	avgDurationField.Config = &data.FieldConfig{
+		Unit: "ms",
+	}
+	p95DurationField := data.NewField("P95 duration", nil, []float64{})
+	p95DurationField.Config = &data.FieldConfig{
+		Unit: "ms",
+	}
+
+	for _, stats := range cloudtrace.GetServiceStats(traces, cloudtrace.ServiceNamePrecedence(conf.ServiceNamePrecedence)) {
+		serviceField.Append(stats.Service)
+		spanCountField.Append(stats.SpanCount)
+		avgDurationField.Append(float64(stats.AvgDuration.Microseconds()) / 1000)
+		p95DurationField.Append(float64(stats.P95Duration.Microseconds()) / 1000)
+	}
+
+	f.Fields = append(f.Fields,
+		serviceField,
+		spanCountField,
+		avgDurationField,
+		p95DurationField,
+	)
+
+	return f
+}
+
+// getListTracesFilter returns the Cloud Trace API filter of a query. Raw filters are used as
+// they are, otherwise the query text is translated and merged with the default filter.
+// Errors queries are also merged with the errors filter, and fail for statuses it excludes
+func (d *CloudTraceDatasource) getListTracesFilter(q queryModel) (string, error) {
+	filter, err := d.getQueryFilter(q)
+	if err != nil {
+		return "", err
+	}
+	if q.QueryType == "errors" {
+		// A 5xx status in the query narrows the errors filter, e.g. to Status:503,
+		// but any other status would replace it and list traces without errors
+		statusKey, errorStatus := splitFilterPart(errorsFilter)
+		for _, status := range cloudtrace.GetListTracesFilterValues(filter, statusKey) {
+			if !strings.HasPrefix(status, errorStatus) {
+				return "", fmt.Errorf("%w: status %s", errNonErrorStatus, status)
+			}
+		}
+		filter = cloudtrace.MergeListTracesFilters(errorsFilter, filter)
+	}
+	return filter, nil
+}
+
+// splitFilterPart splits a Cloud Trace API filter part into its key and value
+func splitFilterPart(part string) (string, string) {
+	kv := strings.SplitN(part, ":", 2)
+	if len(kv) < 2 {
+		return kv[0], ""
+	}
+	return kv[0], kv[1]
+}
+
+// getQueryFilter returns the Cloud Trace API filter of a query's text and the default filter
+func (d *CloudTraceDatasource) getQueryFilter(q queryModel) (string, error) {
+	if q.RawFilter {
+		return q.QueryText, nil
+	}
+
+	// Trace ID prefixes, comparisons and span names are matched after listing traces, not by the Cloud Trace API
+	_, queryText := cloudtrace.ExtractTracePrefix(q.QueryText)
+	_, queryText = cloudtrace.ExtractComparisons(queryText)
+	_, queryText = cloudtrace.ExtractContainsSpan(queryText)
+	filter, err := cloudtrace.GetListTracesFilterWithMaxTerms(queryText, d.conf.MaxFilterTerms)
+	if err != nil {
+		// Point at the bad filter part in the query text as it was written
+		var parseErr *cloudtrace.FilterParseError
+		if errors.As(err, &parseErr) {
+			parseErr.Position = cloudtrace.GetOriginalFilterPosition(q.QueryText, queryText, parseErr.Position)
+		}
+		return "", err
+	}
+	if d.conf.DefaultFilter != "" {
+		defaultFilter, err := cloudtrace.GetListTracesFilter(d.conf.DefaultFilter)
+		if err != nil {
+			// Not returned as a FilterParseError, whose position is within the query text
+			return "", fmt.Errorf("default filter: %s", err)
+		}
+		filter = cloudtrace.MergeListTracesFilters(defaultFilter, filter)
+	}
+
+	return filter, nil
+}
+
+// getExplainFrame describes the Cloud Trace API requests a query would send, without sending them
+func (d *CloudTraceDatasource) getExplainFrame(q queryModel, dQuery backend.DataQuery) (*data.Frame, error) {
+	clientRequest, _, err := d.newTracesTableQuery(q, dQuery)
+	if err != nil {
+		return nil, err
+	}
+	clientRequest = cloudtrace.ClampTimeRange(clientRequest, time.Duration(d.conf.MaxTimeRangeHours)*time.Hour)
+
+	req := cloudtrace.NewListTracesRequest(clientRequest)
+	if d.conf.PageSize > 0 && d.conf.PageSize < req.PageSize {
+		req.PageSize = d.conf.PageSize
+	}
+
+	return createExplainFrame(clientRequest, req, q), nil
+}
+
+// createExplainFrame creates a frame with a row for each parameter of the requests a query would send
+func createExplainFrame(clientRequest *cloudtrace.TracesQuery, req *tracepb.ListTracesRequest, q queryModel) *data.Frame {
+	requestField := data.NewField("Request", nil, []string{})
+	parameterField := data.NewField("Parameter", nil, []string{})
+	valueField := data.NewField("Value", nil, []string{})
+
+	add := func(request, parameter, value string) {
+		requestField.Append(request)
+		parameterField.Append(parameter)
+		valueField.Append(value)
+	}
+
+	add("ListTraces", "projectId", req.ProjectId)
+	add("ListTraces", "filter", req.Filter)
+	add("ListTraces", "startTime", clientRequest.TimeRange.From.UTC().Format(time.RFC3339Nano))
+	add("ListTraces", "endTime", clientRequest.TimeRange.To.UTC().Format(time.RFC3339Nano))
+	add("ListTraces", "limit", strconv.FormatInt(clientRequest.Limit, 10))
+	add("ListTraces", "pageSize", strconv.FormatInt(int64(req.PageSize), 10))
+	add("ListTraces", "orderBy", req.OrderBy)
+	add("ListTraces", "view", req.View.String())
+	add("ListTraces", "bypassCache", strconv.FormatBool(clientRequest.BypassCache))
+
+	if traceID := strings.TrimSpace(q.TraceID); traceID != "" {
+		add("GetTrace", "projectId", q.ProjectID)
+		add("GetTrace", "traceId", traceID)
+	}
+
+	f := data.NewFrame("explain", requestField, parameterField, valueField)
+	f.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeTable}
+	return f
+}
+
+// newTracesQuery creates the client request listing the traces matching a query
+func (d *CloudTraceDatasource) newTracesQuery(q queryModel, dQuery backend.DataQuery) (*cloudtrace.TracesQuery, error) {
+	filter, err := d.getListTracesFilter(q)
+	if err != nil {
+		return nil, err
+	}
+
+	orderBy := q.OrderBy
+	if orderBy == "" {
+		orderBy = d.conf.DefaultOrderBy
+	}
+
 	clientRequest := cloudtrace.TracesQuery{
 		ProjectID: q.ProjectID,
 		Filter:    filter,
-		Limit:     dQuery.MaxDataPoints,
+		Limit:     d.conf.tracesLimit(dQuery.MaxDataPoints),
 		TimeRange: cloudtrace.TimeRange{
 			From: dQuery.TimeRange.From,
 			To:   dQuery.TimeRange.To,
 		},
+		OrderBy:      orderBy,
+		BypassCache:  q.BypassCache,
+		Sampled:      q.Sampled,
+		CompleteView: listsCompleteTraces(q),
 	}
 
-	traces, err := d.client.ListTraces(ctx, &clientRequest)
-	if err != nil {
-		return nil, err
-	}
-
-	f := createTracesTableFrame(traces)
-
-	return f, nil
+	return &clientRequest, nil
 }
 
-func createTracesTableFrame(traces []*tracepb.Trace) *data.Frame {
+func createTracesTableFrame(traces []*tracepb.Trace, projectID string, conf config) *data.Frame {
 	// Create one frame for all traces
 	f := data.NewFrame("traceTable")
 	f.Meta = &data.FrameMeta{}
@@ -352,14 +2117,39 @@ func createTracesTableFrame(traces []*tracepb.Trace) *data.Frame {
 
 	// Create one set of fields for all traces
 	tableTraceIDField := data.NewField("Trace ID", nil, []string{})
+	links := []data.DataLink{}
+	// Link each trace ID to its spans so it can be opened like an exemplar
+	if conf.datasourceUID != "" {
+		links = append(links, createTraceIDLink(projectID, conf))
+	}
+	if conf.TraceLinkTemplate != "" {
+		links = append(links, createTraceLinkFromTemplate(conf.TraceLinkTemplate, projectID))
+	}
+	if len(links) > 0 {
+		tableTraceIDField.Config = &data.FieldConfig{
+			Links: links,
+		}
+	}
 	tableTraceNameField := data.NewField("Trace name", nil, []string{})
 	tableStartTimeField := data.NewField("Start time", nil, []time.Time{})
 	tableLatencyField := data.NewField("Latency", nil, []int64{})
 	tableLatencyField.Config = &data.FieldConfig{
 		Unit: "ms",
 	}
+	tableAgeField := data.NewField("Age", nil, []int64{})
+	tableAgeField.Config = &data.FieldConfig{
+		Unit: "dtdurationms",
+	}
+	tableErrorServiceField := data.NewField("Error service", nil, []string{})
+
+	if limit := conf.frameRowLimit(tracesTableFieldCount); len(traces) > limit {
+		f.Meta.Notices = append(f.Meta.Notices, getTruncatedNotice(limit, len(traces), "traces", conf))
+		traces = traces[:limit]
+	}
 
 	// Add values to each field for each trace
+	now := timeNow()
+	latenciesMicros := []int64{}
 	for _, t := range traces {
 		tableTraceIDField.Append(t.TraceId)
 
@@ -369,11 +2159,30 @@ func createTracesTableFrame(traces []*tracepb.Trace) *data.Frame {
 			continue
 		}
 
-		rootSpan := spans[0]
-		tableTraceNameField.Append(cloudtrace.GetTraceName(rootSpan))
+		// Traces listed with every span don't necessarily list the root span first
+		rootSpan := cloudtrace.GetRootSpan(t)
+		tableTraceNameField.Append(cloudtrace.GetTraceNameWithPrecedence(rootSpan, cloudtrace.ServiceNamePrecedence(conf.ServiceNamePrecedence)))
 		tableStartTimeField.Append(rootSpan.GetStartTime().AsTime())
 		latency := rootSpan.GetEndTime().AsTime().UnixMilli() - rootSpan.GetStartTime().AsTime().UnixMilli()
+		latencyMicros := rootSpan.GetEndTime().AsTime().UnixMicro() - rootSpan.GetStartTime().AsTime().UnixMicro()
+		// Traces listed with every span (e.g. ordered by latency) use the whole trace latency
+		if len(spans) > 1 {
+			traceLatency := cloudtrace.GetTraceLatency(spans)
+			latency, latencyMicros = traceLatency.Milliseconds(), traceLatency.Microseconds()
+		}
 		tableLatencyField.Append(latency)
+		latenciesMicros = append(latenciesMicros, latencyMicros)
+		// Clock skew can put traces in the future, which have no age yet
+		age := now.Sub(rootSpan.GetStartTime().AsTime()).Milliseconds()
+		if age < 0 {
+			age = 0
+		}
+		tableAgeField.Append(age)
+		tableErrorServiceField.Append(cloudtrace.GetErrorService(spans, cloudtrace.ServiceNamePrecedence(conf.ServiceNamePrecedence)))
+	}
+
+	if conf.LatencyUnit == latencyUnitAuto {
+		tableLatencyField = createAutoScaledLatencyField(latenciesMicros)
 	}
 
 	f.Fields = append(f.Fields,
@@ -381,11 +2190,71 @@ func createTracesTableFrame(traces []*tracepb.Trace) *data.Frame {
 		tableTraceNameField,
 		tableStartTimeField,
 		tableLatencyField,
+		tableAgeField,
+		tableErrorServiceField,
 	)
 
 	return f
 }
 
+// createTraceIDLink creates an internal link querying this datasource for the spans of a trace ID
+func createTraceIDLink(projectID string, conf config) data.DataLink {
+	return data.DataLink{
+		Title: "Trace: ${__value.raw}",
+		Internal: &data.InternalDataLink{
+			Query: map[string]interface{}{
+				"queryType": "traceID",
+				"traceId":   "${__value.raw}",
+				"projectId": projectID,
+			},
+			DatasourceUID:  conf.datasourceUID,
+			DatasourceName: conf.datasourceName,
+		},
+	}
+}
+
+// createTraceLinkFromTemplate creates a link from each trace ID to the URL of the template, with
+// {traceId} replaced by the trace ID and {projectId} by the project ID
+func createTraceLinkFromTemplate(template string, projectID string) data.DataLink {
+	url := strings.NewReplacer(
+		traceLinkTraceIDPlaceholder, "${__value.raw}",
+		traceLinkProjectIDPlaceholder, projectID,
+	).Replace(template)
+	return data.DataLink{
+		Title:       "Open trace ${__value.raw}",
+		URL:         url,
+		TargetBlank: true,
+	}
+}
+
+// createAutoScaledLatencyField creates a latency field in the unit (µs, ms or s)
+// best suited to the largest of the given latencies
+func createAutoScaledLatencyField(latenciesMicros []int64) *data.Field {
+	var maxLatency int64
+	for _, l := range latenciesMicros {
+		if l > maxLatency {
+			maxLatency = l
+		}
+	}
+
+	unit, divisor := "µs", 1.0
+	if maxLatency >= int64(time.Second/time.Microsecond) {
+		unit, divisor = "s", float64(time.Second/time.Microsecond)
+	} else if maxLatency >= int64(time.Millisecond/time.Microsecond) {
+		unit, divisor = "ms", float64(time.Millisecond/time.Microsecond)
+	}
+
+	latencyField := data.NewField("Latency", nil, make([]float64, 0, len(latenciesMicros)))
+	latencyField.Config = &data.FieldConfig{
+		Unit: unit,
+	}
+	for _, l := range latenciesMicros {
+		latencyField.Append(float64(l) / divisor)
+	}
+
+	return latencyField
+}
+
 // CheckHealth handles health checks sent from Grafana to the plugin.
 // The main use case for these health checks is the test button on the
 // datasource configuration page which allows users to verify that
@@ -400,22 +2269,71 @@ func (d *CloudTraceDatasource) CheckHealth(ctx context.Context, req *backend.Che
 	if err := json.Unmarshal(settings.JSONData, &conf); err != nil {
 		return nil, fmt.Errorf("unmarshal: %w", err)
 	}
+	// Test a specific project instead of the default, if set
+	if conf.HealthCheckProject != "" {
+		conf.DefaultProject = conf.HealthCheckProject
+	}
+	conf.setImpersonationDefaultProject()
 	if conf.DefaultProject == "" && conf.AuthType == gceAuthentication {
-		proj, err := utils.GCEDefaultProject(ctx, "")
+		proj, err := gceDefaultProject(ctx, "")
 		if err != nil {
 			return nil, fmt.Errorf("failed to get GCE default project: %w", err)
 		}
 		conf.DefaultProject = proj
 	}
-	if err := d.client.TestConnection(ctx, conf.DefaultProject); err != nil {
+
+	details := healthDetails{
+		Project:            conf.DefaultProject,
+		AuthType:           conf.AuthType,
+		UsingImpersonation: conf.UsingImpersonation,
+	}
+	if details.AuthType == "" {
+		details.AuthType = jwtAuthentication
+	}
+	// A missing permission to list projects is reported, rather than treated as no projects.
+	// It's only a detail of the check, so it isn't retried to keep the check quick
+	if _, err := d.client.ListProjects(ctx, &cloudtrace.ProjectsQuery{ReportMissingPermission: true, NoRetry: true}); err == nil {
+		details.ResourceManagerReachable = true
+	}
+
+	tracesFound, err := d.client.TestConnection(ctx, conf.DefaultProject)
+	if errors.Is(err, cloudtrace.ErrNoTraces) && conf.HealthCheckAllowNoTraces {
 		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: fmt.Sprintf("failed to run test query: %s", err),
+			Status:      status,
+			Message:     fmt.Sprintf("Successfully connected to GCP project %s, but found no traces", conf.DefaultProject),
+			JSONDetails: details.toJSON(),
 		}, nil
 	}
+	if err != nil {
+		return &backend.CheckHealthResult{
+			Status:      backend.HealthStatusError,
+			Message:     fmt.Sprintf("failed to run test query: %s", err),
+			JSONDetails: details.toJSON(),
+		}, nil
+	}
+	details.TracesFound = tracesFound
 
 	return &backend.CheckHealthResult{
-		Status:  status,
-		Message: fmt.Sprintf("Successfully queried traces from GCP project %s", conf.DefaultProject),
+		Status:      status,
+		Message:     fmt.Sprintf("Successfully queried traces from GCP project %s", conf.DefaultProject),
+		JSONDetails: details.toJSON(),
 	}, nil
 }
+
+// healthDetails are diagnostics returned with health check results to help triage
+type healthDetails struct {
+	Project                  string `json:"project"`
+	TracesFound              int    `json:"tracesFound"`
+	ResourceManagerReachable bool   `json:"resourceManagerReachable"`
+	AuthType                 string `json:"authType"`
+	UsingImpersonation       bool   `json:"usingImpersonation"`
+}
+
+func (h healthDetails) toJSON() []byte {
+	details, err := json.Marshal(h)
+	if err != nil {
+		log.DefaultLogger.Warn("failed marshaling health details", "error", err)
+		return nil
+	}
+	return details
+}
@@ -16,7 +16,11 @@ package plugin
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -172,8 +176,67 @@ func TestQueryData_BadFilter(t *testing.T) {
 
 	require.NoError(t, err)
 	require.ErrorContains(t, resp.Responses[refID].Error, "bad filter [resource.type.testing]. Must be in form [key]:[value]")
-	require.Nil(t, resp.Responses[refID].Frames)
+	var parseErr *cloudtrace.FilterParseError
+	require.ErrorAs(t, resp.Responses[refID].Error, &parseErr)
+	require.Equal(t, "resource.type.testing", parseErr.Token)
 	client.AssertExpectations(t)
+
+	// The frontend reads where the bad filter part is from the frame metadata
+	require.Len(t, resp.Responses[refID].Frames, 1)
+	frame := resp.Responses[refID].Frames[0]
+	require.Equal(t, refID, frame.Name)
+	require.Empty(t, frame.Fields)
+	meta, err := json.Marshal(frame.Meta)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"custom": {"filterParseError": {"token": "resource.type.testing", "expected": "[key]:[value]", "position": 0}},
+		"notices": [{"severity": "error", "text": "bad filter [resource.type.testing]. Must be in form [key]:[value]"}]
+	}`, string(meta))
+}
+
+func TestQueryData_BadFilter_PositionAfterClientSideFilters(t *testing.T) {
+	testCases := []struct {
+		name             string
+		queryText        string
+		expectedPosition int
+	}{
+		{
+			name:             "After a trace ID prefix",
+			queryText:        "TracePrefix:abc  RootSpan:/a badfilter",
+			expectedPosition: 29,
+		},
+		{
+			name:             "After comparisons and span names",
+			queryText:        "LatencyMs:>500 ContainsSpan:db.query badfilter",
+			expectedPosition: 37,
+		},
+		{
+			name:             "Between client-side filters",
+			queryText:        "ContainsSpan:badfilter badfilter TracePrefix:abc",
+			expectedPosition: 23,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ds := CloudTraceDatasource{
+				client: mocks.NewAPI(t),
+			}
+			queryJSON, err := json.Marshal(map[string]string{"projectId": "testing", "queryText": tc.queryText})
+			require.NoError(t, err)
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{{JSON: queryJSON, RefID: "A"}},
+			})
+			require.NoError(t, err)
+
+			// The position is in the query text as typed, not with client-side filters removed
+			var parseErr *cloudtrace.FilterParseError
+			require.ErrorAs(t, resp.Responses["A"].Error, &parseErr)
+			require.Equal(t, "badfilter", parseErr.Token)
+			require.Equal(t, tc.expectedPosition, parseErr.Position)
+			require.Equal(t, "badfilter", tc.queryText[parseErr.Position:parseErr.Position+len(parseErr.Token)])
+		})
+	}
 }
 
 func TestQueryData_SingleTraceSpans(t *testing.T) {
@@ -229,10 +292,10 @@ func TestQueryData_SingleTraceSpans(t *testing.T) {
 
 	traceFrame := resp.Responses[refID].Frames[0]
 	require.Equal(t, traceID, traceFrame.Name)
-	require.Len(t, traceFrame.Fields, 9)
+	require.Len(t, traceFrame.Fields, 19)
 	require.Equal(t, data.VisTypeTrace, string(traceFrame.Meta.PreferredVisualization))
 
-	expectedFrame := []byte(`{"schema":{"name":"123","meta":{"preferredVisualisationType":"trace"},"fields":[{"name":"traceID","type":"string","typeInfo":{"frame":"string"}},{"name":"parentSpanID","type":"string","typeInfo":{"frame":"string"}},{"name":"spanID","type":"string","typeInfo":{"frame":"string"}},{"name":"serviceName","type":"string","typeInfo":{"frame":"string"}},{"name":"operationName","type":"string","typeInfo":{"frame":"string"}},{"name":"serviceTags","type":"other","typeInfo":{"frame":"json.RawMessage"}},{"name":"tags","type":"other","typeInfo":{"frame":"json.RawMessage"}},{"name":"startTime","type":"time","typeInfo":{"frame":"time.Time"}},{"name":"duration","type":"number","typeInfo":{"frame":"float64"}}]},"data":{"values":[["123"],["0"],["1"],[""],["spanName"],[[]],[[{"key":"key1","value":"value1"}]],[1660920349373],[1]]}}`)
+	expectedFrame := []byte(`{"schema":{"name":"123","meta":{"custom":{"traceLatencyMs":1},"preferredVisualisationType":"trace"},"fields":[{"name":"traceID","type":"string","typeInfo":{"frame":"string"}},{"name":"parentSpanID","type":"string","typeInfo":{"frame":"string"}},{"name":"spanID","type":"string","typeInfo":{"frame":"string"}},{"name":"serviceName","type":"string","typeInfo":{"frame":"string"}},{"name":"operationName","type":"string","typeInfo":{"frame":"string"}},{"name":"serviceTags","type":"other","typeInfo":{"frame":"json.RawMessage"}},{"name":"tags","type":"other","typeInfo":{"frame":"json.RawMessage"}},{"name":"baggageTags","type":"other","typeInfo":{"frame":"json.RawMessage"}},{"name":"startTime","type":"time","typeInfo":{"frame":"time.Time"}},{"name":"duration","type":"number","typeInfo":{"frame":"float64"}},{"name":"outlier","type":"boolean","typeInfo":{"frame":"bool"}},{"name":"url","type":"string","typeInfo":{"frame":"string"}},{"name":"host","type":"string","typeInfo":{"frame":"string"}},{"name":"warnings","type":"number","typeInfo":{"frame":"int64"}},{"name":"percentOfParent","type":"number","typeInfo":{"frame":"float64","nullable":true}},{"name":"onCriticalPath","type":"boolean","typeInfo":{"frame":"bool"}},{"name":"selfTime","type":"number","typeInfo":{"frame":"float64"}},{"name":"grpcStatus","type":"string","typeInfo":{"frame":"string"}},{"name":"messagingDestination","type":"string","typeInfo":{"frame":"string"}}]},"data":{"values":[["123"],["0"],["1"],[""],["spanName"],[[]],[[{"key":"key1","value":"value1"}]],[[]],[1660920349373],[1],[false],[""],[""],[0],[null],[true],[1],[""],[""]]}}`)
 
 	serializedFrame, err := traceFrame.MarshalJSON()
 	require.NoError(t, err)
@@ -248,6 +311,10 @@ func TestQueryData_SingleTraceTable(t *testing.T) {
 	traceID := "123"
 	startTime := timestamppb.New(time.UnixMilli(1660920349373))
 	endTime := timestamppb.New(time.UnixMilli(1660920349374))
+	defer func(original func() time.Time) {
+		timeNow = original
+	}(timeNow)
+	timeNow = func() time.Time { return startTime.AsTime().Add(time.Minute) }
 
 	spans := []*tracepb.TraceSpan{
 		{
@@ -300,13 +367,3179 @@ func TestQueryData_SingleTraceTable(t *testing.T) {
 
 	tableFrame := resp.Responses[refID].Frames[0]
 	require.Equal(t, tableFrameName, tableFrame.Name)
-	require.Len(t, tableFrame.Fields, 4)
+	require.Len(t, tableFrame.Fields, 6)
 	require.Equal(t, data.VisTypeTable, string(tableFrame.Meta.PreferredVisualization))
 
-	expectedFrame := []byte(`{"schema":{"name":"traceTable","meta":{"preferredVisualisationType":"table"},"fields":[{"name":"Trace ID","type":"string","typeInfo":{"frame":"string"}},{"name":"Trace name","type":"string","typeInfo":{"frame":"string"}},{"name":"Start time","type":"time","typeInfo":{"frame":"time.Time"}},{"name":"Latency","type":"number","typeInfo":{"frame":"int64"},"config":{"unit":"ms"}}]},"data":{"values":[["123"],["spanName"],[1660920349373],[1]]}}`)
+	expectedFrame := []byte(`{"schema":{"name":"traceTable","meta":{"preferredVisualisationType":"table"},"fields":[{"name":"Trace ID","type":"string","typeInfo":{"frame":"string"}},{"name":"Trace name","type":"string","typeInfo":{"frame":"string"}},{"name":"Start time","type":"time","typeInfo":{"frame":"time.Time"}},{"name":"Latency","type":"number","typeInfo":{"frame":"int64"},"config":{"unit":"ms"}},{"name":"Age","type":"number","typeInfo":{"frame":"int64"},"config":{"unit":"dtdurationms"}},{"name":"Error service","type":"string","typeInfo":{"frame":"string"}}]},"data":{"values":[["123"],["spanName"],[1660920349373],[1],[60000],[""]]}}`)
 
 	serializedFrame, err := tableFrame.MarshalJSON()
 	require.NoError(t, err)
 	require.Equal(t, string(expectedFrame), string(serializedFrame))
 	client.AssertExpectations(t)
 }
+
+func TestQueryData_SpanTree(t *testing.T) {
+	traceID := "123"
+	startTime := timestamppb.New(time.UnixMilli(1660920349373))
+	endTime := timestamppb.New(time.UnixMilli(1660920349374))
+
+	trace := tracepb.Trace{
+		ProjectId: "testProject",
+		TraceId:   traceID,
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 3, ParentSpanId: 2, Name: "grandchild", StartTime: startTime, EndTime: endTime},
+			{SpanId: 1, Name: "root", StartTime: startTime, EndTime: endTime},
+			{SpanId: 2, ParentSpanId: 1, Name: "child", StartTime: startTime, EndTime: endTime},
+			{SpanId: 4, ParentSpanId: 50, Name: "orphan", StartTime: startTime, EndTime: endTime},
+		},
+	}
+
+	client := mocks.NewAPI(t)
+	client.On("GetTrace", mock.Anything, &cloudtrace.TraceQuery{
+		ProjectID: "testing",
+		TraceID:   traceID,
+	}).Return(&trace, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryType": "spanTree", "traceId": "123"}`),
+				RefID: refID,
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	require.Len(t, resp.Responses[refID].Frames, 1)
+
+	frame := resp.Responses[refID].Frames[0]
+	require.Equal(t, traceID, frame.Name)
+
+	operationNameField, _ := frame.FieldByName("operationName")
+	depthField, _ := frame.FieldByName("depth")
+	operationNames := []string{}
+	depths := []int64{}
+	for i := 0; i < frame.Rows(); i++ {
+		operationNames = append(operationNames, operationNameField.At(i).(string))
+		depths = append(depths, depthField.At(i).(int64))
+	}
+	require.Equal(t, []string{"root", "child", "grandchild", "orphan"}, operationNames)
+	require.Equal(t, []int64{0, 1, 2, 0}, depths)
+	client.AssertExpectations(t)
+}
+
+func TestCreateTracesTableFrame_LatencyUnit(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+
+	testCases := []struct {
+		name            string
+		latencyUnit     string
+		latency         time.Duration
+		expectedUnit    string
+		expectedLatency interface{}
+	}{
+		{
+			name:            "Fixed unit by default",
+			latencyUnit:     "",
+			latency:         2500 * time.Millisecond,
+			expectedUnit:    "ms",
+			expectedLatency: int64(2500),
+		},
+		{
+			name:            "Auto unit microseconds",
+			latencyUnit:     "auto",
+			latency:         500 * time.Microsecond,
+			expectedUnit:    "µs",
+			expectedLatency: float64(500),
+		},
+		{
+			name:            "Auto unit milliseconds",
+			latencyUnit:     "auto",
+			latency:         250 * time.Millisecond,
+			expectedUnit:    "ms",
+			expectedLatency: float64(250),
+		},
+		{
+			name:            "Auto unit seconds",
+			latencyUnit:     "auto",
+			latency:         2500 * time.Millisecond,
+			expectedUnit:    "s",
+			expectedLatency: 2.5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			traces := []*tracepb.Trace{
+				{
+					TraceId: "1",
+					Spans: []*tracepb.TraceSpan{
+						{StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(tc.latency))},
+					},
+				},
+			}
+
+			frame := createTracesTableFrame(traces, "testing", config{LatencyUnit: tc.latencyUnit})
+
+			latencyField, _ := frame.FieldByName("Latency")
+			require.NotNil(t, latencyField)
+			require.Equal(t, tc.expectedUnit, latencyField.Config.Unit)
+			require.Equal(t, tc.expectedLatency, latencyField.At(0))
+		})
+	}
+}
+
+func TestGetServiceAccountJSON(t *testing.T) {
+	secretErr := errors.New("permission denied")
+	defer func(original func(context.Context, string) ([]byte, error)) {
+		accessSecret = original
+	}(accessSecret)
+
+	testCases := []struct {
+		name           string
+		conf           config
+		secureJSONData map[string]string
+		secret         []byte
+		secretErr      error
+		expectedJSON   string
+		expectedErr    string
+	}{
+		{
+			name:         "Secret Manager resource",
+			conf:         config{SecretManagerResource: "projects/p/secrets/s"},
+			secret:       []byte(`{"type":"service_account","project_id":"p"}`),
+			expectedJSON: `{"type":"service_account","project_id":"p"}`,
+		},
+		{
+			name:        "Secret Manager access error",
+			conf:        config{SecretManagerResource: "projects/p/secrets/s"},
+			secretErr:   secretErr,
+			expectedErr: "access secret projects/p/secrets/s: permission denied",
+		},
+		{
+			name:        "Secret Manager secret is not JSON",
+			conf:        config{SecretManagerResource: "projects/p/secrets/s"},
+			secret:      []byte(`not json`),
+			expectedErr: "secret projects/p/secrets/s does not contain service account JSON",
+		},
+		{
+			name:           "Uploaded private key",
+			conf:           config{DefaultProject: "p", ClientEmail: "e", TokenURI: "u"},
+			secureJSONData: map[string]string{privateKeyKey: "key"},
+			expectedJSON:   `{"type":"service_account","project_id":"p","private_key":"key","client_email":"e","token_uri":"u"}`,
+		},
+		{
+			name:        "Missing private key",
+			conf:        config{},
+			expectedErr: errMissingCredentials.Error(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requestedResource string
+			accessSecret = func(_ context.Context, resource string) ([]byte, error) {
+				requestedResource = resource
+				return tc.secret, tc.secretErr
+			}
+
+			serviceAccount, err := getServiceAccountJSON(context.Background(), tc.conf, tc.secureJSONData)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedJSON, string(serviceAccount))
+			require.Equal(t, tc.conf.SecretManagerResource, requestedResource)
+		})
+	}
+}
+
+func TestQueryData_DefaultOrderByAndFilter(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+	conf := config{
+		DefaultOrderBy: "duration desc",
+		DefaultFilter:  "Service:frontend",
+	}
+
+	testCases := []struct {
+		name            string
+		queryJSON       string
+		expectedFilter  string
+		expectedOrderBy string
+	}{
+		{
+			name:            "Defaults apply when the query omits them",
+			queryJSON:       `{"projectId": "testing"}`,
+			expectedFilter:  "g.co/gae/app/module:frontend",
+			expectedOrderBy: "duration desc",
+		},
+		{
+			name:            "Query values override defaults",
+			queryJSON:       `{"projectId": "testing", "orderBy": "start asc", "queryText": "Service:backend MinLatency:1s"}`,
+			expectedFilter:  "g.co/gae/app/module:backend latency:1s",
+			expectedOrderBy: "start asc",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListTraces", mock.Anything, &cloudtrace.TracesQuery{
+				ProjectID: "testing",
+				Filter:    tc.expectedFilter,
+				Limit:     20,
+				TimeRange: cloudtrace.TimeRange{
+					From: from,
+					To:   to,
+				},
+				OrderBy: tc.expectedOrderBy,
+			}).Return([]*tracepb.Trace{}, nil)
+
+			ds := CloudTraceDatasource{
+				client: client,
+				conf:   conf,
+			}
+			refID := "test"
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{
+					{
+						JSON:  []byte(tc.queryJSON),
+						RefID: refID,
+						TimeRange: backend.TimeRange{
+							From: from,
+							To:   to,
+						},
+						MaxDataPoints: 20,
+					},
+				},
+			})
+
+			require.NoError(t, err)
+			require.NoError(t, resp.Responses[refID].Error)
+			require.Len(t, resp.Responses[refID].Frames, 1)
+			client.AssertExpectations(t)
+		})
+	}
+}
+
+func TestQueryData_Errors(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+
+	testCases := []struct {
+		name           string
+		conf           config
+		queryJSON      string
+		expectedFilter string
+	}{
+		{
+			name:           "Errors filter alone",
+			queryJSON:      `{"projectId": "testing", "queryType": "errors"}`,
+			expectedFilter: "/http/status_code:5",
+		},
+		{
+			name:           "Merged with the query and default filters",
+			conf:           config{DefaultFilter: "Version:v2"},
+			queryJSON:      `{"projectId": "testing", "queryType": "errors", "queryText": "Service:backend"}`,
+			expectedFilter: "/http/status_code:5 g.co/gae/app/version:v2 g.co/gae/app/module:backend",
+		},
+		{
+			name:           "Query status narrows the errors filter",
+			queryJSON:      `{"projectId": "testing", "queryType": "errors", "queryText": "Status:503"}`,
+			expectedFilter: "/http/status_code:503",
+		},
+		{
+			name:           "Merged with a raw filter",
+			queryJSON:      `{"projectId": "testing", "queryType": "errors", "queryText": "+root:/checkout", "rawFilter": true}`,
+			expectedFilter: "/http/status_code:5 +root:/checkout",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListTraces", mock.Anything, &cloudtrace.TracesQuery{
+				ProjectID: "testing",
+				Filter:    tc.expectedFilter,
+				Limit:     20,
+				TimeRange: cloudtrace.TimeRange{
+					From: from,
+					To:   to,
+				},
+			}).Return([]*tracepb.Trace{}, nil)
+
+			ds := CloudTraceDatasource{
+				client: client,
+				conf:   tc.conf,
+			}
+			refID := "test"
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{
+					{
+						JSON:  []byte(tc.queryJSON),
+						RefID: refID,
+						TimeRange: backend.TimeRange{
+							From: from,
+							To:   to,
+						},
+						MaxDataPoints: 20,
+					},
+				},
+			})
+
+			require.NoError(t, err)
+			require.NoError(t, resp.Responses[refID].Error)
+			require.Len(t, resp.Responses[refID].Frames, 1)
+			client.AssertExpectations(t)
+		})
+	}
+}
+
+func TestQueryData_Errors_NonErrorStatus(t *testing.T) {
+	testCases := []struct {
+		name string
+		conf config
+		json string
+	}{
+		{
+			name: "Query status",
+			json: `{"projectId": "testing", "queryType": "errors", "queryText": "Status:200"}`,
+		},
+		{
+			name: "Raw filter status",
+			json: `{"projectId": "testing", "queryType": "errors", "queryText": "+/http/status_code:404", "rawFilter": true}`,
+		},
+		{
+			name: "Default filter status",
+			conf: config{DefaultFilter: "Status:2"},
+			json: `{"projectId": "testing", "queryType": "errors"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			ds := CloudTraceDatasource{
+				client: client,
+				conf:   tc.conf,
+			}
+			refID := "test"
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{{JSON: []byte(tc.json), RefID: refID}},
+			})
+
+			// Nothing is listed, rather than traces without errors
+			require.NoError(t, err)
+			require.ErrorIs(t, resp.Responses[refID].Error, errNonErrorStatus)
+			client.AssertNotCalled(t, "ListTraces", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestQueryData_DefaultQueryText(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+	conf := config{
+		DefaultQueryText: "Service:frontend",
+	}
+
+	testCases := []struct {
+		name           string
+		queryJSON      string
+		expectedFilter string
+	}{
+		{
+			name:           "Empty query text falls back to the default",
+			queryJSON:      `{"projectId": "testing"}`,
+			expectedFilter: "g.co/gae/app/module:frontend",
+		},
+		{
+			name:           "Blank query text falls back to the default",
+			queryJSON:      `{"projectId": "testing", "queryText": "  "}`,
+			expectedFilter: "g.co/gae/app/module:frontend",
+		},
+		{
+			name:           "Query text replaces the default",
+			queryJSON:      `{"projectId": "testing", "queryText": "MinLatency:1s"}`,
+			expectedFilter: "latency:1s",
+		},
+		{
+			name:           "Empty raw filter stays empty",
+			queryJSON:      `{"projectId": "testing", "rawFilter": true}`,
+			expectedFilter: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListTraces", mock.Anything, &cloudtrace.TracesQuery{
+				ProjectID: "testing",
+				Filter:    tc.expectedFilter,
+				Limit:     20,
+				TimeRange: cloudtrace.TimeRange{
+					From: from,
+					To:   to,
+				},
+			}).Return([]*tracepb.Trace{}, nil)
+
+			ds := CloudTraceDatasource{
+				client: client,
+				conf:   conf,
+			}
+			refID := "test"
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{
+					{
+						JSON:  []byte(tc.queryJSON),
+						RefID: refID,
+						TimeRange: backend.TimeRange{
+							From: from,
+							To:   to,
+						},
+						MaxDataPoints: 20,
+					},
+				},
+			})
+
+			require.NoError(t, err)
+			require.NoError(t, resp.Responses[refID].Error)
+			require.Len(t, resp.Responses[refID].Frames, 1)
+			client.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCallResource_Defaults(t *testing.T) {
+	ds := CloudTraceDatasource{
+		conf: config{DefaultQueryText: "Service:frontend"},
+	}
+	var resp *backend.CallResourceResponse
+	err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "defaults"},
+		backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+			resp = r
+			return nil
+		}))
+
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.Status)
+	require.JSONEq(t, `{"queryText":"Service:frontend"}`, string(resp.Body))
+}
+
+func TestCallResource_FilterSchema(t *testing.T) {
+	ds := CloudTraceDatasource{}
+
+	var resp *backend.CallResourceResponse
+	err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "filterSchema"},
+		backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+			resp = r
+			return nil
+		}))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.Status)
+
+	var schema []cloudtrace.FilterKeyword
+	require.NoError(t, json.Unmarshal(resp.Body, &schema))
+	require.Equal(t, cloudtrace.GetFilterSchema(), schema)
+}
+
+func TestFilterSchema_QueryFilterKeywords(t *testing.T) {
+	// An example of each keyword getQueryFilter accepts
+	examples := map[string]string{
+		"RootSpan":     "RootSpan:/checkout",
+		"SpanName":     "SpanName:db.query",
+		"HasLabel":     "HasLabel:/http/method",
+		"MinLatency":   "MinLatency:>500",
+		"URL":          "URL:/api",
+		"Method":       "Method:GET",
+		"Version":      "Version:v2",
+		"Service":      "Service:frontend",
+		"Status":       "Status:>=500",
+		"TracePrefix":  "TracePrefix:abc",
+		"ContainsSpan": "ContainsSpan:db.query",
+		"LatencyMs":    "LatencyMs:>500",
+		"Latency":      "Latency:<100",
+	}
+
+	schema := map[string]cloudtrace.FilterKeyword{}
+	for _, keyword := range cloudtrace.GetFilterSchema() {
+		schema[keyword.Keyword] = keyword
+	}
+	require.Len(t, schema, len(examples))
+
+	ds := CloudTraceDatasource{}
+	for keyword, queryText := range examples {
+		_, err := ds.getQueryFilter(queryModel{QueryText: queryText})
+		require.NoError(t, err, queryText)
+		require.Contains(t, schema, keyword)
+		// Keywords used in comparisons list their operators
+		if strings.Contains(queryText, ":>") || strings.Contains(queryText, ":<") {
+			require.NotEmpty(t, schema[keyword].Operators, keyword)
+		}
+	}
+}
+
+func TestQueryData_TableAndTrace(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+	traceID := "123"
+	startTime := timestamppb.New(time.UnixMilli(1660920349373))
+	endTime := timestamppb.New(time.UnixMilli(1660920349374))
+	trace := tracepb.Trace{
+		ProjectId: "testProject",
+		TraceId:   traceID,
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 1, Name: "spanName", StartTime: startTime, EndTime: endTime},
+		},
+	}
+
+	testCases := []struct {
+		name           string
+		queryJSON      string
+		expectedFrames []string
+	}{
+		{
+			name:           "Table only without a trace ID",
+			queryJSON:      `{"projectId": "testing", "queryType": "tableAndTrace", "queryText": "resource.type:\"testing\""}`,
+			expectedFrames: []string{"traceTable"},
+		},
+		{
+			name:           "Table and trace with a trace ID",
+			queryJSON:      `{"projectId": "testing", "queryType": "tableAndTrace", "traceId": "123", "queryText": "resource.type:\"testing\""}`,
+			expectedFrames: []string{"traceTable", traceID},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListTraces", mock.Anything, &cloudtrace.TracesQuery{
+				ProjectID: "testing",
+				Filter:    `resource.type:"testing"`,
+				Limit:     20,
+				TimeRange: cloudtrace.TimeRange{
+					From: from,
+					To:   to,
+				},
+			}).Return([]*tracepb.Trace{&trace}, nil)
+			if len(tc.expectedFrames) > 1 {
+				client.On("GetTrace", mock.Anything, &cloudtrace.TraceQuery{
+					ProjectID: "testing",
+					TraceID:   traceID,
+				}).Return(&trace, nil)
+			}
+
+			ds := CloudTraceDatasource{
+				client: client,
+			}
+			refID := "test"
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{
+					{
+						JSON:  []byte(tc.queryJSON),
+						RefID: refID,
+						TimeRange: backend.TimeRange{
+							From: from,
+							To:   to,
+						},
+						MaxDataPoints: 20,
+					},
+				},
+			})
+
+			require.NoError(t, err)
+			require.NoError(t, resp.Responses[refID].Error)
+			frameNames := []string{}
+			for _, f := range resp.Responses[refID].Frames {
+				frameNames = append(frameNames, f.Name)
+			}
+			require.Equal(t, tc.expectedFrames, frameNames)
+			client.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCreateTracesTableFrame_TraceIDLink(t *testing.T) {
+	traces := []*tracepb.Trace{
+		{
+			TraceId: "123",
+			Spans:   []*tracepb.TraceSpan{{Name: "spanName"}},
+		},
+	}
+
+	// Without a datasource to link to, no link is added
+	frame := createTracesTableFrame(traces, "testing", config{})
+	traceIDField, _ := frame.FieldByName("Trace ID")
+	require.Nil(t, traceIDField.Config)
+
+	frame = createTracesTableFrame(traces, "testing", config{datasourceUID: "uid", datasourceName: "Cloud Trace"})
+	traceIDField, _ = frame.FieldByName("Trace ID")
+	require.NotNil(t, traceIDField.Config)
+	require.Len(t, traceIDField.Config.Links, 1)
+
+	link := traceIDField.Config.Links[0]
+	require.NotNil(t, link.Internal)
+	require.Equal(t, "uid", link.Internal.DatasourceUID)
+	require.Equal(t, "Cloud Trace", link.Internal.DatasourceName)
+	require.Equal(t, map[string]interface{}{
+		"queryType": "traceID",
+		"traceId":   "${__value.raw}",
+		"projectId": "testing",
+	}, link.Internal.Query)
+}
+
+func TestCreateTracesTableFrame_TraceLinkTemplate(t *testing.T) {
+	traces := []*tracepb.Trace{
+		{
+			TraceId: "123",
+			Spans:   []*tracepb.TraceSpan{{Name: "spanName"}},
+		},
+	}
+	template := "https://console.cloud.google.com/traces/list?tid={traceId}&project={projectId}"
+
+	frame := createTracesTableFrame(traces, "testing", config{TraceLinkTemplate: template})
+	traceIDField, _ := frame.FieldByName("Trace ID")
+	require.NotNil(t, traceIDField.Config)
+	require.Equal(t, []data.DataLink{{
+		Title:       "Open trace ${__value.raw}",
+		URL:         "https://console.cloud.google.com/traces/list?tid=${__value.raw}&project=testing",
+		TargetBlank: true,
+	}}, traceIDField.Config.Links)
+
+	// The template link follows the link to the trace's spans
+	frame = createTracesTableFrame(traces, "testing", config{TraceLinkTemplate: template, datasourceUID: "uid"})
+	traceIDField, _ = frame.FieldByName("Trace ID")
+	require.Len(t, traceIDField.Config.Links, 2)
+	require.NotNil(t, traceIDField.Config.Links[0].Internal)
+	require.Equal(t, "https://console.cloud.google.com/traces/list?tid=${__value.raw}&project=testing", traceIDField.Config.Links[1].URL)
+}
+
+func TestCreateTraceSpanFrame_TraceLatency(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 2, ParentSpanId: 1, StartTime: timestamppb.New(start.Add(10 * time.Millisecond)), EndTime: timestamppb.New(start.Add(250 * time.Millisecond))},
+			{SpanId: 1, StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(100 * time.Millisecond))},
+			{SpanId: 3, ParentSpanId: 1, StartTime: timestamppb.New(start.Add(20 * time.Millisecond)), EndTime: timestamppb.New(start.Add(50 * time.Millisecond))},
+		},
+	}
+
+	frame := createTraceSpanFrame(trace, config{}, "", 0, spanWindow{})
+
+	require.Equal(t, map[string]interface{}{"traceLatencyMs": float64(250)}, frame.Meta.Custom)
+}
+
+func TestCheckHealth_JSONDetails(t *testing.T) {
+	testCases := []struct {
+		name            string
+		tracesFound     int
+		connectionErr   error
+		projectsErr     error
+		expectedStatus  backend.HealthStatus
+		expectedDetails string
+	}{
+		{
+			name:            "Healthy",
+			tracesFound:     1,
+			expectedStatus:  backend.HealthStatusOk,
+			expectedDetails: `{"project":"testing","tracesFound":1,"resourceManagerReachable":true,"authType":"jwt","usingImpersonation":true}`,
+		},
+		{
+			name:            "Several traces found and no permission to list projects",
+			tracesFound:     5,
+			projectsErr:     cloudtrace.ErrProjectsPermissionDenied,
+			expectedStatus:  backend.HealthStatusOk,
+			expectedDetails: `{"project":"testing","tracesFound":5,"resourceManagerReachable":false,"authType":"jwt","usingImpersonation":true}`,
+		},
+		{
+			name:            "Test query and Resource Manager failing",
+			connectionErr:   errors.New("no entries"),
+			projectsErr:     errors.New("unreachable"),
+			expectedStatus:  backend.HealthStatusError,
+			expectedDetails: `{"project":"testing","tracesFound":0,"resourceManagerReachable":false,"authType":"jwt","usingImpersonation":true}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListProjects", mock.Anything, &cloudtrace.ProjectsQuery{ReportMissingPermission: true, NoRetry: true}).Return([]string{}, tc.projectsErr)
+			client.On("TestConnection", mock.Anything, "testing").Return(tc.tracesFound, tc.connectionErr)
+
+			ds := CloudTraceDatasource{
+				client: client,
+			}
+			result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{
+				PluginContext: backend.PluginContext{
+					DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+						JSONData: []byte(`{"defaultProject": "testing", "usingImpersonation": true}`),
+					},
+				},
+			})
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedStatus, result.Status)
+			require.True(t, json.Valid(result.JSONDetails))
+			require.JSONEq(t, tc.expectedDetails, string(result.JSONDetails))
+			client.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCheckHealth_AllowNoTraces(t *testing.T) {
+	testCases := []struct {
+		name            string
+		jsonData        string
+		tracesFound     int
+		connectionErr   error
+		expectedStatus  backend.HealthStatus
+		expectedMessage string
+	}{
+		{
+			name:            "No traces fail by default",
+			jsonData:        `{"defaultProject": "testing"}`,
+			connectionErr:   cloudtrace.ErrNoTraces,
+			expectedStatus:  backend.HealthStatusError,
+			expectedMessage: "failed to run test query: no entries",
+		},
+		{
+			name:            "No traces allowed",
+			jsonData:        `{"defaultProject": "testing", "healthCheckAllowNoTraces": true}`,
+			connectionErr:   cloudtrace.ErrNoTraces,
+			expectedStatus:  backend.HealthStatusOk,
+			expectedMessage: "Successfully connected to GCP project testing, but found no traces",
+		},
+		{
+			name:            "Other errors fail when no traces are allowed",
+			jsonData:        `{"defaultProject": "testing", "healthCheckAllowNoTraces": true}`,
+			connectionErr:   errors.New("permission denied"),
+			expectedStatus:  backend.HealthStatusError,
+			expectedMessage: "failed to run test query: permission denied",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListProjects", mock.Anything, &cloudtrace.ProjectsQuery{ReportMissingPermission: true, NoRetry: true}).Return([]string{"testing"}, nil)
+			client.On("TestConnection", mock.Anything, "testing").Return(tc.tracesFound, tc.connectionErr)
+
+			ds := CloudTraceDatasource{
+				client: client,
+			}
+			result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{
+				PluginContext: backend.PluginContext{
+					DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+						JSONData: []byte(tc.jsonData),
+					},
+				},
+			})
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedStatus, result.Status)
+			require.Equal(t, tc.expectedMessage, result.Message)
+		})
+	}
+}
+
+func TestCheckHealth_Project(t *testing.T) {
+	testCases := []struct {
+		name            string
+		jsonData        string
+		expectedProject string
+	}{
+		{
+			name:            "Default project",
+			jsonData:        `{"defaultProject": "testing"}`,
+			expectedProject: "testing",
+		},
+		{
+			name:            "Overridden project",
+			jsonData:        `{"defaultProject": "testing", "healthCheckProject": "other"}`,
+			expectedProject: "other",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListProjects", mock.Anything, &cloudtrace.ProjectsQuery{ReportMissingPermission: true, NoRetry: true}).Return([]string{"testing", "other"}, nil)
+			client.On("TestConnection", mock.Anything, tc.expectedProject).Return(1, nil)
+
+			ds := CloudTraceDatasource{
+				client: client,
+			}
+			result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{
+				PluginContext: backend.PluginContext{
+					DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+						JSONData: []byte(tc.jsonData),
+					},
+				},
+			})
+
+			require.NoError(t, err)
+			require.Equal(t, backend.HealthStatusOk, result.Status)
+			require.Equal(t, "Successfully queried traces from GCP project "+tc.expectedProject, result.Message)
+			client.AssertExpectations(t)
+		})
+	}
+}
+
+func TestQueryData_ServiceStats(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+	start := time.UnixMilli(1660920349373)
+	span := func(service string, duration time.Duration) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			StartTime: timestamppb.New(start),
+			EndTime:   timestamppb.New(start.Add(duration)),
+			Labels:    map[string]string{"service.name": service},
+		}
+	}
+	trace := tracepb.Trace{
+		ProjectId: "testing",
+		TraceId:   "123",
+		Spans: []*tracepb.TraceSpan{
+			span("frontend", 100*time.Millisecond),
+			span("backend", 10*time.Millisecond),
+			span("backend", 30*time.Millisecond),
+		},
+	}
+
+	client := mocks.NewAPI(t)
+	client.On("ListTraces", mock.Anything, &cloudtrace.TracesQuery{
+		ProjectID: "testing",
+		Filter:    `resource.type:"testing"`,
+		Limit:     20,
+		TimeRange: cloudtrace.TimeRange{
+			From: from,
+			To:   to,
+		},
+		CompleteView: true,
+	}).Return([]*tracepb.Trace{&trace}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryType": "serviceStats", "queryText": "resource.type:\"testing\""}`),
+				RefID: refID,
+				TimeRange: backend.TimeRange{
+					From: from,
+					To:   to,
+				},
+				MaxDataPoints: 20,
+			},
+		},
+	})
+
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	require.Len(t, resp.Responses[refID].Frames, 1)
+	frame := resp.Responses[refID].Frames[0]
+	require.Equal(t, "serviceStats", frame.Name)
+	require.Equal(t, 2, frame.Rows())
+
+	serviceField, _ := frame.FieldByName("Service")
+	countField, _ := frame.FieldByName("Span count")
+	avgField, _ := frame.FieldByName("Average duration")
+	p95Field, _ := frame.FieldByName("P95 duration")
+	require.Equal(t, "backend", serviceField.At(0))
+	require.Equal(t, int64(2), countField.At(0))
+	require.Equal(t, 20.0, avgField.At(0))
+	require.Equal(t, 30.0, p95Field.At(0))
+	require.Equal(t, "frontend", serviceField.At(1))
+	require.Equal(t, int64(1), countField.At(1))
+	require.Equal(t, 100.0, avgField.At(1))
+	require.Equal(t, 100.0, p95Field.At(1))
+	client.AssertExpectations(t)
+}
+
+func TestCreateTraceSpanFrame_DebugMode(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	trace := &tracepb.Trace{
+		ProjectId: "testing",
+		TraceId:   "123",
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 1, Name: "spanName", StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(time.Millisecond))},
+		},
+	}
+
+	frame := createTraceSpanFrame(trace, config{}, "", 0, spanWindow{})
+	require.NotContains(t, frame.Meta.Custom, "rawTrace")
+
+	frame = createTraceSpanFrame(trace, config{DebugMode: true}, "", 0, spanWindow{})
+	custom, ok := frame.Meta.Custom.(map[string]interface{})
+	require.True(t, ok)
+	rawTrace, ok := custom["rawTrace"].(json.RawMessage)
+	require.True(t, ok)
+
+	var decoded struct {
+		ProjectID string `json:"projectId"`
+		TraceID   string `json:"traceId"`
+		Spans     []struct {
+			Name string `json:"name"`
+		} `json:"spans"`
+	}
+	require.NoError(t, json.Unmarshal(rawTrace, &decoded))
+	require.Equal(t, "testing", decoded.ProjectID)
+	require.Equal(t, "123", decoded.TraceID)
+	require.Len(t, decoded.Spans, 1)
+	require.Equal(t, "spanName", decoded.Spans[0].Name)
+}
+
+func TestQueryData_RootSpans(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+	startTime := timestamppb.New(time.UnixMilli(1660920349373))
+	endTime := timestamppb.New(time.UnixMilli(1660920349374))
+	traces := []*tracepb.Trace{
+		{
+			TraceId: "1",
+			Spans: []*tracepb.TraceSpan{
+				{SpanId: 10, Name: "firstRoot", StartTime: startTime, EndTime: endTime},
+			},
+		},
+		{
+			TraceId: "2",
+			Spans:   []*tracepb.TraceSpan{},
+		},
+		{
+			TraceId: "3",
+			Spans: []*tracepb.TraceSpan{
+				{SpanId: 30, Name: "secondRoot", StartTime: startTime, EndTime: endTime},
+			},
+		},
+	}
+
+	client := mocks.NewAPI(t)
+	client.On("ListTraces", mock.Anything, &cloudtrace.TracesQuery{
+		ProjectID: "testing",
+		Filter:    `resource.type:"testing"`,
+		Limit:     20,
+		TimeRange: cloudtrace.TimeRange{
+			From: from,
+			To:   to,
+		},
+	}).Return(traces, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryType": "roots", "queryText": "resource.type:\"testing\""}`),
+				RefID: refID,
+				TimeRange: backend.TimeRange{
+					From: from,
+					To:   to,
+				},
+				MaxDataPoints: 20,
+			},
+		},
+	})
+
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	require.Len(t, resp.Responses[refID].Frames, 1)
+	frame := resp.Responses[refID].Frames[0]
+	require.Equal(t, "roots", frame.Name)
+	require.Equal(t, data.VisTypeTrace, string(frame.Meta.PreferredVisualization))
+	require.Len(t, frame.Fields, 19)
+	require.Equal(t, 2, frame.Rows())
+
+	traceIDField, _ := frame.FieldByName("traceID")
+	spanIDField, _ := frame.FieldByName("spanID")
+	operationNameField, _ := frame.FieldByName("operationName")
+	require.Equal(t, "1", traceIDField.At(0))
+	require.Equal(t, "10", spanIDField.At(0))
+	require.Equal(t, "firstRoot", operationNameField.At(0))
+	require.Equal(t, "3", traceIDField.At(1))
+	require.Equal(t, "30", spanIDField.At(1))
+	require.Equal(t, "secondRoot", operationNameField.At(1))
+	client.AssertExpectations(t)
+}
+
+func TestCreateFrames_TimeZone(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 1, StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(time.Millisecond))},
+		},
+	}
+
+	// Times are UTC instants without display config, so Grafana shows them in the
+	// dashboard's time zone. A time zone in the datasource settings is ignored
+	conf := config{}
+	require.NoError(t, json.Unmarshal([]byte(`{"timeZone": "Europe/Paris"}`), &conf))
+
+	spanFrame := createTraceSpanFrame(trace, conf, "", 0, spanWindow{})
+	spanStartTime, _ := spanFrame.FieldByName("startTime")
+	require.Nil(t, spanStartTime.Config)
+	require.Equal(t, start.UTC(), spanStartTime.At(0))
+
+	tableFrame := createTracesTableFrame([]*tracepb.Trace{trace}, "testing", conf)
+	tableStartTime, _ := tableFrame.FieldByName("Start time")
+	require.Nil(t, tableStartTime.Config)
+	require.Equal(t, start.UTC(), tableStartTime.At(0))
+}
+
+func TestCallResource_ProjectsIncludeDeleted(t *testing.T) {
+	testCases := []struct {
+		name           string
+		url            string
+		includeDeleted bool
+	}{
+		{
+			name: "Deleted projects excluded by default",
+			url:  "projects",
+		},
+		{
+			name:           "Deleted projects included",
+			url:            "projects?includeDeleted=true",
+			includeDeleted: true,
+		},
+		{
+			name: "Invalid param value",
+			url:  "projects?includeDeleted=maybe",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListProjects", mock.Anything, &cloudtrace.ProjectsQuery{IncludeDeleted: tc.includeDeleted}).Return([]string{"testing"}, nil)
+
+			ds := CloudTraceDatasource{
+				client: client,
+			}
+			var resp *backend.CallResourceResponse
+			err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "projects", URL: tc.url},
+				backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+					resp = r
+					return nil
+				}))
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.Status)
+			require.JSONEq(t, `["testing"]`, string(resp.Body))
+			client.AssertExpectations(t)
+		})
+	}
+}
+
+func TestQueryData_DefaultLimit(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+
+	testCases := []struct {
+		name          string
+		conf          config
+		maxDataPoints int64
+		expectedLimit int64
+	}{
+		{
+			name:          "Max data points used as the limit",
+			maxDataPoints: 20,
+			expectedLimit: 20,
+		},
+		{
+			name:          "Zero max data points",
+			maxDataPoints: 0,
+			expectedLimit: 100,
+		},
+		{
+			name:          "Negative max data points",
+			maxDataPoints: -1,
+			expectedLimit: 100,
+		},
+		{
+			name:          "Configured default limit",
+			conf:          config{DefaultLimit: 50},
+			maxDataPoints: 0,
+			expectedLimit: 50,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListTraces", mock.Anything, &cloudtrace.TracesQuery{
+				ProjectID: "testing",
+				Limit:     tc.expectedLimit,
+				TimeRange: cloudtrace.TimeRange{
+					From: from,
+					To:   to,
+				},
+			}).Return([]*tracepb.Trace{}, nil)
+
+			ds := CloudTraceDatasource{
+				client: client,
+				conf:   tc.conf,
+			}
+			refID := "test"
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{
+					{
+						JSON:  []byte(`{"projectId": "testing"}`),
+						RefID: refID,
+						TimeRange: backend.TimeRange{
+							From: from,
+							To:   to,
+						},
+						MaxDataPoints: tc.maxDataPoints,
+					},
+				},
+			})
+
+			require.NoError(t, err)
+			require.NoError(t, resp.Responses[refID].Error)
+			client.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCallResource_Metadata(t *testing.T) {
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 1, Labels: map[string]string{"http.method": "GET", "service.name": "frontend"}},
+			{SpanId: 2, Labels: map[string]string{"/http/method": "POST", "/http/status_code": "200"}},
+			{SpanId: 3, Labels: map[string]string{"http.method": "GET"}},
+		},
+	}
+
+	testCases := []struct {
+		name         string
+		url          string
+		expectedBody string
+	}{
+		{
+			name:         "Projects only",
+			url:          "metadata",
+			expectedBody: `{"projects":["testing","other"]}`,
+		},
+		{
+			name:         "Projects with label keys and methods",
+			url:          "metadata?projectId=testing",
+			expectedBody: `{"projects":["testing","other"],"labelKeys":["/http/method","/http/status_code","http.method","service.name"],"methods":["GET","POST"]}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListProjects", mock.Anything, &cloudtrace.ProjectsQuery{}).Return([]string{"testing", "other"}, nil)
+			if tc.url != "metadata" {
+				client.On("ListTraces", mock.Anything, mock.MatchedBy(func(q *cloudtrace.TracesQuery) bool {
+					return q.ProjectID == "testing" && q.CompleteView
+				})).Return([]*tracepb.Trace{trace}, nil)
+			}
+
+			ds := CloudTraceDatasource{
+				client: client,
+			}
+			var resp *backend.CallResourceResponse
+			err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "metadata", URL: tc.url},
+				backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+					resp = r
+					return nil
+				}))
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.Status)
+			require.JSONEq(t, tc.expectedBody, string(resp.Body))
+			client.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCallResource_ProjectsAPIDisabled(t *testing.T) {
+	client := mocks.NewAPI(t)
+	client.On("ListProjects", mock.Anything, &cloudtrace.ProjectsQuery{}).Return([]string{}, fmt.Errorf("%w: forbidden", cloudtrace.ErrResourceManagerDisabled))
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	var resp *backend.CallResourceResponse
+	err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "projects", URL: "projects"},
+		backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+			resp = r
+			return nil
+		}))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.Status)
+
+	var body projectsHint
+	require.NoError(t, json.Unmarshal(resp.Body, &body))
+	require.Equal(t, []string{}, body.Projects)
+	require.Equal(t, cloudtrace.ResourceManagerDisabledHint, body.Hint)
+}
+
+func TestQueryData_RawFilter(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+
+	testCases := []struct {
+		name           string
+		queryJSON      string
+		expectedFilter string
+	}{
+		{
+			name:           "Query text translated by default",
+			queryJSON:      `{"projectId": "testing", "queryText": "SpanName:+root MinLatency:100ms"}`,
+			expectedFilter: "env:prod +span:root latency:100ms",
+		},
+		{
+			name:           "Raw filter skips translation and the default filter",
+			queryJSON:      `{"projectId": "testing", "queryText": "+^span:root latency:100ms", "rawFilter": true}`,
+			expectedFilter: "+^span:root latency:100ms",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListTraces", mock.Anything, &cloudtrace.TracesQuery{
+				ProjectID: "testing",
+				Filter:    tc.expectedFilter,
+				Limit:     20,
+				TimeRange: cloudtrace.TimeRange{
+					From: from,
+					To:   to,
+				},
+			}).Return([]*tracepb.Trace{}, nil)
+
+			ds := CloudTraceDatasource{
+				client: client,
+				conf:   config{DefaultFilter: "env:prod"},
+			}
+			refID := "test"
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{
+					{
+						JSON:  []byte(tc.queryJSON),
+						RefID: refID,
+						TimeRange: backend.TimeRange{
+							From: from,
+							To:   to,
+						},
+						MaxDataPoints: 20,
+					},
+				},
+			})
+
+			require.NoError(t, err)
+			require.NoError(t, resp.Responses[refID].Error)
+			client.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCreateTraceSpanFrame_SpanFilter(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 1, Name: "root", StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(100 * time.Millisecond))},
+			{SpanId: 2, ParentSpanId: 1, Name: "query", StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(10 * time.Millisecond))},
+			{SpanId: 3, ParentSpanId: 1, Name: "render", StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(200 * time.Millisecond))},
+		},
+	}
+
+	frame := createTraceSpanFrame(trace, config{}, "query", 0, spanWindow{})
+
+	require.Equal(t, 2, frame.Rows())
+	spanIDField, _ := frame.FieldByName("spanID")
+	require.Equal(t, "1", spanIDField.At(0))
+	require.Equal(t, "2", spanIDField.At(1))
+	// The trace latency is still of the whole trace
+	require.Equal(t, map[string]interface{}{"traceLatencyMs": float64(200)}, frame.Meta.Custom)
+}
+
+func TestCreateTraceSpanFrame_ExcludeServices(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 1, Name: "root", StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(100 * time.Millisecond))},
+			{SpanId: 2, ParentSpanId: 1, Name: "outbound", Labels: map[string]string{"service.name": "istio-proxy"}, StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(10 * time.Millisecond))},
+			{SpanId: 3, ParentSpanId: 2, Name: "query", StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(10 * time.Millisecond))},
+		},
+	}
+
+	frame := createTraceSpanFrame(trace, config{ExcludeServices: []string{"istio-proxy"}}, "", 0, spanWindow{})
+
+	require.Equal(t, 2, frame.Rows())
+	spanIDField, _ := frame.FieldByName("spanID")
+	parentSpanIDField, _ := frame.FieldByName("parentSpanID")
+	require.Equal(t, "3", spanIDField.At(1))
+	require.Equal(t, "1", parentSpanIDField.At(1))
+}
+
+func TestCreateTraceSpanFrame_Name(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 2, ParentSpanId: 1, Name: "query", StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(10 * time.Millisecond))},
+			{
+				SpanId:    1,
+				Name:      "/checkout",
+				Labels:    map[string]string{"g.co/gae/app/module": "frontend", "/http/method": "POST"},
+				StartTime: timestamppb.New(start),
+				EndTime:   timestamppb.New(start.Add(100 * time.Millisecond)),
+			},
+		},
+	}
+
+	testCases := []struct {
+		name         string
+		conf         config
+		trace        *tracepb.Trace
+		expectedName string
+	}{
+		{
+			name:         "Trace ID by default",
+			trace:        trace,
+			expectedName: "123",
+		},
+		{
+			name:         "Trace name of the root span",
+			conf:         config{SpanFrameName: "traceName"},
+			trace:        trace,
+			expectedName: "frontend: HTTP POST /checkout",
+		},
+		{
+			name:         "Trace ID without spans to name the trace by",
+			conf:         config{SpanFrameName: "traceName"},
+			trace:        &tracepb.Trace{TraceId: "123"},
+			expectedName: "123",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			frame := createTraceSpanFrame(tc.trace, tc.conf, "", 0, spanWindow{})
+			require.Equal(t, tc.expectedName, frame.Name)
+		})
+	}
+}
+
+func TestCreateTraceSpanFrame_SelfTime(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	span := func(id uint64, parentID uint64, startMs int, endMs int) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start.Add(time.Duration(startMs) * time.Millisecond)),
+			EndTime:      timestamppb.New(start.Add(time.Duration(endMs) * time.Millisecond)),
+		}
+	}
+
+	frame := createTraceSpanFrame(&tracepb.Trace{
+		TraceId: "123",
+		Spans:   []*tracepb.TraceSpan{span(1, 0, 0, 100), span(2, 1, 10, 30), span(3, 1, 40, 70)},
+	}, config{}, "", 0, spanWindow{})
+
+	selfTimeField, _ := frame.FieldByName("selfTime")
+	require.Equal(t, float64(50), selfTimeField.At(0))
+	require.Equal(t, float64(20), selfTimeField.At(1))
+	require.Equal(t, float64(30), selfTimeField.At(2))
+}
+
+func TestCreateTraceSpanFrame_GRPCStatus(t *testing.T) {
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 1, Name: "/cart.Cart/GetCart", Labels: map[string]string{"rpc.grpc.status_code": "5"}},
+			{SpanId: 2, ParentSpanId: 1, Name: "query"},
+		},
+	}
+
+	frame := createTraceSpanFrame(trace, config{}, "", 0, spanWindow{})
+
+	grpcStatusField, _ := frame.FieldByName("grpcStatus")
+	require.Equal(t, "NOT_FOUND", grpcStatusField.At(0))
+	require.Equal(t, "", grpcStatusField.At(1))
+}
+
+func TestCreateTraceSpanFrame_Messaging(t *testing.T) {
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 1, Name: "checkout"},
+			{SpanId: 2, ParentSpanId: 1, Name: "orders send", Labels: map[string]string{
+				"messaging.system":           "kafka",
+				"messaging.destination.name": "orders",
+				"span.kind":                  "producer",
+			}},
+		},
+	}
+
+	frame := createTraceSpanFrame(trace, config{}, "", 0, spanWindow{})
+
+	operationNameField, _ := frame.FieldByName("operationName")
+	require.Equal(t, "checkout", operationNameField.At(0))
+	require.Equal(t, "kafka SEND orders", operationNameField.At(1))
+	messagingDestinationField, _ := frame.FieldByName("messagingDestination")
+	require.Equal(t, "", messagingDestinationField.At(0))
+	require.Equal(t, "orders", messagingDestinationField.At(1))
+}
+
+func TestCreateTraceSpanFrame_MissingParents(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	span := func(id uint64, parentID uint64, startOffset time.Duration, endOffset time.Duration) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			Name:         fmt.Sprint("span", id),
+			StartTime:    timestamppb.New(start.Add(startOffset)),
+			EndTime:      timestamppb.New(start.Add(endOffset)),
+		}
+	}
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			span(1, 0, 0, 100*time.Millisecond),
+			// Both children of span 7, which is missing from the trace
+			span(2, 7, 10*time.Millisecond, 20*time.Millisecond),
+			span(3, 7, 15*time.Millisecond, 40*time.Millisecond),
+		},
+	}
+
+	frame := createTraceSpanFrame(trace, config{}, "", 0, spanWindow{})
+
+	require.Equal(t, 4, frame.Rows())
+	spanIDField, _ := frame.FieldByName("spanID")
+	parentSpanIDField, _ := frame.FieldByName("parentSpanID")
+	operationNameField, _ := frame.FieldByName("operationName")
+	startTimeField, _ := frame.FieldByName("startTime")
+	durationField, _ := frame.FieldByName("duration")
+	require.Equal(t, "7", spanIDField.At(3))
+	require.Equal(t, "1", parentSpanIDField.At(3))
+	require.Equal(t, cloudtrace.MissingSpanName, operationNameField.At(3))
+	require.Equal(t, start.Add(10*time.Millisecond).UTC(), startTimeField.At(3))
+	require.Equal(t, float64(30), durationField.At(3))
+	require.Equal(t, "7", parentSpanIDField.At(1))
+	require.Equal(t, "7", parentSpanIDField.At(2))
+
+	require.Len(t, frame.Meta.Notices, 1)
+	require.Contains(t, frame.Meta.Notices[0].Text, "2 spans have parent spans missing from the trace")
+
+	// Complete traces are unchanged
+	frame = createTraceSpanFrame(&tracepb.Trace{TraceId: "123", Spans: trace.Spans[:1]}, config{}, "", 0, spanWindow{})
+	require.Equal(t, 1, frame.Rows())
+	require.Empty(t, frame.Meta.Notices)
+}
+
+func TestCreateTraceSpanFrame_ClockSkew(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	span := func(id uint64, parentID uint64, startOffset time.Duration) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start.Add(startOffset)),
+			EndTime:      timestamppb.New(start.Add(startOffset + 10*time.Millisecond)),
+		}
+	}
+
+	// The child starts before its parent
+	frame := createTraceSpanFrame(&tracepb.Trace{
+		TraceId: "123",
+		Spans:   []*tracepb.TraceSpan{span(1, 0, 0), span(2, 1, 5*time.Millisecond), span(3, 2, 2*time.Millisecond)},
+	}, config{}, "", 0, spanWindow{})
+	require.Equal(t, []data.Notice{{
+		Severity: data.NoticeSeverityWarning,
+		Text:     "1 spans start before their parent span, likely due to clock skew between services: 3",
+	}}, frame.Meta.Notices)
+
+	// Many skewed spans are summarized
+	spans := []*tracepb.TraceSpan{span(1, 0, 0)}
+	for id := uint64(2); id <= 8; id++ {
+		spans = append(spans, span(id, 1, -time.Millisecond))
+	}
+	frame = createTraceSpanFrame(&tracepb.Trace{TraceId: "123", Spans: spans}, config{}, "", 0, spanWindow{})
+	require.Len(t, frame.Meta.Notices, 1)
+	require.Equal(t, "7 spans start before their parent span, likely due to clock skew between services: 2, 3, 4, 5, 6, and 2 more",
+		frame.Meta.Notices[0].Text)
+
+	// No notice without skew
+	frame = createTraceSpanFrame(&tracepb.Trace{
+		TraceId: "123",
+		Spans:   []*tracepb.TraceSpan{span(1, 0, 0), span(2, 1, 0)},
+	}, config{}, "", 0, spanWindow{})
+	require.Empty(t, frame.Meta.Notices)
+}
+
+func TestCreateTracesTableFrame_ErrorService(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	span := func(id uint64, parentID uint64, kind tracepb.TraceSpan_SpanKind, service string, labels map[string]string) *tracepb.TraceSpan {
+		spanLabels := map[string]string{"service.name": service}
+		for key, value := range labels {
+			spanLabels[key] = value
+		}
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			Kind:         kind,
+			Name:         "span",
+			Labels:       spanLabels,
+			StartTime:    timestamppb.New(start),
+			EndTime:      timestamppb.New(start.Add(10 * time.Millisecond)),
+		}
+	}
+	failed := map[string]string{"/http/status_code": "503"}
+
+	traces := []*tracepb.Trace{
+		// The error propagates up from the payment service, called by checkout
+		{TraceId: "downstream", Spans: []*tracepb.TraceSpan{
+			span(1, 0, tracepb.TraceSpan_RPC_SERVER, "frontend", failed),
+			span(2, 1, tracepb.TraceSpan_RPC_CLIENT, "frontend", failed),
+			span(3, 2, tracepb.TraceSpan_RPC_SERVER, "checkout", failed),
+			span(4, 3, tracepb.TraceSpan_RPC_CLIENT, "checkout", map[string]string{"otel.status_code": "ERROR"}),
+			span(5, 4, tracepb.TraceSpan_RPC_SERVER, "payment", map[string]string{"otel.status_code": "ERROR"}),
+			span(6, 3, tracepb.TraceSpan_RPC_CLIENT, "checkout", nil),
+		}},
+		// A server span is preferred over a client span at the same depth
+		{TraceId: "sameDepth", Spans: []*tracepb.TraceSpan{
+			span(1, 0, tracepb.TraceSpan_SPAN_KIND_UNSPECIFIED, "frontend", nil),
+			span(2, 1, tracepb.TraceSpan_RPC_CLIENT, "frontend", failed),
+			span(3, 1, tracepb.TraceSpan_RPC_SERVER, "cart", failed),
+		}},
+		// Listed with only the root span
+		{TraceId: "root", Spans: []*tracepb.TraceSpan{span(1, 0, tracepb.TraceSpan_RPC_SERVER, "frontend", failed)}},
+		{TraceId: "ok", Spans: []*tracepb.TraceSpan{span(1, 0, tracepb.TraceSpan_RPC_SERVER, "frontend", nil)}},
+	}
+
+	frame := createTracesTableFrame(traces, "testing", config{})
+
+	errorServiceField, _ := frame.FieldByName("Error service")
+	require.Equal(t, "payment", errorServiceField.At(0))
+	require.Equal(t, "cart", errorServiceField.At(1))
+	require.Equal(t, "frontend", errorServiceField.At(2))
+	require.Equal(t, "", errorServiceField.At(3))
+}
+
+func TestCreateTracesTableFrame_CompleteTraceLatency(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	traces := []*tracepb.Trace{
+		{
+			TraceId: "rootOnly",
+			Spans: []*tracepb.TraceSpan{
+				{SpanId: 1, StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(20 * time.Millisecond))},
+			},
+		},
+		{
+			TraceId: "complete",
+			Spans: []*tracepb.TraceSpan{
+				{SpanId: 1, StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(20 * time.Millisecond))},
+				{SpanId: 2, ParentSpanId: 1, StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(300 * time.Millisecond))},
+			},
+		},
+	}
+
+	frame := createTracesTableFrame(traces, "testing", config{})
+
+	latencyField, _ := frame.FieldByName("Latency")
+	require.Equal(t, int64(20), latencyField.At(0))
+	require.Equal(t, int64(300), latencyField.At(1))
+}
+
+func TestCreateTracesTableFrame_RootSpanNotFirst(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	traces := []*tracepb.Trace{
+		{
+			TraceId: "complete",
+			Spans: []*tracepb.TraceSpan{
+				{SpanId: 2, ParentSpanId: 1, Name: "child", StartTime: timestamppb.New(start.Add(10 * time.Millisecond)), EndTime: timestamppb.New(start.Add(20 * time.Millisecond))},
+				{SpanId: 1, Name: "root", StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(30 * time.Millisecond))},
+			},
+		},
+	}
+
+	frame := createTracesTableFrame(traces, "testing", config{})
+
+	nameField, _ := frame.FieldByName("Trace name")
+	startTimeField, _ := frame.FieldByName("Start time")
+	require.Equal(t, "root", nameField.At(0))
+	require.Equal(t, start.UTC(), startTimeField.At(0).(time.Time).UTC())
+
+	roots := createRootSpansFrame(traces, config{})
+	require.Equal(t, 1, roots.Rows())
+	operationField, _ := roots.FieldByName("operationName")
+	require.Equal(t, "root", operationField.At(0))
+}
+
+func TestQueryData_PastedTraceReference(t *testing.T) {
+	startTime := timestamppb.New(time.UnixMilli(1660920349373))
+	trace := tracepb.Trace{
+		ProjectId: "other-project",
+		TraceId:   "abc123",
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 1, Name: "spanName", StartTime: startTime, EndTime: startTime},
+		},
+	}
+
+	client := mocks.NewAPI(t)
+	client.On("GetTrace", mock.Anything, &cloudtrace.TraceQuery{
+		ProjectID: "other-project",
+		TraceID:   "abc123",
+	}).Return(&trace, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryType": "traceID", "traceId": "severity=INFO trace=projects/other-project/traces/abc123"}`),
+				RefID: refID,
+			},
+		},
+	})
+
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	require.Len(t, resp.Responses[refID].Frames, 1)
+	require.Equal(t, "abc123", resp.Responses[refID].Frames[0].Name)
+	client.AssertExpectations(t)
+}
+
+func TestCreateTracesTableFrame_Age(t *testing.T) {
+	past := time.Now().Add(-5 * time.Minute)
+	future := time.Now().Add(time.Hour)
+	traces := []*tracepb.Trace{
+		{TraceId: "past", Spans: []*tracepb.TraceSpan{{StartTime: timestamppb.New(past), EndTime: timestamppb.New(past)}}},
+		{TraceId: "future", Spans: []*tracepb.TraceSpan{{StartTime: timestamppb.New(future), EndTime: timestamppb.New(future)}}},
+	}
+
+	frame := createTracesTableFrame(traces, "testing", config{})
+
+	ageField, _ := frame.FieldByName("Age")
+	require.NotNil(t, ageField)
+	require.Equal(t, "dtdurationms", ageField.Config.Unit)
+	require.GreaterOrEqual(t, ageField.At(0).(int64), (5 * time.Minute).Milliseconds())
+	require.Equal(t, int64(0), ageField.At(1))
+}
+
+func TestCreateTraceSpanFrame_NegativeDuration(t *testing.T) {
+	start := time.UnixMilli(1660920349373)
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			{SpanId: 1, StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(10 * time.Millisecond))},
+			{SpanId: 2, ParentSpanId: 1, StartTime: timestamppb.New(start), EndTime: timestamppb.New(start.Add(-5 * time.Millisecond))},
+		},
+	}
+
+	testCases := []struct {
+		name              string
+		conf              config
+		expectedDurations []float64
+	}{
+		{
+			name:              "Negative durations kept by default",
+			conf:              config{},
+			expectedDurations: []float64{10, -5},
+		},
+		{
+			name:              "Negative durations clamped",
+			conf:              config{ClampNegativeDurations: true},
+			expectedDurations: []float64{10, 0},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spanFrame := createTraceSpanFrame(trace, tc.conf, "", 0, spanWindow{})
+			treeFrame := createSpanTreeFrame(trace, tc.conf)
+
+			for _, frame := range []*data.Frame{spanFrame, treeFrame} {
+				durationField, _ := frame.FieldByName("duration")
+				durations := []float64{}
+				for i := 0; i < durationField.Len(); i++ {
+					durations = append(durations, durationField.At(i).(float64))
+				}
+				require.Equal(t, tc.expectedDurations, durations)
+			}
+		})
+	}
+}
+
+func TestQueryData_CredentialRef(t *testing.T) {
+	defaultClient := mocks.NewAPI(t)
+	orgA := mocks.NewAPI(t)
+	orgB := mocks.NewAPI(t)
+	orgA.On("GetTrace", mock.Anything, &cloudtrace.TraceQuery{ProjectID: "a", TraceID: "1"}).
+		Return(&tracepb.Trace{ProjectId: "a", TraceId: "1"}, nil)
+	orgB.On("GetTrace", mock.Anything, &cloudtrace.TraceQuery{ProjectID: "b", TraceID: "2"}).
+		Return(&tracepb.Trace{ProjectId: "b", TraceId: "2"}, nil)
+
+	credentials, err := newCredentialSets(config{}, map[string]string{
+		credentialSetsKey: `{"orgA": {"project_id": "a"}, "orgB": {"project_id": "b"}}`,
+	})
+	require.NoError(t, err)
+	created := map[string]int{}
+	credentials.newClient = func(_ context.Context, serviceAccount []byte) (cloudtrace.API, error) {
+		var sa serviceAccountJSON
+		require.NoError(t, json.Unmarshal(serviceAccount, &sa))
+		created[sa.ProjectID]++
+		if sa.ProjectID == "a" {
+			return orgA, nil
+		}
+		return orgB, nil
+	}
+
+	ds := CloudTraceDatasource{
+		client:      defaultClient,
+		credentials: credentials,
+	}
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{JSON: []byte(`{"projectId": "a", "queryType": "traceID", "traceId": "1", "credentialRef": "orgA"}`), RefID: "A"},
+			{JSON: []byte(`{"projectId": "b", "queryType": "traceID", "traceId": "2", "credentialRef": "orgB"}`), RefID: "B"},
+			{JSON: []byte(`{"projectId": "a", "queryType": "traceID", "traceId": "1", "credentialRef": "orgA"}`), RefID: "C"},
+			{JSON: []byte(`{"projectId": "a", "queryType": "traceID", "traceId": "1", "credentialRef": "orgC"}`), RefID: "D"},
+		},
+	})
+
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses["A"].Error)
+	require.NoError(t, resp.Responses["B"].Error)
+	require.NoError(t, resp.Responses["C"].Error)
+	require.ErrorIs(t, resp.Responses["D"].Error, errUnknownCredentialRef)
+	require.Nil(t, resp.Responses["D"].Frames)
+	// Clients are created once per credential set, and the default client isn't used
+	require.Equal(t, map[string]int{"a": 1, "b": 1}, created)
+	orgA.AssertNumberOfCalls(t, "GetTrace", 2)
+	orgB.AssertNumberOfCalls(t, "GetTrace", 1)
+	defaultClient.AssertNotCalled(t, "GetTrace", mock.Anything, mock.Anything)
+}
+
+func TestQueryData_CredentialRef_CancelledQuery(t *testing.T) {
+	orgA := mocks.NewAPI(t)
+	orgA.On("GetTrace", mock.Anything, &cloudtrace.TraceQuery{ProjectID: "a", TraceID: "1"}).
+		Return(&tracepb.Trace{ProjectId: "a", TraceId: "1"}, nil)
+
+	credentials, err := newCredentialSets(config{}, map[string]string{
+		credentialSetsKey: `{"orgA": {"project_id": "a"}}`,
+	})
+	require.NoError(t, err)
+	var clientCtxs []context.Context
+	credentials.newClient = func(ctx context.Context, _ []byte) (cloudtrace.API, error) {
+		clientCtxs = append(clientCtxs, ctx)
+		return orgA, nil
+	}
+
+	ds := CloudTraceDatasource{
+		client:      mocks.NewAPI(t),
+		credentials: credentials,
+	}
+	req := &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{JSON: []byte(`{"projectId": "a", "queryType": "traceID", "traceId": "1", "credentialRef": "orgA"}`), RefID: "A"},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := ds.QueryData(ctx, req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses["A"].Error)
+	cancel()
+
+	resp, err = ds.QueryData(context.Background(), req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses["A"].Error)
+
+	// The cached client isn't tied to the first query, whose context is cancelled
+	require.Len(t, clientCtxs, 1)
+	require.NoError(t, clientCtxs[0].Err())
+	orgA.AssertNumberOfCalls(t, "GetTrace", 2)
+}
+
+func TestQueryData_Explain(t *testing.T) {
+	to := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	from := to.Add(-48 * time.Hour)
+
+	// Explaining never calls GCP, so the mock has no expectations
+	client := mocks.NewAPI(t)
+	ds := CloudTraceDatasource{
+		client: client,
+		conf:   config{MaxTimeRangeHours: 24, PageSize: 20},
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryType": "explain", "traceId": "123", "queryText": "MinLatency:100ms", "orderBy": "latency desc"}`),
+				RefID: refID,
+				TimeRange: backend.TimeRange{
+					From: from,
+					To:   to,
+				},
+				MaxDataPoints: 50,
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	require.Len(t, resp.Responses[refID].Frames, 1)
+
+	f := resp.Responses[refID].Frames[0]
+	require.Equal(t, "explain", f.Name)
+	explained := map[string]string{}
+	for i := 0; i < f.Rows(); i++ {
+		explained[f.Fields[0].At(i).(string)+"."+f.Fields[1].At(i).(string)] = f.Fields[2].At(i).(string)
+	}
+	require.Equal(t, map[string]string{
+		"ListTraces.projectId":   "testing",
+		"ListTraces.filter":      "latency:100ms",
+		"ListTraces.startTime":   "2024-01-01T12:00:00Z",
+		"ListTraces.endTime":     "2024-01-02T12:00:00Z",
+		"ListTraces.limit":       "50",
+		"ListTraces.pageSize":    "20",
+		"ListTraces.orderBy":     "duration desc",
+		"ListTraces.view":        "COMPLETE",
+		"ListTraces.bypassCache": "false",
+		"GetTrace.projectId":     "testing",
+		"GetTrace.traceId":       "123",
+	}, explained)
+}
+
+func TestQueryData_Explain_SameAsTracesTable(t *testing.T) {
+	defer func(original func() time.Time) {
+		timeNow = original
+	}(timeNow)
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+
+	client := mocks.NewAPI(t)
+	ds := CloudTraceDatasource{
+		client: client,
+		conf:   config{MaxLookbackHours: 48},
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryType": "explain", "multiService": true}`),
+				RefID: refID,
+				TimeRange: backend.TimeRange{
+					From: now.AddDate(-1, 0, 0),
+					To:   now,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+
+	f := resp.Responses[refID].Frames[0]
+	explained := map[string]string{}
+	for i := 0; i < f.Rows(); i++ {
+		explained[f.Fields[0].At(i).(string)+"."+f.Fields[1].At(i).(string)] = f.Fields[2].At(i).(string)
+	}
+	// The maximum lookback and the view of multi-service tables apply like they do to the table
+	require.Equal(t, "2024-01-08T00:00:00Z", explained["ListTraces.startTime"])
+	require.Equal(t, "COMPLETE", explained["ListTraces.view"])
+}
+
+func TestEstimateTraceCount(t *testing.T) {
+	to := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	timeRange := cloudtrace.TimeRange{From: to.Add(-24 * time.Hour), To: to}
+	tracesSince := func(count int, oldest time.Time) []*tracepb.Trace {
+		traces := []*tracepb.Trace{}
+		for i := 0; i < count; i++ {
+			traces = append(traces, &tracepb.Trace{
+				TraceId: fmt.Sprint(i),
+				Spans:   []*tracepb.TraceSpan{{StartTime: timestamppb.New(oldest.Add(time.Duration(i) * time.Second))}},
+			})
+		}
+		return traces
+	}
+
+	testCases := []struct {
+		name     string
+		traces   []*tracepb.Trace
+		matches  int64
+		expected traceEstimate
+	}{
+		{
+			name:     "Fewer traces than the limit are exact",
+			traces:   tracesSince(3, to.Add(-time.Hour)),
+			matches:  3,
+			expected: traceEstimate{EstimatedTraces: 3, Exact: true},
+		},
+		{
+			name:     "Sample over half the range is doubled",
+			traces:   tracesSince(10, to.Add(-12*time.Hour)),
+			matches:  10,
+			expected: traceEstimate{EstimatedTraces: 20},
+		},
+		{
+			name:    "Sample over a minute of the range is warned about",
+			traces:  tracesSince(10, to.Add(-time.Minute)),
+			matches: 10,
+			expected: traceEstimate{
+				EstimatedTraces: 14400,
+				Warning:         "about 14400 traces match, consider a narrower filter or time range",
+			},
+		},
+		{
+			name:     "Only matches after listing are counted",
+			traces:   tracesSince(3, to.Add(-time.Hour)),
+			matches:  1,
+			expected: traceEstimate{EstimatedTraces: 1, Exact: true},
+		},
+		{
+			name:     "Only matches after listing are extrapolated",
+			traces:   tracesSince(10, to.Add(-12*time.Hour)),
+			matches:  5,
+			expected: traceEstimate{EstimatedTraces: 10},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, estimateTraceCount(tc.traces, tc.matches, 10, timeRange))
+		})
+	}
+}
+
+func TestCallResource_Estimate(t *testing.T) {
+	client := mocks.NewAPI(t)
+	client.On("ListTraces", mock.Anything, &cloudtrace.TracesQuery{
+		ProjectID: "testing",
+		Filter:    "latency:100ms",
+		Limit:     estimateSampleLimit,
+		TimeRange: cloudtrace.TimeRange{
+			From: time.Unix(1000, 0),
+			To:   time.Unix(2000, 0),
+		},
+	}).Return([]*tracepb.Trace{{TraceId: "1"}}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	send := func(url string) *backend.CallResourceResponse {
+		var resp *backend.CallResourceResponse
+		err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "estimate", URL: url},
+			backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+				resp = r
+				return nil
+			}))
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := send("estimate?projectId=testing&queryText=MinLatency:100ms&from=1000000&to=2000000")
+	require.Equal(t, http.StatusOK, resp.Status)
+	require.JSONEq(t, `{"estimatedTraces":1,"exact":true}`, string(resp.Body))
+
+	resp = send("estimate?queryText=MinLatency:100ms")
+	require.Equal(t, http.StatusBadRequest, resp.Status)
+	client.AssertExpectations(t)
+}
+
+func TestCallResource_Estimate_TracePrefix(t *testing.T) {
+	client := mocks.NewAPI(t)
+	client.On("ListTraces", mock.Anything, mock.MatchedBy(func(q *cloudtrace.TracesQuery) bool {
+		return q.Filter == "latency:100ms"
+	})).Return([]*tracepb.Trace{{TraceId: "abc123"}, {TraceId: "def456"}}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	var resp *backend.CallResourceResponse
+	err := ds.CallResource(context.Background(), &backend.CallResourceRequest{
+		Path: "estimate",
+		URL:  "estimate?projectId=testing&queryText=TracePrefix:abc%20MinLatency:100ms&from=1000000&to=2000000",
+	}, backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+		resp = r
+		return nil
+	}))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.Status)
+	require.JSONEq(t, `{"estimatedTraces":1,"exact":true}`, string(resp.Body))
+	client.AssertExpectations(t)
+}
+
+func TestCallResource_Estimate_DefaultTimeRange(t *testing.T) {
+	defer func(original func() time.Time) {
+		timeNow = original
+	}(timeNow)
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+
+	client := mocks.NewAPI(t)
+	client.On("ListTraces", mock.Anything, mock.MatchedBy(func(q *cloudtrace.TracesQuery) bool {
+		return q.TimeRange.From.Equal(now.Add(-time.Hour)) && q.TimeRange.To.Equal(now)
+	})).Return([]*tracepb.Trace{{TraceId: "1"}}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	var resp *backend.CallResourceResponse
+	err := ds.CallResource(context.Background(), &backend.CallResourceRequest{
+		Path: "estimate",
+		URL:  "estimate?projectId=testing&queryText=MinLatency:100ms",
+	}, backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+		resp = r
+		return nil
+	}))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.Status)
+	client.AssertExpectations(t)
+}
+
+func TestProjectFromServiceAccountEmail(t *testing.T) {
+	testCases := []struct {
+		name            string
+		email           string
+		expectedProject string
+		expectedOK      bool
+	}{
+		{
+			name:            "User-managed service account",
+			email:           "grafana@my-project.iam.gserviceaccount.com",
+			expectedProject: "my-project",
+			expectedOK:      true,
+		},
+		{
+			name:            "Surrounding whitespace",
+			email:           " grafana@my-project.iam.gserviceaccount.com\n",
+			expectedProject: "my-project",
+			expectedOK:      true,
+		},
+		{name: "Empty", email: ""},
+		{name: "No at sign", email: "my-project.iam.gserviceaccount.com"},
+		{name: "Several at signs", email: "a@b@my-project.iam.gserviceaccount.com"},
+		{name: "No name", email: "@my-project.iam.gserviceaccount.com"},
+		{name: "No project", email: "grafana@.iam.gserviceaccount.com"},
+		{name: "Google-managed service account", email: "123-compute@developer.gserviceaccount.com"},
+		{name: "Not a service account", email: "someone@example.com"},
+		{name: "Domain with a dotted project", email: "grafana@a.b.iam.gserviceaccount.com"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			project, ok := projectFromServiceAccountEmail(tc.email)
+			require.Equal(t, tc.expectedOK, ok)
+			require.Equal(t, tc.expectedProject, project)
+		})
+	}
+}
+
+func TestSetImpersonationDefaultProject(t *testing.T) {
+	conf := config{UsingImpersonation: true, ServiceAccountToImpersonate: "grafana@target.iam.gserviceaccount.com"}
+	conf.setImpersonationDefaultProject()
+	require.Equal(t, "target", conf.DefaultProject)
+
+	conf = config{UsingImpersonation: true, ServiceAccountToImpersonate: "grafana@target.iam.gserviceaccount.com", DefaultProject: "set"}
+	conf.setImpersonationDefaultProject()
+	require.Equal(t, "set", conf.DefaultProject)
+
+	conf = config{ServiceAccountToImpersonate: "grafana@target.iam.gserviceaccount.com"}
+	conf.setImpersonationDefaultProject()
+	require.Equal(t, "", conf.DefaultProject)
+}
+
+func TestSetGCEDefaultProject(t *testing.T) {
+	defer func(original func(context.Context, string) (string, error)) {
+		gceDefaultProject = original
+	}(gceDefaultProject)
+	lookups := 0
+	gceDefaultProject = func(context.Context, string) (string, error) {
+		lookups++
+		return "gce-project", nil
+	}
+
+	conf := config{AuthType: gceAuthentication}
+	conf.setGCEDefaultProject(context.Background())
+	require.Equal(t, "gce-project", conf.DefaultProject)
+
+	// A default project that's set, or other authentication, doesn't look up the metadata
+	conf = config{AuthType: gceAuthentication, DefaultProject: "set"}
+	conf.setGCEDefaultProject(context.Background())
+	require.Equal(t, "set", conf.DefaultProject)
+	conf = config{AuthType: jwtAuthentication}
+	conf.setGCEDefaultProject(context.Background())
+	require.Equal(t, "", conf.DefaultProject)
+	require.Equal(t, 1, lookups)
+
+	// Outside GCE the metadata server is unreachable
+	gceDefaultProject = func(context.Context, string) (string, error) {
+		return "", errors.New("metadata: GCE metadata not defined")
+	}
+	conf = config{AuthType: gceAuthentication}
+	conf.setGCEDefaultProject(context.Background())
+	require.Equal(t, "", conf.DefaultProject)
+
+	// The lookup has a deadline, so a slow metadata server doesn't stall creating the data source
+	gceDefaultProject = func(ctx context.Context, _ string) (string, error) {
+		deadline, ok := ctx.Deadline()
+		require.True(t, ok)
+		require.WithinDuration(t, time.Now().Add(gceMetadataTimeout), deadline, time.Second)
+		return "", context.DeadlineExceeded
+	}
+	conf = config{AuthType: gceAuthentication}
+	conf.setGCEDefaultProject(context.Background())
+	require.Equal(t, "", conf.DefaultProject)
+}
+
+func TestClampLookback(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name              string
+		maxLookback       time.Duration
+		timeRange         cloudtrace.TimeRange
+		expectedTimeRange cloudtrace.TimeRange
+		expectedNotice    bool
+	}{
+		{
+			name:              "Unlimited",
+			timeRange:         cloudtrace.TimeRange{From: now.AddDate(-2, 0, 0), To: now},
+			expectedTimeRange: cloudtrace.TimeRange{From: now.AddDate(-2, 0, 0), To: now},
+		},
+		{
+			name:              "Within the lookback",
+			maxLookback:       24 * time.Hour,
+			timeRange:         cloudtrace.TimeRange{From: now.Add(-time.Hour), To: now},
+			expectedTimeRange: cloudtrace.TimeRange{From: now.Add(-time.Hour), To: now},
+		},
+		{
+			name:              "Start clamped",
+			maxLookback:       24 * time.Hour,
+			timeRange:         cloudtrace.TimeRange{From: now.AddDate(-2, 0, 0), To: now},
+			expectedTimeRange: cloudtrace.TimeRange{From: now.Add(-24 * time.Hour), To: now},
+			expectedNotice:    true,
+		},
+		{
+			name:              "Whole range before the lookback",
+			maxLookback:       24 * time.Hour,
+			timeRange:         cloudtrace.TimeRange{From: now.AddDate(0, 0, -5), To: now.AddDate(0, 0, -4)},
+			expectedTimeRange: cloudtrace.TimeRange{From: now.AddDate(0, 0, -4), To: now.AddDate(0, 0, -4)},
+			expectedNotice:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &cloudtrace.TracesQuery{TimeRange: tc.timeRange}
+			notice := clampLookback(q, tc.maxLookback, now)
+
+			require.Equal(t, tc.expectedTimeRange, q.TimeRange)
+			require.Equal(t, tc.expectedNotice, notice != nil)
+		})
+	}
+}
+
+func TestQueryData_MaxLookbackNotice(t *testing.T) {
+	defer func(original func() time.Time) {
+		timeNow = original
+	}(timeNow)
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+
+	client := mocks.NewAPI(t)
+	client.On("ListTraces", mock.Anything, mock.MatchedBy(func(q *cloudtrace.TracesQuery) bool {
+		return q.TimeRange.From.Equal(now.Add(-48 * time.Hour))
+	})).Return([]*tracepb.Trace{}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+		conf:   config{MaxLookbackHours: 48},
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing"}`),
+				RefID: refID,
+				TimeRange: backend.TimeRange{
+					From: now.AddDate(-1, 0, 0),
+					To:   now,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	require.Len(t, resp.Responses[refID].Frames[0].Meta.Notices, 1)
+	require.Equal(t, "Traces are only queried from the last 48h0m0s, as configured in the data source", resp.Responses[refID].Frames[0].Meta.Notices[0].Text)
+}
+
+func TestCallResource_OTLP(t *testing.T) {
+	client := mocks.NewAPI(t)
+	client.On("GetTrace", mock.Anything, &cloudtrace.TraceQuery{ProjectID: "other", TraceID: "abc"}).
+		Return(&tracepb.Trace{TraceId: "abc", Spans: []*tracepb.TraceSpan{{SpanId: 1, Name: "root"}}}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+		conf:   config{DefaultProject: "testing"},
+	}
+	send := func(path string, url string) *backend.CallResourceResponse {
+		var resp *backend.CallResourceResponse
+		err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: path, URL: url},
+			backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+				resp = r
+				return nil
+			}))
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := send("otlp/abc", "otlp/abc?projectId=other")
+	require.Equal(t, http.StatusOK, resp.Status)
+	var body cloudtrace.OTLPTracesData
+	require.NoError(t, json.Unmarshal(resp.Body, &body))
+	require.Len(t, body.ResourceSpans, 1)
+	require.Equal(t, "0000000000000001", body.ResourceSpans[0].ScopeSpans[0].Spans[0].SpanID)
+
+	resp = send("otlp/", "otlp/")
+	require.Equal(t, http.StatusBadRequest, resp.Status)
+	client.AssertExpectations(t)
+}
+
+func TestCallResource_ProjectsHealth(t *testing.T) {
+	client := mocks.NewAPI(t)
+	client.On("TestConnection", mock.Anything, "healthy").Return(1, nil)
+	client.On("TestConnection", mock.Anything, "denied").Return(0, errors.New("permission denied"))
+	client.On("TestConnection", mock.Anything, "empty").Return(0, cloudtrace.ErrNoTraces)
+	client.On("TestConnection", mock.Anything, "other").Return(1, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	send := func(url string) *backend.CallResourceResponse {
+		var resp *backend.CallResourceResponse
+		err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "projectsHealth", URL: url},
+			backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+				resp = r
+				return nil
+			}))
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := send("projectsHealth?projectIds=healthy,denied,empty&projectIds=other")
+	require.Equal(t, http.StatusOK, resp.Status)
+	require.JSONEq(t, `[
+		{"projectId":"healthy","ok":true},
+		{"projectId":"denied","ok":false,"error":"permission denied"},
+		{"projectId":"empty","ok":false,"error":"no entries"},
+		{"projectId":"other","ok":true}
+	]`, string(resp.Body))
+
+	ds.conf.HealthCheckAllowNoTraces = true
+	resp = send("projectsHealth?projectIds=empty")
+	require.Equal(t, http.StatusOK, resp.Status)
+	require.JSONEq(t, `[{"projectId":"empty","ok":true}]`, string(resp.Body))
+
+	resp = send("projectsHealth")
+	require.Equal(t, http.StatusBadRequest, resp.Status)
+	client.AssertExpectations(t)
+}
+
+func TestQueryData_TracePrefix(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+	span := &tracepb.TraceSpan{
+		Name:      "root",
+		StartTime: timestamppb.New(from),
+		EndTime:   timestamppb.New(from.Add(time.Second)),
+	}
+
+	client := mocks.NewAPI(t)
+	client.On("ListTraces", mock.Anything, mock.MatchedBy(func(q *cloudtrace.TracesQuery) bool {
+		return q.Filter == "latency:1s"
+	})).Return([]*tracepb.Trace{
+		{TraceId: "abc123", Spans: []*tracepb.TraceSpan{span}},
+		{TraceId: "def456", Spans: []*tracepb.TraceSpan{span}},
+	}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryText": "TracePrefix:ABC MinLatency:1s"}`),
+				RefID: refID,
+				TimeRange: backend.TimeRange{
+					From: from,
+					To:   to,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	frame := resp.Responses[refID].Frames[0]
+	require.Equal(t, 1, frame.Rows())
+	require.Equal(t, "abc123", frame.Fields[0].At(0))
+	client.AssertExpectations(t)
+}
+
+func TestQueryData_FiltersAfterListing_AllQueryTypes(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+	trace := func(id string, latency time.Duration, name string) *tracepb.Trace {
+		return &tracepb.Trace{TraceId: id, Spans: []*tracepb.TraceSpan{{
+			SpanId:    1,
+			Name:      name,
+			StartTime: timestamppb.New(from),
+			EndTime:   timestamppb.New(from.Add(latency)),
+		}}}
+	}
+	// sumInt64 adds up an int64 field, e.g. the span counts of service stats
+	sumInt64 := func(field *data.Field) int {
+		sum := 0
+		for i := 0; i < field.Len(); i++ {
+			sum += int(field.At(i).(int64))
+		}
+		return sum
+	}
+
+	filters := []struct {
+		queryText    string
+		completeView bool
+	}{
+		{queryText: "TracePrefix:abc"},
+		{queryText: "LatencyMs:>500", completeView: true},
+		{queryText: "ContainsSpan:db.query", completeView: true},
+	}
+	queryTypes := []struct {
+		queryType string
+		matches   func(f *data.Frame) int
+	}{
+		{queryType: "", matches: func(f *data.Frame) int { return f.Rows() }},
+		{queryType: "errors", matches: func(f *data.Frame) int { return f.Rows() }},
+		{queryType: "roots", matches: func(f *data.Frame) int { return f.Rows() }},
+		{queryType: "spansTable", matches: func(f *data.Frame) int { return f.Rows() }},
+		{queryType: "serviceStats", matches: func(f *data.Frame) int { return sumInt64(f.Fields[1]) }},
+		{queryType: "latencyHistogram", matches: func(f *data.Frame) int { return sumInt64(f.Fields[2]) }},
+	}
+
+	for _, filter := range filters {
+		for _, tc := range queryTypes {
+			t.Run(filter.queryText+"/"+tc.queryType, func(t *testing.T) {
+				client := mocks.NewAPI(t)
+				client.On("ListTraces", mock.Anything, mock.MatchedBy(func(q *cloudtrace.TracesQuery) bool {
+					return q.CompleteView || !filter.completeView
+				})).Return([]*tracepb.Trace{
+					trace("abc123", time.Second, "db.query"),
+					trace("def456", 10*time.Millisecond, "root"),
+				}, nil)
+
+				ds := CloudTraceDatasource{
+					client: client,
+				}
+				refID := "test"
+				resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+					Queries: []backend.DataQuery{
+						{
+							JSON:  []byte(fmt.Sprintf(`{"projectId": "testing", "queryType": %q, "queryText": %q}`, tc.queryType, filter.queryText)),
+							RefID: refID,
+							TimeRange: backend.TimeRange{
+								From: from,
+								To:   to,
+							},
+						},
+					},
+				})
+				require.NoError(t, err)
+				require.NoError(t, resp.Responses[refID].Error)
+				require.Equal(t, 1, tc.matches(resp.Responses[refID].Frames[0]))
+				client.AssertExpectations(t)
+			})
+		}
+	}
+}
+
+func TestQueryData_ContainsSpan(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+	root := &tracepb.TraceSpan{
+		SpanId:    1,
+		Name:      "/checkout",
+		StartTime: timestamppb.New(from),
+		EndTime:   timestamppb.New(from.Add(time.Second)),
+	}
+	child := &tracepb.TraceSpan{
+		SpanId:       2,
+		ParentSpanId: 1,
+		Name:         "db.query",
+		StartTime:    timestamppb.New(from),
+		EndTime:      timestamppb.New(from.Add(time.Millisecond)),
+	}
+
+	client := mocks.NewAPI(t)
+	client.On("ListTraces", mock.Anything, mock.MatchedBy(func(q *cloudtrace.TracesQuery) bool {
+		return q.Filter == "root:/checkout" && q.CompleteView
+	})).Return([]*tracepb.Trace{
+		{TraceId: "abc123", Spans: []*tracepb.TraceSpan{root}},
+		{TraceId: "def456", Spans: []*tracepb.TraceSpan{root, child}},
+	}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryText": "RootSpan:/checkout ContainsSpan:db.query"}`),
+				RefID: refID,
+				TimeRange: backend.TimeRange{
+					From: from,
+					To:   to,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	frame := resp.Responses[refID].Frames[0]
+	require.Equal(t, 1, frame.Rows())
+	require.Equal(t, "def456", frame.Fields[0].At(0))
+	client.AssertExpectations(t)
+}
+
+func TestQueryData_ErrorOnEmpty(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+
+	testCases := []struct {
+		name         string
+		errorOnEmpty bool
+		queryJSON    string
+		expectedErr  error
+	}{
+		{
+			name:      "No traces is an empty frame by default",
+			queryJSON: `{"projectId": "testing"}`,
+		},
+		{
+			name:         "No traces is an error if configured",
+			errorOnEmpty: true,
+			queryJSON:    `{"projectId": "testing"}`,
+			expectedErr:  errNoTracesFound,
+		},
+		{
+			name:      "Trace without spans is an empty frame by default",
+			queryJSON: `{"projectId": "testing", "queryType": "traceID", "traceId": "123"}`,
+		},
+		{
+			name:         "Trace without spans is an error if configured",
+			errorOnEmpty: true,
+			queryJSON:    `{"projectId": "testing", "queryType": "traceID", "traceId": "123"}`,
+			expectedErr:  errNoTracesFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListTraces", mock.Anything, mock.Anything).Return([]*tracepb.Trace{}, nil).Maybe()
+			client.On("GetTrace", mock.Anything, &cloudtrace.TraceQuery{ProjectID: "testing", TraceID: "123"}).
+				Return(&tracepb.Trace{TraceId: "123"}, nil).Maybe()
+
+			ds := CloudTraceDatasource{
+				client: client,
+				conf:   config{ErrorOnEmpty: tc.errorOnEmpty},
+			}
+			refID := "test"
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{
+					{
+						JSON:  []byte(tc.queryJSON),
+						RefID: refID,
+						TimeRange: backend.TimeRange{
+							From: from,
+							To:   to,
+						},
+					},
+				},
+			})
+			require.NoError(t, err)
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, resp.Responses[refID].Error, tc.expectedErr)
+				require.Empty(t, resp.Responses[refID].Frames)
+				return
+			}
+			require.NoError(t, resp.Responses[refID].Error)
+			require.Len(t, resp.Responses[refID].Frames, 1)
+			require.Equal(t, 0, resp.Responses[refID].Frames[0].Rows())
+		})
+	}
+}
+
+func TestQueryData_Comparisons(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+	trace := func(id string, latency time.Duration) *tracepb.Trace {
+		return &tracepb.Trace{TraceId: id, Spans: []*tracepb.TraceSpan{{
+			SpanId:    1,
+			Name:      "root",
+			StartTime: timestamppb.New(from),
+			EndTime:   timestamppb.New(from.Add(latency)),
+		}}}
+	}
+
+	client := mocks.NewAPI(t)
+	client.On("ListTraces", mock.Anything, mock.MatchedBy(func(q *cloudtrace.TracesQuery) bool {
+		// The comparison isn't sent to the Cloud Trace API
+		return q.Filter == "g.co/gae/app/module:frontend" && q.CompleteView
+	})).Return([]*tracepb.Trace{trace("fast", 100*time.Millisecond), trace("slow", time.Second)}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryText": "LatencyMs:>500 Service:frontend"}`),
+				RefID: refID,
+				TimeRange: backend.TimeRange{
+					From: from,
+					To:   to,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	frame := resp.Responses[refID].Frames[0]
+	require.Equal(t, 1, frame.Rows())
+	require.Equal(t, "slow", frame.Fields[0].At(0))
+	client.AssertExpectations(t)
+}
+
+func TestQueryData_MultiService(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+	span := func(id uint64, parentID uint64, service string) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			Name:         "root",
+			Labels:       map[string]string{"service.name": service},
+			StartTime:    timestamppb.New(from),
+			EndTime:      timestamppb.New(from.Add(time.Second)),
+		}
+	}
+
+	client := mocks.NewAPI(t)
+	client.On("ListTraces", mock.Anything, mock.MatchedBy(func(q *cloudtrace.TracesQuery) bool {
+		// Every span is needed to find the services of each trace
+		return q.CompleteView
+	})).Return([]*tracepb.Trace{
+		{TraceId: "single", Spans: []*tracepb.TraceSpan{span(1, 0, "frontend"), span(2, 1, "frontend")}},
+		{TraceId: "multi", Spans: []*tracepb.TraceSpan{span(1, 0, "frontend"), span(2, 1, "cart")}},
+	}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "multiService": true}`),
+				RefID: refID,
+				TimeRange: backend.TimeRange{
+					From: from,
+					To:   to,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	frame := resp.Responses[refID].Frames[0]
+	require.Equal(t, 1, frame.Rows())
+	require.Equal(t, "multi", frame.Fields[0].At(0))
+	client.AssertExpectations(t)
+}
+
+func TestQueryData_MergedTraces(t *testing.T) {
+	start := time.Now().Add(-1 * time.Minute)
+	span := func(id uint64, parentID uint64, name string, offset time.Duration) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			Name:         name,
+			StartTime:    timestamppb.New(start.Add(offset)),
+			EndTime:      timestamppb.New(start.Add(offset + time.Second)),
+		}
+	}
+
+	client := mocks.NewAPI(t)
+	client.On("GetTraces", mock.Anything, &cloudtrace.TracesBatchQuery{ProjectID: "testing", TraceIDs: []string{"a", "b"}}).
+		Return([]*tracepb.Trace{
+			{TraceId: "a", Spans: []*tracepb.TraceSpan{span(1, 0, "request", 0)}},
+			{TraceId: "b", Spans: []*tracepb.TraceSpan{span(2, 0, "job", 2*time.Second)}},
+		}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryType": "mergedTraces", "traceIds": ["a", " b ", ""]}`),
+				RefID: refID,
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	frame := resp.Responses[refID].Frames[0]
+	require.Equal(t, "a+b", frame.Name)
+	require.Equal(t, 3, frame.Rows())
+
+	// Both traces' roots are children of the synthetic root
+	traceIDField, _ := frame.FieldByName("traceID")
+	spanIDField, _ := frame.FieldByName("spanID")
+	parentSpanIDField, _ := frame.FieldByName("parentSpanID")
+	operationNameField, _ := frame.FieldByName("operationName")
+	require.Equal(t, cloudtrace.MergedRootSpanName, operationNameField.At(0))
+	require.Equal(t, "0", parentSpanIDField.At(0))
+	rootID := spanIDField.At(0)
+	for i := 1; i < frame.Rows(); i++ {
+		require.Equal(t, "a+b", traceIDField.At(i))
+		require.Equal(t, rootID, parentSpanIDField.At(i))
+	}
+
+	// The synthetic root spans both traces
+	durationField, _ := frame.FieldByName("duration")
+	require.Equal(t, float64(3000), durationField.At(0))
+}
+
+func TestQueryData_MergedTraces_PartialFailure(t *testing.T) {
+	client := mocks.NewAPI(t)
+	client.On("GetTraces", mock.Anything, mock.Anything).
+		Return([]*tracepb.Trace{{TraceId: "a", Spans: []*tracepb.TraceSpan{{SpanId: 1, Name: "request"}}}},
+			errors.New("failed getting 1 of 2 traces: b: not found"))
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryType": "mergedTraces", "traceIds": ["a", "b"]}`),
+				RefID: refID,
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	frame := resp.Responses[refID].Frames[0]
+	require.Equal(t, 2, frame.Rows())
+	require.Len(t, frame.Meta.Notices, 1)
+	require.Contains(t, frame.Meta.Notices[0].Text, "b: not found")
+}
+
+func TestQueryData_Exemplars(t *testing.T) {
+	start := time.Now().Add(-1 * time.Minute)
+	trace := func(id string, name string) *tracepb.Trace {
+		return &tracepb.Trace{TraceId: id, Spans: []*tracepb.TraceSpan{{
+			SpanId:    1,
+			Name:      name,
+			StartTime: timestamppb.New(start),
+			EndTime:   timestamppb.New(start.Add(time.Second)),
+		}}}
+	}
+
+	client := mocks.NewAPI(t)
+	client.On("GetTraces", mock.Anything, &cloudtrace.TracesBatchQuery{ProjectID: "testing", TraceIDs: []string{"a", "b", "c"}}).
+		Return([]*tracepb.Trace{trace("a", "checkout"), trace("b", "cart"), trace("c", "search")}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				// An interpolated multi-value variable, and a repeated ID
+				JSON:  []byte(`{"projectId": "testing", "queryType": "exemplars", "traceIds": ["{a,b}", "c", "a"]}`),
+				RefID: refID,
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	frame := resp.Responses[refID].Frames[0]
+	require.Equal(t, "traceTable", frame.Name)
+	require.Equal(t, 3, frame.Rows())
+	traceIDField, _ := frame.FieldByName("Trace ID")
+	traceNameField, _ := frame.FieldByName("Trace name")
+	for i, expected := range []string{"a", "b", "c"} {
+		require.Equal(t, expected, traceIDField.At(i))
+	}
+	require.Equal(t, "checkout", traceNameField.At(0))
+}
+
+func TestQueryData_Exemplars_NoTraceIDs(t *testing.T) {
+	ds := CloudTraceDatasource{
+		client: mocks.NewAPI(t),
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryType": "exemplars", "traceIds": [" "]}`),
+				RefID: refID,
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.ErrorContains(t, resp.Responses[refID].Error, "no exemplar trace IDs")
+}
+
+func TestCreateTraceSpanFrame_MaxFrameCells(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	spans := []*tracepb.TraceSpan{}
+	for i := 1; i <= 1000; i++ {
+		spans = append(spans, &tracepb.TraceSpan{
+			SpanId:       uint64(i),
+			ParentSpanId: uint64(i - 1),
+			StartTime:    timestamppb.New(start.Add(time.Duration(i) * time.Millisecond)),
+			EndTime:      timestamppb.New(start.Add(time.Second)),
+		})
+	}
+	trace := &tracepb.Trace{TraceId: "123", Spans: spans}
+	fieldCount := len(createDefaultSpanFields(nil, config{}))
+
+	frame := createTraceSpanFrame(trace, config{MaxFrameCells: 10*fieldCount + 1}, "", 0, spanWindow{})
+
+	require.Equal(t, 10, frame.Rows())
+	require.LessOrEqual(t, frame.Rows()*len(frame.Fields), 10*fieldCount+1)
+	// The earliest spans are kept, so every kept span's parent is too
+	spanIDField, _ := frame.FieldByName("spanID")
+	require.Equal(t, "1", spanIDField.At(0))
+	require.Equal(t, "10", spanIDField.At(9))
+	require.Len(t, frame.Meta.Notices, 1)
+	require.Equal(t, data.NoticeSeverityWarning, frame.Meta.Notices[0].Severity)
+	require.Contains(t, frame.Meta.Notices[0].Text, "Showing 10 of 1000 spans")
+
+	// The default budget fits the whole trace
+	frame = createTraceSpanFrame(trace, config{}, "", 0, spanWindow{})
+	require.Equal(t, 1000, frame.Rows())
+	require.Empty(t, frame.Meta.Notices)
+}
+
+func TestCreateTracesTableFrame_MaxFrameCells(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	traces := []*tracepb.Trace{}
+	for i := 0; i < 5; i++ {
+		traces = append(traces, &tracepb.Trace{TraceId: fmt.Sprint(i), Spans: []*tracepb.TraceSpan{{
+			SpanId:    1,
+			StartTime: timestamppb.New(start),
+			EndTime:   timestamppb.New(start.Add(time.Second)),
+		}}})
+	}
+
+	frame := createTracesTableFrame(traces, "testing", config{MaxFrameCells: 2 * tracesTableFieldCount})
+
+	require.Equal(t, 2, frame.Rows())
+	require.Len(t, frame.Fields, tracesTableFieldCount)
+	traceIDField, _ := frame.FieldByName("Trace ID")
+	require.Equal(t, "0", traceIDField.At(0))
+	require.Equal(t, "1", traceIDField.At(1))
+	require.Len(t, frame.Meta.Notices, 1)
+	require.Contains(t, frame.Meta.Notices[0].Text, "Showing 2 of 5 traces")
+}
+
+func TestGetSpanWindow(t *testing.T) {
+	testCases := []struct {
+		name          string
+		from          string
+		to            string
+		expected      spanWindow
+		expectedError string
+	}{
+		{
+			name:     "No window",
+			expected: spanWindow{},
+		},
+		{
+			name:     "Window",
+			from:     "1.5s",
+			to:       "3s",
+			expected: spanWindow{From: 1500 * time.Millisecond, To: 3 * time.Second},
+		},
+		{
+			name:     "Open ended window",
+			from:     "2s",
+			expected: spanWindow{From: 2 * time.Second},
+		},
+		{
+			name:          "Invalid duration",
+			from:          "soon",
+			expectedError: "invalid span window start soon",
+		},
+		{
+			name:          "Negative start",
+			from:          "-1s",
+			expectedError: "must not be negative",
+		},
+		{
+			name:          "End before start",
+			from:          "2s",
+			to:            "1s",
+			expectedError: "must be after the start",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			window, err := getSpanWindow(queryModel{SpanWindowFrom: tc.from, SpanWindowTo: tc.to})
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, window)
+		})
+	}
+}
+
+func TestCreateTraceSpanFrame_SpanWindow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := func(id uint64, parentID uint64, from time.Duration, to time.Duration) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start.Add(from)),
+			EndTime:      timestamppb.New(start.Add(to)),
+		}
+	}
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			span(1, 0, 0, 10*time.Second),
+			span(2, 1, time.Second, 2*time.Second),
+			span(3, 1, 5*time.Second, 6*time.Second),
+			span(4, 3, 5*time.Second, 5500*time.Millisecond),
+		},
+	}
+
+	// The window is relative to the start of the trace
+	frame := createTraceSpanFrame(trace, config{}, "", 0, spanWindow{From: 4 * time.Second, To: 5200 * time.Millisecond})
+
+	spanIDField, _ := frame.FieldByName("spanID")
+	require.Equal(t, 3, frame.Rows())
+	require.Equal(t, "1", spanIDField.At(0))
+	require.Equal(t, "3", spanIDField.At(1))
+	require.Equal(t, "4", spanIDField.At(2))
+}
+
+func TestQueryData_SpansTable(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+	span := func(id uint64, parentID uint64, service string, durationMs int, labels map[string]string) *tracepb.TraceSpan {
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels["service.name"] = service
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			Name:         "op" + fmt.Sprint(id),
+			Labels:       labels,
+			StartTime:    timestamppb.New(from),
+			EndTime:      timestamppb.New(from.Add(time.Duration(durationMs) * time.Millisecond)),
+		}
+	}
+	traces := []*tracepb.Trace{
+		{TraceId: "a", Spans: []*tracepb.TraceSpan{
+			span(1, 0, "frontend", 100, nil),
+			span(2, 1, "cart", 40, map[string]string{"/http/status_code": "503"}),
+		}},
+		{TraceId: "b", Spans: []*tracepb.TraceSpan{
+			span(1, 0, "frontend", 50, map[string]string{"otel.status_code": "OK"}),
+			span(2, 1, "search", 10, nil),
+		}},
+	}
+
+	testCases := []struct {
+		name          string
+		maxDataPoints int64
+		expectedRows  int
+		expectNotice  bool
+	}{
+		{
+			name:          "Every span",
+			maxDataPoints: 10,
+			expectedRows:  4,
+		},
+		{
+			name:          "Limit caps the spans",
+			maxDataPoints: 3,
+			expectedRows:  3,
+			expectNotice:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := mocks.NewAPI(t)
+			client.On("ListTraces", mock.Anything, mock.MatchedBy(func(q *cloudtrace.TracesQuery) bool {
+				return q.CompleteView && q.Limit == tc.maxDataPoints
+			})).Return(traces, nil)
+
+			ds := CloudTraceDatasource{
+				client: client,
+			}
+			refID := "test"
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{
+					{
+						JSON:          []byte(`{"projectId": "testing", "queryType": "spansTable"}`),
+						RefID:         refID,
+						MaxDataPoints: tc.maxDataPoints,
+						TimeRange: backend.TimeRange{
+							From: from,
+							To:   to,
+						},
+					},
+				},
+			})
+			require.NoError(t, err)
+			require.NoError(t, resp.Responses[refID].Error)
+			frame := resp.Responses[refID].Frames[0]
+			require.Equal(t, "spansTable", frame.Name)
+			require.Equal(t, tc.expectedRows, frame.Rows())
+
+			// Spans of every trace are flattened into the table, in order
+			expected := [][]interface{}{
+				{"a", "1", "frontend", "op1", float64(100), "UNSET"},
+				{"a", "2", "cart", "op2", float64(40), "ERROR"},
+				{"b", "1", "frontend", "op1", float64(50), "OK"},
+				{"b", "2", "search", "op2", float64(10), "UNSET"},
+			}
+			for i := 0; i < frame.Rows(); i++ {
+				require.Equal(t, expected[i], frame.RowCopy(i))
+			}
+			if tc.expectNotice {
+				require.Len(t, frame.Meta.Notices, 1)
+				require.Contains(t, frame.Meta.Notices[0].Text, "Showing the first 3 of 4 spans")
+			} else {
+				require.Empty(t, frame.Meta.Notices)
+			}
+		})
+	}
+}
+
+func TestQueryData_LatencyHistogram(t *testing.T) {
+	to := time.Now()
+	from := to.Add(-1 * time.Hour)
+	trace := func(id string, latency time.Duration) *tracepb.Trace {
+		return &tracepb.Trace{TraceId: id, Spans: []*tracepb.TraceSpan{{
+			SpanId:    1,
+			StartTime: timestamppb.New(from),
+			EndTime:   timestamppb.New(from.Add(latency)),
+		}}}
+	}
+
+	client := mocks.NewAPI(t)
+	client.On("ListTraces", mock.Anything, mock.Anything).Return([]*tracepb.Trace{
+		trace("a", 50*time.Millisecond),
+		trace("b", 200*time.Millisecond),
+		trace("c", 300*time.Millisecond),
+		trace("d", 2*time.Second),
+	}, nil)
+
+	ds := CloudTraceDatasource{
+		client: client,
+	}
+	refID := "test"
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				JSON:  []byte(`{"projectId": "testing", "queryType": "latencyHistogram", "latencyBuckets": [100, 500, 1000]}`),
+				RefID: refID,
+				TimeRange: backend.TimeRange{
+					From: from,
+					To:   to,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses[refID].Error)
+	frame := resp.Responses[refID].Frames[0]
+	require.Equal(t, "latencyHistogram", frame.Name)
+	require.Equal(t, 4, frame.Rows())
+
+	upper := func(ms float64) *float64 { return &ms }
+	expected := [][]interface{}{
+		{float64(0), upper(100), int64(1)},
+		{float64(100), upper(500), int64(2)},
+		// Empty buckets are still returned
+		{float64(500), upper(1000), int64(0)},
+		{float64(1000), (*float64)(nil), int64(1)},
+	}
+	for i, row := range expected {
+		require.Equal(t, row, frame.RowCopy(i))
+	}
+}
+
+func TestQueryData_LatencyHistogram_InvalidBuckets(t *testing.T) {
+	testCases := []struct {
+		name    string
+		buckets string
+	}{
+		{name: "Not ascending", buckets: "[100, 50]"},
+		{name: "Repeated", buckets: "[100, 100]"},
+		{name: "Not positive", buckets: "[0, 100]"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ds := CloudTraceDatasource{
+				client: mocks.NewAPI(t),
+			}
+			refID := "test"
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{
+					{
+						JSON:  []byte(`{"projectId": "testing", "queryType": "latencyHistogram", "latencyBuckets": ` + tc.buckets + `}`),
+						RefID: refID,
+					},
+				},
+			})
+			require.NoError(t, err)
+			require.ErrorContains(t, resp.Responses[refID].Error, "must be positive and ascending")
+		})
+	}
+}
+
+func TestCreateTraceSpanFrame_PercentOfParent(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := func(id uint64, parentID uint64, startMs int, endMs int) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start.Add(time.Duration(startMs) * time.Millisecond)),
+			EndTime:      timestamppb.New(start.Add(time.Duration(endMs) * time.Millisecond)),
+		}
+	}
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			span(1, 0, 0, 200),
+			span(2, 1, 0, 50),
+			span(3, 1, 50, 200),
+			// The parent of this span is missing from the trace, so it gets a placeholder parent
+			span(4, 9, 0, 10),
+		},
+	}
+
+	frame := createTraceSpanFrame(trace, config{}, "", 0, spanWindow{})
+
+	field, _ := frame.FieldByName("percentOfParent")
+	require.NotNil(t, field)
+	require.Nil(t, field.At(0))
+	require.InDelta(t, 25.0, *field.At(1).(*float64), 0.001)
+	require.InDelta(t, 75.0, *field.At(2).(*float64), 0.001)
+	require.InDelta(t, 100.0, *field.At(3).(*float64), 0.001)
+	require.InDelta(t, 5.0, *field.At(4).(*float64), 0.001)
+}
+
+func TestCreateTraceSpanFrame_SpanFieldOrder(t *testing.T) {
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans:   []*tracepb.TraceSpan{{SpanId: 1, Name: "root"}},
+	}
+
+	names := func(f *data.Frame) []string {
+		names := []string{}
+		for _, field := range f.Fields {
+			names = append(names, field.Name)
+		}
+		return names
+	}
+
+	frame := createTraceSpanFrame(trace, config{}, "", 0, spanWindow{})
+	require.Equal(t, []string{"traceID", "parentSpanID", "spanID", "serviceName", "operationName", "serviceTags", "tags",
+		"baggageTags", "startTime", "duration", "outlier", "url", "host", "warnings", "percentOfParent", "onCriticalPath", "selfTime", "grpcStatus", "messagingDestination"}, names(frame))
+
+	frame = createTraceSpanFrame(trace, config{SpanFieldOrder: []string{"duration", "serviceName"}}, "", 0, spanWindow{})
+	require.Equal(t, []string{"duration", "serviceName", "traceID", "parentSpanID", "spanID", "operationName", "serviceTags", "tags",
+		"baggageTags", "startTime", "outlier", "url", "host", "warnings", "percentOfParent", "onCriticalPath", "selfTime", "grpcStatus", "messagingDestination"}, names(frame))
+	operationName, _ := frame.FieldByName("operationName")
+	require.Equal(t, "root", operationName.At(0))
+}
+
+func TestOrderFields_Invalid(t *testing.T) {
+	fields := createDefaultSpanFields(nil, config{})
+
+	_, err := orderFields(fields, []string{"duration", "latency"})
+	require.EqualError(t, err, "unknown field latency")
+
+	_, err = orderFields(fields, []string{"duration", "duration"})
+	require.EqualError(t, err, "field duration is listed more than once")
+
+	_, err = NewCloudTraceDatasource(backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"spanFieldOrder": ["latency"]}`),
+	})
+	require.EqualError(t, err, "invalid span field order: unknown field latency")
+}
+
+func TestNewCloudTraceDatasource_InvalidRegion(t *testing.T) {
+	_, err := NewCloudTraceDatasource(backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"region": "Europe-West4"}`),
+	})
+	require.ErrorIs(t, err, cloudtrace.ErrInvalidRegion)
+}
+
+func TestCreateTraceSpanFrame_OnCriticalPath(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := func(id uint64, parentID uint64, startMs int, endMs int) *tracepb.TraceSpan {
+		return &tracepb.TraceSpan{
+			SpanId:       id,
+			ParentSpanId: parentID,
+			StartTime:    timestamppb.New(start.Add(time.Duration(startMs) * time.Millisecond)),
+			EndTime:      timestamppb.New(start.Add(time.Duration(endMs) * time.Millisecond)),
+		}
+	}
+	trace := &tracepb.Trace{
+		TraceId: "123",
+		Spans: []*tracepb.TraceSpan{
+			span(1, 0, 0, 100),
+			span(2, 1, 0, 90),
+			span(3, 1, 10, 20),
+		},
+	}
+
+	frame := createTraceSpanFrame(trace, config{}, "", 0, spanWindow{})
+
+	field, _ := frame.FieldByName("onCriticalPath")
+	require.NotNil(t, field)
+	require.Equal(t, true, field.At(0))
+	require.Equal(t, true, field.At(1))
+	require.Equal(t, false, field.At(2))
+}
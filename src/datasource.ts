@@ -66,8 +66,14 @@ export class DataSource extends DataSourceWithBackend<Query, CloudTraceOptions>
    *
    * @returns List of discovered project IDs
    */
-  getProjects(): Promise<string[]> {
-    return this.getResource(`projects`);
+  async getProjects(): Promise<string[]> {
+    const response: string[] | { projects: string[]; hint: string } = await this.getResource(`projects`);
+    if (Array.isArray(response)) {
+      return response;
+    }
+    // Projects couldn't be listed, the hint explains why
+    console.warn(response.hint);
+    return response.projects;
   }
 
   applyTemplateVariables(query: Query, scopedVars: ScopedVars): Query {